@@ -0,0 +1,163 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+)
+
+// StatBatch stats the resources of refs, resolving the shares as Stat does, and returns
+// their stats in the same order. A failure only affects the stat of its reference.
+//
+// The references are grouped by the storage provider they are found in, the groups are
+// stated concurrently by at most stat_batch_workers workers and the references of a group
+// one after the other, so that a large batch does not flood a single provider. The shares
+// are resolved before grouping, their names and children being grouped by the provider of
+// their targets. The stats share the memos of the batch, resolving a share once for all
+// its children.
+//
+// The CS3 gateway API has no batch stat yet, so it is only available in process.
+func (s *svc) StatBatch(ctx context.Context, refs []*provider.Reference) ([]*provider.StatResponse, error) {
+	ctx, done := s.observe(ctx, "StatBatch")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+
+	res := make([]*provider.StatResponse, len(refs))
+	groups := s.groupByProvider(ctx, refs)
+
+	workers := s.c.StatBatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+
+	queue := make(chan []int, len(groups))
+	for _, g := range groups {
+		queue <- g
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range queue {
+				for _, i := range g {
+					res[i] = s.statBatchItem(ctx, refs[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	done(status.NewOK(ctx), nil)
+	return res, nil
+}
+
+// groupByProvider returns the indexes of refs grouped by the address of the storage provider
+// they are found in, after resolving the shares, in the order of their first reference.
+// References whose provider cannot be found are alone in their group, their stat reports the error.
+func (s *svc) groupByProvider(ctx context.Context, refs []*provider.Reference) [][]int {
+	var groups [][]int
+	byAddress := map[string]int{}
+	for i, ref := range refs {
+		if ref == nil {
+			groups = append(groups, []int{i})
+			continue
+		}
+		p, err := s.findProvider(ctx, s.statTarget(ctx, ref))
+		if err != nil {
+			groups = append(groups, []int{i})
+			continue
+		}
+		g, ok := byAddress[p.Address]
+		if !ok {
+			g = len(groups)
+			byAddress[p.Address] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// statTarget returns the reference whose stat is the one of ref: for the share names and children,
+// the target of their share. References which cannot be resolved are returned as they are,
+// their stat reports the error.
+func (s *svc) statTarget(ctx context.Context, ref *provider.Reference) *provider.Reference {
+	p := ref.GetPath()
+	if !s.inSharedFolder(ctx, p) {
+		return ref
+	}
+	_, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil || !name && !child {
+		return ref
+	}
+
+	shareName, shareChild := p, ""
+	if child {
+		if shareName, shareChild, err = s.splitShare(ctx, p); err != nil {
+			return ref
+		}
+	}
+	statRes, err := s.statResolution(ctx, &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: shareName,
+		},
+	})
+	if err != nil || statRes.Status.Code != rpc.Code_CODE_OK {
+		return ref
+	}
+	// the regular resources colliding with a share name are returned as they are
+	ri, err := s.checkRef(ctx, statRes.Info)
+	if err != nil {
+		return ref
+	}
+	return &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: path.Join(ri.Path, shareChild),
+		},
+	}
+}
+
+// statBatchItem stats a reference of a batch, turning the errors into the status of its stat.
+func (s *svc) statBatchItem(ctx context.Context, ref *provider.Reference) *provider.StatResponse {
+	if ref == nil {
+		return &provider.StatResponse{
+			Status: status.NewInvalidArg(ctx, "gateway: missing reference"),
+		}
+	}
+	res, err := s.Stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return &provider.StatResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error stating "+ref.String()),
+		}
+	}
+	return res
+}
@@ -0,0 +1,141 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+func TestStatBatch(t *testing.T) {
+	home := newFakeStorage("home")
+	home.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	home.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/users/peter/Holidays/a.jpg", provider.ResourceType_RESOURCE_TYPE_FILE)
+	home.add("/users/peter/Holidays/b.jpg", provider.ResourceType_RESOURCE_TYPE_FILE)
+	home.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	eos := newFakeStorage("eos")
+	eos.add("/eos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	eos.add("/eos/data.csv", provider.ResourceType_RESOURCE_TYPE_FILE)
+	s, stop := newTestGateway(t, home)
+	defer stop()
+	defer mountFakeStorage(t, s, "/eos", eos)()
+	s.c.StatBatchWorkers = 2
+
+	path := func(p string) *provider.Reference {
+		return &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+	}
+	id := func(storageID, opaqueID string) *provider.Reference {
+		return &provider.Reference{Spec: &provider.Reference_Id{Id: &provider.ResourceId{StorageId: storageID, OpaqueId: opaqueID}}}
+	}
+
+	// as with Stat, the stats of share children are the ones of the targets
+	tests := []struct {
+		ref  *provider.Reference
+		code rpc.Code
+		path string
+	}{
+		{path("/home/MyShares/photos/a.jpg"), rpc.Code_CODE_OK, "/users/peter/Holidays/a.jpg"},
+		{path("/eos/data.csv"), rpc.Code_CODE_OK, "/eos/data.csv"},
+		{path("/home/missing.txt"), rpc.Code_CODE_NOT_FOUND, ""},
+		{id("home", "/home/report.txt"), rpc.Code_CODE_OK, "/home/report.txt"},
+		{nil, rpc.Code_CODE_INVALID_ARGUMENT, ""},
+		{path("/home/MyShares/music/song.mp3"), rpc.Code_CODE_NOT_FOUND, ""},
+		{id("eos", "/eos/data.csv"), rpc.Code_CODE_OK, "/eos/data.csv"},
+		{path("/home/MyShares/photos/b.jpg"), rpc.Code_CODE_OK, "/users/peter/Holidays/b.jpg"},
+		{path("/home/report.txt"), rpc.Code_CODE_OK, "/home/report.txt"},
+	}
+
+	refs := make([]*provider.Reference, len(tests))
+	for i, tt := range tests {
+		refs[i] = tt.ref
+	}
+
+	res, err := s.StatBatch(context.Background(), refs)
+	if err != nil {
+		t.Fatalf("StatBatch() error = %v", err)
+	}
+	if len(res) != len(refs) {
+		t.Fatalf("StatBatch() returned %d stats, want %d", len(res), len(refs))
+	}
+	for i, tt := range tests {
+		if res[i].Status.Code != tt.code {
+			t.Errorf("stat %d (%v) code = %v, want %v", i, tt.ref, res[i].Status.Code, tt.code)
+			continue
+		}
+		if tt.code == rpc.Code_CODE_OK && res[i].Info.Path != tt.path {
+			t.Errorf("stat %d (%v) path = %s, want %s", i, tt.ref, res[i].Info.Path, tt.path)
+		}
+	}
+
+	// the share is resolved once for both of its children, only the missing share
+	// is stated again after grouping
+	if n := home.count("Stat"); n > 9 {
+		t.Errorf("StatBatch() did %d stats in the home storage", n)
+	}
+}
+
+func TestGroupByProvider(t *testing.T) {
+	home := newFakeStorage("home")
+	home.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	home.addReference("/home/MyShares/data", "").Target = "cs3:eos//eos/data"
+	eos := newFakeStorage("eos")
+	eos.add("/eos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	eos.add("/eos/data", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	s, stop := newTestGateway(t, home)
+	defer stop()
+	defer mountFakeStorage(t, s, "/eos", eos)()
+
+	// the share children are grouped by the provider of the target of their share
+	refs := []*provider.Reference{
+		{Spec: &provider.Reference_Path{Path: "/home/a"}},
+		{Spec: &provider.Reference_Path{Path: "/eos/b"}},
+		nil,
+		{Spec: &provider.Reference_Path{Path: "/home/MyShares/c"}},
+		{Spec: &provider.Reference_Path{Path: "/eos/d"}},
+		{Spec: &provider.Reference_Path{Path: "/home/MyShares/data/results.csv"}},
+		{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/a.jpg"}},
+		{Spec: &provider.Reference_Path{Path: "/home/MyShares/data"}},
+	}
+	ctx := s.withProviderMemo(s.withStatMemo(context.Background()))
+	groups := s.groupByProvider(ctx, refs)
+
+	want := [][]int{{0, 3, 6}, {1, 4, 5, 7}, {2}}
+	if len(groups) != len(want) {
+		t.Fatalf("groupByProvider() = %v, want %v", groups, want)
+	}
+	for i := range want {
+		if len(groups[i]) != len(want[i]) {
+			t.Fatalf("groupByProvider() = %v, want %v", groups, want)
+		}
+		for j := range want[i] {
+			if groups[i][j] != want[i][j] {
+				t.Errorf("groupByProvider() = %v, want %v", groups, want)
+			}
+		}
+	}
+}
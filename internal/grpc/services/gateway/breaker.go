@@ -0,0 +1,95 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// circuitBreaker tracks the health of the storage providers from the outcome of the calls
+// done to them. After threshold consecutive failures the circuit of a provider opens and
+// the provider is skipped for cooldown, after which it is tried again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	openUntil map[string]time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		failures:  map[string]int{},
+		openUntil: map[string]time.Time{},
+	}
+}
+
+// isOpen reports whether the provider at addr must be skipped.
+// A nil breaker never opens.
+func (b *circuitBreaker) isOpen(addr string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil[addr])
+}
+
+// record updates the health of the provider at addr with the outcome of a call.
+// Only the errors telling the provider cannot be reached count as failures,
+// errors of the operations are reported in the status of the responses.
+func (b *circuitBreaker) record(addr string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch gstatus.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		b.failures[addr]++
+		if b.failures[addr] >= b.threshold {
+			b.openUntil[addr] = time.Now().Add(b.cooldown)
+			b.failures[addr] = 0
+		}
+	default:
+		delete(b.failures, addr)
+		delete(b.openUntil, addr)
+	}
+}
+
+// intercept records the outcome of the calls done on the connections to the storage providers.
+// A call failing because the deadline of the caller expired tells nothing about the provider,
+// only the deadlines reported by the provider itself are recorded.
+func (b *circuitBreaker) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if gstatus.Code(err) == codes.DeadlineExceeded && ctx.Err() != nil {
+		return err
+	}
+	b.record(cc.Target(), err)
+	return err
+}
@@ -0,0 +1,194 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	unavailable := gstatus.Error(codes.Unavailable, "connection refused")
+
+	b.record("a", unavailable)
+	if b.isOpen("a") {
+		t.Fatalf("circuit open after 1 failure, threshold is 2")
+	}
+
+	// a success resets the failures
+	b.record("a", nil)
+	b.record("a", unavailable)
+	if b.isOpen("a") {
+		t.Fatalf("circuit open after a success")
+	}
+
+	b.record("a", unavailable)
+	if !b.isOpen("a") {
+		t.Fatalf("circuit closed after 2 consecutive failures")
+	}
+	if b.isOpen("b") {
+		t.Fatalf("circuit of another provider is open")
+	}
+
+	// errors of the operations do not count
+	b.record("b", errors.New("error"))
+	b.record("b", gstatus.Error(codes.NotFound, "not found"))
+	if b.isOpen("b") {
+		t.Fatalf("circuit open after errors not related to the health of the provider")
+	}
+
+	// after the cooldown the provider is tried again
+	b.cooldown = 0
+	b.record("c", unavailable)
+	b.record("c", unavailable)
+	if b.isOpen("c") {
+		t.Fatalf("circuit still open after the cooldown")
+	}
+}
+
+func TestInterceptDeadlines(t *testing.T) {
+	cc, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer cc.Close()
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		wantOpen bool
+	}{
+		{"unavailable", context.Background(), gstatus.Error(codes.Unavailable, "connection refused"), true},
+		{"deadline of the provider", context.Background(), gstatus.Error(codes.DeadlineExceeded, "storage timed out"), true},
+		{"deadline of the caller", expired, gstatus.Error(codes.DeadlineExceeded, "context deadline exceeded"), false},
+		{"operation error", context.Background(), gstatus.Error(codes.NotFound, "not found"), false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(1, time.Minute)
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return tt.err
+			}
+			if err := b.intercept(tt.ctx, "/Stat", nil, nil, cc, invoker); err != tt.err {
+				t.Fatalf("intercept() error = %v, want %v", err, tt.err)
+			}
+			if open := b.isOpen(cc.Target()); open != tt.wantOpen {
+				t.Errorf("isOpen() = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestProviderConnsCircuitBreaker(t *testing.T) {
+	lis := listen(t)
+	srv := grpc.NewServer()
+	provider.RegisterProviderAPIServer(srv, newFakeStorage("home"))
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	addr := lis.Addr().String()
+
+	b := newCircuitBreaker(1, time.Minute)
+	conns := newProviderConns(grpc.WithUnaryInterceptor(b.intercept))
+	defer conns.close()
+
+	c, err := conns.get(addr)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	srv.Stop()
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}}
+	if _, err := c.Stat(context.Background(), &provider.StatRequest{Ref: ref}); err == nil {
+		t.Fatalf("Stat() of a stopped provider succeeded")
+	}
+	if !b.isOpen(addr) {
+		t.Errorf("circuit closed after a call to a stopped provider")
+	}
+}
+
+// replicatedRegistry returns an unreachable replica before the provider of the wrapped registry.
+type replicatedRegistry struct {
+	StorageRegistry
+	replica string
+}
+
+func (r *replicatedRegistry) FindProviders(ctx context.Context, ref *provider.Reference) ([]*registry.ProviderInfo, error) {
+	p, err := r.FindProvider(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return []*registry.ProviderInfo{{Address: r.replica}, p}, nil
+}
+
+func TestSelectHealthyReplica(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	reg := &replicatedRegistry{StorageRegistry: s.storageRegistry, replica: "127.0.0.1:1"}
+	s.storageRegistry = reg
+	s.breaker = newCircuitBreaker(1, time.Minute)
+	s.breaker.record(reg.replica, gstatus.Error(codes.Unavailable, "connection refused"))
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}}
+	res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+
+	// every replica is unhealthy
+	p, err := reg.FindProvider(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("FindProvider() error = %v", err)
+	}
+	s.breaker.record(p.Address, gstatus.Error(codes.Unavailable, "connection refused"))
+
+	res, err = s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_UNAVAILABLE {
+		t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_UNAVAILABLE)
+	}
+	if !strings.Contains(res.Status.Message, `path:"/home"`) {
+		t.Errorf("Stat() message = %q, want the reference", res.Status.Message)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a small in memory cache whose entries expire after a fixed ttl.
+// When the cache is full the expired entries are purged and, if still full,
+// the new entry is not stored.
+type ttlCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, max int) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		max:     max,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok && c.max > 0 && len(c.entries) >= c.max {
+		c.purge()
+		if len(c.entries) >= c.max {
+			return
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// purge removes the expired entries, the lock must be held.
+func (c *ttlCache) purge() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
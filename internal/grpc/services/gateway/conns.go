@@ -0,0 +1,82 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"sync"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
+	"google.golang.org/grpc"
+)
+
+// providerConns are the connections of the gateway to the storage providers. They are dialed
+// with the options of the gateway, e.g. the circuit breaker, leaving the connections of the
+// pool shared with the other services untouched. A nil providerConns uses the pool.
+type providerConns struct {
+	mu    sync.Mutex
+	opts  []grpc.DialOption
+	conns map[string]*grpc.ClientConn
+}
+
+func newProviderConns(opts ...grpc.DialOption) *providerConns {
+	return &providerConns{
+		opts:  opts,
+		conns: map[string]*grpc.ClientConn{},
+	}
+}
+
+// get returns a client of the storage provider at addr, dialing it on first use.
+func (c *providerConns) get(addr string) (provider.ProviderAPIClient, error) {
+	if c == nil {
+		return pool.GetStorageProviderServiceClient(addr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = pool.NewConn(addr, c.opts...); err != nil {
+			return nil, err
+		}
+		c.conns[addr] = conn
+	}
+	return provider.NewProviderAPIClient(conn), nil
+}
+
+// close closes the connections, returning the first error.
+func (c *providerConns) close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for addr, conn := range c.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.conns, addr)
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/internal/http/services/datagateway"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/rhttp"
+	"github.com/pkg/errors"
+)
+
+// Copy copies the resource at src to dst, recursing into containers.
+// The CS3 APIs do not define a copy operation, neither for the gateway nor for the
+// storage providers, so the files are streamed from a download of the source to an
+// upload of the destination, whether they live in the same storage provider or not.
+// The references are resolved by the gateway calls used, so src and dst can be in
+// shares like for a Move, but the shared folder and the share names, the mount points,
+// cannot be copied over.
+func (s *svc) Copy(ctx context.Context, src, dst *provider.Reference) (*rpc.Status, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	log := appctx.GetLogger(ctx)
+
+	p, err := s.getPath(ctx, src)
+	if err != nil {
+		log.Err(err).Msg("gateway: error copying")
+		return getPathErrorStatus(ctx, err), nil
+	}
+	dp, err := s.getPath(ctx, dst)
+	if err != nil {
+		log.Err(err).Msg("gateway: error copying")
+		return getPathErrorStatus(ctx, err), nil
+	}
+
+	srcFolder, _, _, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return splitErrorStatus(ctx, err), nil
+	}
+	dstFolder, dstName, _, err := s.classifySharePath(ctx, dp)
+	if err != nil {
+		return splitErrorStatus(ctx, err), nil
+	}
+	if srcFolder || dstFolder {
+		return status.NewInvalidArg(ctx, "gateway: cannot copy the share folder"), nil
+	}
+	if dstName {
+		return status.NewInvalidArg(ctx, "gateway: cannot copy over a share name"), nil
+	}
+	if dp == p || strings.HasPrefix(dp, p+"/") {
+		return status.NewInvalidArg(ctx, "gateway: cannot copy a resource into itself"), nil
+	}
+
+	statRes, err := s.Stat(ctx, &provider.StatRequest{Ref: pathRef(p)})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error stating copy source")
+	}
+	if statRes.Status.Code != rpc.Code_CODE_OK {
+		return statRes.Status, nil
+	}
+
+	return s.copy(ctx, statRes.Info, p, dp)
+}
+
+// copy copies the resource described by info from the path p to dp.
+func (s *svc) copy(ctx context.Context, info *provider.ResourceInfo, p, dp string) (*rpc.Status, error) {
+	switch info.Type {
+	case provider.ResourceType_RESOURCE_TYPE_CONTAINER:
+		return s.copyContainer(ctx, p, dp)
+	case provider.ResourceType_RESOURCE_TYPE_FILE:
+		return s.copyFile(ctx, info, p, dp)
+	default:
+		appctx.GetLogger(ctx).Warn().Str("path", p).Msgf("gateway: copy: skipping resource of type %s", info.Type)
+		return status.NewOK(ctx), nil
+	}
+}
+
+func (s *svc) copyContainer(ctx context.Context, p, dp string) (*rpc.Status, error) {
+	createRes, err := s.CreateContainer(ctx, &provider.CreateContainerRequest{Ref: pathRef(dp)})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error creating copy destination")
+	}
+	if createRes.Status.Code != rpc.Code_CODE_OK {
+		return createRes.Status, nil
+	}
+
+	listRes, err := s.ListContainer(ctx, &provider.ListContainerRequest{Ref: pathRef(p)})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error listing copy source")
+	}
+	if listRes.Status.Code != rpc.Code_CODE_OK {
+		return listRes.Status, nil
+	}
+
+	for _, child := range listRes.Infos {
+		name := path.Base(child.Path)
+		st, err := s.copy(ctx, child, path.Join(p, name), path.Join(dp, name))
+		if err != nil || st.Code != rpc.Code_CODE_OK {
+			return st, err
+		}
+	}
+	return status.NewOK(ctx), nil
+}
+
+func (s *svc) copyFile(ctx context.Context, info *provider.ResourceInfo, p, dp string) (*rpc.Status, error) {
+	downRes, err := s.InitiateFileDownload(ctx, &provider.InitiateFileDownloadRequest{Ref: pathRef(p)})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error initiating copy download")
+	}
+	if downRes.Status.Code != rpc.Code_CODE_OK {
+		return downRes.Status, nil
+	}
+
+	length := strconv.FormatUint(info.Size, 10)
+	upRes, err := s.InitiateFileUpload(ctx, &provider.InitiateFileUploadRequest{
+		Ref: pathRef(dp),
+		Opaque: &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				"Upload-Length": {Decoder: "plain", Value: []byte(length)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error initiating copy upload")
+	}
+	if upRes.Status.Code != rpc.Code_CODE_OK {
+		return upRes.Status, nil
+	}
+
+	client := rhttp.GetHTTPClient(rhttp.Context(ctx))
+
+	downReq, err := rhttp.NewRequest(ctx, http.MethodGet, downRes.DownloadEndpoint, nil)
+	if err != nil {
+		return status.NewInternal(ctx, err, "gateway: error copying "+p), nil
+	}
+	downReq.Header.Set(datagateway.TokenTransportHeader, downRes.Token)
+	download, err := client.Do(downReq)
+	if err != nil {
+		return status.NewInternal(ctx, err, "gateway: error downloading "+p), nil
+	}
+	defer download.Body.Close()
+	if download.StatusCode != http.StatusOK {
+		err := fmt.Errorf("gateway: download of %s failed with status %d", p, download.StatusCode)
+		return status.NewInternal(ctx, err, "gateway: error downloading "+p), nil
+	}
+
+	upReq, err := rhttp.NewRequest(ctx, http.MethodPut, upRes.UploadEndpoint, download.Body)
+	if err != nil {
+		return status.NewInternal(ctx, err, "gateway: error copying "+p), nil
+	}
+	upReq.ContentLength = int64(info.Size)
+	upReq.Header.Set(datagateway.TokenTransportHeader, upRes.Token)
+	upload, err := client.Do(upReq)
+	if err != nil {
+		return status.NewInternal(ctx, err, "gateway: error uploading "+dp), nil
+	}
+	defer upload.Body.Close()
+	if upload.StatusCode != http.StatusOK && upload.StatusCode != http.StatusCreated && upload.StatusCode != http.StatusNoContent {
+		err := fmt.Errorf("gateway: upload of %s failed with status %d", dp, upload.StatusCode)
+		return status.NewInternal(ctx, err, "gateway: error uploading "+dp), nil
+	}
+
+	return status.NewOK(ctx), nil
+}
+
+func pathRef(p string) *provider.Reference {
+	return &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+}
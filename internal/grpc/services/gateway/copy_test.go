@@ -0,0 +1,217 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"google.golang.org/grpc"
+)
+
+// fakeData is the data server of a fakeStorage, holding the content of its files.
+type fakeData struct {
+	sync.Mutex
+	storage *fakeStorage
+	content map[string][]byte
+}
+
+func serveFakeData(storage *fakeStorage) (*fakeData, func()) {
+	d := &fakeData{storage: storage, content: map[string][]byte{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.Lock()
+		defer d.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			content, ok := d.content[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(content)
+		case http.MethodPut:
+			content, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			d.content[r.URL.Path] = content
+			d.storage.add(r.URL.Path, provider.ResourceType_RESOURCE_TYPE_FILE).Size = uint64(len(content))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	storage.dataEndpoint = srv.URL
+	return d, srv.Close
+}
+
+func (d *fakeData) addFile(p, content string) {
+	d.Lock()
+	defer d.Unlock()
+	d.content[p] = []byte(content)
+	d.storage.add(p, provider.ResourceType_RESOURCE_TYPE_FILE).Size = uint64(len(content))
+}
+
+func (d *fakeData) get(p string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	content, ok := d.content[p]
+	return string(content), ok
+}
+
+// mountFakeStorage serves another storage at prefix in the gateway created by newTestGateway.
+func mountFakeStorage(t *testing.T, s *svc, prefix string, storage *fakeStorage) func() {
+	lis := listen(t)
+	srv := grpc.NewServer()
+	provider.RegisterProviderAPIServer(srv, storage)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	rules := s.c.StorageRegistryDrivers["static"]["rules"].(map[string]string)
+	rules[prefix] = lis.Addr().String()
+	rules[storage.storageID] = lis.Addr().String()
+	reg, err := getStorageRegistry(s.c)
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("error creating storage registry: %v", err)
+	}
+	s.storageRegistry = reg
+	return srv.Stop
+}
+
+func TestCopy(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		dst  string
+		code rpc.Code
+		// files maps storage:path to the expected content.
+		files map[string]string
+	}{
+		{
+			name: "same provider file",
+			src:  "/home/Documents/report.txt",
+			dst:  "/home/report.txt",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"home:/home/report.txt": "report",
+			},
+		},
+		{
+			name: "same provider container",
+			src:  "/home/Documents",
+			dst:  "/home/Backup",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"home:/home/Backup/report.txt":       "report",
+				"home:/home/Backup/drafts/draft.txt": "draft",
+			},
+		},
+		{
+			name: "cross provider container",
+			src:  "/home/Documents",
+			dst:  "/eos/Documents",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"eos:/eos/Documents/report.txt":       "report",
+				"eos:/eos/Documents/drafts/draft.txt": "draft",
+			},
+		},
+		{
+			name: "share child source",
+			src:  "/home/MyShares/photos/Ibiza/beach.png",
+			dst:  "/eos/beach.png",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"eos:/eos/beach.png": "sand",
+			},
+		},
+		{
+			name: "share child destination",
+			src:  "/home/Documents/report.txt",
+			dst:  "/home/MyShares/photos/report.txt",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"home:/users/peter/photos/report.txt": "report",
+			},
+		},
+		{
+			name: "share name source",
+			src:  "/home/MyShares/photos",
+			dst:  "/home/photos",
+			code: rpc.Code_CODE_OK,
+			files: map[string]string{
+				"home:/home/photos/Ibiza/beach.png": "sand",
+			},
+		},
+		{"share name destination", "/home/Documents", "/home/MyShares/Documents", rpc.Code_CODE_INVALID_ARGUMENT, nil},
+		{"share folder", "/home/MyShares", "/home/Shares", rpc.Code_CODE_INVALID_ARGUMENT, nil},
+		{"into itself", "/home/Documents", "/home/Documents/drafts/Documents", rpc.Code_CODE_INVALID_ARGUMENT, nil},
+		{"missing source", "/home/missing.txt", "/home/found.txt", rpc.Code_CODE_NOT_FOUND, nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			home := newSharesStorage()
+			home.add("/home/Documents", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+			home.add("/home/Documents/drafts", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+			homeData, stopHomeData := serveFakeData(home)
+			defer stopHomeData()
+			homeData.addFile("/home/Documents/report.txt", "report")
+			homeData.addFile("/home/Documents/drafts/draft.txt", "draft")
+			homeData.addFile("/users/peter/photos/Ibiza/beach.png", "sand")
+
+			eos := newFakeStorage("eos")
+			eos.add("/eos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+			eosData, stopEOSData := serveFakeData(eos)
+			defer stopEOSData()
+
+			s, stop := newTestGateway(t, home)
+			defer stop()
+			defer mountFakeStorage(t, s, "/eos", eos)()
+
+			st, err := s.Copy(context.Background(), pathRef(tt.src), pathRef(tt.dst))
+			if err != nil {
+				t.Fatalf("Copy() error = %v", err)
+			}
+			if st.Code != tt.code {
+				t.Fatalf("Copy() code = %v, want %v: %s", st.Code, tt.code, st.Message)
+			}
+
+			data := map[string]*fakeData{"home": homeData, "eos": eosData}
+			for k, want := range tt.files {
+				parts := strings.SplitN(k, ":", 2)
+				got, ok := data[parts[0]].get(parts[1])
+				if !ok || got != want {
+					t.Errorf("Copy() content at %s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
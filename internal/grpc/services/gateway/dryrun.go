@@ -0,0 +1,65 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"strconv"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/pkg/errors"
+)
+
+// dryRunKey is the key of the opaque of the Delete and Move requests asking, with a true
+// value, to validate the mutation without doing it: the references are resolved and the
+// providers found and checked as for the mutation, which is then not forwarded. The response
+// holds the key too, for clients to tell a validated mutation from a done one.
+const dryRunKey = "dry-run"
+
+// isDryRun reports whether a request asks for its mutation to only be validated.
+func isDryRun(o *typespb.Opaque) bool {
+	e, ok := o.GetMap()[dryRunKey]
+	if !ok {
+		return false
+	}
+	dryRun, err := strconv.ParseBool(string(e.Value))
+	return err == nil && dryRun
+}
+
+// dryRun returns the status the mutation of the resource at ref on the storage provider
+// would have without doing it: not found if the resource does not exist, ok otherwise.
+func dryRun(ctx context.Context, c provider.ProviderAPIClient, ref *provider.Reference) (*rpc.Status, *typespb.Opaque, error) {
+	res, err := c.Stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "gateway: error calling Stat")
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return res.Status, nil, nil
+	}
+
+	o := &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			dryRunKey: {Decoder: "plain", Value: []byte("true")},
+		},
+	}
+	return status.NewOK(ctx), o, nil
+}
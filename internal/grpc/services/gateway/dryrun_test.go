@@ -0,0 +1,181 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"google.golang.org/grpc"
+)
+
+func TestDryRun(t *testing.T) {
+	dryRunOpaque := func() *typespb.Opaque {
+		return &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				dryRunKey: {Decoder: "plain", Value: []byte("true")},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		src    string
+		dst    string
+		code   rpc.Code
+		reason string
+	}{
+		{"delete", "Delete", "/home/report.txt", "", rpc.Code_CODE_OK, ""},
+		{"delete missing", "Delete", "/home/missing.txt", "", rpc.Code_CODE_NOT_FOUND, ""},
+		{"delete share child", "Delete", "/home/MyShares/photos/Paris", "", rpc.Code_CODE_OK, ""},
+		{"unmount share", "Delete", "/home/MyShares/photos", "", rpc.Code_CODE_OK, ""},
+		{"delete in deleted share", "Delete", "/home/MyShares/music/song.mp3", "", rpc.Code_CODE_FAILED_PRECONDITION, "share_target_not_found"},
+		{"move", "Move", "/home/report.txt", "/home/renamed.txt", rpc.Code_CODE_OK, ""},
+		{"move missing", "Move", "/home/missing.txt", "/home/renamed.txt", rpc.Code_CODE_NOT_FOUND, ""},
+		{"move share child", "Move", "/home/MyShares/photos/Paris", "/home/MyShares/photos/London", rpc.Code_CODE_OK, ""},
+		{"move across providers", "Move", "/home/report.txt", "/eos/report.txt", rpc.Code_CODE_UNIMPLEMENTED, crossStorageMoveError},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			home := newSharesStorage()
+			home.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+			// the owner deleted the target of the music share
+			delete(home.infos, "/users/peter/music")
+			eos := newFakeStorage("eos")
+			eos.add("/eos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+			s, stop := newTestGateway(t, home)
+			defer stop()
+			defer mountFakeStorage(t, s, "/eos", eos)()
+
+			src := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.src}}
+			var st *rpc.Status
+			var o *typespb.Opaque
+			switch tt.method {
+			case "Delete":
+				res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: dryRunOpaque(), Ref: src})
+				if err != nil {
+					t.Fatalf("Delete() error = %v", err)
+				}
+				st, o = res.Status, res.Opaque
+			case "Move":
+				dst := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.dst}}
+				res, err := s.Move(context.Background(), &provider.MoveRequest{Opaque: dryRunOpaque(), Source: src, Destination: dst})
+				if err != nil {
+					t.Fatalf("Move() error = %v", err)
+				}
+				st, o = res.Status, res.Opaque
+			}
+
+			if st.Code != tt.code {
+				t.Errorf("%s() code = %v, want %v", tt.method, st.Code, tt.code)
+			}
+			if e := o.GetMap()["error"]; tt.reason != "" && (e == nil || string(e.Value) != tt.reason) {
+				t.Errorf("%s() opaque = %v, want error %s", tt.method, o, tt.reason)
+			}
+			if tt.code == rpc.Code_CODE_OK && !isDryRun(o) {
+				t.Errorf("%s() opaque = %v, want it marked as a dry run", tt.method, o)
+			}
+			for _, storage := range []*fakeStorage{home, eos} {
+				for _, m := range []string{"Delete", "Move"} {
+					if n := storage.count(m); n != 0 {
+						t.Errorf("%s() called %s %d times on %s in a dry run, want 0", tt.method, m, n, storage.storageID)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("not a dry run", func(t *testing.T) {
+		home := newFakeStorage("home")
+		home.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		home.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+		s, stop := newTestGateway(t, home)
+		defer stop()
+
+		o := &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				dryRunKey: {Decoder: "plain", Value: []byte("false")},
+			},
+		}
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/report.txt"}}
+		res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: ref})
+		if err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			t.Errorf("Delete() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+		}
+		if n := home.count("Delete"); n != 1 {
+			t.Errorf("Delete() called Delete %d times, want 1", n)
+		}
+	})
+}
+
+func TestDryRunUnmountShare(t *testing.T) {
+	storage := newSharesStorage()
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	shares := &fakeShares{}
+	shares.received = append(shares.received, &collaboration.ReceivedShare{
+		Share: &collaboration.Share{
+			Id:         &collaboration.ShareId{OpaqueId: "photos"},
+			ResourceId: &provider.ResourceId{StorageId: "home", OpaqueId: "/users/peter/photos"},
+		},
+		State: collaboration.ShareState_SHARE_STATE_ACCEPTED,
+	})
+	lis := listen(t)
+	srv := grpc.NewServer()
+	collaboration.RegisterCollaborationAPIServer(srv, shares)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+
+	s.c.CommitShareToStorageRef = true
+	s.c.UserShareProviderEndpoint = lis.Addr().String()
+
+	o := &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			dryRunKey: {Decoder: "plain", Value: []byte("true")},
+		},
+	}
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+	res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: ref})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Delete() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+
+	if _, ok := storage.lookup(ref); !ok {
+		t.Errorf("share was unmounted in a dry run")
+	}
+	if state := shares.state("photos"); state != collaboration.ShareState_SHARE_STATE_ACCEPTED {
+		t.Errorf("share state = %v, want it accepted", state)
+	}
+}
@@ -20,18 +20,26 @@ package gateway
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"strings"
+	"time"
 
 	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 
 	"github.com/cs3org/reva/pkg/rgrpc"
+	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
 	"github.com/cs3org/reva/pkg/sharedconf"
+	"github.com/cs3org/reva/pkg/storage/utils/templates"
 	"github.com/cs3org/reva/pkg/token"
 	"github.com/cs3org/reva/pkg/token/manager/registry"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 func init() {
@@ -54,14 +62,117 @@ type config struct {
 	CommitShareToStorageGrant     bool   `mapstructure:"commit_share_to_storage_grant"`
 	CommitShareToStorageRef       bool   `mapstructure:"commit_share_to_storage_ref"`
 	DisableHomeCreationOnLogin    bool   `mapstructure:"disable_home_creation_on_login"`
+	IncludeSharesInQuota          bool   `mapstructure:"include_shares_in_quota"`
 	TransferSharedSecret          string `mapstructure:"transfer_shared_secret"`
 	TransferExpires               int64  `mapstructure:"transfer_expires"`
-	TokenManager                  string `mapstructure:"token_manager"`
+	// TransferMaxExpires caps TransferExpires, in seconds, to avoid long lived transfer tokens.
+	TransferMaxExpires int64 `mapstructure:"transfer_max_expires"`
+	// TransferClockSkew is the time in seconds transfer tokens are valid before being issued,
+	// so that they can be used right away by data gateways whose clock is slightly behind.
+	// Zero means the default of 5 seconds, a negative value disables the skew.
+	TransferClockSkew int64 `mapstructure:"transfer_clock_skew"`
+	// TransferSigningAlg is the algorithm signing the transfer tokens. HMAC algorithms use the
+	// transfer shared secret, RSA and ECDSA ones the private key at TransferSigningKey.
+	TransferSigningAlg string `mapstructure:"transfer_signing_alg"`
+	// TransferSigningKey is the path of the PEM encoded private key signing the transfer tokens.
+	TransferSigningKey string `mapstructure:"transfer_signing_key"`
+	TokenManager       string `mapstructure:"token_manager"`
 	// ShareFolder is the location where to create shares in the recipient's storage provider.
 	ShareFolder   string                            `mapstructure:"share_folder"`
 	TokenManagers map[string]map[string]interface{} `mapstructure:"token_managers"`
+	// StorageRegistryDriver selects a storage registry driver to resolve providers locally
+	// instead of asking the storage registry service. Empty means using the service.
+	StorageRegistryDriver  string                            `mapstructure:"storage_registry_driver"`
+	StorageRegistryDrivers map[string]map[string]interface{} `mapstructure:"storage_registry_drivers"`
+	// DataGateways maps a region label to the data gateway serving it. Transfers are routed to the
+	// data gateway in the region of the storage provider, falling back to datagateway.
+	DataGateways map[string]string `mapstructure:"datagateways"`
+	// ResolutionCacheTTL is the time in seconds the stats done to resolve shares are cached. 0 disables the cache.
+	ResolutionCacheTTL int `mapstructure:"resolution_cache_ttl"`
+	// ResolutionCacheSize is the maximum number of cached resolution stats.
+	ResolutionCacheSize int `mapstructure:"resolution_cache_size"`
+	// ProviderCacheTTL is the time in seconds the providers found in the storage registry are cached.
+	// A negative value disables the cache.
+	ProviderCacheTTL int `mapstructure:"provider_cache_ttl"`
+	// ProviderCacheSize is the maximum number of cached providers.
+	ProviderCacheSize int `mapstructure:"provider_cache_size"`
+	// DisableStatMemo disables the reuse of the stats done by a request, e.g. to resolve
+	// a share and then its target, by the later stats of the same resources in the request.
+	DisableStatMemo bool `mapstructure:"disable_stat_memo"`
+	// MaxConcurrentResolutions limits the stats done at the same time to resolve shares,
+	// 100 when not positive.
+	MaxConcurrentResolutions int `mapstructure:"max_concurrent_resolutions"`
+	// ShareResolutionWorkers is the maximum number of shares resolved at the same time to list the shared folder.
+	ShareResolutionWorkers int `mapstructure:"share_resolution_workers"`
+	// ListBrokenShares lists the shares that cannot be resolved in the shared folder as references
+	// carrying the error in their opaque, instead of leaving them out.
+	ListBrokenShares bool `mapstructure:"list_broken_shares"`
+	// ShareNameCollision is the precedence of the regular resources created in the share folder
+	// over the share names they collide with: "resource", the default, serves them as regular
+	// resources while "error" fails the requests to them with an internal error.
+	ShareNameCollision string `mapstructure:"share_name_collision"`
+	// StatBatchWorkers is the maximum number of storage providers stated at the same time by a batch stat.
+	StatBatchWorkers int `mapstructure:"stat_batch_workers"`
+	// AdminGroup is the group whose members get diagnostics about misconfigured shares.
+	AdminGroup string `mapstructure:"admin_group"`
+	// MaxPathLength is the maximum length in bytes of the paths handled by the gateway.
+	// A negative value disables the limit.
+	MaxPathLength int `mapstructure:"max_path_length"`
+	// MaxPathSegments is the maximum number of segments of the paths handled by the gateway.
+	// A negative value disables the limit.
+	MaxPathSegments int `mapstructure:"max_path_segments"`
+	// MaxReferenceHops is the maximum number of references followed to resolve a reshare.
+	MaxReferenceHops int `mapstructure:"max_reference_hops"`
+	// RetryBudget is the number of retries shared by all the calls delegated to the providers in one request.
+	RetryBudget int `mapstructure:"retry_budget"`
+	// MaxRetries is the number of times the idempotent calls to the providers are retried when
+	// the providers are unavailable. A negative value disables the retries.
+	MaxRetries int `mapstructure:"max_retries"`
+	// RetryBaseDelay is the delay in milliseconds before the first retry, doubled at every retry.
+	RetryBaseDelay int `mapstructure:"retry_base_delay"`
+	// HomeLayout is the template of the path of the home of the users, e.g. /eos/user/{{substr 0 1 .Username}}/{{.Username}}.
+	HomeLayout string `mapstructure:"home_layout"`
+	// HomeAttribute is the key of the user opaque holding the path of the home of the user, it takes precedence over the layout.
+	HomeAttribute string `mapstructure:"home_attribute"`
+	// CircuitBreakerThreshold is the number of consecutive failed calls after which a storage provider
+	// is considered unhealthy and skipped when one of its replicas can be used instead.
+	CircuitBreakerThreshold int `mapstructure:"circuit_breaker_threshold"`
+	// CircuitBreakerCooldown is the time in seconds an unhealthy storage provider is skipped before being tried again.
+	CircuitBreakerCooldown int `mapstructure:"circuit_breaker_cooldown"`
+	// HealthProbeInterval is the time in seconds between the probes of the health of the storage
+	// providers done in the background. 0 disables the background probes, the health is then probed on demand.
+	HealthProbeInterval int `mapstructure:"health_probe_interval"`
+	// HealthProbeTimeout is the time in milliseconds a storage provider has to answer a health probe.
+	HealthProbeTimeout int `mapstructure:"health_probe_timeout"`
+	// RedactedOpaqueKeys are the keys of the opaque of the resources removed from the
+	// responses of Stat and ListContainer, unless the caller is an admin.
+	RedactedOpaqueKeys []string `mapstructure:"redacted_opaque_keys"`
+	// TrustedReferenceTargets restricts the targets of the references resolved by the gateway.
+	// An entry is either the id of a storage whose cs3 targets are trusted or a prefix of the
+	// trusted targets holding a scheme, e.g. webdav://cloud.example.org/, matching up to a slash.
+	// All the targets are trusted when empty.
+	TrustedReferenceTargets []string `mapstructure:"trusted_reference_targets"`
+	// Relocations maps the ids of the storages whose resources have been moved to the ids of
+	// the storages now holding them, to follow the references to moved targets.
+	Relocations map[string]string `mapstructure:"relocations"`
+	// ShareFolderEtag computes the etag of the shared folder from the etags of the share targets,
+	// for clients to detect changes in the shares. It requires to resolve all the shares on every stat.
+	ShareFolderEtag bool `mapstructure:"share_folder_etag"`
+	// Metrics records the number of calls, the latencies and the reference resolutions of the
+	// storage operations, exported by the prometheus http service.
+	Metrics bool `mapstructure:"metrics"`
+	// Keepalive of the connections to the storage providers, times are in seconds.
+	StorageProviderKeepaliveTime                int  `mapstructure:"storage_provider_keepalive_time"`
+	StorageProviderKeepaliveTimeout             int  `mapstructure:"storage_provider_keepalive_timeout"`
+	StorageProviderKeepalivePermitWithoutStream bool `mapstructure:"storage_provider_keepalive_permit_without_stream"`
 }
 
+// The precedences of the regular resources of the share folder over the share names.
+const (
+	shareNameCollisionResource = "resource"
+	shareNameCollisionError    = "error"
+)
+
 // sets defaults
 func (c *config) init() {
 	if c.ShareFolder == "" {
@@ -97,12 +208,111 @@ func (c *config) init() {
 	if c.TransferExpires == 0 {
 		c.TransferExpires = 10
 	}
+
+	if c.TransferMaxExpires == 0 {
+		c.TransferMaxExpires = 3600
+	}
+
+	// a negative skew disables it, as zero stands for the default.
+	if c.TransferClockSkew == 0 {
+		c.TransferClockSkew = 5
+	} else if c.TransferClockSkew < 0 {
+		c.TransferClockSkew = 0
+	}
+
+	if c.TransferSigningAlg == "" {
+		c.TransferSigningAlg = "HS256"
+	}
+
+	if c.ResolutionCacheSize == 0 {
+		c.ResolutionCacheSize = 1000
+	}
+
+	if c.ProviderCacheTTL == 0 {
+		c.ProviderCacheTTL = 5
+	}
+
+	if c.ProviderCacheSize == 0 {
+		c.ProviderCacheSize = 10000
+	}
+
+	if c.MaxConcurrentResolutions <= 0 {
+		c.MaxConcurrentResolutions = 100
+	}
+
+	if c.ShareResolutionWorkers == 0 {
+		c.ShareResolutionWorkers = 10
+	}
+
+	if c.ShareNameCollision == "" {
+		c.ShareNameCollision = shareNameCollisionResource
+	}
+
+	if c.StatBatchWorkers == 0 {
+		c.StatBatchWorkers = 10
+	}
+
+	if c.MaxPathLength == 0 {
+		c.MaxPathLength = 4096
+	}
+
+	if c.MaxPathSegments == 0 {
+		c.MaxPathSegments = 256
+	}
+
+	if c.MaxReferenceHops == 0 {
+		c.MaxReferenceHops = 3
+	}
+
+	if c.RetryBudget == 0 {
+		c.RetryBudget = 10
+	}
+
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 2
+	}
+
+	if c.RetryBaseDelay == 0 {
+		c.RetryBaseDelay = 100
+	}
+
+	if c.CircuitBreakerThreshold == 0 {
+		c.CircuitBreakerThreshold = 5
+	}
+
+	if c.CircuitBreakerCooldown == 0 {
+		c.CircuitBreakerCooldown = 30
+	}
+
+	if c.StorageProviderKeepaliveTime == 0 {
+		c.StorageProviderKeepaliveTime = int(pool.DefaultKeepaliveTime.Seconds())
+	}
+
+	if c.HealthProbeTimeout == 0 {
+		c.HealthProbeTimeout = 2000
+	}
+
+	if c.StorageProviderKeepaliveTimeout == 0 {
+		c.StorageProviderKeepaliveTimeout = int(pool.DefaultKeepaliveTimeout.Seconds())
+	}
 }
 
 type svc struct {
-	c              *config
-	dataGatewayURL url.URL
-	tokenmgr       token.Manager
+	c               *config
+	dataGatewayURL  url.URL
+	tokenmgr        token.Manager
+	storageRegistry StorageRegistry
+	resolutionCache *ttlCache
+	providerCache   *ttlCache
+	resolutionSem   chan struct{}
+	breaker         *circuitBreaker
+	conns           *providerConns
+	relocator       Relocator
+	metrics         MetricsSink
+	prober          *healthProber
+	// the method and key signing the transfer tokens, HS256 with the shared secret if nil.
+	transferSigningMethod jwt.SigningMethod
+	transferSigningKey    interface{}
 }
 
 // New creates a new gateway svc that acts as a proxy for any grpc operation.
@@ -116,21 +326,82 @@ func New(m map[string]interface{}, ss *grpc.Server) (rgrpc.Service, error) {
 
 	c.init()
 
+	if err := c.checkTransferExpires(); err != nil {
+		return nil, err
+	}
+
 	// ensure DataGatewayEndpoint is a valid URI
 	u, err := url.Parse(c.DataGatewayEndpoint)
 	if err != nil {
 		return nil, err
 	}
 
+	for region, endpoint := range c.DataGateways {
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, errors.Wrapf(err, "gateway: invalid data gateway for region %s", region)
+		}
+	}
+
 	tokenManager, err := getTokenManager(c.TokenManager, c.TokenManagers)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.ShareNameCollision != shareNameCollisionResource && c.ShareNameCollision != shareNameCollisionError {
+		return nil, fmt.Errorf("gateway: invalid share name collision precedence %q", c.ShareNameCollision)
+	}
+
+	if err := validateHomeLayout(c.HomeLayout); err != nil {
+		return nil, err
+	}
+
+	storageRegistry, err := getStorageRegistry(c)
+	if err != nil {
+		return nil, err
+	}
+
+	signingMethod, signingKey, err := getTransferSigningKey(c.TransferSigningAlg, c.TransferSharedSecret, c.TransferSigningKey)
+	if err != nil {
+		return nil, err
+	}
+
+	breaker := newCircuitBreaker(c.CircuitBreakerThreshold, time.Duration(c.CircuitBreakerCooldown)*time.Second)
+
 	s := &svc{
-		c:              c,
-		dataGatewayURL: *u,
-		tokenmgr:       tokenManager,
+		c:               c,
+		dataGatewayURL:  *u,
+		tokenmgr:        tokenManager,
+		storageRegistry: storageRegistry,
+		resolutionCache: newTTLCache(time.Duration(c.ResolutionCacheTTL)*time.Second, c.ResolutionCacheSize),
+		providerCache:   newTTLCache(time.Duration(c.ProviderCacheTTL)*time.Second, c.ProviderCacheSize),
+		resolutionSem:   make(chan struct{}, c.MaxConcurrentResolutions),
+		breaker:         breaker,
+		conns: newProviderConns(
+			grpc.WithUnaryInterceptor(breaker.intercept),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                time.Duration(c.StorageProviderKeepaliveTime) * time.Second,
+				Timeout:             time.Duration(c.StorageProviderKeepaliveTimeout) * time.Second,
+				PermitWithoutStream: c.StorageProviderKeepalivePermitWithoutStream,
+			}),
+		),
+
+		transferSigningMethod: signingMethod,
+		transferSigningKey:    signingKey,
+	}
+
+	if len(c.Relocations) > 0 {
+		s.relocator = staticRelocator(c.Relocations)
+	}
+
+	if c.Metrics {
+		s.metrics, err = newOpencensusSink()
+		if err != nil {
+			return nil, errors.Wrap(err, "gateway: error registering the metrics views")
+		}
+	}
+
+	if c.HealthProbeInterval > 0 {
+		s.prober = s.startHealthProber(time.Duration(c.HealthProbeInterval) * time.Second)
 	}
 
 	return s, nil
@@ -141,7 +412,14 @@ func (s *svc) Register(ss *grpc.Server) {
 }
 
 func (s *svc) Close() error {
-	return nil
+	s.prober.close()
+	err := s.conns.close()
+	if c, ok := s.storageRegistry.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (s *svc) UnprotectedEndpoints() []string {
@@ -157,6 +435,38 @@ func parseConfig(m map[string]interface{}) (*config, error) {
 	return c, nil
 }
 
+// checkTransferExpires validates the lifetime of the transfer tokens and caps it to the maximum.
+func (c *config) checkTransferExpires() error {
+	if c.TransferExpires < 1 {
+		return fmt.Errorf("gateway: transfer_expires must be at least 1 second, got %d", c.TransferExpires)
+	}
+	if c.TransferMaxExpires < 1 {
+		return fmt.Errorf("gateway: transfer_max_expires must be at least 1 second, got %d", c.TransferMaxExpires)
+	}
+
+	if c.TransferExpires > c.TransferMaxExpires {
+		log.Warn().Int64("transfer_expires", c.TransferExpires).Int64("transfer_max_expires", c.TransferMaxExpires).Msg("gateway: capping the lifetime of transfer tokens")
+		c.TransferExpires = c.TransferMaxExpires
+	}
+	return nil
+}
+
+// validateHomeLayout checks the home layout template can be executed.
+func validateHomeLayout(layout string) (err error) {
+	if layout == "" {
+		return nil
+	}
+
+	// templates panic on invalid layouts
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("gateway: invalid home layout %q: %v", layout, r)
+		}
+	}()
+	templates.WithUser(&userpb.User{Id: &userpb.UserId{}}, layout)
+	return nil
+}
+
 func getTokenManager(manager string, m map[string]map[string]interface{}) (token.Manager, error) {
 	if f, ok := registry.NewFuncs[manager]; ok {
 		return f(m[manager])
@@ -0,0 +1,388 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"google.golang.org/grpc"
+)
+
+// fakeStorage is an in memory storage provider used to test the gateway
+// against a real grpc connection.
+type fakeStorage struct {
+	provider.UnimplementedProviderAPIServer
+
+	sync.Mutex
+	storageID string
+	infos     map[string]*provider.ResourceInfo
+	calls     map[string]int
+	// warning is reported in the opaque of the successful deletions.
+	warning string
+	// recycle holds the items listed in the recycle bin.
+	recycle []*provider.RecycleItem
+	// onStat is called before serving each stat.
+	onStat func(ref *provider.Reference)
+	// quotaRequests are the GetQuota requests received.
+	quotaRequests []*provider.GetQuotaRequest
+	// recycleStreamRequests are the ListRecycleStream requests received.
+	recycleStreamRequests []*provider.ListRecycleStreamRequest
+	// recycleBatch is the number of recycle items streamed before yielding.
+	recycleBatch int
+	// unavailable is the number of the next Stat and Delete calls failing as unavailable.
+	unavailable int
+	// deleteRequests and moveRequests are the Delete and Move requests received.
+	deleteRequests []*provider.DeleteRequest
+	moveRequests   []*provider.MoveRequest
+	// downloadRequests are the InitiateFileDownload requests received.
+	downloadRequests []*provider.InitiateFileDownloadRequest
+	// dataEndpoint, when set, is the data server the transfers are exposed at, the path appended.
+	dataEndpoint string
+	// protocols, when set, are advertised in the opaque of the transfer responses.
+	protocols []*transferProtocol
+}
+
+func newFakeStorage(storageID string) *fakeStorage {
+	return &fakeStorage{
+		storageID: storageID,
+		infos:     map[string]*provider.ResourceInfo{},
+		calls:     map[string]int{},
+	}
+}
+
+// add stores a resource of the given type at p. The id of the resource is its path.
+func (f *fakeStorage) add(p string, t provider.ResourceType) *provider.ResourceInfo {
+	f.Lock()
+	defer f.Unlock()
+	info := &provider.ResourceInfo{
+		Id:   &provider.ResourceId{StorageId: f.storageID, OpaqueId: p},
+		Path: p,
+		Type: t,
+	}
+	f.infos[p] = info
+	return info
+}
+
+// addReference stores a reference at p pointing to the resource at target.
+func (f *fakeStorage) addReference(p, target string) *provider.ResourceInfo {
+	info := f.add(p, provider.ResourceType_RESOURCE_TYPE_REFERENCE)
+	info.Target = "cs3:" + f.storageID + "/" + target
+	return info
+}
+
+func (f *fakeStorage) count(method string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeStorage) lookup(ref *provider.Reference) (*provider.ResourceInfo, bool) {
+	if ref.GetPath() != "" {
+		info, ok := f.infos[ref.GetPath()]
+		return info, ok
+	}
+	info, ok := f.infos[ref.GetId().GetOpaqueId()]
+	return info, ok
+}
+
+func (f *fakeStorage) Stat(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error) {
+	if f.onStat != nil {
+		f.onStat(req.Ref)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.calls["Stat"]++
+	if f.unavailable > 0 {
+		f.unavailable--
+		return &provider.StatResponse{Status: status.NewUnavailable(ctx, errtypes.Unavailable("fake"), "fake: unavailable")}, nil
+	}
+
+	info, ok := f.lookup(req.Ref)
+	if !ok {
+		return &provider.StatResponse{Status: status.NewNotFound(ctx, "fake: not found")}, nil
+	}
+	return &provider.StatResponse{Status: status.NewOK(ctx), Info: info}, nil
+}
+
+func (f *fakeStorage) ListContainer(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["ListContainer"]++
+
+	parent, ok := f.lookup(req.Ref)
+	if !ok {
+		return &provider.ListContainerResponse{Status: status.NewNotFound(ctx, "fake: not found")}, nil
+	}
+
+	infos := []*provider.ResourceInfo{}
+	for p, info := range f.infos {
+		if path.Dir(p) == parent.Path && p != parent.Path {
+			infos = append(infos, info)
+		}
+	}
+	return &provider.ListContainerResponse{Status: status.NewOK(ctx), Infos: infos}, nil
+}
+
+func (f *fakeStorage) CreateContainer(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
+	f.Lock()
+	f.calls["CreateContainer"]++
+	f.Unlock()
+
+	f.add(req.Ref.GetPath(), provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	return &provider.CreateContainerResponse{Status: status.NewOK(ctx)}, nil
+}
+
+func (f *fakeStorage) CreateReference(ctx context.Context, req *provider.CreateReferenceRequest) (*provider.CreateReferenceResponse, error) {
+	f.Lock()
+	f.calls["CreateReference"]++
+	f.Unlock()
+
+	info := f.add(req.Path, provider.ResourceType_RESOURCE_TYPE_REFERENCE)
+	info.Target = req.TargetUri
+	return &provider.CreateReferenceResponse{Status: status.NewOK(ctx)}, nil
+}
+
+func (f *fakeStorage) Delete(ctx context.Context, req *provider.DeleteRequest) (*provider.DeleteResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["Delete"]++
+	f.deleteRequests = append(f.deleteRequests, req)
+	if f.unavailable > 0 {
+		f.unavailable--
+		return &provider.DeleteResponse{Status: status.NewUnavailable(ctx, errtypes.Unavailable("fake"), "fake: unavailable")}, nil
+	}
+
+	info, ok := f.lookup(req.Ref)
+	if !ok {
+		return &provider.DeleteResponse{Status: status.NewNotFound(ctx, "fake: not found")}, nil
+	}
+	for p := range f.infos {
+		if p == info.Path || strings.HasPrefix(p, info.Path+"/") {
+			delete(f.infos, p)
+		}
+	}
+
+	res := &provider.DeleteResponse{Status: status.NewOK(ctx)}
+	if f.warning != "" {
+		res.Opaque = &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				"warning": {Decoder: "plain", Value: []byte(f.warning)},
+			},
+		}
+	}
+	return res, nil
+}
+
+var (
+	listenedMu sync.Mutex
+	listened   = map[string]bool{}
+)
+
+// listen listens on a local port not used before by the tests. The clients of the storage
+// providers are pooled by address, so a server started on the port of a stopped one would be
+// reached through the client of the latter, failing the calls while it reconnects.
+func listen(t testing.TB) net.Listener {
+	for {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+
+		listenedMu.Lock()
+		used := listened[lis.Addr().String()]
+		listened[lis.Addr().String()] = true
+		listenedMu.Unlock()
+		if !used {
+			return lis
+		}
+		lis.Close()
+	}
+}
+
+// newTestGateway starts the fake storage on a local grpc server and returns a gateway
+// resolving every path and the storage id to it.
+func newTestGateway(t testing.TB, storage *fakeStorage) (*svc, func()) {
+	lis := listen(t)
+
+	srv := grpc.NewServer()
+	provider.RegisterProviderAPIServer(srv, storage)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	c := &config{
+		ShareFolder:           "MyShares",
+		MaxReferenceHops:      3,
+		StorageRegistryDriver: "static",
+		StorageRegistryDrivers: map[string]map[string]interface{}{
+			"static": {
+				"rules": map[string]string{
+					"/":               lis.Addr().String(),
+					storage.storageID: lis.Addr().String(),
+				},
+			},
+		},
+	}
+	reg, err := getStorageRegistry(c)
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("error creating storage registry: %v", err)
+	}
+
+	return &svc{c: c, storageRegistry: reg}, srv.Stop
+}
+
+func (f *fakeStorage) Move(ctx context.Context, req *provider.MoveRequest) (*provider.MoveResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["Move"]++
+	f.moveRequests = append(f.moveRequests, req)
+
+	info, ok := f.lookup(req.Source)
+	if !ok {
+		return &provider.MoveResponse{Status: status.NewNotFound(ctx, "fake: not found")}, nil
+	}
+	src, dst := info.Path, req.Destination.GetPath()
+	moved := map[string]*provider.ResourceInfo{}
+	for p, i := range f.infos {
+		if p == src || strings.HasPrefix(p, src+"/") {
+			delete(f.infos, p)
+			moved[dst+strings.TrimPrefix(p, src)] = i
+		}
+	}
+	for p, i := range moved {
+		i.Path = p
+		i.Id = &provider.ResourceId{StorageId: f.storageID, OpaqueId: p}
+		f.infos[p] = i
+	}
+	return &provider.MoveResponse{Status: status.NewOK(ctx)}, nil
+}
+
+func (f *fakeStorage) InitiateFileDownload(ctx context.Context, req *provider.InitiateFileDownloadRequest) (*provider.InitiateFileDownloadResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["InitiateFileDownload"]++
+	f.downloadRequests = append(f.downloadRequests, req)
+
+	info, ok := f.lookup(req.Ref)
+	if !ok {
+		return &provider.InitiateFileDownloadResponse{Status: status.NewNotFound(ctx, "fake: not found")}, nil
+	}
+	if f.dataEndpoint != "" {
+		return &provider.InitiateFileDownloadResponse{
+			Status:           status.NewOK(ctx),
+			DownloadEndpoint: f.dataEndpoint + info.Path,
+			Expose:           true,
+		}, nil
+	}
+	return &provider.InitiateFileDownloadResponse{
+		Status:           status.NewOK(ctx),
+		Opaque:           f.protocolsOpaque(),
+		DownloadEndpoint: "http://127.0.0.1:19001/data",
+	}, nil
+}
+
+func (f *fakeStorage) InitiateFileUpload(ctx context.Context, req *provider.InitiateFileUploadRequest) (*provider.InitiateFileUploadResponse, error) {
+	f.Lock()
+	f.calls["InitiateFileUpload"]++
+	f.Unlock()
+
+	if f.dataEndpoint != "" {
+		return &provider.InitiateFileUploadResponse{
+			Status:         status.NewOK(ctx),
+			UploadEndpoint: f.dataEndpoint + req.Ref.GetPath(),
+			Expose:         true,
+		}, nil
+	}
+	return &provider.InitiateFileUploadResponse{
+		Status:         status.NewOK(ctx),
+		Opaque:         f.protocolsOpaque(),
+		UploadEndpoint: "http://127.0.0.1:19001/data",
+	}, nil
+}
+
+// protocolsOpaque returns the opaque advertising the protocols of the transfers, if any.
+func (f *fakeStorage) protocolsOpaque() *typespb.Opaque {
+	if len(f.protocols) == 0 {
+		return nil
+	}
+	value, _ := json.Marshal(f.protocols)
+	return &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			protocolsKey: {Decoder: "json", Value: value},
+		},
+	}
+}
+
+func (f *fakeStorage) ListRecycle(ctx context.Context, req *provider.ListRecycleRequest) (*provider.ListRecycleResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["ListRecycle"]++
+
+	return &provider.ListRecycleResponse{Status: status.NewOK(ctx), RecycleItems: f.recycle}, nil
+}
+
+func (f *fakeStorage) ListRecycleStream(req *provider.ListRecycleStreamRequest, ss provider.ProviderAPI_ListRecycleStreamServer) error {
+	f.Lock()
+	f.calls["ListRecycleStream"]++
+	f.recycleStreamRequests = append(f.recycleStreamRequests, req)
+	items, batch := f.recycle, f.recycleBatch
+	f.Unlock()
+
+	if batch <= 0 {
+		batch = len(items)
+	}
+	for len(items) > 0 {
+		n := batch
+		if n > len(items) {
+			n = len(items)
+		}
+		for _, item := range items[:n] {
+			if err := ss.Send(&provider.ListRecycleStreamResponse{Status: status.NewOK(ss.Context()), RecycleItem: item}); err != nil {
+				return err
+			}
+		}
+		items = items[n:]
+		// the client may have gone away while the batch was sent
+		if err := ss.Context().Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) GetQuota(ctx context.Context, req *provider.GetQuotaRequest) (*provider.GetQuotaResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["GetQuota"]++
+	f.quotaRequests = append(f.quotaRequests, req)
+
+	return &provider.GetQuotaResponse{Status: status.NewOK(ctx), TotalBytes: 100, UsedBytes: 10}, nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// ProviderHealth is the health of a storage provider, as seen by a probe.
+type ProviderHealth struct {
+	Address string
+	// ProviderPath is the first path the provider serves in the storage registry.
+	ProviderPath string
+	Healthy      bool
+	// Latency is the time the provider took to answer the probe.
+	Latency time.Duration
+	// Error is the reason the provider is unhealthy, empty when healthy.
+	Error string
+}
+
+// GatewayHealth aggregates the health of the storage providers the gateway routes to.
+type GatewayHealth struct {
+	// Healthy is true when all the storage providers are healthy.
+	Healthy   bool
+	CheckedAt time.Time
+	// Providers are sorted by address.
+	Providers []*ProviderHealth
+}
+
+// GetGatewayHealth returns the health of the storage providers known by the storage registry.
+// When the background prober is enabled the result of its last probe is returned, otherwise
+// the providers are probed on demand. The storage registry must be able to list its providers.
+//
+// The CS3 gateway API has no health call yet, so it is only available in process.
+func (s *svc) GetGatewayHealth(ctx context.Context) (*GatewayHealth, error) {
+	if h := s.prober.get(); h != nil {
+		return h, nil
+	}
+	return s.probeHealth(ctx)
+}
+
+// probeHealth probes all the storage providers of the registry at the same time.
+// Providers serving several paths are probed once.
+func (s *svc) probeHealth(ctx context.Context) (*GatewayHealth, error) {
+	r, ok := s.storageRegistry.(ListingStorageRegistry)
+	if !ok {
+		return nil, errtypes.NotSupported("gateway: the storage registry cannot list its providers")
+	}
+
+	providers, err := r.ListProviders(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error listing storage providers")
+	}
+
+	paths := map[string]string{}
+	for _, p := range providers {
+		if cur, ok := paths[p.Address]; !ok || p.ProviderPath < cur {
+			paths[p.Address] = p.ProviderPath
+		}
+	}
+	addresses := make([]string, 0, len(paths))
+	for addr := range paths {
+		addresses = append(addresses, addr)
+	}
+	sort.Strings(addresses)
+
+	h := &GatewayHealth{
+		Healthy:   true,
+		CheckedAt: time.Now(),
+		Providers: make([]*ProviderHealth, len(addresses)),
+	}
+	var wg sync.WaitGroup
+	for i, addr := range addresses {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			h.Providers[i] = s.probeProvider(ctx, addr, paths[addr])
+		}(i, addr)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range h.Providers {
+		h.Healthy = h.Healthy && p.Healthy
+	}
+	return h, nil
+}
+
+// probeProvider stats the path served by the provider at addr. Like for the circuit breaker,
+// only a provider that cannot be reached or does not answer in time is unhealthy, errors of
+// the stat itself, e.g. a missing authentication, still tell the provider is up.
+func (s *svc) probeProvider(ctx context.Context, addr, p string) *ProviderHealth {
+	h := &ProviderHealth{Address: addr, ProviderPath: p}
+
+	c, err := s.conns.get(addr)
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.c.HealthProbeTimeout)*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res, err := c.Stat(ctx, &provider.StatRequest{
+		Ref: &provider.Reference{
+			Spec: &provider.Reference_Path{
+				Path: p,
+			},
+		},
+	})
+	h.Latency = time.Since(start)
+
+	switch {
+	case gstatus.Code(err) == codes.Unavailable || gstatus.Code(err) == codes.DeadlineExceeded:
+		h.Error = err.Error()
+	case err == nil && res.Status.Code == rpc.Code_CODE_UNAVAILABLE:
+		h.Error = "storage provider unavailable: " + res.Status.Message
+	default:
+		h.Healthy = true
+	}
+	return h
+}
+
+// healthProber probes the health of the storage providers in the background.
+// A nil prober holds no health.
+type healthProber struct {
+	mu   sync.Mutex
+	last *GatewayHealth
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHealthProber probes the health of the storage providers right away and then at every interval.
+func (s *svc) startHealthProber(interval time.Duration) *healthProber {
+	hp := &healthProber{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(hp.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.probe(hp)
+			select {
+			case <-ticker.C:
+			case <-hp.stop:
+				return
+			}
+		}
+	}()
+	return hp
+}
+
+// probe probes the health of the storage providers, logging the providers whose health changed.
+func (s *svc) probe(hp *healthProber) {
+	h, err := s.probeHealth(context.Background())
+	if err != nil {
+		log.Error().Err(err).Msg("gateway: error probing the health of the storage providers")
+		return
+	}
+
+	last := hp.get()
+	for _, p := range h.Providers {
+		if last.healthy(p.Address) == p.Healthy {
+			continue
+		}
+		if p.Healthy {
+			log.Info().Str("address", p.Address).Msg("gateway: storage provider is healthy")
+		} else {
+			log.Warn().Str("address", p.Address).Str("error", p.Error).Msg("gateway: storage provider is unhealthy")
+		}
+	}
+
+	hp.mu.Lock()
+	hp.last = h
+	hp.mu.Unlock()
+}
+
+func (hp *healthProber) get() *GatewayHealth {
+	if hp == nil {
+		return nil
+	}
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return hp.last
+}
+
+// close stops the background probes.
+func (hp *healthProber) close() {
+	if hp == nil {
+		return
+	}
+	close(hp.stop)
+	<-hp.done
+}
+
+// healthy reports whether the provider at addr was healthy. Unknown providers were healthy.
+func (h *GatewayHealth) healthy(addr string) bool {
+	if h == nil {
+		return true
+	}
+	for _, p := range h.Providers {
+		if p.Address == addr {
+			return p.Healthy
+		}
+	}
+	return true
+}
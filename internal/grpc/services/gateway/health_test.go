@@ -0,0 +1,170 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+)
+
+// newHealthGateway returns a gateway routing to a healthy storage, a storage that cannot be
+// reached, a storage answering too late and a storage reporting it is unavailable.
+func newHealthGateway(t *testing.T) (*svc, *fakeStorage, map[string]string, func()) {
+	storage := newFakeStorage("home")
+	s, stop := newTestGateway(t, storage)
+	s.c.HealthProbeTimeout = 100
+
+	// the slow storage answers once the test is done, after the probes timed out
+	unblock := make(chan struct{})
+	slow := newFakeStorage("slow")
+	slow.onStat = func(ref *provider.Reference) {
+		<-unblock
+	}
+	stopSlow := mountFakeStorage(t, s, "/slow", slow)
+
+	flaky := newFakeStorage("flaky")
+	flaky.unavailable = 1000
+	stopFlaky := mountFakeStorage(t, s, "/flaky", flaky)
+
+	// nothing listens at the address of the storage that is down
+	lis := listen(t)
+	down := lis.Addr().String()
+	lis.Close()
+	rules := s.c.StorageRegistryDrivers["static"]["rules"].(map[string]string)
+	rules["/down"] = down
+	reg, err := getStorageRegistry(s.c)
+	if err != nil {
+		t.Fatalf("error creating storage registry: %v", err)
+	}
+	s.storageRegistry = reg
+
+	paths := map[string]string{}
+	for p, addr := range rules {
+		if p[0] == '/' {
+			paths[p] = addr
+		}
+	}
+	return s, storage, paths, func() {
+		close(unblock)
+		stopFlaky()
+		stopSlow()
+		stop()
+	}
+}
+
+func TestGetGatewayHealth(t *testing.T) {
+	s, storage, addresses, stop := newHealthGateway(t)
+	defer stop()
+
+	h, err := s.GetGatewayHealth(context.Background())
+	if err != nil {
+		t.Fatalf("GetGatewayHealth() error = %v", err)
+	}
+	if h.Healthy {
+		t.Errorf("GetGatewayHealth() healthy with unhealthy providers")
+	}
+
+	want := map[string]bool{"/": true, "/slow": false, "/flaky": false, "/down": false}
+	if len(h.Providers) != len(want) {
+		t.Fatalf("GetGatewayHealth() returned %d providers, want %d", len(h.Providers), len(want))
+	}
+	for _, p := range h.Providers {
+		healthy, ok := want[p.ProviderPath]
+		if !ok {
+			t.Errorf("GetGatewayHealth() returned unexpected provider %v", p)
+			continue
+		}
+		if p.Address != addresses[p.ProviderPath] {
+			t.Errorf("GetGatewayHealth() provider %s address = %s, want %s", p.ProviderPath, p.Address, addresses[p.ProviderPath])
+		}
+		if p.Healthy != healthy {
+			t.Errorf("GetGatewayHealth() provider %s healthy = %v, want %v", p.ProviderPath, p.Healthy, healthy)
+		}
+		if !p.Healthy && p.Error == "" {
+			t.Errorf("GetGatewayHealth() provider %s is unhealthy without error", p.ProviderPath)
+		}
+	}
+
+	// the home storage is registered both by path and by id, but probed once
+	if n := storage.count("Stat"); n != 1 {
+		t.Errorf("home storage probed %d times, want 1", n)
+	}
+}
+
+func TestGetGatewayHealthAllHealthy(t *testing.T) {
+	s, stop := newTestGateway(t, newFakeStorage("home"))
+	defer stop()
+	s.c.HealthProbeTimeout = 1000
+
+	h, err := s.GetGatewayHealth(context.Background())
+	if err != nil {
+		t.Fatalf("GetGatewayHealth() error = %v", err)
+	}
+	if !h.Healthy || len(h.Providers) != 1 {
+		t.Errorf("GetGatewayHealth() = %+v, want a single healthy provider", h)
+	}
+}
+
+func TestGetGatewayHealthNotSupported(t *testing.T) {
+	s, stop := newTestGateway(t, newFakeStorage("home"))
+	defer stop()
+	// the registry only finds providers
+	s.storageRegistry = &countingRegistry{StorageRegistry: s.storageRegistry}
+
+	_, err := s.GetGatewayHealth(context.Background())
+	if _, ok := err.(errtypes.IsNotSupported); !ok {
+		t.Errorf("GetGatewayHealth() error = %v, want not supported", err)
+	}
+}
+
+func TestHealthProber(t *testing.T) {
+	s, _, _, stop := newHealthGateway(t)
+	defer stop()
+
+	s.prober = s.startHealthProber(20 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.prober.get() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the prober did not probe the providers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h, err := s.GetGatewayHealth(context.Background())
+	if err != nil {
+		t.Fatalf("GetGatewayHealth() error = %v", err)
+	}
+	if h != s.prober.get() || h.Healthy || len(h.Providers) != 4 {
+		t.Errorf("GetGatewayHealth() = %+v, want the last probe", h)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// the probes stop with the gateway
+	select {
+	case <-s.prober.done:
+	default:
+		t.Errorf("the prober still runs after the gateway was closed")
+	}
+}
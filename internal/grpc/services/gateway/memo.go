@@ -0,0 +1,146 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/golang/protobuf/proto"
+)
+
+// providerMemo remembers the providers resolved while serving a single request,
+// so that a request touching several paths of the shared folder looks them up once.
+// Being scoped to the request, it cannot serve stale entries like a global cache.
+type providerMemo struct {
+	sync.Mutex
+	providers map[string]*registry.ProviderInfo
+}
+
+type providerMemoKey struct{}
+
+// withProviderMemo returns a context carrying a new provider memo, unless the context
+// already carries one, in which case the memo is shared with the calling request.
+func (s *svc) withProviderMemo(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(providerMemoKey{}).(*providerMemo); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, providerMemoKey{}, &providerMemo{providers: map[string]*registry.ProviderInfo{}})
+}
+
+// memoKey returns the key under which the provider of ref is remembered.
+// The shared folder and all the mount points in it live in the same provider,
+// the share targets, referenced by id, are remembered by storage id and
+// any other path by itself.
+func (s *svc) memoKey(ctx context.Context, ref *provider.Reference) (string, bool) {
+	if id := ref.GetId(); id != nil {
+		if id.StorageId == "" {
+			return "", false
+		}
+		return "id:" + id.StorageId, true
+	}
+
+	p := ref.GetPath()
+	if p == "" {
+		return "", false
+	}
+	if s.inSharedFolder(ctx, p) {
+		return "path:" + s.getSharedFolder(ctx), true
+	}
+	return "path:" + p, true
+}
+
+// cacheKey returns the key under which the provider of ref is kept in the provider cache.
+// Unlike the memo, the cache is shared by all the requests and the registry may route
+// the same path to a different provider for each user, so the paths are scoped by the
+// user of the context. Storage ids name the same storage for everyone and are kept as is.
+func (s *svc) cacheKey(ctx context.Context, key string) string {
+	if !strings.HasPrefix(key, "path:") {
+		return key
+	}
+	if u, ok := user.ContextGetUser(ctx); ok {
+		return u.GetId().GetIdp() + "!" + u.GetId().GetOpaqueId() + "!" + key
+	}
+	return key
+}
+
+func (m *providerMemo) get(key string) (*registry.ProviderInfo, bool) {
+	m.Lock()
+	defer m.Unlock()
+	p, ok := m.providers[key]
+	return p, ok
+}
+
+func (m *providerMemo) set(key string, p *registry.ProviderInfo) {
+	m.Lock()
+	defer m.Unlock()
+	m.providers[key] = p
+}
+
+// statMemo remembers the successful stats done while serving a single request, so that
+// the share resolution stating the same resources several times asks the providers once.
+// It is forgotten as soon as the request changes anything in the storages. The responses
+// are copied in and out, the callers rewrite the paths of the infos they get.
+type statMemo struct {
+	sync.Mutex
+	stats map[string]*provider.StatResponse
+}
+
+type statMemoKey struct{}
+
+// withStatMemo returns a context carrying a new stat memo, unless disabled or the
+// context already carries one, in which case the memo is shared with the calling request.
+func (s *svc) withStatMemo(ctx context.Context) context.Context {
+	if s.c.DisableStatMemo {
+		return ctx
+	}
+	if _, ok := ctx.Value(statMemoKey{}).(*statMemo); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, statMemoKey{}, &statMemo{stats: map[string]*provider.StatResponse{}})
+}
+
+// forgetStats empties the stat memo of the request after a change in the storages.
+func (s *svc) forgetStats(ctx context.Context) {
+	if m, ok := ctx.Value(statMemoKey{}).(*statMemo); ok {
+		m.Lock()
+		defer m.Unlock()
+		m.stats = map[string]*provider.StatResponse{}
+	}
+}
+
+func (m *statMemo) get(key string) (*provider.StatResponse, bool) {
+	m.Lock()
+	defer m.Unlock()
+	res, ok := m.stats[key]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(res).(*provider.StatResponse), true
+}
+
+func (m *statMemo) set(key string, res *provider.StatResponse) {
+	m.Lock()
+	defer m.Unlock()
+	m.stats[key] = proto.Clone(res).(*provider.StatResponse)
+}
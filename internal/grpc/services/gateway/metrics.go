@@ -0,0 +1,134 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// MetricsSink records the metrics of the storage operations served by the gateway.
+type MetricsSink interface {
+	// RecordCall records a call to method answered with code after latency.
+	RecordCall(ctx context.Context, method string, code rpc.Code, latency time.Duration)
+	// RecordResolutions records the number of stats done to resolve references while serving method.
+	RecordResolutions(ctx context.Context, method string, n int64)
+}
+
+var (
+	methodKey = tag.MustNewKey("method")
+	codeKey   = tag.MustNewKey("code")
+
+	// callLatencyMeasure records the time taken by the gateway to answer the storage operations.
+	callLatencyMeasure = stats.Float64("cs3_org_reva_gateway_call_latency", "The time taken by the gateway to answer a storage operation", stats.UnitMilliseconds)
+	// resolutionsMeasure records the stats done to resolve references while serving a storage operation.
+	resolutionsMeasure = stats.Int64("cs3_org_reva_gateway_reference_resolutions", "The number of stats done to resolve references while serving a storage operation", stats.UnitDimensionless)
+)
+
+// metricsViews are the views exported for the storage operations: the number of calls per
+// method and code, the distribution of their latencies per method and the total number of
+// stats done to resolve references per method. They are registered once for all the gateways.
+var metricsViews = []*view.View{
+	{
+		Name:        "cs3_org_reva_gateway_calls",
+		Description: "The number of storage operations served by the gateway",
+		Measure:     callLatencyMeasure,
+		TagKeys:     []tag.Key{methodKey, codeKey},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        callLatencyMeasure.Name(),
+		Description: callLatencyMeasure.Description(),
+		Measure:     callLatencyMeasure,
+		TagKeys:     []tag.Key{methodKey},
+		Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+	},
+	{
+		Name:        resolutionsMeasure.Name(),
+		Description: resolutionsMeasure.Description(),
+		Measure:     resolutionsMeasure,
+		TagKeys:     []tag.Key{methodKey},
+		Aggregation: view.Sum(),
+	},
+}
+
+// opencensusSink records the metrics with opencensus, exported by the prometheus http service.
+type opencensusSink struct{}
+
+// newOpencensusSink registers the views of the storage operations and returns a sink recording them.
+func newOpencensusSink() (MetricsSink, error) {
+	if err := view.Register(metricsViews...); err != nil {
+		return nil, err
+	}
+	return opencensusSink{}, nil
+}
+
+func (opencensusSink) RecordCall(ctx context.Context, method string, code rpc.Code, latency time.Duration) {
+	_ = stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(methodKey, method), tag.Upsert(codeKey, code.String())},
+		callLatencyMeasure.M(float64(latency)/float64(time.Millisecond)))
+}
+
+func (opencensusSink) RecordResolutions(ctx context.Context, method string, n int64) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(methodKey, method)}, resolutionsMeasure.M(n))
+}
+
+// callMetrics counts the stats done to resolve references while serving a call.
+type callMetrics struct {
+	resolutions int64
+}
+
+type callMetricsKey struct{}
+
+// observe starts the metrics of a call to method and returns the context to serve it with, and
+// the function recording them once answered. Calls done by the gateway to itself while serving
+// another one are part of the outer call and not recorded on their own. Without a metrics sink
+// nothing is recorded.
+func (s *svc) observe(ctx context.Context, method string) (context.Context, func(st *rpc.Status, err error)) {
+	if s.metrics == nil {
+		return ctx, func(*rpc.Status, error) {}
+	}
+	if _, ok := ctx.Value(callMetricsKey{}).(*callMetrics); ok {
+		return ctx, func(*rpc.Status, error) {}
+	}
+
+	m := &callMetrics{}
+	start := time.Now()
+	return context.WithValue(ctx, callMetricsKey{}, m), func(st *rpc.Status, err error) {
+		code := st.GetCode()
+		if err != nil {
+			code = rpc.Code_CODE_INTERNAL
+		}
+		s.metrics.RecordCall(ctx, method, code, time.Since(start))
+		s.metrics.RecordResolutions(ctx, method, atomic.LoadInt64(&m.resolutions))
+	}
+}
+
+// countResolution counts a stat done to resolve a reference in the metrics of the call.
+func countResolution(ctx context.Context) {
+	if m, ok := ctx.Value(callMetricsKey{}).(*callMetrics); ok {
+		atomic.AddInt64(&m.resolutions, 1)
+	}
+}
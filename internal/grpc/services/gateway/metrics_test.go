@@ -0,0 +1,137 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"go.opencensus.io/stats/view"
+)
+
+// recordedCalls returns the number of calls to method answered with code recorded so far.
+func recordedCalls(t *testing.T, method string, code rpc.Code) int64 {
+	rows, err := view.RetrieveData("cs3_org_reva_gateway_calls")
+	if err != nil {
+		t.Fatalf("RetrieveData() error = %v", err)
+	}
+	for _, row := range rows {
+		tags := map[string]string{}
+		for _, tag := range row.Tags {
+			tags[tag.Key.Name()] = tag.Value
+		}
+		if tags[methodKey.Name()] == method && tags[codeKey.Name()] == code.String() {
+			return row.Data.(*view.CountData).Value
+		}
+	}
+	return 0
+}
+
+// recordedResolutions returns the number of reference resolutions recorded so far for method.
+func recordedResolutions(t *testing.T, method string) float64 {
+	rows, err := view.RetrieveData(resolutionsMeasure.Name())
+	if err != nil {
+		t.Fatalf("RetrieveData() error = %v", err)
+	}
+	for _, row := range rows {
+		if len(row.Tags) == 1 && row.Tags[0].Value == method {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	metrics, err := newOpencensusSink()
+	if err != nil {
+		t.Fatalf("newOpencensusSink() error = %v", err)
+	}
+	s.metrics = metrics
+
+	stat := func(p string) {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+		if _, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref}); err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+	}
+	move := func(src, dst string) {
+		req := &provider.MoveRequest{
+			Source:      &provider.Reference{Spec: &provider.Reference_Path{Path: src}},
+			Destination: &provider.Reference{Spec: &provider.Reference_Path{Path: dst}},
+		}
+		if _, err := s.Move(context.Background(), req); err != nil {
+			t.Fatalf("Move() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		code   rpc.Code
+		call   func()
+	}{
+		{"stat", "Stat", rpc.Code_CODE_OK, func() { stat("/home/report.txt") }},
+		{"stat missing", "Stat", rpc.Code_CODE_NOT_FOUND, func() { stat("/home/missing.txt") }},
+		{"move", "Move", rpc.Code_CODE_OK, func() { move("/home/report.txt", "/home/renamed.txt") }},
+		{"move missing", "Move", rpc.Code_CODE_NOT_FOUND, func() { move("/home/missing.txt", "/home/found.txt") }},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			before := recordedCalls(t, tt.method, tt.code)
+			tt.call()
+			if got := recordedCalls(t, tt.method, tt.code) - before; got != 1 {
+				t.Errorf("%s recorded %d calls with %v, want 1", tt.method, got, tt.code)
+			}
+		})
+	}
+
+	// only the stat of the share name follows a reference
+	before := recordedResolutions(t, "Stat")
+	stat("/home/MyShares/photos")
+	if got := recordedResolutions(t, "Stat") - before; got != 1 {
+		t.Errorf("Stat() recorded %v reference resolutions, want 1", got)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	ctx := context.Background()
+	observed, done := s.observe(ctx, "Stat")
+	if observed != ctx {
+		t.Errorf("observe() changed the context without a metrics sink")
+	}
+	done(nil, nil)
+}
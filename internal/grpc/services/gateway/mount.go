@@ -0,0 +1,154 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/pkg/errors"
+)
+
+// MountShare mounts the share received by the current user with the given id at mountPoint,
+// creating a reference to the shared resource. The mount point must be a name directly in the
+// shared folder of the user, not taken by another share or resource. The state of the share in
+// the share manager is left untouched.
+func (s *svc) MountShare(ctx context.Context, shareID *collaboration.ShareId, mountPoint string) error {
+	p := path.Clean(mountPoint)
+	if ok, err := s.isShareName(ctx, p); err != nil || !ok {
+		return errtypes.BadRequest("gateway: mount point is not a name in the shared folder: " + mountPoint)
+	}
+
+	res, err := s.GetReceivedShare(ctx, &collaboration.GetReceivedShareRequest{
+		Ref: &collaboration.ShareReference{
+			Spec: &collaboration.ShareReference_Id{
+				Id: shareID,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		if res.Status.Code == rpc.Code_CODE_NOT_FOUND {
+			return errtypes.NotFound("gateway: received share not found: " + shareID.GetOpaqueId())
+		}
+		return status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+
+	id := res.Share.GetShare().GetResourceId()
+	if id == nil {
+		return errors.New("gateway: received share has no resource id: " + shareID.GetOpaqueId())
+	}
+	// cs3 is the Scheme and %s/%s is the Opaque parts of a net.URL.
+	target := fmt.Sprintf("cs3:%s/%s", id.GetStorageId(), id.GetOpaqueId())
+	uri, err := url.Parse(target)
+	if err != nil {
+		return errors.Wrapf(err, "gateway: error parsing target uri:%s", target)
+	}
+	if !s.trustedTarget(uri) {
+		return errtypes.PermissionDenied("gateway: untrusted reference target:" + target)
+	}
+
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: p,
+		},
+	}
+	c, err := s.find(ctx, ref)
+	if err != nil {
+		return errors.Wrap(err, "gateway: error finding storage provider of the shared folder")
+	}
+
+	// the name is checked on the storage holding the shared folder, without resolving the shares.
+	statRes, err := c.Stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return errors.Wrap(err, "gateway: error calling Stat")
+	}
+	switch statRes.Status.Code {
+	case rpc.Code_CODE_OK:
+		return errtypes.AlreadyExists("gateway: mount point already taken: " + p)
+	case rpc.Code_CODE_NOT_FOUND:
+	default:
+		return status.NewErrorFromCode(statRes.Status.Code, "gateway")
+	}
+
+	createRes, err := c.CreateReference(ctx, &provider.CreateReferenceRequest{
+		Path:      p,
+		TargetUri: target,
+	})
+	s.forgetStats(ctx)
+	if err != nil {
+		return errors.Wrap(err, "gateway: error calling CreateReference")
+	}
+	if createRes.Status.Code != rpc.Code_CODE_OK {
+		return status.NewErrorFromCode(createRes.Status.Code, "gateway")
+	}
+
+	appctx.GetLogger(ctx).Info().Str("share", shareID.GetOpaqueId()).Str("path", p).Msg("gateway: share mounted")
+	return nil
+}
+
+// UnmountShare removes the reference mounting a share at mountPoint, leaving the target of the
+// share untouched, as deleting the share name does. Resources in the shared folder that are not
+// share references are not mount points and cannot be unmounted.
+func (s *svc) UnmountShare(ctx context.Context, mountPoint string) error {
+	p := path.Clean(mountPoint)
+	if ok, err := s.isShareName(ctx, p); err != nil || !ok {
+		return errtypes.BadRequest("gateway: mount point is not a name in the shared folder: " + mountPoint)
+	}
+
+	ctx = s.withStatMemo(ctx)
+	statRes, err := s.stat(ctx, &provider.StatRequest{
+		Ref: &provider.Reference{
+			Spec: &provider.Reference_Path{
+				Path: p,
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "gateway: error stating mount point")
+	}
+	if statRes.Status.Code != rpc.Code_CODE_OK {
+		if statRes.Status.Code == rpc.Code_CODE_NOT_FOUND {
+			return errtypes.NotFound("gateway: mount point not found: " + p)
+		}
+		return status.NewErrorFromCode(statRes.Status.Code, "gateway")
+	}
+	if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+		return errtypes.BadRequest("gateway: not a mount point: " + p)
+	}
+
+	res, err := s.unmountShare(ctx, &provider.DeleteRequest{}, p)
+	if err != nil {
+		return err
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"google.golang.org/grpc"
+)
+
+// newMountGateway returns a gateway over the shares storage, whose user received a share
+// of the folder of peter /users/peter/videos, not mounted yet.
+func newMountGateway(t *testing.T) (*svc, *fakeStorage, func()) {
+	storage := newSharesStorage()
+	storage.add("/users/peter/videos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/notes.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	s, stop := newTestGateway(t, storage)
+
+	shares := &fakeShares{
+		received: []*collaboration.ReceivedShare{
+			{
+				Share: &collaboration.Share{
+					Id:         &collaboration.ShareId{OpaqueId: "videos"},
+					ResourceId: &provider.ResourceId{StorageId: "home", OpaqueId: "/users/peter/videos"},
+				},
+				State: collaboration.ShareState_SHARE_STATE_ACCEPTED,
+			},
+		},
+	}
+	lis := listen(t)
+	srv := grpc.NewServer()
+	collaboration.RegisterCollaborationAPIServer(srv, shares)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	s.c.UserShareProviderEndpoint = lis.Addr().String()
+
+	return s, storage, func() {
+		srv.Stop()
+		stop()
+	}
+}
+
+func TestMountShare(t *testing.T) {
+	tests := []struct {
+		name       string
+		share      string
+		mountPoint string
+		err        error
+	}{
+		{"mounted", "videos", "/home/MyShares/movies", nil},
+		{"trailing slash", "videos", "/home/MyShares/movies/", nil},
+		{"name of another share", "videos", "/home/MyShares/photos", errtypes.AlreadyExists("")},
+		{"name of a resource", "videos", "/home/MyShares/notes.txt", errtypes.AlreadyExists("")},
+		{"outside of the shared folder", "videos", "/home/movies", errtypes.BadRequest("")},
+		{"in a share", "videos", "/home/MyShares/photos/movies", errtypes.BadRequest("")},
+		{"shared folder", "videos", "/home/MyShares", errtypes.BadRequest("")},
+		{"unknown share", "books", "/home/MyShares/books", errtypes.NotFound("")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, storage, stop := newMountGateway(t)
+			defer stop()
+
+			err := s.MountShare(context.Background(), &collaboration.ShareId{OpaqueId: tt.share}, tt.mountPoint)
+			switch tt.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("MountShare() error = %v", err)
+				}
+			case errtypes.AlreadyExists:
+				if _, ok := err.(errtypes.IsAlreadyExists); !ok {
+					t.Errorf("MountShare() error = %v, want already exists", err)
+				}
+			case errtypes.BadRequest:
+				if _, ok := err.(errtypes.IsBadRequest); !ok {
+					t.Errorf("MountShare() error = %v, want bad request", err)
+				}
+			case errtypes.NotFound:
+				if _, ok := err.(errtypes.IsNotFound); !ok {
+					t.Errorf("MountShare() error = %v, want not found", err)
+				}
+			}
+
+			if tt.err != nil {
+				if n := storage.count("CreateReference"); n != 0 {
+					t.Errorf("MountShare() created %d references, want none", n)
+				}
+				return
+			}
+
+			// the mounted share resolves to the shared folder of peter
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/movies"}}
+			res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+			if res.Info.Id.OpaqueId != "/users/peter/videos" {
+				t.Errorf("Stat() = %v, want the target of the share", res.Info)
+			}
+		})
+	}
+}
+
+func TestUnmountShare(t *testing.T) {
+	tests := []struct {
+		name       string
+		mountPoint string
+		err        error
+	}{
+		{"unmounted", "/home/MyShares/music", nil},
+		{"not mounted", "/home/MyShares/movies", errtypes.NotFound("")},
+		{"not a mount point", "/home/MyShares/notes.txt", errtypes.BadRequest("")},
+		{"outside of the shared folder", "/home/music", errtypes.BadRequest("")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, storage, stop := newMountGateway(t)
+			defer stop()
+
+			err := s.UnmountShare(context.Background(), tt.mountPoint)
+			switch tt.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("UnmountShare() error = %v", err)
+				}
+			case errtypes.BadRequest:
+				if _, ok := err.(errtypes.IsBadRequest); !ok {
+					t.Errorf("UnmountShare() error = %v, want bad request", err)
+				}
+			case errtypes.NotFound:
+				if _, ok := err.(errtypes.IsNotFound); !ok {
+					t.Errorf("UnmountShare() error = %v, want not found", err)
+				}
+			}
+
+			if tt.err != nil {
+				if n := storage.count("Delete"); n != 0 {
+					t.Errorf("UnmountShare() deleted %d resources, want none", n)
+				}
+				return
+			}
+
+			if _, ok := storage.infos["/home/MyShares/music"]; ok {
+				t.Errorf("UnmountShare() left the reference in the shared folder")
+			}
+			if _, ok := storage.infos["/users/peter/music"]; !ok {
+				t.Errorf("UnmountShare() removed the target of the share")
+			}
+		})
+	}
+}
+
+func TestMountUnmountShare(t *testing.T) {
+	s, _, stop := newMountGateway(t)
+	defer stop()
+	ctx := context.Background()
+	id := &collaboration.ShareId{OpaqueId: "videos"}
+
+	if err := s.MountShare(ctx, id, "/home/MyShares/movies"); err != nil {
+		t.Fatalf("MountShare() error = %v", err)
+	}
+	if err := s.MountShare(ctx, id, "/home/MyShares/movies"); err == nil {
+		t.Errorf("MountShare() at a taken mount point returned no error")
+	}
+	if err := s.UnmountShare(ctx, "/home/MyShares/movies"); err != nil {
+		t.Fatalf("UnmountShare() error = %v", err)
+	}
+	// the name is free again
+	if err := s.MountShare(ctx, id, "/home/MyShares/movies"); err != nil {
+		t.Errorf("MountShare() after unmounting error = %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/golang/protobuf/proto"
+)
+
+// brokenShareError is the error code of the entries of the shared folder listed for the
+// shares that could not be resolved for another reason than those described by shareError.
+const brokenShareError = "share_not_resolved"
+
+// resolveMounts returns the entries of the listing of the shared folder p for the share
+// references refs, in the same order. The shares are resolved concurrently by at most
+// share_resolution_workers workers. A share that cannot be resolved does not fail the
+// listing: it is left out, or listed as is with the error in its opaque when
+// list_broken_shares is enabled. The workers stop resolving once the request is canceled,
+// in which case the error of the context is returned.
+func (s *svc) resolveMounts(ctx context.Context, c provider.ProviderAPIClient, p string, refs []*provider.ResourceInfo) ([]*provider.ResourceInfo, error) {
+	entries := make([]*provider.ResourceInfo, len(refs))
+
+	workers := s.c.ShareResolutionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(refs) {
+		workers = len(refs)
+	}
+
+	queue := make(chan int, len(refs))
+	for i := range refs {
+		queue <- i
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				info, err := s.resolveMount(ctx, c, p, refs[i])
+				if err != nil {
+					info = s.brokenMount(ctx, p, refs[i], err)
+				}
+				entries[i] = info
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	infos := make([]*provider.ResourceInfo, 0, len(entries))
+	for _, info := range entries {
+		if info != nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// brokenMount returns the entry of the listing of the shared folder p for the share reference
+// ref that could not be resolved, or nil when the broken shares are left out of the listings.
+func (s *svc) brokenMount(ctx context.Context, p string, ref *provider.ResourceInfo, err error) *provider.ResourceInfo {
+	log := appctx.GetLogger(ctx)
+	if !s.c.ListBrokenShares {
+		log.Warn().Err(err).Str("path", ref.Path).Msg("gateway: skipping share that cannot be resolved")
+		return nil
+	}
+
+	code := brokenShareError
+	if _, o := shareError(ctx, err, "gateway: error resolving reference:"+ref.Path); o != nil {
+		code = string(o.Map["error"].Value)
+	}
+
+	entry := proto.Clone(ref).(*provider.ResourceInfo)
+	entry.Path = path.Join(p, path.Base(ref.Path))
+	if entry.Opaque == nil {
+		entry.Opaque = &typespb.Opaque{}
+	}
+	if entry.Opaque.Map == nil {
+		entry.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	entry.Opaque.Map["error"] = &typespb.OpaqueEntry{
+		Decoder: "plain",
+		Value:   []byte(code),
+	}
+	return entry
+}
@@ -0,0 +1,255 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// newMountsStorage returns a storage whose shared folder holds the given shares, in the
+// same order as the returned references. The names starting with "broken" point to a
+// missing target and the ones starting with "crafted" to an untrusted one.
+func newMountsStorage(names ...string) (*fakeStorage, []*provider.ResourceInfo) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+
+	refs := make([]*provider.ResourceInfo, 0, len(names))
+	for _, name := range names {
+		target := "/users/peter/" + name
+		ref := storage.addReference("/home/MyShares/"+name, target)
+		switch {
+		case strings.HasPrefix(name, "broken"):
+		case strings.HasPrefix(name, "crafted"):
+			ref.Target = "cs3:admin//etc"
+		default:
+			storage.add(target, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		}
+		refs = append(refs, ref)
+	}
+	return storage, refs
+}
+
+func TestResolveMounts(t *testing.T) {
+	names := []string{"photos", "broken-music", "docs", "crafted", "videos", "broken-books", "games"}
+
+	tests := []struct {
+		name    string
+		workers int
+		list    bool
+		want    []string
+		errors  map[string]string
+	}{
+		{
+			name:    "skip broken shares",
+			workers: 3,
+			want:    []string{"photos", "docs", "videos", "games"},
+		},
+		{
+			name:    "list broken shares",
+			workers: 3,
+			list:    true,
+			want:    names,
+			errors: map[string]string{
+				"broken-music": "share_target_not_found",
+				"crafted":      "share_target_not_trusted",
+				"broken-books": "share_target_not_found",
+			},
+		},
+		{
+			name:    "single worker",
+			workers: 1,
+			want:    []string{"photos", "docs", "videos", "games"},
+		},
+		{
+			name:    "more workers than shares",
+			workers: 100,
+			want:    []string{"photos", "docs", "videos", "games"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage, refs := newMountsStorage(names...)
+			// the first shares are the slowest to resolve, for the workers to finish out of order
+			delays := map[string]time.Duration{}
+			for i, name := range names {
+				delays["/users/peter/"+name] = time.Duration(len(names)-i) * time.Millisecond
+			}
+			storage.onStat = func(ref *provider.Reference) {
+				time.Sleep(delays[ref.GetId().GetOpaqueId()])
+			}
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+			s.c.ShareResolutionWorkers = tt.workers
+			s.c.ListBrokenShares = tt.list
+			s.c.TrustedReferenceTargets = []string{"home"}
+
+			ctx := context.Background()
+			c, err := s.find(ctx, &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}})
+			if err != nil {
+				t.Fatalf("find() error = %v", err)
+			}
+
+			infos, err := s.resolveMounts(ctx, c, "/home/MyShares", refs)
+			if err != nil {
+				t.Fatalf("resolveMounts() error = %v", err)
+			}
+
+			got := make([]string, 0, len(infos))
+			for _, info := range infos {
+				name := strings.TrimPrefix(info.Path, "/home/MyShares/")
+				got = append(got, name)
+
+				e := info.GetOpaque().GetMap()["error"]
+				if code, broken := tt.errors[name]; broken {
+					if e == nil || string(e.Value) != code {
+						t.Errorf("resolveMounts() entry %s opaque = %v, want error %s", name, info.Opaque, code)
+					}
+					if info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+						t.Errorf("resolveMounts() entry %s type = %v, want the reference", name, info.Type)
+					}
+					continue
+				}
+				if e != nil {
+					t.Errorf("resolveMounts() entry %s has error %s", name, e.Value)
+				}
+				if info.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+					t.Errorf("resolveMounts() entry %s type = %v, want the target", name, info.Type)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveMounts() entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListSharedFolderDeletedTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		list  bool
+		paths []string
+	}{
+		{"omitted", false, []string{"/home/MyShares/docs", "/home/MyShares/photos"}},
+		{"tombstone", true, []string{"/home/MyShares/docs", "/home/MyShares/music", "/home/MyShares/photos"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newSharesStorage()
+			// the owner deleted the target of the music share
+			delete(storage.infos, "/users/peter/music")
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+			s.c.ShareResolutionWorkers = 2
+			s.c.ListBrokenShares = tt.list
+
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+			res, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("ListContainer() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("ListContainer() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+			listed := res.Infos
+
+			ss := &listContainerStream{ctx: context.Background()}
+			if err := s.ListContainerStream(&provider.ListContainerStreamRequest{Ref: ref}, ss); err != nil {
+				t.Fatalf("ListContainerStream() error = %v", err)
+			}
+			streamed := []*provider.ResourceInfo{}
+			for _, res := range ss.sent {
+				if res.Status.Code != rpc.Code_CODE_OK {
+					t.Fatalf("ListContainerStream() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+				}
+				streamed = append(streamed, res.Info)
+			}
+
+			for call, infos := range map[string][]*provider.ResourceInfo{"ListContainer": listed, "ListContainerStream": streamed} {
+				paths := []string{}
+				for _, info := range infos {
+					paths = append(paths, info.Path)
+					e := info.GetOpaque().GetMap()["error"]
+					if info.Path != "/home/MyShares/music" {
+						if e != nil || info.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+							t.Errorf("%s() entry %s = %v, want the target", call, info.Path, info)
+						}
+						continue
+					}
+					if e == nil || string(e.Value) != "share_target_not_found" || info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+						t.Errorf("%s() entry %s = %v, want a reference with error share_target_not_found", call, info.Path, info)
+					}
+				}
+				sort.Strings(paths)
+				if !reflect.DeepEqual(paths, tt.paths) {
+					t.Errorf("%s() entries = %v, want %v", call, paths, tt.paths)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListSharedFolder lists a shared folder holding 100 shares whose targets take
+// a millisecond to stat, with a growing number of workers resolving them.
+func BenchmarkListSharedFolder(b *testing.B) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("share%d", i)
+	}
+
+	for _, workers := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			storage, _ := newMountsStorage(names...)
+			storage.onStat = func(ref *provider.Reference) {
+				if ref.GetId() != nil {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			s, stop := newTestGateway(b, storage)
+			defer stop()
+			s.c.ShareResolutionWorkers = workers
+			s.c.DisableStatMemo = true
+
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+				if err != nil {
+					b.Fatalf("ListContainer() error = %v", err)
+				}
+				if len(res.Infos) != len(names) {
+					b.Fatalf("ListContainer() returned %d entries, want %d", len(res.Infos), len(names))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"strings"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/pkg/errors"
+)
+
+// ifMatchKey and ifNoneMatchKey are the keys of the opaque of the Delete, Move and
+// InitiateFileUpload requests holding the etags the resource must or must not have
+// for the mutation to be done, following the If-Match and If-None-Match HTTP headers.
+// Both hold a comma separated list of etags or *, matching any existing resource.
+const (
+	ifMatchKey     = "if-match"
+	ifNoneMatchKey = "if-none-match"
+)
+
+// checkPreconditions returns the status of a mutation of the resource at ref whose preconditions
+// in the opaque are not met, or nil if they are or the request has none. The resource is stated
+// as clients see it, the target of a share name, so only requests with preconditions pay a stat.
+func (s *svc) checkPreconditions(ctx context.Context, ref *provider.Reference, o *typespb.Opaque) *rpc.Status {
+	ifMatch, hasIfMatch := o.GetMap()[ifMatchKey]
+	ifNoneMatch, hasIfNoneMatch := o.GetMap()[ifNoneMatchKey]
+	if !hasIfMatch && !hasIfNoneMatch {
+		return nil
+	}
+
+	res, err := s.statResolvingShares(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return status.NewInternal(ctx, err, "gateway: error stating resource to check preconditions")
+	}
+
+	var etag string
+	switch res.Status.Code {
+	case rpc.Code_CODE_OK:
+		etag = res.Info.Etag
+	case rpc.Code_CODE_NOT_FOUND:
+	default:
+		return res.Status
+	}
+	exists := res.Status.Code == rpc.Code_CODE_OK
+
+	if hasIfMatch && !matchEtag(string(ifMatch.Value), etag, exists) {
+		err := errors.New("etag does not match " + string(ifMatch.Value))
+		return status.NewFailedPrecondition(ctx, err, "gateway: if-match precondition failed")
+	}
+	if hasIfNoneMatch && matchEtag(string(ifNoneMatch.Value), etag, exists) {
+		err := errors.New("etag matches " + string(ifNoneMatch.Value))
+		return status.NewFailedPrecondition(ctx, err, "gateway: if-none-match precondition failed")
+	}
+	return nil
+}
+
+// matchEtag reports whether the etag of a resource matches a list of etags. * matches any
+// existing resource. Etags are compared without their quotes and weakness indicator, as
+// the storage providers do not agree on quoting them.
+func matchEtag(list, etag string, exists bool) bool {
+	if !exists {
+		return false
+	}
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || (e != "" && normalizeEtag(e) == normalizeEtag(etag)) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeEtag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(etag, "W/"), "\"")
+}
@@ -0,0 +1,157 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+)
+
+func TestPreconditions(t *testing.T) {
+	// the mutations are done on a file of the home and on a file of a share of peter
+	newStorage := func() *fakeStorage {
+		storage := newSharesStorage()
+		storage.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE).Etag = `"home-etag"`
+		storage.add("/users/peter/photos/beach.png", provider.ResourceType_RESOURCE_TYPE_FILE).Etag = `"share-etag"`
+		storage.dataEndpoint = "http://127.0.0.1:19001/data"
+		return storage
+	}
+
+	type mutation func(s *svc, p string, o *typespb.Opaque) (*rpc.Status, error)
+	mutations := map[string]mutation{
+		"Delete": func(s *svc, p string, o *typespb.Opaque) (*rpc.Status, error) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+			res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: ref})
+			return res.GetStatus(), err
+		},
+		"Move": func(s *svc, p string, o *typespb.Opaque) (*rpc.Status, error) {
+			src := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+			dst := &provider.Reference{Spec: &provider.Reference_Path{Path: p + ".bak"}}
+			res, err := s.Move(context.Background(), &provider.MoveRequest{Opaque: o, Source: src, Destination: dst})
+			return res.GetStatus(), err
+		},
+		"InitiateFileUpload": func(s *svc, p string, o *typespb.Opaque) (*rpc.Status, error) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+			res, err := s.InitiateFileUpload(context.Background(), &provider.InitiateFileUploadRequest{Opaque: o, Ref: ref})
+			return res.GetStatus(), err
+		},
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		ifMatch     string
+		ifNoneMatch string
+		code        rpc.Code
+	}{
+		{"no precondition", "/home/report.txt", "", "", rpc.Code_CODE_OK},
+		{"matching etag", "/home/report.txt", `"home-etag"`, "", rpc.Code_CODE_OK},
+		{"matching unquoted weak etag", "/home/report.txt", `W/home-etag`, "", rpc.Code_CODE_OK},
+		{"matching one of the etags", "/home/report.txt", `"old", "home-etag"`, "", rpc.Code_CODE_OK},
+		{"matching any", "/home/report.txt", "*", "", rpc.Code_CODE_OK},
+		{"changed etag", "/home/report.txt", `"old"`, "", rpc.Code_CODE_FAILED_PRECONDITION},
+		{"none matching", "/home/report.txt", "", `"old"`, rpc.Code_CODE_OK},
+		{"none matching the etag", "/home/report.txt", "", `"home-etag"`, rpc.Code_CODE_FAILED_PRECONDITION},
+		{"none matching any", "/home/report.txt", "", "*", rpc.Code_CODE_FAILED_PRECONDITION},
+		{"share child without precondition", "/home/MyShares/photos/beach.png", "", "", rpc.Code_CODE_OK},
+		{"share child matching etag", "/home/MyShares/photos/beach.png", `"share-etag"`, "", rpc.Code_CODE_OK},
+		{"share child changed etag", "/home/MyShares/photos/beach.png", `"old"`, "", rpc.Code_CODE_FAILED_PRECONDITION},
+		{"share child none matching the etag", "/home/MyShares/photos/beach.png", "", `"share-etag"`, rpc.Code_CODE_FAILED_PRECONDITION},
+	}
+
+	for method, mutate := range mutations {
+		for _, tt := range tests {
+			method, mutate, tt := method, mutate, tt
+			t.Run(method+"/"+tt.name, func(t *testing.T) {
+				storage := newStorage()
+				s, stop := newTestGateway(t, storage)
+				defer stop()
+
+				o := &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{}}
+				if tt.ifMatch != "" {
+					o.Map[ifMatchKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(tt.ifMatch)}
+				}
+				if tt.ifNoneMatch != "" {
+					o.Map[ifNoneMatchKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(tt.ifNoneMatch)}
+				}
+
+				st, err := mutate(s, tt.path, o)
+				if err != nil {
+					t.Fatalf("%s() error = %v", method, err)
+				}
+				if st.GetCode() != tt.code {
+					t.Errorf("%s() code = %v, want %v", method, st.GetCode(), tt.code)
+				}
+
+				forwarded := storage.count(method)
+				if tt.code == rpc.Code_CODE_OK && forwarded != 1 {
+					t.Errorf("%s forwarded %d times, want 1", method, forwarded)
+				}
+				if tt.code != rpc.Code_CODE_OK && forwarded != 0 {
+					t.Errorf("%s forwarded %d times despite the failed precondition", method, forwarded)
+				}
+			})
+		}
+	}
+}
+
+func TestUploadPreconditionsNewFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifMatch     string
+		ifNoneMatch string
+		code        rpc.Code
+	}{
+		// a client creating a file makes sure it does not overwrite another one
+		{"create only", "", "*", rpc.Code_CODE_OK},
+		{"update only", "*", "", rpc.Code_CODE_FAILED_PRECONDITION},
+		{"update of an etag", `"home-etag"`, "", rpc.Code_CODE_FAILED_PRECONDITION},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newSharesStorage()
+			storage.dataEndpoint = "http://127.0.0.1:19001/data"
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+
+			o := &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{}}
+			if tt.ifMatch != "" {
+				o.Map[ifMatchKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(tt.ifMatch)}
+			}
+			if tt.ifNoneMatch != "" {
+				o.Map[ifNoneMatchKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(tt.ifNoneMatch)}
+			}
+
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/new.txt"}}
+			res, err := s.InitiateFileUpload(context.Background(), &provider.InitiateFileUploadRequest{Opaque: o, Ref: ref})
+			if err != nil {
+				t.Fatalf("InitiateFileUpload() error = %v", err)
+			}
+			if res.Status.Code != tt.code {
+				t.Errorf("InitiateFileUpload() code = %v, want %v", res.Status.Code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/pkg/errors"
+)
+
+// protocolsKey is the key of the opaque of the transfer responses holding, as a json list,
+// the protocols a storage provider offers for the transfer, e.g. simple and tus uploads.
+// The endpoint of the response is the one of the protocol the provider prefers.
+const protocolsKey = "protocols"
+
+// transferProtocol is a protocol offered for a transfer. The gateway replaces the endpoint
+// of the provider with the one of the data gateway and adds the token signing the former.
+type transferProtocol struct {
+	Protocol string `json:"protocol"`
+	Endpoint string `json:"endpoint"`
+	Token    string `json:"token,omitempty"`
+}
+
+// signProtocols signs the endpoints of all the protocols advertised in the opaque of a
+// transfer response for the client to pick one, and routes them to the data gateway.
+func (s *svc) signProtocols(ctx context.Context, o *typespb.Opaque, dataGateway string, methods []string, length int64, rng string, expires int64) error {
+	e, ok := o.GetMap()[protocolsKey]
+	if !ok {
+		return nil
+	}
+
+	var protocols []*transferProtocol
+	if e.Decoder != "json" || json.Unmarshal(e.Value, &protocols) != nil {
+		return errors.New("gateway: invalid protocols advertised by the storage provider")
+	}
+
+	for _, p := range protocols {
+		u, err := url.Parse(p.Endpoint)
+		if err != nil {
+			return errors.Wrapf(err, "gateway: wrong format for the endpoint of protocol %s", p.Protocol)
+		}
+		token, err := s.sign(ctx, u.String(), methods, length, rng, expires)
+		if err != nil {
+			return errors.Wrapf(err, "gateway: error creating signature for protocol %s", p.Protocol)
+		}
+		p.Endpoint = dataGateway
+		p.Token = token
+	}
+
+	value, err := json.Marshal(protocols)
+	if err != nil {
+		return errors.Wrap(err, "gateway: error encoding protocols")
+	}
+	o.Map[protocolsKey] = &typespb.OpaqueEntry{Decoder: "json", Value: value}
+	return nil
+}
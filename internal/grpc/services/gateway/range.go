@@ -0,0 +1,100 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+)
+
+// downloadRangeKey is the key of the opaque of the download requests holding the byte range
+// to download, in the format of the HTTP Range header with a single range, e.g. bytes=0-1023.
+// The range is validated against the size of the file and signed in the transfer token, and
+// the normalized range is returned under the same key in the opaque of the response.
+const downloadRangeKey = "range"
+
+// rangeNotSatisfiableError is returned when the requested range starts beyond the end of the file.
+type rangeNotSatisfiableError string
+
+func (e rangeNotSatisfiableError) Error() string {
+	return "gateway: range not satisfiable: " + string(e)
+}
+
+// downloadRange returns the range requested in the opaque of a download of a file of the given
+// size, normalized to bytes=start-end, or an empty string when the whole file is downloaded.
+// As for HTTP, an end beyond the end of the file is capped to the last byte of the file.
+func downloadRange(o *typespb.Opaque, size uint64) (string, error) {
+	e, ok := o.GetMap()[downloadRangeKey]
+	if !ok {
+		return "", nil
+	}
+
+	value := string(e.Value)
+	spec := strings.TrimPrefix(value, "bytes=")
+	if spec == value || strings.Contains(spec, ",") {
+		return "", errtypes.BadRequest("gateway: invalid range, only a single byte range is supported: " + value)
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return "", errtypes.BadRequest("gateway: invalid range: " + value)
+	}
+
+	var start, end uint64
+	switch {
+	case parts[0] == "":
+		// the suffix range bytes=-n downloads the last n bytes
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || n == 0 {
+			return "", errtypes.BadRequest("gateway: invalid range: " + value)
+		}
+		if size == 0 {
+			return "", rangeNotSatisfiableError(value)
+		}
+		if n < size {
+			start = size - n
+		}
+		end = size - 1
+	default:
+		var err error
+		start, err = strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return "", errtypes.BadRequest("gateway: invalid range: " + value)
+		}
+		end = size - 1
+		if parts[1] != "" {
+			end, err = strconv.ParseUint(parts[1], 10, 64)
+			if err != nil || end < start {
+				return "", errtypes.BadRequest("gateway: invalid range: " + value)
+			}
+		}
+		if start >= size {
+			return "", rangeNotSatisfiableError(value)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return fmt.Sprintf("bytes=%d-%d", start, end), nil
+}
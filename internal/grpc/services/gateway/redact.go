@@ -0,0 +1,59 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+// redact removes the opaque entries configured in redacted_opaque_keys from the infos,
+// for the storage providers not to leak internal details like backend paths to the users.
+// The infos are returned untouched to the admins.
+func (s *svc) redact(ctx context.Context, infos ...*provider.ResourceInfo) {
+	if len(s.c.RedactedOpaqueKeys) == 0 {
+		return
+	}
+
+	if u, ok := user.ContextGetUser(ctx); ok && isAdmin(u, s.c.AdminGroup) {
+		return
+	}
+
+	redacted := make(map[string]bool, len(s.c.RedactedOpaqueKeys))
+	for _, k := range s.c.RedactedOpaqueKeys {
+		redacted[k] = true
+	}
+
+	for _, info := range infos {
+		if info.GetOpaque().GetMap() == nil {
+			continue
+		}
+		// the opaque is replaced and not modified in place, as the info may be shared with the resolution cache.
+		m := make(map[string]*typespb.OpaqueEntry, len(info.Opaque.Map))
+		for k, v := range info.Opaque.Map {
+			if !redacted[k] {
+				m[k] = v
+			}
+		}
+		info.Opaque = &typespb.Opaque{Map: m}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+func TestRedact(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	docs := storage.add("/home/docs", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	docs.Opaque = &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			"backend_path": {Decoder: "plain", Value: []byte("/eos/user/e/einstein/docs")},
+			"color":        {Decoder: "plain", Value: []byte("blue")},
+		},
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.AdminGroup = "admins"
+	s.c.RedactedOpaqueKeys = []string{"backend_path"}
+
+	tests := []struct {
+		name     string
+		groups   []string
+		redacted bool
+	}{
+		{"admin", []string{"admins"}, false},
+		{"user", []string{"physics"}, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			u := &userpb.User{Id: &userpb.UserId{OpaqueId: "einstein"}, Groups: tt.groups}
+			ctx := user.ContextSetUser(context.Background(), u)
+
+			check := func(method string, info *provider.ResourceInfo) {
+				m := info.GetOpaque().GetMap()
+				if _, ok := m["backend_path"]; ok == tt.redacted {
+					t.Errorf("%s() backend_path present = %v, want %v", method, ok, !tt.redacted)
+				}
+				if _, ok := m["color"]; !ok {
+					t.Errorf("%s() removed a field not configured to be redacted", method)
+				}
+			}
+
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/docs"}}
+			statRes, err := s.Stat(ctx, &provider.StatRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if statRes.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("Stat() code = %v, want %v", statRes.Status.Code, rpc.Code_CODE_OK)
+			}
+			check("Stat", statRes.Info)
+
+			ref = &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}}
+			listRes, err := s.ListContainer(ctx, &provider.ListContainerRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("ListContainer() error = %v", err)
+			}
+			if listRes.Status.Code != rpc.Code_CODE_OK || len(listRes.Infos) != 1 {
+				t.Fatalf("ListContainer() code = %v, entries = %d", listRes.Status.Code, len(listRes.Infos))
+			}
+			check("ListContainer", listRes.Infos[0])
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// referenceResolver resolves the target of a reference with a given uri scheme
+// to the resource it points to. c is the client of the storage provider holding
+// the reference and chain the references already followed to reach it.
+type referenceResolver func(s *svc, ctx context.Context, c provider.ProviderAPIClient, storageID string, uri *url.URL, chain []string) (*provider.ResourceInfo, error)
+
+// referenceResolvers holds the resolvers by uri scheme.
+var referenceResolvers = map[string]referenceResolver{}
+
+func init() {
+	registerReferenceResolver("cs3", resolveCS3Ref)
+	registerReferenceResolver("webdav", resolveWebDAVRef)
+}
+
+// registerReferenceResolver registers the resolver for the references with the given scheme.
+func registerReferenceResolver(scheme string, r referenceResolver) {
+	referenceResolvers[scheme] = r
+}
+
+// resolveCS3Ref resolves cs3:<storage_id>/<opaque_id> targets.
+func resolveCS3Ref(s *svc, ctx context.Context, c provider.ProviderAPIClient, storageID string, uri *url.URL, chain []string) (*provider.ResourceInfo, error) {
+	return s.handleCS3Ref(ctx, c, storageID, uri.Opaque, chain)
+}
+
+// resolveWebDAVRef resolves webdav://<host>/<path> targets. The gateway does
+// not talk webdav, so the remote resource is not stated: it is returned as a
+// reference for the clients to follow.
+func resolveWebDAVRef(s *svc, ctx context.Context, c provider.ProviderAPIClient, storageID string, uri *url.URL, chain []string) (*provider.ResourceInfo, error) {
+	p := path.Clean("/" + uri.Path)
+	return &provider.ResourceInfo{
+		Type:   provider.ResourceType_RESOURCE_TYPE_REFERENCE,
+		Id:     &provider.ResourceId{StorageId: uri.Host, OpaqueId: p},
+		Path:   p,
+		Target: uri.String(),
+	}, nil
+}
+
+// trustedTarget reports whether the target of a reference can be resolved. All the targets are
+// trusted when no trusted reference targets are configured. Otherwise a cs3 target is trusted
+// when its storage id is one of them, and any target when it is under one of them holding
+// a scheme, e.g. webdav://cloud.example.org/: it starts with it, followed by a slash or nothing.
+func (s *svc) trustedTarget(uri *url.URL) bool {
+	if len(s.c.TrustedReferenceTargets) == 0 {
+		return true
+	}
+
+	target := uri.String()
+	storageID := ""
+	if uri.Scheme == "cs3" {
+		storageID = strings.SplitN(uri.Opaque, "/", 2)[0]
+	}
+	for _, t := range s.c.TrustedReferenceTargets {
+		if strings.Contains(t, ":") {
+			if underPrefix(target, t) {
+				return true
+			}
+		} else if storageID != "" && t == storageID {
+			return true
+		}
+	}
+	return false
+}
+
+// underPrefix reports whether the target is the prefix or under it, the prefix being followed by
+// a slash, so that e.g. cs3:eos does not match cs3:eos-backup/ nor https://host https://host.evil.com.
+func underPrefix(target, prefix string) bool {
+	if !strings.HasPrefix(target, prefix) {
+		return false
+	}
+	rest := target[len(prefix):]
+	return rest == "" || strings.HasSuffix(prefix, "/") || strings.HasPrefix(rest, "/")
+}
@@ -0,0 +1,148 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/pkg/errors"
+)
+
+func TestHandleRefSchemes(t *testing.T) {
+	s := &svc{c: &config{MaxReferenceHops: 3}}
+	tests := []struct {
+		name    string
+		target  string
+		want    *provider.ResourceInfo
+		wantErr string
+	}{
+		{
+			name:   "webdav",
+			target: "webdav://cloud.example.org/remote.php/dav/files/einstein/../marie",
+			want: &provider.ResourceInfo{
+				Type:   provider.ResourceType_RESOURCE_TYPE_REFERENCE,
+				Id:     &provider.ResourceId{StorageId: "cloud.example.org", OpaqueId: "/remote.php/dav/files/marie"},
+				Path:   "/remote.php/dav/files/marie",
+				Target: "webdav://cloud.example.org/remote.php/dav/files/einstein/../marie",
+			},
+		},
+		{
+			name:    "unknown scheme",
+			target:  "smb://server/share",
+			wantErr: "no reference handler for scheme:smb",
+		},
+		{
+			name:    "no scheme",
+			target:  "/users/einstein",
+			wantErr: "no reference handler for scheme:",
+		},
+		{
+			name:    "invalid uri",
+			target:  "cs3://%zz",
+			wantErr: "error parsing target uri",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.handleRef(context.Background(), nil, "home", tt.target, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("handleRef() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleRef() error = %v", err)
+			}
+			if got.String() != tt.want.String() {
+				t.Errorf("handleRef() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterReferenceResolver(t *testing.T) {
+	var resolved *url.URL
+	registerReferenceResolver("test", func(s *svc, ctx context.Context, c provider.ProviderAPIClient, storageID string, uri *url.URL, chain []string) (*provider.ResourceInfo, error) {
+		resolved = uri
+		return &provider.ResourceInfo{Path: uri.Opaque}, nil
+	})
+	defer delete(referenceResolvers, "test")
+
+	s := &svc{c: &config{}}
+	ri, err := s.handleRef(context.Background(), nil, "home", "test:some/target", nil)
+	if err != nil {
+		t.Fatalf("handleRef() error = %v", err)
+	}
+	if resolved == nil || ri.Path != "some/target" {
+		t.Errorf("handleRef() = %v, expected the registered resolver to be used", ri)
+	}
+}
+
+func TestTrustedReferenceTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		target  string
+		allowed bool
+	}{
+		{"no allowlist", nil, "cs3:eos/users/peter", true},
+		{"trusted storage", []string{"home", "eos"}, "cs3:eos/users/peter", true},
+		{"untrusted storage", []string{"home"}, "cs3:eos/users/peter", false},
+		{"storage id prefix", []string{"eo"}, "cs3:eos/users/peter", false},
+		{"trusted prefix", []string{"webdav://cloud.example.org/"}, "webdav://cloud.example.org/remote.php/dav/files/marie", true},
+		{"untrusted host", []string{"webdav://cloud.example.org/"}, "webdav://cloud.example.org.evil.com/files", false},
+		{"storage id for webdav", []string{"cloud.example.org"}, "webdav://cloud.example.org/files", false},
+		{"cs3 prefix", []string{"cs3:eos/users/"}, "cs3:eos/users/peter", true},
+		{"cs3 storage prefix", []string{"cs3:eos"}, "cs3:eos/users/peter", true},
+		{"neighbour cs3 storage", []string{"cs3:eos"}, "cs3:eos-backup/users/peter", false},
+		{"neighbour cs3 folder", []string{"cs3:eos/users/pete"}, "cs3:eos/users/peter", false},
+		{"host prefix", []string{"https://cloud.example.org"}, "https://cloud.example.org/remote.php/dav/files/marie", true},
+		{"exact host", []string{"https://cloud.example.org"}, "https://cloud.example.org", true},
+		{"neighbour host", []string{"https://cloud.example.org"}, "https://cloud.example.org.evil.com/files", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &svc{c: &config{MaxReferenceHops: 3, TrustedReferenceTargets: tt.trusted}}
+			uri, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			if got := s.trustedTarget(uri); got != tt.allowed {
+				t.Errorf("trustedTarget(%s) = %v, want %v", tt.target, got, tt.allowed)
+			}
+
+			if tt.allowed {
+				return
+			}
+			_, err = s.handleRef(context.Background(), nil, "home", tt.target, nil)
+			if _, ok := errors.Cause(err).(errtypes.IsPermissionDenied); !ok {
+				t.Errorf("handleRef(%s) error = %v, want permission denied", tt.target, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/pkg/errors"
+)
+
+// Relocator finds where the resources moved to another storage provider are now.
+type Relocator interface {
+	// Relocate returns the new id of the resource with the given id,
+	// or nil when the resource has not been relocated.
+	Relocate(ctx context.Context, id *provider.ResourceId) (*provider.ResourceId, error)
+}
+
+// staticRelocator relocates all the resources of a storage to another one,
+// as done by migrations keeping the opaque ids of the resources.
+type staticRelocator map[string]string
+
+func (r staticRelocator) Relocate(ctx context.Context, id *provider.ResourceId) (*provider.ResourceId, error) {
+	storageID, ok := r[id.StorageId]
+	if !ok {
+		return nil, nil
+	}
+	return &provider.ResourceId{StorageId: storageID, OpaqueId: id.OpaqueId}, nil
+}
+
+// statRelocated stats the new location of the target of a reference not found at id.
+// The reference itself is left as is, the CS3 APIs do not allow to update its target,
+// so the relocation is logged for operators to recreate it.
+func (s *svc) statRelocated(ctx context.Context, id *provider.ResourceId) (*provider.StatResponse, error) {
+	newID, err := s.relocator.Relocate(ctx, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error relocating reference target")
+	}
+	if newID == nil {
+		return &provider.StatResponse{
+			Status: status.NewNotFound(ctx, "gateway: reference target not found"),
+		}, nil
+	}
+
+	log := appctx.GetLogger(ctx)
+	log.Info().Str("from", id.StorageId+"/"+id.OpaqueId).Str("to", newID.StorageId+"/"+newID.OpaqueId).Msg("gateway: following relocated reference target")
+
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Id{
+			Id: newID,
+		},
+	}
+	res, err := s.statResolution(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error calling stat")
+	}
+	return res, nil
+}
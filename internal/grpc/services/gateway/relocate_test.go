@@ -0,0 +1,65 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+func TestStatRelocatedTarget(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	// the share was created when the photos were in the storage "old"
+	ref := storage.addReference("/home/MyShares/photos", "/users/peter/photos")
+	ref.Target = "cs3:old//users/peter/photos"
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	stat := func() *provider.StatResponse {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		return res
+	}
+
+	// without relocations the share is broken
+	if res := stat(); res.Status.Code == rpc.Code_CODE_OK {
+		t.Fatalf("Stat() code = %v, want an error", res.Status.Code)
+	}
+
+	s.relocator = staticRelocator{"old": "home"}
+	res := stat()
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	if res.Info.Path != "/home/MyShares/photos" {
+		t.Errorf("Stat() path = %s, want /home/MyShares/photos", res.Info.Path)
+	}
+	if res.Info.Id.GetStorageId() != "home" {
+		t.Errorf("Stat() storage id = %s, want home", res.Info.Id.GetStorageId())
+	}
+}
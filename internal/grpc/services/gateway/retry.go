@@ -0,0 +1,107 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// retryBudget bounds the retries done by all the calls delegated to the providers
+// while serving a single request, so that a request fanning out into many calls
+// cannot amplify the load on the providers during an incident.
+type retryBudget struct {
+	sync.Mutex
+	left int
+}
+
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a context carrying a new retry budget, unless the context
+// already carries one, in which case the budget is shared with the calling request.
+func (s *svc) withRetryBudget(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{left: s.c.RetryBudget})
+}
+
+// takeRetry consumes a retry from the budget of the request. It returns false when the
+// budget is exhausted and the call must fail instead of being retried.
+// Calls outside of a request carrying a budget are not limited.
+func takeRetry(ctx context.Context) bool {
+	b, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.left <= 0 {
+		return false
+	}
+	b.left--
+	return true
+}
+
+// retry calls call until it succeeds or fails with a non transient error, up to MaxRetries
+// more times, waiting between the attempts with an exponential backoff with jitter.
+// call returns the status of the provider response and the error of the grpc call.
+// Only idempotent calls must be retried. Every retry is taken from the budget of the request.
+func (s *svc) retry(ctx context.Context, call func() (*rpc.Status, error)) error {
+	for attempt := 0; ; attempt++ {
+		st, err := call()
+		if !isTransient(st, err) || attempt >= s.c.MaxRetries || !takeRetry(ctx) {
+			return err
+		}
+
+		delay := backoff(time.Duration(s.c.RetryBaseDelay)*time.Millisecond, attempt)
+		appctx.GetLogger(ctx).Debug().Int("attempt", attempt+1).Dur("delay", delay).Msg("gateway: retrying call to storage provider")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransient reports whether a provider call failed because the provider was briefly unavailable.
+func isTransient(st *rpc.Status, err error) bool {
+	if err != nil {
+		return gstatus.Code(err) == codes.Unavailable
+	}
+	return st.GetCode() == rpc.Code_CODE_UNAVAILABLE
+}
+
+// backoff returns the delay before the retry following the given attempt: base doubled at
+// every attempt, of which a random half is kept to spread the retries of concurrent requests.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
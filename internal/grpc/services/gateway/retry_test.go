@@ -0,0 +1,188 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+func TestRetryBudget(t *testing.T) {
+	s := &svc{c: &config{RetryBudget: 3}}
+	ctx := s.withRetryBudget(context.Background())
+
+	// every sub call of the request wants to retry twice
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := s.withRetryBudget(ctx)
+			for j := 0; j < 2; j++ {
+				if takeRetry(sub) {
+					mu.Lock()
+					granted++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if granted != 3 {
+		t.Errorf("granted %d retries, want 3", granted)
+	}
+	if takeRetry(ctx) {
+		t.Errorf("takeRetry() = true, want exhausted budget")
+	}
+
+	// another request gets its own budget
+	if !takeRetry(s.withRetryBudget(context.Background())) {
+		t.Errorf("takeRetry() = false on a new request")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := &rpc.Status{Code: rpc.Code_CODE_UNAVAILABLE}
+	ok := &rpc.Status{Code: rpc.Code_CODE_OK}
+
+	tests := []struct {
+		name     string
+		results  []error
+		statuses []*rpc.Status
+		budget   int
+		calls    int
+		err      bool
+	}{
+		{"succeeds first", []error{nil}, []*rpc.Status{ok}, 10, 1, false},
+		{"unavailable status then success", []error{nil, nil}, []*rpc.Status{unavailable, ok}, 10, 2, false},
+		{"unavailable error then success", []error{gstatus.Error(codes.Unavailable, "down"), nil}, []*rpc.Status{nil, ok}, 10, 2, false},
+		{"not transient", []error{errors.New("boom")}, []*rpc.Status{nil}, 10, 1, true},
+		{"not found", []error{nil}, []*rpc.Status{{Code: rpc.Code_CODE_NOT_FOUND}}, 10, 1, false},
+		{"retries exhausted", []error{nil, nil, nil, nil}, []*rpc.Status{unavailable, unavailable, unavailable, ok}, 10, 3, false},
+		{"budget exhausted", []error{nil, nil}, []*rpc.Status{unavailable, ok}, 0, 1, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &svc{c: &config{MaxRetries: 2, RetryBaseDelay: 1, RetryBudget: tt.budget}}
+			ctx := s.withRetryBudget(context.Background())
+
+			calls := 0
+			err := s.retry(ctx, func() (*rpc.Status, error) {
+				st, err := tt.statuses[calls], tt.results[calls]
+				calls++
+				return st, err
+			})
+			if (err != nil) != tt.err {
+				t.Errorf("retry() error = %v, want error %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("retry() called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := &svc{c: &config{MaxRetries: 5, RetryBaseDelay: int(time.Hour / time.Millisecond)}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.retry(ctx, func() (*rpc.Status, error) {
+			calls++
+			return &rpc.Status{Code: rpc.Code_CODE_UNAVAILABLE}, nil
+		})
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("retry() did not stop on cancellation")
+	}
+	if calls != 1 {
+		t.Errorf("retry() called %d times, want 1", calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		max := base << uint(attempt)
+		for i := 0; i < 100; i++ {
+			if d := backoff(base, attempt); d < max/2 || d > max {
+				t.Fatalf("backoff(%v, %d) = %v, want between %v and %v", base, attempt, d, max/2, max)
+			}
+		}
+	}
+	if d := backoff(0, 3); d != 0 {
+		t.Errorf("backoff() = %v without base delay, want 0", d)
+	}
+}
+
+func TestStatRetriesUnavailableProvider(t *testing.T) {
+	storage := newSharesStorage()
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.MaxRetries = 2
+	s.c.RetryBaseDelay = 1
+	s.c.RetryBudget = 10
+
+	// the provider is back on the second attempt
+	storage.unavailable = 1
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}}
+	res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	if n := storage.count("Stat"); n != 2 {
+		t.Errorf("stated %d times, want 2", n)
+	}
+
+	// mutations are not retried
+	storage.unavailable = 1
+	dres, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: &provider.Reference{Spec: &provider.Reference_Path{Path: "/users/peter/music"}}})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if dres.Status.Code != rpc.Code_CODE_UNAVAILABLE {
+		t.Errorf("Delete() code = %v, want %v", dres.Status.Code, rpc.Code_CODE_UNAVAILABLE)
+	}
+	if n := storage.count("Delete"); n != 1 {
+		t.Errorf("deleted %d times, want 1", n)
+	}
+}
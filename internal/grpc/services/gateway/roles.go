@@ -0,0 +1,221 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"strings"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleCustom = "custom"
+)
+
+// roles maps the known role names to their permission sets, the sets are
+// the same the ocs api uses when creating shares for a role.
+var roles = []struct {
+	name        string
+	permissions *provider.ResourcePermissions
+}{
+	{
+		name: roleViewer,
+		permissions: &provider.ResourcePermissions{
+			ListContainer:        true,
+			ListGrants:           true,
+			ListFileVersions:     true,
+			ListRecycle:          true,
+			Stat:                 true,
+			GetPath:              true,
+			GetQuota:             true,
+			InitiateFileDownload: true,
+		},
+	},
+	{
+		name: roleEditor,
+		permissions: &provider.ResourcePermissions{
+			ListContainer:        true,
+			ListGrants:           true,
+			ListFileVersions:     true,
+			ListRecycle:          true,
+			Stat:                 true,
+			GetPath:              true,
+			GetQuota:             true,
+			InitiateFileDownload: true,
+
+			Move:               true,
+			InitiateFileUpload: true,
+			RestoreFileVersion: true,
+			RestoreRecycleItem: true,
+			CreateContainer:    true,
+			Delete:             true,
+			PurgeRecycle:       true,
+		},
+	},
+}
+
+// roleLabel returns the name of the role matching the permission set or
+// "custom" when the set does not match any known role.
+func roleLabel(p *provider.ResourcePermissions) string {
+	for _, r := range roles {
+		if proto.Equal(p, r.permissions) {
+			return r.name
+		}
+	}
+	return roleCustom
+}
+
+// effectivePermissions returns the permissions present in both sets.
+// A nil set does not restrict the other one.
+func effectivePermissions(a, b *provider.ResourcePermissions) *provider.ResourcePermissions {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &provider.ResourcePermissions{
+		AddGrant:             a.AddGrant && b.AddGrant,
+		CreateContainer:      a.CreateContainer && b.CreateContainer,
+		Delete:               a.Delete && b.Delete,
+		GetPath:              a.GetPath && b.GetPath,
+		GetQuota:             a.GetQuota && b.GetQuota,
+		InitiateFileDownload: a.InitiateFileDownload && b.InitiateFileDownload,
+		InitiateFileUpload:   a.InitiateFileUpload && b.InitiateFileUpload,
+		ListGrants:           a.ListGrants && b.ListGrants,
+		ListContainer:        a.ListContainer && b.ListContainer,
+		ListFileVersions:     a.ListFileVersions && b.ListFileVersions,
+		ListRecycle:          a.ListRecycle && b.ListRecycle,
+		Move:                 a.Move && b.Move,
+		RemoveGrant:          a.RemoveGrant && b.RemoveGrant,
+		PurgeRecycle:         a.PurgeRecycle && b.PurgeRecycle,
+		RestoreFileVersion:   a.RestoreFileVersion && b.RestoreFileVersion,
+		RestoreRecycleItem:   a.RestoreRecycleItem && b.RestoreRecycleItem,
+		Stat:                 a.Stat && b.Stat,
+		UpdateGrant:          a.UpdateGrant && b.UpdateGrant,
+	}
+}
+
+// withRole adds the role label of the effective permissions of a mounted
+// share to the info, ref carries the permissions granted by the share.
+func withRole(ref, info *provider.ResourceInfo) *provider.ResourceInfo {
+	if ref.PermissionSet == nil && info.PermissionSet == nil {
+		return info
+	}
+
+	if info.Opaque == nil {
+		info.Opaque = &typespb.Opaque{}
+	}
+	if info.Opaque.Map == nil {
+		info.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	info.Opaque.Map["role"] = &typespb.OpaqueEntry{
+		Decoder: "plain",
+		Value:   []byte(roleLabel(effectivePermissions(ref.PermissionSet, info.PermissionSet))),
+	}
+	return info
+}
+
+// permissionFields gives access to the single permissions of a set by name.
+var permissionFields = []struct {
+	name string
+	get  func(*provider.ResourcePermissions) bool
+}{
+	{"add_grant", (*provider.ResourcePermissions).GetAddGrant},
+	{"create_container", (*provider.ResourcePermissions).GetCreateContainer},
+	{"delete", (*provider.ResourcePermissions).GetDelete},
+	{"get_path", (*provider.ResourcePermissions).GetGetPath},
+	{"get_quota", (*provider.ResourcePermissions).GetGetQuota},
+	{"initiate_file_download", (*provider.ResourcePermissions).GetInitiateFileDownload},
+	{"initiate_file_upload", (*provider.ResourcePermissions).GetInitiateFileUpload},
+	{"list_grants", (*provider.ResourcePermissions).GetListGrants},
+	{"list_container", (*provider.ResourcePermissions).GetListContainer},
+	{"list_file_versions", (*provider.ResourcePermissions).GetListFileVersions},
+	{"list_recycle", (*provider.ResourcePermissions).GetListRecycle},
+	{"move", (*provider.ResourcePermissions).GetMove},
+	{"remove_grant", (*provider.ResourcePermissions).GetRemoveGrant},
+	{"purge_recycle", (*provider.ResourcePermissions).GetPurgeRecycle},
+	{"restore_file_version", (*provider.ResourcePermissions).GetRestoreFileVersion},
+	{"restore_recycle_item", (*provider.ResourcePermissions).GetRestoreRecycleItem},
+	{"stat", (*provider.ResourcePermissions).GetStat},
+	{"update_grant", (*provider.ResourcePermissions).GetUpdateGrant},
+}
+
+// exceedingPermissions returns the names of the permissions granted that the target does not allow.
+func exceedingPermissions(grant, target *provider.ResourcePermissions) []string {
+	if grant == nil || target == nil {
+		return nil
+	}
+
+	var exceeding []string
+	for _, f := range permissionFields {
+		if f.get(grant) && !f.get(target) {
+			exceeding = append(exceeding, f.name)
+		}
+	}
+	return exceeding
+}
+
+// withPermissionDiagnostics flags, for admins only, the shares whose grant claims more
+// permissions than the target allows by listing the exceeding permissions in the opaque.
+func (s *svc) withPermissionDiagnostics(ctx context.Context, ref, info *provider.ResourceInfo) *provider.ResourceInfo {
+	u, ok := user.ContextGetUser(ctx)
+	if !ok || !isAdmin(u, s.c.AdminGroup) {
+		return info
+	}
+
+	exceeding := exceedingPermissions(ref.PermissionSet, info.PermissionSet)
+	if len(exceeding) == 0 {
+		return info
+	}
+
+	appctx.GetLogger(ctx).Warn().Str("path", info.Path).Strs("permissions", exceeding).Msg("gateway: share grant exceeds the permissions of the target")
+	if info.Opaque == nil {
+		info.Opaque = &typespb.Opaque{}
+	}
+	if info.Opaque.Map == nil {
+		info.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	info.Opaque.Map["exceeding_permissions"] = &typespb.OpaqueEntry{
+		Decoder: "plain",
+		Value:   []byte(strings.Join(exceeding, ",")),
+	}
+	return info
+}
+
+// isAdmin returns whether the user is a member of the admin group.
+func isAdmin(u *userpb.User, group string) bool {
+	if group == "" {
+		return false
+	}
+	for _, g := range u.GetGroups() {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+func TestWithRole(t *testing.T) {
+	viewer := &provider.ResourcePermissions{
+		ListContainer:        true,
+		ListGrants:           true,
+		ListFileVersions:     true,
+		ListRecycle:          true,
+		Stat:                 true,
+		GetPath:              true,
+		GetQuota:             true,
+		InitiateFileDownload: true,
+	}
+	editor := &provider.ResourcePermissions{
+		ListContainer:        true,
+		ListGrants:           true,
+		ListFileVersions:     true,
+		ListRecycle:          true,
+		Stat:                 true,
+		GetPath:              true,
+		GetQuota:             true,
+		InitiateFileDownload: true,
+		Move:                 true,
+		InitiateFileUpload:   true,
+		RestoreFileVersion:   true,
+		RestoreRecycleItem:   true,
+		CreateContainer:      true,
+		Delete:               true,
+		PurgeRecycle:         true,
+	}
+	owner := &provider.ResourcePermissions{
+		AddGrant:             true,
+		CreateContainer:      true,
+		Delete:               true,
+		GetPath:              true,
+		GetQuota:             true,
+		InitiateFileDownload: true,
+		InitiateFileUpload:   true,
+		ListGrants:           true,
+		ListContainer:        true,
+		ListFileVersions:     true,
+		ListRecycle:          true,
+		Move:                 true,
+		RemoveGrant:          true,
+		PurgeRecycle:         true,
+		RestoreFileVersion:   true,
+		RestoreRecycleItem:   true,
+		Stat:                 true,
+		UpdateGrant:          true,
+	}
+
+	tests := []struct {
+		name   string
+		grant  *provider.ResourcePermissions
+		target *provider.ResourcePermissions
+		want   string
+	}{
+		{"viewer", viewer, owner, roleViewer},
+		{"editor", editor, owner, roleEditor},
+		{"editor grant on read only target", editor, viewer, roleViewer},
+		{"custom", &provider.ResourcePermissions{Stat: true, Delete: true}, owner, roleCustom},
+		{"target only", nil, editor, roleEditor},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &provider.ResourceInfo{PermissionSet: tt.grant}
+			info := withRole(ref, &provider.ResourceInfo{PermissionSet: tt.target})
+			if info.Opaque == nil || info.Opaque.Map["role"] == nil {
+				t.Fatalf("withRole() did not add a role")
+			}
+			if got := string(info.Opaque.Map["role"].Value); got != tt.want {
+				t.Errorf("withRole() role = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRoleNoPermissions(t *testing.T) {
+	info := withRole(&provider.ResourceInfo{}, &provider.ResourceInfo{})
+	if info.Opaque != nil {
+		t.Errorf("withRole() opaque = %v, want nil", info.Opaque)
+	}
+}
+
+func TestWithPermissionDiagnostics(t *testing.T) {
+	s := &svc{c: &config{AdminGroup: "admins"}}
+	grant := &provider.ResourcePermissions{Stat: true, Delete: true, Move: true}
+	target := &provider.ResourcePermissions{Stat: true}
+
+	tests := []struct {
+		name   string
+		groups []string
+		target *provider.ResourcePermissions
+		want   string
+	}{
+		{"admin", []string{"admins"}, target, "delete,move"},
+		{"admin subset", []string{"admins"}, grant, ""},
+		{"not admin", []string{"users"}, target, ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := user.ContextSetUser(context.Background(), &userpb.User{
+				Id:     &userpb.UserId{OpaqueId: "einstein"},
+				Groups: tt.groups,
+			})
+			ref := &provider.ResourceInfo{PermissionSet: grant}
+			info := s.withPermissionDiagnostics(ctx, ref, &provider.ResourceInfo{PermissionSet: tt.target})
+
+			got := ""
+			if e, ok := info.GetOpaque().GetMap()["exceeding_permissions"]; ok {
+				got = string(e.Value)
+			}
+			if got != tt.want {
+				t.Errorf("withPermissionDiagnostics() exceeding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
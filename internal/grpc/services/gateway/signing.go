@@ -0,0 +1,63 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"io/ioutil"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// getTransferSigningKey returns the signing method of the transfer tokens and the key to sign them.
+// HMAC algorithms sign with the shared secret, RSA and ECDSA ones with the PEM encoded private key
+// stored at keyPath, so that the data gateways only need the public key.
+func getTransferSigningKey(alg, secret, keyPath string) (jwt.SigningMethod, interface{}, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, nil, errors.New("gateway: unknown transfer signing algorithm " + alg)
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return method, []byte(secret), nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+	default:
+		return nil, nil, errors.New("gateway: unsupported transfer signing algorithm " + alg)
+	}
+
+	if keyPath == "" {
+		return nil, nil, errors.New("gateway: transfer_signing_key is required for " + alg)
+	}
+	pem, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "gateway: error reading transfer signing key")
+	}
+
+	var key interface{}
+	if _, ok := method.(*jwt.SigningMethodRSA); ok {
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+	} else {
+		key, err = jwt.ParseECPrivateKeyFromPEM(pem)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "gateway: error parsing transfer signing key")
+	}
+	return method, key, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// writeKeyPair writes a new PEM encoded key pair for alg in dir and returns
+// the path of the private key and the public key.
+func writeKeyPair(t *testing.T, dir, alg string) (string, interface{}) {
+	var (
+		der    []byte
+		typ    string
+		public interface{}
+		err    error
+	)
+	switch alg {
+	case "RS256":
+		var k *rsa.PrivateKey
+		if k, err = rsa.GenerateKey(rand.Reader, 2048); err == nil {
+			der, typ, public = x509.MarshalPKCS1PrivateKey(k), "RSA PRIVATE KEY", &k.PublicKey
+		}
+	case "ES256":
+		var k *ecdsa.PrivateKey
+		if k, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err == nil {
+			der, err = x509.MarshalECPrivateKey(k)
+			typ, public = "EC PRIVATE KEY", &k.PublicKey
+		}
+	}
+	if err != nil {
+		t.Fatalf("error generating %s key: %v", alg, err)
+	}
+
+	p := path.Join(dir, alg+".pem")
+	if err := ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	return p, public
+}
+
+func TestTransferSigningRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reva-signing")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		alg string
+	}{
+		{"HS256"},
+		{"RS256"},
+		{"ES256"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.alg, func(t *testing.T) {
+			var keyPath string
+			var verifyKey interface{} = []byte("secret")
+			if tt.alg != "HS256" {
+				keyPath, verifyKey = writeKeyPair(t, dir, tt.alg)
+			}
+
+			method, key, err := getTransferSigningKey(tt.alg, "secret", keyPath)
+			if err != nil {
+				t.Fatalf("getTransferSigningKey() error = %v", err)
+			}
+			s := &svc{
+				c:                     &config{TransferSharedSecret: "secret", TransferExpires: 10},
+				transferSigningMethod: method,
+				transferSigningKey:    key,
+			}
+
+			tkn, err := s.sign(context.Background(), "http://127.0.0.1:19001/data/file", downloadMethods, 0, "", 10)
+			if err != nil {
+				t.Fatalf("sign() error = %v", err)
+			}
+
+			claims := &transferClaims{}
+			j, err := jwt.ParseWithClaims(tkn, claims, func(token *jwt.Token) (interface{}, error) {
+				return verifyKey, nil
+			})
+			if err != nil {
+				t.Fatalf("ParseWithClaims() error = %v", err)
+			}
+			if j.Method.Alg() != tt.alg {
+				t.Errorf("expected alg %s, got %s", tt.alg, j.Method.Alg())
+			}
+			if claims.Target != "http://127.0.0.1:19001/data/file" {
+				t.Errorf("unexpected target %s", claims.Target)
+			}
+		})
+	}
+}
+
+func TestGetTransferSigningKeyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		alg     string
+		keyPath string
+	}{
+		{"unknown algorithm", "XS256", ""},
+		{"unsigned", "none", ""},
+		{"missing key", "RS256", ""},
+		{"unreadable key", "ES256", "/nonexistent/key.pem"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := getTransferSigningKey(tt.alg, "secret", tt.keyPath); err == nil {
+				t.Errorf("getTransferSigningKey() expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/pkg/errors"
+)
+
+// shareFolderEtag computes the etag of the shared folder from the etags of the share targets.
+//
+// The etag is computed over a snapshot: the references are listed once and only the targets
+// of the listed references are resolved. Shares added or removed while the targets are being
+// resolved are not part of the result, so the etag always corresponds to a set of shares that
+// existed at the time of the listing, never to a mix of two states of the folder, and the
+// changes are reflected by the next computation.
+// Shares whose target cannot be resolved are part of the etag without the etag of their target.
+func (s *svc) shareFolderEtag(ctx context.Context, ref *provider.Reference) (string, error) {
+	c, err := s.find(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.listContainerOn(ctx, c, &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		return "", errors.Wrap(err, "gateway: error listing shared folder")
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return "", status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+
+	entries := make([]string, len(res.Infos))
+	var wg sync.WaitGroup
+	for i, ri := range res.Infos {
+		wg.Add(1)
+		go func(i int, ri *provider.ResourceInfo) {
+			defer wg.Done()
+			etag := ""
+			info, err := s.checkRefOn(ctx, c, ri)
+			if err != nil {
+				appctx.GetLogger(ctx).Warn().Err(err).Str("path", ri.Path).Msg("gateway: error resolving share for the shared folder etag")
+			} else {
+				etag = info.Etag
+			}
+			entries[i] = path.Base(ri.Path) + ":" + etag
+		}(i, ri)
+	}
+	wg.Wait()
+
+	sort.Strings(entries)
+	h := sha1.New()
+	for _, e := range entries {
+		fmt.Fprintln(h, e)
+	}
+	return fmt.Sprintf("\"%x\"", h.Sum(nil)), nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+func TestShareFolderEtagSnapshot(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	for _, name := range []string{"photos", "music", "docs"} {
+		target := storage.add("/users/peter/"+name, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		target.Etag = "\"" + name + "\""
+	}
+	storage.addReference("/home/MyShares/photos", "/users/peter/photos")
+	storage.addReference("/home/MyShares/music", "/users/peter/music")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.ShareFolderEtag = true
+
+	etag := func() string {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+		}
+		return res.Info.Etag
+	}
+
+	// a share is added while the targets are being resolved
+	var once sync.Once
+	storage.onStat = func(ref *provider.Reference) {
+		if ref.GetId() != nil {
+			once.Do(func() { storage.addReference("/home/MyShares/docs", "/users/peter/docs") })
+		}
+	}
+	during := etag()
+	storage.onStat = nil
+
+	after := etag()
+	if after == during {
+		t.Errorf("etag %s did not change after adding a share", after)
+	}
+
+	// the etag computed during the modification is the one of the folder before it
+	storage.Lock()
+	delete(storage.infos, "/home/MyShares/docs")
+	storage.Unlock()
+	if before := etag(); before != during {
+		t.Errorf("etag %s computed during the modification, want %s", during, before)
+	}
+
+	// the etag changes with the targets
+	storage.Lock()
+	storage.infos["/users/peter/music"].Etag = "\"music2\""
+	storage.Unlock()
+	if changed := etag(); changed == during {
+		t.Errorf("etag %s did not change after a target changed", changed)
+	}
+}
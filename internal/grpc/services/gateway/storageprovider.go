@@ -20,9 +20,14 @@ package gateway
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,34 +35,181 @@ import (
 	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
 	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
 	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
 	"github.com/cs3org/reva/pkg/appctx"
 	"github.com/cs3org/reva/pkg/errtypes"
 	"github.com/cs3org/reva/pkg/rgrpc/status"
-	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
+	"github.com/cs3org/reva/pkg/storage/utils/templates"
+	"github.com/cs3org/reva/pkg/user"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 )
 
+// shareExpirationKey is the metadata key holding the expiration of the share a reference points to.
+const shareExpirationKey = "share_expiration"
+
+// lockTokenKey is the opaque key of the token of the lock held by the client on the resource
+// it deletes or moves. The gateway only rewrites the references of the Delete and Move requests
+// it forwards and keeps their opaque, so that the storage providers can validate the token.
+const lockTokenKey = "lock-token"
+
+// errReferenceChainTooLong is returned when resolving more references than allowed to reach a target.
+var errReferenceChainTooLong = errors.New("gateway: reference chain too long")
+
+// errReferenceLoop is returned when a chain of references leads back to one of its references.
+var errReferenceLoop = errors.New("gateway: reference loop")
+
+// crossStorageMoveError is the error set in the opaque of a move response when source and
+// destination live in different storage providers. The move is not done, and clients can copy
+// the resource and delete the source instead.
+const crossStorageMoveError = "cross_storage_move"
+
+// shareNotMountedError is returned when the share name is not mounted in the share folder of the user.
+type shareNotMountedError string
+
+func (e shareNotMountedError) Error() string { return "gateway: share not mounted: " + string(e) }
+
+// shareTargetNotFoundError is returned when the target of a mounted share does not exist anymore,
+// for example when the owner deleted it.
+type shareTargetNotFoundError string
+
+func (e shareTargetNotFoundError) Error() string {
+	return "gateway: share target not found: " + string(e)
+}
+
+// shareError returns the status and the opaque, describing the error to clients, for an error
+// resolving a share. Errors other than a missing mount, a missing or an untrusted target are
+// internal errors.
+func shareError(ctx context.Context, err error, msg string) (*rpc.Status, *typespb.Opaque) {
+	if st := canceledStatus(ctx, msg); st != nil {
+		return st, nil
+	}
+
+	var code string
+	var st *rpc.Status
+	switch errors.Cause(err).(type) {
+	case shareNotMountedError:
+		code = "share_not_mounted"
+		st = status.NewNotFound(ctx, msg+": share not mounted")
+	case shareTargetNotFoundError:
+		code = "share_target_not_found"
+		st = status.NewFailedPrecondition(ctx, err, msg+": share target not found")
+	case errtypes.PermissionDenied:
+		code = "share_target_not_trusted"
+		st = status.NewPermissionDenied(ctx, err, msg+": share target not trusted")
+	default:
+		return status.NewInternal(ctx, err, msg), nil
+	}
+
+	return st, &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			"error": {Decoder: "plain", Value: []byte(code)},
+		},
+	}
+}
+
+// shareNameError returns the error for a share name that could not be stated.
+func shareNameError(shareName string, code rpc.Code) error {
+	if code == rpc.Code_CODE_NOT_FOUND {
+		return shareNotMountedError(shareName)
+	}
+	return status.NewErrorFromCode(code, "gateway")
+}
+
+// canceledStatus returns the status for a request whose context has been canceled or has
+// timed out, or nil if it is still alive. Resolving a share takes several sequential calls
+// and checking in between avoids issuing the remaining ones for a client that left.
+func canceledStatus(ctx context.Context, msg string) *rpc.Status {
+	if err := ctx.Err(); err != nil {
+		return status.NewCancelled(ctx, err, msg+": request canceled")
+	}
+	return nil
+}
+
 // transferClaims are custom claims for a JWT token to be used between the metadata and data gateways.
+// Tokens without version only carry the target and are accepted by the data gateways
+// during a deprecation window.
 type transferClaims struct {
 	jwt.StandardClaims
 	Target string `json:"target"`
+	// V is the version of the claims.
+	V int `json:"v,omitempty"`
+	// Methods are the HTTP methods the token can be used with.
+	Methods []string `json:"methods,omitempty"`
+	// Length is the expected length of the upload, 0 if unknown.
+	Length int64 `json:"length,omitempty"`
+	// Range is the only byte range the download can be done for, the whole file if empty.
+	Range string `json:"range,omitempty"`
+	// Nonce makes every token unique, for data gateways to detect replays.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// transferClaimsVersion is the version of the transfer claims signed by the gateway.
+const transferClaimsVersion = 2
+
+var (
+	downloadMethods = []string{"GET", "HEAD"}
+	uploadMethods   = []string{"PUT", "PATCH", "HEAD"}
+)
+
+// transferTTLKey is the key of the request opaque holding the lifetime in seconds
+// requested for the transfer token, e.g. for large uploads over slow links.
+const transferTTLKey = "transfer-ttl-seconds"
+
+// transferExpires returns the lifetime in seconds of the transfer token of a request,
+// the one requested in the opaque capped to transfer_max_expires, transfer_expires by default.
+func (s *svc) transferExpires(ctx context.Context, o *typespb.Opaque) int64 {
+	e, ok := o.GetMap()[transferTTLKey]
+	if !ok {
+		return s.c.TransferExpires
+	}
+
+	ttl, err := strconv.ParseInt(string(e.Value), 10, 64)
+	if err != nil || ttl < 1 {
+		appctx.GetLogger(ctx).Warn().Str("value", string(e.Value)).Msg("gateway: ignoring invalid transfer ttl")
+		return s.c.TransferExpires
+	}
+	if ttl > s.c.TransferMaxExpires {
+		return s.c.TransferMaxExpires
+	}
+	return ttl
 }
 
-func (s *svc) sign(ctx context.Context, target string) (string, error) {
-	ttl := time.Duration(s.c.TransferExpires) * time.Second
+// sign returns a transfer token valid for expires seconds for target that can only be used
+// with the given methods and, when length is known, to upload length bytes or, when rng is
+// not empty, to download the byte range rng.
+func (s *svc) sign(ctx context.Context, target string, methods []string, length int64, rng string, expires int64) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "error generating nonce")
+	}
+
+	ttl := time.Duration(expires) * time.Second
+	skew := time.Duration(s.c.TransferClockSkew) * time.Second
+	now := time.Now()
 	claims := transferClaims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(ttl).Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
 			Audience:  "reva",
-			IssuedAt:  time.Now().Unix(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Add(-skew).Unix(),
 		},
-		Target: target,
+		Target:  target,
+		V:       transferClaimsVersion,
+		Methods: methods,
+		Length:  length,
+		Range:   rng,
+		Nonce:   hex.EncodeToString(nonce),
 	}
 
-	t := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), claims)
+	method, key := s.transferSigningMethod, s.transferSigningKey
+	if method == nil {
+		method, key = jwt.SigningMethodHS256, []byte(s.c.TransferSharedSecret)
+	}
+	t := jwt.NewWithClaims(method, claims)
 
-	tkn, err := t.SignedString([]byte(s.c.TransferSharedSecret))
+	tkn, err := t.SignedString(key)
 	if err != nil {
 		return "", errors.Wrapf(err, "error signing token with claims %+v", claims)
 	}
@@ -66,23 +218,22 @@ func (s *svc) sign(ctx context.Context, target string) (string, error) {
 }
 
 func (s *svc) CreateHome(ctx context.Context, req *provider.CreateHomeRequest) (*provider.CreateHomeResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	log := appctx.GetLogger(ctx)
 
 	home := s.getHome(ctx)
 	c, err := s.findByPath(ctx, home)
 	if err != nil {
 		log.Err(err).Msg("gateway: error finding storage provider")
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.CreateHomeResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.CreateHomeResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.CreateHome(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		log.Err(err).Msg("gateway: error creating home on storage provider")
 		return &provider.CreateHomeResponse{
@@ -99,13 +250,36 @@ func (s *svc) GetHome(ctx context.Context, req *provider.GetHomeRequest) (*provi
 	return homeRes, nil
 }
 
+// defaultHome is the home of the users when no home layout is configured.
+const defaultHome = "/home"
+
+// getHome returns the home of the user in the context. It is read from the configured
+// user attribute, to support users whose home does not follow the layout, then built
+// from the home layout. It defaults to /home.
 func (s *svc) getHome(ctx context.Context) string {
-	// TODO(labkode): issue #601, /home will be hardcoded.
-	return "/home"
+	u, ok := user.ContextGetUser(ctx)
+	if !ok {
+		return defaultHome
+	}
+
+	if s.c.HomeAttribute != "" {
+		if e, ok := u.GetOpaque().GetMap()[s.c.HomeAttribute]; ok && len(e.Value) > 0 {
+			return path.Join("/", string(e.Value))
+		}
+	}
+
+	if s.c.HomeLayout != "" {
+		return path.Join("/", templates.WithUser(u, s.c.HomeLayout))
+	}
+
+	return defaultHome
 }
 func (s *svc) InitiateFileDownload(ctx context.Context, req *provider.InitiateFileDownloadRequest) (*gateway.InitiateFileDownloadResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	statReq := &provider.StatRequest{Ref: req.Ref}
-	statRes, err := s.stat(ctx, statReq)
+	statRes, err := s.Stat(ctx, statReq)
 	if err != nil {
 		return &gateway.InitiateFileDownloadResponse{
 			Status: status.NewInternal(ctx, err, "gateway: error stating ref:"+req.Ref.String()),
@@ -123,19 +297,38 @@ func (s *svc) InitiateFileDownload(ctx context.Context, req *provider.InitiateFi
 		}, nil
 	}
 
+	info := statRes.Info
+
 	p, err := s.getPath(ctx, req.Ref)
 	if err != nil {
 		return &gateway.InitiateFileDownloadResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
 	if !s.inSharedFolder(ctx, p) {
-		return s.initiateFileDownload(ctx, req)
+		return s.initiateFileDownload(ctx, req, info)
 	}
 
 	log := appctx.GetLogger(ctx)
-	if s.isSharedFolder(ctx, p) || s.isShareName(ctx, p) {
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	collision, err := s.collidesWithShareName(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error downloading"),
+		}, nil
+	}
+	if collision {
+		return s.initiateFileDownload(ctx, req, info)
+	}
+
+	if folder || name {
 		log.Debug().Msgf("path:%s points to shared folder or share name", p)
 		err := errtypes.PermissionDenied("gateway: cannot upload to share folder or share name: path=" + p)
 		log.Err(err).Msg("gateway: error downloading")
@@ -145,9 +338,14 @@ func (s *svc) InitiateFileDownload(ctx context.Context, req *provider.InitiateFi
 
 	}
 
-	if s.isShareChild(ctx, p) {
+	if child {
 		log.Debug().Msgf("shared child: %s", p)
-		shareName, shareChild := s.splitShare(ctx, p)
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &gateway.InitiateFileDownloadResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
@@ -170,14 +368,6 @@ func (s *svc) InitiateFileDownload(ctx context.Context, req *provider.InitiateFi
 			}, nil
 		}
 
-		if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			err := errors.New(fmt.Sprintf("gateway: expected reference: got:%+v", statRes.Info))
-			log.Err(err).Msg("gateway: error creating container")
-			return &gateway.InitiateFileDownloadResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error creating container"),
-			}, nil
-		}
-
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
@@ -194,25 +384,47 @@ func (s *svc) InitiateFileDownload(ctx context.Context, req *provider.InitiateFi
 			},
 		}
 		req.Ref = ref
-		return s.initiateFileDownload(ctx, req)
+		return s.initiateFileDownload(ctx, req, info)
 	}
 
-	panic("gateway: download: unknown path:" + p)
+	return &gateway.InitiateFileDownloadResponse{
+		Status: unknownPathStatus(ctx, "download", p),
+	}, nil
 }
 
-func (s *svc) initiateFileDownload(ctx context.Context, req *provider.InitiateFileDownloadRequest) (*gateway.InitiateFileDownloadResponse, error) {
+// initiateFileDownload asks the storage provider for a download endpoint. The info of the file
+// is used to give the client hints for HTTP caching and conditional requests.
+func (s *svc) initiateFileDownload(ctx context.Context, req *provider.InitiateFileDownloadRequest, info *provider.ResourceInfo) (*gateway.InitiateFileDownloadResponse, error) {
 	log := appctx.GetLogger(ctx)
-	c, err := s.find(ctx, req.Ref)
+	p, err := s.findProvider(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: findErrorStatus(ctx, err),
+		}, nil
+	}
+
+	c, err := s.getStorageProviderClient(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: status.NewInternal(ctx, err, "error connecting to storage provider="+p.Address),
+		}, nil
+	}
+
+	rng, err := downloadRange(req.Opaque, info.GetSize())
+	if err != nil {
+		if _, ok := err.(rangeNotSatisfiableError); ok {
 			return &gateway.InitiateFileDownloadResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
+				Status: status.NewOutOfRange(ctx, err.Error()),
 			}, nil
 		}
 		return &gateway.InitiateFileDownloadResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: status.NewInvalidArg(ctx, err.Error()),
 		}, nil
 	}
+	if rng != "" {
+		// the provider gets the normalized range
+		req.Opaque.Map[downloadRangeKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(rng)}
+	}
 
 	storageRes, err := c.InitiateFileDownload(ctx, req)
 	if err != nil {
@@ -220,16 +432,32 @@ func (s *svc) initiateFileDownload(ctx context.Context, req *provider.InitiateFi
 	}
 
 	res := &gateway.InitiateFileDownloadResponse{
-		Opaque:           storageRes.Opaque,
+		Opaque:           withCacheHints(storageRes.Opaque, info),
 		Status:           storageRes.Status,
 		DownloadEndpoint: storageRes.DownloadEndpoint,
 	}
+	if rng != "" && res.Status.GetCode() == rpc.Code_CODE_OK {
+		if res.Opaque == nil {
+			res.Opaque = &typespb.Opaque{}
+		}
+		if res.Opaque.Map == nil {
+			res.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+		}
+		res.Opaque.Map[downloadRangeKey] = &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(rng)}
+	}
 
 	if storageRes.Expose {
 		log.Info().Msg("download is routed directly to data server - skipping data gateway")
 		return res, nil
 	}
 
+	dataGateway, err := s.getDataGateway(p)
+	if err != nil {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: status.NewInternal(ctx, err, "gateway: no data gateway for download"),
+		}, nil
+	}
+
 	// sign the download location and pass it to the data gateway
 	u, err := url.Parse(res.DownloadEndpoint)
 	if err != nil {
@@ -238,26 +466,96 @@ func (s *svc) initiateFileDownload(ctx context.Context, req *provider.InitiateFi
 		}, nil
 	}
 
-	// TODO(labkode): calculate signature of the whole request? we only sign the URI now. Maybe worth https://tools.ietf.org/html/draft-cavage-http-signatures-11
 	target := u.String()
-	token, err := s.sign(ctx, target)
+	token, err := s.sign(ctx, target, downloadMethods, 0, rng, s.transferExpires(ctx, req.Opaque))
 	if err != nil {
 		return &gateway.InitiateFileDownloadResponse{
 			Status: status.NewInternal(ctx, err, "error creating signature for download"),
 		}, nil
 	}
 
-	res.DownloadEndpoint = s.c.DataGatewayEndpoint
+	if err := s.signProtocols(ctx, res.Opaque, dataGateway, downloadMethods, 0, rng, s.transferExpires(ctx, req.Opaque)); err != nil {
+		return &gateway.InitiateFileDownloadResponse{
+			Status: status.NewInternal(ctx, err, "error signing download protocols"),
+		}, nil
+	}
+
+	res.DownloadEndpoint = dataGateway
 	res.Token = token
 
 	return res, nil
 }
 
+// uploadLength returns the length of the upload announced in the opaque, 0 if unknown.
+func uploadLength(o *typespb.Opaque) int64 {
+	e, ok := o.GetMap()["Upload-Length"]
+	if !ok {
+		return 0
+	}
+	length, err := strconv.ParseInt(string(e.Value), 10, 64)
+	if err != nil || length < 0 {
+		return 0
+	}
+	return length
+}
+
+// getDataGateway returns the data gateway serving the region of the storage provider.
+// An error is returned when no data gateway is configured for it, as the transfers of
+// providers not exposing their data server must go through one.
+func (s *svc) getDataGateway(p *registry.ProviderInfo) (string, error) {
+	if e, ok := p.GetOpaque().GetMap()["region"]; ok {
+		if endpoint, ok := s.c.DataGateways[string(e.Value)]; ok && endpoint != "" {
+			return endpoint, nil
+		}
+	}
+
+	if s.c.DataGatewayEndpoint == "" {
+		return "", errtypes.InternalError("gateway: datagateway is not configured for storage provider " + p.Address)
+	}
+	return s.c.DataGatewayEndpoint, nil
+}
+
+// withCacheHints adds the etag and the modification time, in seconds since epoch,
+// of a file to the opaque of a download response.
+func withCacheHints(o *typespb.Opaque, info *provider.ResourceInfo) *typespb.Opaque {
+	if info == nil {
+		return o
+	}
+
+	hints := map[string]string{}
+	if info.Etag != "" {
+		hints["etag"] = info.Etag
+	}
+	if info.Mtime != nil {
+		hints["mtime"] = strconv.FormatUint(info.Mtime.Seconds, 10)
+	}
+	if len(hints) == 0 {
+		return o
+	}
+
+	if o == nil {
+		o = &typespb.Opaque{}
+	}
+	if o.Map == nil {
+		o.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	for k, v := range hints {
+		o.Map[k] = &typespb.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte(v),
+		}
+	}
+	return o
+}
+
 func (s *svc) InitiateFileUpload(ctx context.Context, req *provider.InitiateFileUploadRequest) (*gateway.InitiateFileUploadResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	p, err := s.getPath(ctx, req.Ref)
 	if err != nil {
 		return &gateway.InitiateFileUploadResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
@@ -266,7 +564,24 @@ func (s *svc) InitiateFileUpload(ctx context.Context, req *provider.InitiateFile
 	}
 
 	log := appctx.GetLogger(ctx)
-	if s.isSharedFolder(ctx, p) || s.isShareName(ctx, p) {
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileUploadResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	collision, err := s.collidesWithShareName(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileUploadResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error uploading"),
+		}, nil
+	}
+	if collision {
+		return s.initiateFileUpload(ctx, req)
+	}
+
+	if folder || name {
 		log.Debug().Msgf("path:%s points to shared folder or share name", p)
 		err := errtypes.PermissionDenied("gateway: cannot upload to share folder or share name: path=" + p)
 		log.Err(err).Msg("gateway: error downloading")
@@ -276,9 +591,14 @@ func (s *svc) InitiateFileUpload(ctx context.Context, req *provider.InitiateFile
 
 	}
 
-	if s.isShareChild(ctx, p) {
+	if child {
 		log.Debug().Msgf("shared child: %s", p)
-		shareName, shareChild := s.splitShare(ctx, p)
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &gateway.InitiateFileUploadResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
@@ -301,14 +621,6 @@ func (s *svc) InitiateFileUpload(ctx context.Context, req *provider.InitiateFile
 			}, nil
 		}
 
-		if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			err := errors.New(fmt.Sprintf("gateway: expected reference: got:%+v", statRes.Info))
-			log.Err(err).Msg("gateway: error creating container")
-			return &gateway.InitiateFileUploadResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error uploading"),
-			}, nil
-		}
-
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
@@ -328,24 +640,33 @@ func (s *svc) InitiateFileUpload(ctx context.Context, req *provider.InitiateFile
 		return s.initiateFileUpload(ctx, req)
 	}
 
-	panic("gateway: upload: unknown path:" + p)
+	return &gateway.InitiateFileUploadResponse{
+		Status: unknownPathStatus(ctx, "upload", p),
+	}, nil
 }
 
 func (s *svc) initiateFileUpload(ctx context.Context, req *provider.InitiateFileUploadRequest) (*gateway.InitiateFileUploadResponse, error) {
 	log := appctx.GetLogger(ctx)
-	c, err := s.find(ctx, req.Ref)
+	if st := s.checkPreconditions(ctx, req.Ref, req.Opaque); st != nil {
+		return &gateway.InitiateFileUploadResponse{Status: st}, nil
+	}
+
+	p, err := s.findProvider(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &gateway.InitiateFileUploadResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &gateway.InitiateFileUploadResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
+		}, nil
+	}
+
+	c, err := s.getStorageProviderClient(ctx, p)
+	if err != nil {
+		return &gateway.InitiateFileUploadResponse{
+			Status: status.NewInternal(ctx, err, "error connecting to storage provider="+p.Address),
 		}, nil
 	}
 
 	storageRes, err := c.InitiateFileUpload(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling InitiateFileUpload")
 	}
@@ -360,7 +681,7 @@ func (s *svc) initiateFileUpload(ctx context.Context, req *provider.InitiateFile
 	}
 
 	res := &gateway.InitiateFileUploadResponse{
-		Opaque:             storageRes.Opaque,
+		Opaque:             relayWarnings(storageRes.Status, storageRes.Opaque),
 		Status:             storageRes.Status,
 		UploadEndpoint:     storageRes.UploadEndpoint,
 		AvailableChecksums: storageRes.AvailableChecksums,
@@ -371,6 +692,13 @@ func (s *svc) initiateFileUpload(ctx context.Context, req *provider.InitiateFile
 		return res, nil
 	}
 
+	dataGateway, err := s.getDataGateway(p)
+	if err != nil {
+		return &gateway.InitiateFileUploadResponse{
+			Status: status.NewInternal(ctx, err, "gateway: no data gateway for upload"),
+		}, nil
+	}
+
 	// sign the upload location and pass it to the data gateway
 	u, err := url.Parse(res.UploadEndpoint)
 	if err != nil {
@@ -379,22 +707,30 @@ func (s *svc) initiateFileUpload(ctx context.Context, req *provider.InitiateFile
 		}, nil
 	}
 
-	// TODO(labkode): calculate signature of the url, we only sign the URI. At some points maybe worth https://tools.ietf.org/html/draft-cavage-http-signatures-11
 	target := u.String()
-	token, err := s.sign(ctx, target)
+	token, err := s.sign(ctx, target, uploadMethods, uploadLength(req.Opaque), "", s.transferExpires(ctx, req.Opaque))
 	if err != nil {
 		return &gateway.InitiateFileUploadResponse{
 			Status: status.NewInternal(ctx, err, "error creating signature for download"),
 		}, nil
 	}
 
-	res.UploadEndpoint = s.c.DataGatewayEndpoint
+	if err := s.signProtocols(ctx, res.Opaque, dataGateway, uploadMethods, uploadLength(req.Opaque), "", s.transferExpires(ctx, req.Opaque)); err != nil {
+		return &gateway.InitiateFileUploadResponse{
+			Status: status.NewInternal(ctx, err, "error signing upload protocols"),
+		}, nil
+	}
+
+	res.UploadEndpoint = dataGateway
 	res.Token = token
 
 	return res, nil
 }
 
 func (s *svc) GetPath(ctx context.Context, req *provider.GetPathRequest) (*provider.GetPathResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	ref := &provider.Reference{
 		Spec: &provider.Reference_Id{
 			Id: req.ResourceId,
@@ -422,10 +758,24 @@ func (s *svc) GetPath(ctx context.Context, req *provider.GetPathRequest) (*provi
 }
 
 func (s *svc) CreateContainer(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
+	ctx, done := s.observe(ctx, "CreateContainer")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	res, err := s.createContainerResolvingShares(ctx, req)
+	done(res.GetStatus(), err)
+	return res, err
+}
+
+func (s *svc) createContainerResolvingShares(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
+	if isRecursive(req.Opaque) {
+		return s.CreateContainerRecursive(ctx, req)
+	}
+
 	p, err := s.getPath(ctx, req.Ref)
 	if err != nil {
 		return &provider.CreateContainerResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
@@ -434,7 +784,24 @@ func (s *svc) CreateContainer(ctx context.Context, req *provider.CreateContainer
 	}
 
 	log := appctx.GetLogger(ctx)
-	if s.isSharedFolder(ctx, p) || s.isShareName(ctx, p) {
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &provider.CreateContainerResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	collision, err := s.collidesWithShareName(ctx, p)
+	if err != nil {
+		return &provider.CreateContainerResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error creating container"),
+		}, nil
+	}
+	if collision {
+		return s.createContainer(ctx, req)
+	}
+
+	if folder || name {
 		log.Debug().Msgf("path:%s points to shared folder or share name", p)
 		err := errtypes.PermissionDenied("gateway: cannot create container on share folder or share name: path=" + p)
 		log.Err(err).Msg("gateway: error creating container")
@@ -444,9 +811,14 @@ func (s *svc) CreateContainer(ctx context.Context, req *provider.CreateContainer
 
 	}
 
-	if s.isShareChild(ctx, p) {
+	if child {
 		log.Debug().Msgf("shared child: %s", p)
-		shareName, shareChild := s.splitShare(ctx, p)
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &provider.CreateContainerResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
@@ -469,14 +841,6 @@ func (s *svc) CreateContainer(ctx context.Context, req *provider.CreateContainer
 			}, nil
 		}
 
-		if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			err := errors.New(fmt.Sprintf("gateway: expected reference: got:%+v", statRes.Info))
-			log.Err(err).Msg("gateway: error creating container")
-			return &provider.CreateContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error creating container"),
-			}, nil
-		}
-
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
@@ -496,23 +860,21 @@ func (s *svc) CreateContainer(ctx context.Context, req *provider.CreateContainer
 		return s.createContainer(ctx, req)
 	}
 
-	panic("gateway: create container on unknown path:" + p)
+	return &provider.CreateContainerResponse{
+		Status: unknownPathStatus(ctx, "create container", p),
+	}, nil
 }
 
 func (s *svc) createContainer(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.CreateContainerResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.CreateContainerResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.CreateContainer(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling CreateContainer")
 	}
@@ -520,51 +882,193 @@ func (s *svc) createContainer(ctx context.Context, req *provider.CreateContainer
 	return res, nil
 }
 
+// CreateContainerRecursive creates the container pointed by the reference and all its missing
+// parents, like mkdir -p. Every level goes through Stat and CreateContainer so paths
+// inside the share folder are resolved. If the leaf already exists the call succeeds.
+func (s *svc) CreateContainerRecursive(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	p, err := s.getPath(ctx, req.Ref)
+	if err != nil {
+		return &provider.CreateContainerResponse{
+			Status: getPathErrorStatus(ctx, err),
+		}, nil
+	}
+
+	return mkdirAll(ctx, p, s.Stat, s.CreateContainer)
+}
+
+type statFunc func(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error)
+type createContainerFunc func(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error)
+type listContainerFunc func(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error)
+
+// mkdirAll walks p from the root and creates the containers that do not exist yet.
+// Once a level is missing all the levels below are created without stating them.
+func mkdirAll(ctx context.Context, p string, stat statFunc, mkdir createContainerFunc) (*provider.CreateContainerResponse, error) {
+	log := appctx.GetLogger(ctx)
+
+	missing := false
+	for _, dir := range parentPaths(p) {
+		ref := &provider.Reference{
+			Spec: &provider.Reference_Path{
+				Path: dir,
+			},
+		}
+
+		if !missing {
+			statRes, err := stat(ctx, &provider.StatRequest{Ref: ref})
+			if err != nil {
+				return &provider.CreateContainerResponse{
+					Status: status.NewInternal(ctx, err, "gateway: error stating "+dir),
+				}, nil
+			}
+
+			switch statRes.Status.Code {
+			case rpc.Code_CODE_OK:
+				if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+					log.Debug().Msgf("gateway: mkdir -p: %s exists but is not a container: type=%s", dir, statRes.Info.Type)
+					return &provider.CreateContainerResponse{
+						Status: status.NewInvalidArg(ctx, "path component is not a container: "+dir),
+					}, nil
+				}
+				continue
+			case rpc.Code_CODE_NOT_FOUND:
+				missing = true
+			default:
+				err := status.NewErrorFromCode(statRes.Status.Code, "gateway")
+				return &provider.CreateContainerResponse{
+					Status: status.NewInternal(ctx, err, "gateway: error stating "+dir),
+				}, nil
+			}
+		}
+
+		log.Debug().Msgf("gateway: mkdir -p: creating %s", dir)
+		res, err := mkdir(ctx, &provider.CreateContainerRequest{Ref: ref})
+		if err != nil {
+			return nil, err
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			return res, nil
+		}
+	}
+
+	return &provider.CreateContainerResponse{
+		Status: status.NewOK(ctx),
+	}, nil
+}
+
+// parentPaths returns all the paths from the top most directory down to p.
+// For /home/a/b it returns [/home /home/a /home/a/b].
+func parentPaths(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return []string{}
+	}
+
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	paths := make([]string, 0, len(parts))
+	for i := range parts {
+		paths = append(paths, "/"+path.Join(parts[:i+1]...))
+	}
+	return paths
+}
+
+// isRecursive checks if the opaque of a CreateContainer request asks for the
+// missing parents to be created as well.
+func isRecursive(o *typespb.Opaque) bool {
+	if o == nil || o.Map == nil {
+		return false
+	}
+	e, ok := o.Map["recursive"]
+	if !ok {
+		return false
+	}
+	return string(e.Value) == "true"
+}
+
 // check if the path contains the prefix of the shared folder
 func (s *svc) inSharedFolder(ctx context.Context, p string) bool {
 	sharedFolder := s.getSharedFolder(ctx)
-	return strings.HasPrefix(p, sharedFolder)
+	p = path.Clean("/" + p)
+	return p == sharedFolder || strings.HasPrefix(p, sharedFolder+"/")
+}
+
+// unknownPathStatus logs and reports a path inside the share folder that
+// matches none of the share folder, share name or share child cases.
+func unknownPathStatus(ctx context.Context, op, p string) *rpc.Status {
+	err := errors.New("gateway: " + op + ": unknown path:" + p)
+	appctx.GetLogger(ctx).Error().Err(err).Msg("gateway: error routing path")
+	return status.NewInvalidArg(ctx, err.Error())
 }
 
 func (s *svc) Delete(ctx context.Context, req *provider.DeleteRequest) (*provider.DeleteResponse, error) {
+	ctx, done := s.observe(ctx, "Delete")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	res, err := s.deleteResolvingShares(ctx, req)
+	done(res.GetStatus(), err)
+	return res, err
+}
+
+func (s *svc) deleteResolvingShares(ctx context.Context, req *provider.DeleteRequest) (*provider.DeleteResponse, error) {
 	p, err := s.getPath(ctx, req.Ref)
 	if err != nil {
 		return &provider.DeleteResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error deleting"); st != nil {
+		return &provider.DeleteResponse{Status: st}, nil
+	}
+
 	if !s.inSharedFolder(ctx, p) {
 		return s.delete(ctx, req)
 	}
 
 	log := appctx.GetLogger(ctx)
-	if s.isSharedFolder(ctx, p) {
-		// TODO(labkode): deleting share names should be allowed, means unmounting.
-		log.Debug().Msgf("path:%s points to shared folder or share name", p)
-		err := errtypes.PermissionDenied("gateway: cannot delete share folder or share name: path=" + p)
-		log.Err(err).Msg("gateway: error creating container")
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
 		return &provider.DeleteResponse{
-			Status: status.NewInvalidArg(ctx, "path points to share folder or share name"),
+			Status: splitErrorStatus(ctx, err),
 		}, nil
+	}
 
+	collision, err := s.collidesWithShareName(ctx, p)
+	if err != nil {
+		return &provider.DeleteResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error deleting"),
+		}, nil
+	}
+	if collision {
+		return s.delete(ctx, req)
 	}
 
-	if s.isShareName(ctx, p) {
-		log.Debug().Msgf("path:%s points to share name", p)
+	if folder {
+		log.Debug().Msgf("path:%s points to shared folder", p)
+		err := errtypes.PermissionDenied("gateway: cannot delete share folder: path=" + p)
+		log.Err(err).Msg("gateway: error deleting")
+		return &provider.DeleteResponse{
+			Status: status.NewInvalidArg(ctx, "path points to share folder"),
+		}, nil
 
-		ref := &provider.Reference{
-			Spec: &provider.Reference_Path{
-				Path: p,
-			},
-		}
+	}
 
-		req.Ref = ref
-		return s.delete(ctx, req)
+	// deleting a share name unmounts the share, the target is not touched.
+	if name {
+		log.Debug().Msgf("path:%s points to share name", p)
+		return s.unmountShare(ctx, req, p)
 	}
 
-	if s.isShareChild(ctx, p) {
-		shareName, shareChild := s.splitShare(ctx, p)
+	if child {
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &provider.DeleteResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 		log.Debug().Msgf("path:%s sharename:%s sharechild: %s", p, shareName, shareChild)
 
 		ref := &provider.Reference{
@@ -582,29 +1086,33 @@ func (s *svc) Delete(ctx context.Context, req *provider.DeleteRequest) (*provide
 		}
 
 		if statRes.Status.Code != rpc.Code_CODE_OK {
-			err := status.NewErrorFromCode(statRes.Status.Code, "gateway")
+			err := shareNameError(shareName, statRes.Status.Code)
 			log.Err(err).Msg("gateway: error deleting")
+			st, o := shareError(ctx, err, "gateway: error deleting")
 			return &provider.DeleteResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error deleting"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
-		if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			err := errors.New(fmt.Sprintf("gateway: expected reference: got:%+v", statRes.Info))
-			log.Err(err).Msg("gateway: error deleting")
-			return &provider.DeleteResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error deleting"),
-			}, nil
+		if st := canceledStatus(ctx, "gateway: error deleting"); st != nil {
+			return &provider.DeleteResponse{Status: st}, nil
 		}
 
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
+			st, o := shareError(ctx, err, "error creating container")
 			return &provider.DeleteResponse{
-				Status: status.NewInternal(ctx, err, "error creating container"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error deleting"); st != nil {
+			return &provider.DeleteResponse{Status: st}, nil
+		}
+
 		// append child to target
 		target := path.Join(ri.Path, shareChild)
 		ref = &provider.Reference{
@@ -613,67 +1121,136 @@ func (s *svc) Delete(ctx context.Context, req *provider.DeleteRequest) (*provide
 			},
 		}
 
+		// the request is forwarded with its opaque, holding the lock token if any.
 		req.Ref = ref
 		return s.delete(ctx, req)
 	}
 
-	panic("gateway: delete called on unknown path:" + p)
+	return &provider.DeleteResponse{
+		Status: unknownPathStatus(ctx, "delete", p),
+	}, nil
 }
 
 func (s *svc) delete(ctx context.Context, req *provider.DeleteRequest) (*provider.DeleteResponse, error) {
+	if st := s.checkPreconditions(ctx, req.Ref, req.Opaque); st != nil {
+		return &provider.DeleteResponse{Status: st}, nil
+	}
+
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.DeleteResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.DeleteResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if isDryRun(req.Opaque) {
+		st, o, err := dryRun(ctx, c, req.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return &provider.DeleteResponse{Status: st, Opaque: o}, nil
+	}
+
 	res, err := c.Delete(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling Delete")
 	}
 
+	res.Opaque = relayWarnings(res.Status, res.Opaque)
 	return res, nil
 }
 
 func (s *svc) Move(ctx context.Context, req *provider.MoveRequest) (*provider.MoveResponse, error) {
+	ctx, done := s.observe(ctx, "Move")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	res, err := s.moveResolvingShares(ctx, req)
+	done(res.GetStatus(), err)
+	return res, err
+}
+
+func (s *svc) moveResolvingShares(ctx context.Context, req *provider.MoveRequest) (*provider.MoveResponse, error) {
 	log := appctx.GetLogger(ctx)
 
 	p, err := s.getPath(ctx, req.Source)
 	if err != nil {
 		log.Err(err).Msg("gateway: error moving")
 		return &provider.MoveResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+		return &provider.MoveResponse{Status: st}, nil
+	}
+
 	dp, err := s.getPath(ctx, req.Destination)
 	if err != nil {
 		log.Err(err).Msg("gateway: error moving")
 		return &provider.MoveResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error gettng path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+		return &provider.MoveResponse{Status: st}, nil
+	}
+
 	if !s.inSharedFolder(ctx, p) && !s.inSharedFolder(ctx, dp) {
 		return s.move(ctx, req)
 	}
 
+	_, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &provider.MoveResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+	_, dname, dchild, err := s.classifySharePath(ctx, dp)
+	if err != nil {
+		return &provider.MoveResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	collision, err := s.collidesWithShareName(ctx, p)
+	if err != nil {
+		return &provider.MoveResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error moving"),
+		}, nil
+	}
+	dcollision, err := s.collidesWithShareName(ctx, dp)
+	if err != nil {
+		return &provider.MoveResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error moving"),
+		}, nil
+	}
+	if (collision || !s.inSharedFolder(ctx, p)) && (dcollision || !s.inSharedFolder(ctx, dp)) {
+		return s.move(ctx, req)
+	}
+
 	// allow renaming the share folder, the mount point, not the target.
-	if s.isShareName(ctx, p) && s.isShareName(ctx, dp) {
+	if name && dname {
 		log.Info().Msgf("gateway: move: renaming share mountpoint: from:%s to:%s", p, dp)
 		return s.move(ctx, req)
 	}
 
 	// resolve references and check the ref points to the same base path, paranoia check.
-	if s.isShareChild(ctx, p) && s.isShareChild(ctx, dp) {
-		shareName, shareChild := s.splitShare(ctx, p)
-		dshareName, dshareChild := s.splitShare(ctx, dp)
+	if child && dchild {
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &provider.MoveResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
+		dshareName, dshareChild, err := s.splitShare(ctx, dp)
+		if err != nil {
+			return &provider.MoveResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 		log.Debug().Msgf("srcpath:%s dstpath:%s srcsharename:%s srcsharechild: %s dstsharename:%s dstsharechild:%s ", p, dp, shareName, shareChild, dshareName, dshareChild)
 
 		if shareName != dshareName {
@@ -706,22 +1283,25 @@ func (s *svc) Move(ctx context.Context, req *provider.MoveRequest) (*provider.Mo
 			}, nil
 		}
 
-		if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			err := errors.New(fmt.Sprintf("gateway: expected reference: got:%+v", statRes.Info))
-			log.Err(err).Msg("gateway: error deleting")
-			return &provider.MoveResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error deleting"),
-			}, nil
+		if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+			return &provider.MoveResponse{Status: st}, nil
 		}
 
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
+			if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+				return &provider.MoveResponse{Status: st}, nil
+			}
 			return &provider.MoveResponse{
 				Status: status.NewInternal(ctx, err, "error moving"),
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+			return &provider.MoveResponse{Status: st}, nil
+		}
+
 		src := &provider.Reference{
 			Spec: &provider.Reference_Path{
 				Path: path.Join(ri.Path, shareChild),
@@ -733,18 +1313,26 @@ func (s *svc) Move(ctx context.Context, req *provider.MoveRequest) (*provider.Mo
 			},
 		}
 
+		// the request is forwarded with its opaque, holding the lock token if any.
 		req.Source = src
 		req.Destination = dst
 
 		return s.move(ctx, req)
 	}
 
-	panic("gateway: move called on unknown path:" + p)
+	return &provider.MoveResponse{
+		Status: unknownPathStatus(ctx, "move", p),
+	}, nil
 }
 
 func (s *svc) move(ctx context.Context, req *provider.MoveRequest) (*provider.MoveResponse, error) {
 	srcP, err := s.findProvider(ctx, req.Source)
 	if err != nil {
+		if _, ok := err.(errtypes.IsUnavailable); ok {
+			return &provider.MoveResponse{
+				Status: status.NewUnavailable(ctx, err, "source storage provider unavailable"),
+			}, nil
+		}
 		if _, ok := err.(errtypes.IsNotFound); ok {
 			return &provider.MoveResponse{
 				Status: status.NewNotFound(ctx, "source storage provider not found"),
@@ -755,8 +1343,17 @@ func (s *svc) move(ctx context.Context, req *provider.MoveRequest) (*provider.Mo
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error moving"); st != nil {
+		return &provider.MoveResponse{Status: st}, nil
+	}
+
 	dstP, err := s.findProvider(ctx, req.Destination)
 	if err != nil {
+		if _, ok := err.(errtypes.IsUnavailable); ok {
+			return &provider.MoveResponse{
+				Status: status.NewUnavailable(ctx, err, "destination storage provider unavailable"),
+			}, nil
+		}
 		if _, ok := err.(errtypes.IsNotFound); ok {
 			return &provider.MoveResponse{
 				Status: status.NewNotFound(ctx, "destination storage provider not found"),
@@ -767,14 +1364,24 @@ func (s *svc) move(ctx context.Context, req *provider.MoveRequest) (*provider.Mo
 		}, nil
 	}
 
-	// if providers are not the same we do not implement cross storage copy yet.
+	// if providers are not the same we do not implement cross storage move yet,
+	// clients find the reason in the opaque and can fall back to copy and delete.
 	if srcP.Address != dstP.Address {
 		res := &provider.MoveResponse{
-			Status: status.NewUnimplemented(ctx, nil, "gateway: cross storage copy not yet implemented"),
+			Status: status.NewUnimplemented(ctx, nil, "gateway: cross storage move not yet implemented"),
+			Opaque: &typespb.Opaque{
+				Map: map[string]*typespb.OpaqueEntry{
+					"error": {Decoder: "plain", Value: []byte(crossStorageMoveError)},
+				},
+			},
 		}
 		return res, nil
 	}
 
+	if st := s.checkPreconditions(ctx, req.Source, req.Opaque); st != nil {
+		return &provider.MoveResponse{Status: st}, nil
+	}
+
 	c, err := s.getStorageProviderClient(ctx, srcP)
 	if err != nil {
 		return &provider.MoveResponse{
@@ -782,23 +1389,37 @@ func (s *svc) move(ctx context.Context, req *provider.MoveRequest) (*provider.Mo
 		}, nil
 	}
 
-	return c.Move(ctx, req)
+	if isDryRun(req.Opaque) {
+		st, o, err := dryRun(ctx, c, req.Source)
+		if err != nil {
+			return nil, err
+		}
+		return &provider.MoveResponse{Status: st, Opaque: o}, nil
+	}
+
+	res, err := c.Move(ctx, req)
+	s.forgetStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Opaque = relayWarnings(res.Status, res.Opaque)
+	return res, nil
 }
 
 func (s *svc) SetArbitraryMetadata(ctx context.Context, req *provider.SetArbitraryMetadataRequest) (*provider.SetArbitraryMetadataResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.SetArbitraryMetadataResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.SetArbitraryMetadataResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.SetArbitraryMetadata(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling Stat")
 	}
@@ -807,19 +1428,18 @@ func (s *svc) SetArbitraryMetadata(ctx context.Context, req *provider.SetArbitra
 }
 
 func (s *svc) UnsetArbitraryMetadata(ctx context.Context, req *provider.UnsetArbitraryMetadataRequest) (*provider.UnsetArbitraryMetadataResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.UnsetArbitraryMetadataResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.UnsetArbitraryMetadataResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.UnsetArbitraryMetadata(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling Stat")
 	}
@@ -830,40 +1450,105 @@ func (s *svc) UnsetArbitraryMetadata(ctx context.Context, req *provider.UnsetArb
 func (s *svc) stat(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error) {
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.StatResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.StatResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
-	return c.Stat(ctx, req)
+	return s.statOn(ctx, c, req)
+}
+
+// statOn stats with the client c, retrying when the provider is unavailable.
+// The successful stats are remembered in the stat memo of the request.
+func (s *svc) statOn(ctx context.Context, c provider.ProviderAPIClient, req *provider.StatRequest) (*provider.StatResponse, error) {
+	m, _ := ctx.Value(statMemoKey{}).(*statMemo)
+	key := req.String()
+	if m != nil {
+		if res, ok := m.get(key); ok {
+			return res, nil
+		}
+	}
+
+	var res *provider.StatResponse
+	err := s.retry(ctx, func() (*rpc.Status, error) {
+		var err error
+		res, err = c.Stat(ctx, req)
+		return res.GetStatus(), err
+	})
+	if m != nil && err == nil && res.Status.Code == rpc.Code_CODE_OK {
+		m.set(key, res)
+	}
+	return res, err
+}
+
+// listContainerOn lists with the client c, retrying when the provider is unavailable.
+func (s *svc) listContainerOn(ctx context.Context, c provider.ProviderAPIClient, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+	var res *provider.ListContainerResponse
+	err := s.retry(ctx, func() (*rpc.Status, error) {
+		var err error
+		res, err = c.ListContainer(ctx, req)
+		return res.GetStatus(), err
+	})
+	return res, err
 }
 
 func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error) {
+	ctx, done := s.observe(ctx, "Stat")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	res, err := s.statResolvingShares(ctx, req)
+	done(res.GetStatus(), err)
+	if err != nil {
+		return nil, err
+	}
+
+	s.redact(ctx, res.Info)
+	return res, nil
+}
+
+func (s *svc) statResolvingShares(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error) {
 	p, err := s.getPath(ctx, req.Ref, req.ArbitraryMetadataKeys...)
 	if err != nil {
 		return &provider.StatResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error getting path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error stating"); st != nil {
+		return &provider.StatResponse{Status: st}, nil
+	}
+
 	if !s.inSharedFolder(ctx, p) {
 		return s.stat(ctx, req)
 	}
 
-	// TODO(labkode): we need to generate a unique etag based on the contained share names.
-	if s.isSharedFolder(ctx, p) {
-		return s.stat(ctx, req)
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &provider.StatResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	if folder {
+		res, err := s.stat(ctx, req)
+		if err != nil || res.Status.Code != rpc.Code_CODE_OK || !s.c.ShareFolderEtag {
+			return res, err
+		}
+
+		etag, err := s.shareFolderEtag(ctx, req.Ref)
+		if err != nil {
+			appctx.GetLogger(ctx).Warn().Err(err).Msg("gateway: error computing the etag of the shared folder")
+			return res, nil
+		}
+		res.Info.Etag = etag
+		return res, nil
 	}
 
 	log := appctx.GetLogger(ctx)
 
 	// we need to provide the info of the target, not the reference.
-	if s.isShareName(ctx, p) {
+	if name {
 		res, err := s.stat(ctx, req)
 		if err != nil {
 			return &provider.StatResponse{
@@ -872,21 +1557,25 @@ func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.St
 		}
 
 		if res.Status.Code != rpc.Code_CODE_OK {
-			err := status.NewErrorFromCode(res.Status.Code, "gateway")
+			err := shareNameError(p, res.Status.Code)
 			log.Err(err).Msg("gateway: error stating")
+			st, o := shareError(ctx, err, "gateway: error stating")
 			return &provider.StatResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error stating"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
-		if res.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-			panic("gateway: a share name must be of type reference: ref:" + res.Info.Path)
+		if st := canceledStatus(ctx, "gateway: error stating"); st != nil {
+			return &provider.StatResponse{Status: st}, nil
 		}
 
 		ri, err := s.checkRef(ctx, res.Info)
 		if err != nil {
+			st, o := shareError(ctx, err, "gateway: error resolving reference:"+p)
 			return &provider.StatResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error resolving reference:"+p),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
@@ -895,14 +1584,21 @@ func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.St
 		// is reference to /user/peter/Holidays/photos, we need to still return to the user
 		// /home/MyShares/photos
 		orgPath := res.Info.Path
-		res.Info = ri
+		expiration := shareExpiration(ctx, res.Info)
+		res.Info = s.withPermissionDiagnostics(ctx, res.Info, ri)
 		res.Info.Path = orgPath
+		res.Opaque = withShareExpiration(res.Opaque, expiration)
 		return res, nil
 
 	}
 
-	if s.isShareChild(ctx, p) {
-		shareName, shareChild := s.splitShare(ctx, p)
+	if child {
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &provider.StatResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
@@ -910,8 +1606,7 @@ func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.St
 			},
 		}
 
-		statReq := &provider.StatRequest{Ref: ref}
-		statRes, err := s.stat(ctx, statReq)
+		statRes, err := s.statResolution(ctx, ref)
 		if err != nil {
 			return &provider.StatResponse{
 				Status: status.NewInternal(ctx, err, "gateway: error stating"),
@@ -919,21 +1614,33 @@ func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.St
 		}
 
 		if statRes.Status.Code != rpc.Code_CODE_OK {
-			err := status.NewErrorFromCode(statRes.Status.Code, "gateway")
+			err := shareNameError(shareName, statRes.Status.Code)
 			log.Err(err).Msg("gateway: error stating")
+			st, o := shareError(ctx, err, "gateway: error stating")
 			return &provider.StatResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error stating"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error stating"); st != nil {
+			return &provider.StatResponse{Status: st}, nil
+		}
+
 		ri, err := s.checkRef(ctx, statRes.Info)
 		if err != nil {
 			log.Err(err).Msg("gateway: error resolving reference")
+			st, o := shareError(ctx, err, "error stating")
 			return &provider.StatResponse{
-				Status: status.NewInternal(ctx, err, "error stating"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error stating"); st != nil {
+			return &provider.StatResponse{Status: st}, nil
+		}
+
 		// append child to target
 		target := path.Join(ri.Path, shareChild)
 		ref = &provider.Reference{
@@ -942,15 +1649,120 @@ func (s *svc) Stat(ctx context.Context, req *provider.StatRequest) (*provider.St
 			},
 		}
 		req.Ref = ref
-		return s.stat(ctx, req)
+		res, err := s.stat(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.Status.Code == rpc.Code_CODE_OK {
+			res.Opaque = withShareExpiration(res.Opaque, shareExpiration(ctx, statRes.Info))
+		}
+		return res, nil
+	}
+
+	return &provider.StatResponse{
+		Status: unknownPathStatus(ctx, "stat", p),
+	}, nil
+}
+
+// shareExpiration returns the expiration of the share a reference has been created for,
+// in seconds since epoch, as stored in the reference metadata. An empty string is
+// returned for shares that do not expire.
+func shareExpiration(ctx context.Context, ref *provider.ResourceInfo) string {
+	exp, ok := ref.GetArbitraryMetadata().GetMetadata()[shareExpirationKey]
+	if !ok || exp == "" {
+		return ""
+	}
+
+	if _, err := strconv.ParseUint(exp, 10, 64); err != nil {
+		log := appctx.GetLogger(ctx)
+		log.Warn().Err(err).Msgf("gateway: ignoring invalid share expiration on reference:%s", ref.Path)
+		return ""
+	}
+	return exp
+}
+
+// withShareExpiration adds the share expiration to the opaque of a response.
+// The opaque is left untouched when the share does not expire.
+func withShareExpiration(o *typespb.Opaque, expiration string) *typespb.Opaque {
+	if expiration == "" {
+		return o
+	}
+
+	if o == nil {
+		o = &typespb.Opaque{}
+	}
+	if o.Map == nil {
+		o.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	o.Map[shareExpirationKey] = &typespb.OpaqueEntry{
+		Decoder: "plain",
+		Value:   []byte(expiration),
+	}
+	return o
+}
+
+// statResolution stats the share references and their targets when resolving shares.
+// Successful results are cached per user for a short time and the number of concurrent
+// resolution stats is limited to not overwhelm the storage of the share owners.
+func (s *svc) statResolution(ctx context.Context, ref *provider.Reference) (*provider.StatResponse, error) {
+	return s.statResolutionOn(ctx, nil, ref)
+}
+
+// statResolutionOn is statResolution using the client c, when not nil, instead of looking up the provider.
+func (s *svc) statResolutionOn(ctx context.Context, c provider.ProviderAPIClient, ref *provider.Reference) (*provider.StatResponse, error) {
+	key := ref.String()
+	if u, ok := user.ContextGetUser(ctx); ok {
+		key = u.GetId().GetIdp() + "!" + u.GetId().GetOpaqueId() + "!" + key
+	}
+
+	// the cached results are shared by the requests, which rewrite the responses they
+	// get, so the cache holds and returns copies.
+	if res, ok := s.resolutionCache.get(key); ok {
+		return proto.Clone(res.(*provider.StatResponse)).(*provider.StatResponse), nil
+	}
+
+	if s.resolutionSem != nil {
+		select {
+		case s.resolutionSem <- struct{}{}:
+			defer func() { <-s.resolutionSem }()
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "gateway: error waiting to resolve reference")
+		}
+	}
+
+	countResolution(ctx)
+	var res *provider.StatResponse
+	var err error
+	if c != nil {
+		res, err = s.statOn(ctx, c, &provider.StatRequest{Ref: ref})
+	} else {
+		res, err = s.stat(ctx, &provider.StatRequest{Ref: ref})
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	panic("gateway: stating an unknown path:" + p)
+	if res.Status.Code == rpc.Code_CODE_OK {
+		s.resolutionCache.set(key, proto.Clone(res))
+	}
+	return res, nil
 }
 
 func (s *svc) checkRef(ctx context.Context, ri *provider.ResourceInfo) (*provider.ResourceInfo, error) {
-	if ri.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-		panic("gateway: calling checkRef on a non reference type:" + ri.String())
+	return s.checkRefOn(ctx, nil, ri)
+}
+
+// checkRefOn resolves the reference ri using c, the client of the storage provider holding ri,
+// to stat targets living in the same storage without looking up their provider again.
+// A nil client always looks up the provider of the target.
+func (s *svc) checkRefOn(ctx context.Context, c provider.ProviderAPIClient, ri *provider.ResourceInfo) (*provider.ResourceInfo, error) {
+	collision, err := s.shareNameCollision(ctx, ri)
+	if err != nil {
+		return nil, err
+	}
+	if collision {
+		return ri, nil
 	}
 
 	// reference types MUST have a target resource id.
@@ -960,7 +1772,8 @@ func (s *svc) checkRef(ctx context.Context, ri *provider.ResourceInfo) (*provide
 		return nil, err
 	}
 
-	newResourceInfo, err := s.handleRef(ctx, target)
+	chain := []string{ri.Id.GetStorageId() + "/" + ri.Id.GetOpaqueId()}
+	newResourceInfo, err := s.handleRef(ctx, c, ri.Id.GetStorageId(), target, chain)
 	if err != nil {
 		err := errors.Wrapf(err, "gateway: error handling ref target:%s", target)
 		return nil, err
@@ -968,24 +1781,83 @@ func (s *svc) checkRef(ctx context.Context, ri *provider.ResourceInfo) (*provide
 	return newResourceInfo, nil
 }
 
-func (s *svc) handleRef(ctx context.Context, targetURI string) (*provider.ResourceInfo, error) {
+// shareNameCollision reports whether ri, the resource at a share name, is a regular folder or file
+// created in the share folder, colliding with the share names. With the "resource" precedence the
+// regular resource wins and is served as is, operators being warned to move it away. With the "error"
+// one, an internal error naming its path and type is returned.
+func (s *svc) shareNameCollision(ctx context.Context, ri *provider.ResourceInfo) (bool, error) {
+	if ri.Type == provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+		return false, nil
+	}
+
+	if s.c.ShareNameCollision == shareNameCollisionError {
+		err := errtypes.InternalError(fmt.Sprintf("gateway: a share name must be of type reference: path:%s type:%s", ri.Path, ri.Type))
+		appctx.GetLogger(ctx).Err(err).Msg("gateway: error resolving share name")
+		return false, err
+	}
+
+	appctx.GetLogger(ctx).Warn().Str("path", ri.Path).Str("type", ri.Type.String()).Msg("gateway: resource in the share folder is not a reference, serving it as a regular resource")
+	return true, nil
+}
+
+// collidesWithShareName reports whether p, a share name or a share child, is in a regular resource
+// colliding with the share names, see shareNameCollision. Such paths are served as the paths
+// outside the share folder.
+func (s *svc) collidesWithShareName(ctx context.Context, p string) (bool, error) {
+	shareName := p
+	name, err := s.isShareName(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	if !name {
+		child, err := s.isShareChild(ctx, p)
+		if err != nil || !child {
+			return false, err
+		}
+		if shareName, _, err = s.splitShare(ctx, p); err != nil {
+			return false, err
+		}
+	}
+
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: shareName,
+		},
+	}
+	res, err := s.stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return false, err
+	}
+
+	// missing share names are reported by the resolution of the share.
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return false, nil
+	}
+	return s.shareNameCollision(ctx, res.Info)
+}
+
+// handleRef resolves the target of a reference, chain holds the <storage_id>/<opaque_id> of the
+// references followed so far, the number of hops being its length.
+func (s *svc) handleRef(ctx context.Context, c provider.ProviderAPIClient, storageID, targetURI string, chain []string) (*provider.ResourceInfo, error) {
 	uri, err := url.Parse(targetURI)
 	if err != nil {
 		return nil, errors.Wrapf(err, "gateway: error parsing target uri:%s", targetURI)
 	}
 
-	scheme := uri.Scheme
+	// a crafted reference must not give access to the resources of another storage.
+	if !s.trustedTarget(uri) {
+		return nil, errtypes.PermissionDenied("gateway: untrusted reference target:" + targetURI)
+	}
 
-	switch scheme {
-	case "cs3":
-		return s.handleCS3Ref(ctx, uri.Opaque)
-	default:
-		err := errors.New("gateway: no reference handler for scheme:" + scheme)
+	resolve, ok := referenceResolvers[uri.Scheme]
+	if !ok {
+		err := errors.New("gateway: no reference handler for scheme:" + uri.Scheme)
 		return nil, err
 	}
+	return resolve(s, ctx, c, storageID, uri, chain)
 }
 
-func (s *svc) handleCS3Ref(ctx context.Context, opaque string) (*provider.ResourceInfo, error) {
+func (s *svc) handleCS3Ref(ctx context.Context, c provider.ProviderAPIClient, storageID, opaque string, chain []string) (*provider.ResourceInfo, error) {
 	// a cs3 ref has the following layout: <storage_id>/<opaque_id>
 	parts := strings.SplitN(opaque, "/", 2)
 	if len(parts) < 2 {
@@ -993,6 +1865,13 @@ func (s *svc) handleCS3Ref(ctx context.Context, opaque string) (*provider.Resour
 		return nil, err
 	}
 
+	// a target already followed would be resolved again and again until the hop limit.
+	for _, followed := range chain {
+		if followed == opaque {
+			return nil, errors.Wrapf(errReferenceLoop, "gateway: %s -> %s", strings.Join(chain, " -> "), opaque)
+		}
+	}
+
 	storageid := parts[0]
 	opaqueid := parts[1]
 	id := &provider.ResourceId{
@@ -1009,94 +1888,236 @@ func (s *svc) handleCS3Ref(ctx context.Context, opaque string) (*provider.Resour
 	// we could call here the Stat method again, but that is calling for problems in case
 	// there is a loop of targets pointing to targets, so better avoid it.
 
-	req := &provider.StatRequest{Ref: ref}
-	res, err := s.stat(ctx, req)
+	// the client of the reference can only be reused for targets in the same storage.
+	if storageID == "" || storageid != storageID {
+		c = nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "gateway: stopped resolving reference")
+	}
+
+	res, err := s.statResolutionOn(ctx, c, ref)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling stat")
 	}
 
+	// the target may have been moved to another storage provider, leaving the reference stale.
+	if res.Status.Code == rpc.Code_CODE_NOT_FOUND && s.relocator != nil {
+		res, err = s.statRelocated(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.Status.Code == rpc.Code_CODE_NOT_FOUND {
+		return nil, shareTargetNotFoundError(opaque)
+	}
+
 	if res.Status.Code != rpc.Code_CODE_OK {
 		err := errors.New("gateway: error stating target reference")
 		return nil, err
 	}
 
+	// a reshare is a reference pointing to another reference, follow the chain up to the limit.
 	if res.Info.Type == provider.ResourceType_RESOURCE_TYPE_REFERENCE {
-		err := errors.New("gateway: error the target of a reference cannot be another reference")
-		return nil, err
+		if len(chain) >= s.c.MaxReferenceHops {
+			return nil, errors.Wrapf(errReferenceChainTooLong, "gateway: stopped after %d references at %s", len(chain), res.Info.Path)
+		}
+		return s.handleRef(ctx, c, storageid, res.Info.Target, append(chain, opaque))
 	}
 
 	return res.Info, nil
 }
 
-func (s *svc) ListContainerStream(req *provider.ListContainerStreamRequest, ss gateway.GatewayAPI_ListContainerStreamServer) error {
-	return errors.New("Unimplemented")
-}
-
-func (s *svc) listContainer(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
-	c, err := s.find(ctx, req.Ref)
+// resolveMount returns the entry of the listing of the shared folder p for the share reference ref.
+// A nil info is returned for the shares to be skipped.
+func (s *svc) resolveMount(ctx context.Context, c provider.ProviderAPIClient, p string, ref *provider.ResourceInfo) (*provider.ResourceInfo, error) {
+	info, err := s.checkRefOn(ctx, c, ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.ListContainerResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
+		// a too long chain of reshares or a loop only hides the share, not the whole listing.
+		if cause := errors.Cause(err); cause == errReferenceChainTooLong || cause == errReferenceLoop {
+			appctx.GetLogger(ctx).Warn().Err(err).Str("path", ref.Path).Msg("gateway: skipping share")
+			return nil, nil
 		}
-		return &provider.ListContainerResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
-		}, nil
+		return nil, err
 	}
+	return s.withPermissionDiagnostics(ctx, ref, withRole(ref, mountEntry(p, ref, info))), nil
+}
 
-	res, err := c.ListContainer(ctx, req)
-	if err != nil {
-		return nil, errors.Wrap(err, "gateway: error calling ListContainer")
-	}
+// ListContainerStream sends the entries of the container one by one, with the same resolution of
+// the shares as ListContainer. The shares of the shared folder are resolved and sent one at a time,
+// the broken ones being left out or sent as references carrying their error, as in ListContainer.
+// Other errors are sent as a last response carrying the status, and the listing stops as soon as the
+// client cancels the stream.
+func (s *svc) ListContainerStream(req *provider.ListContainerStreamRequest, ss gateway.GatewayAPI_ListContainerStreamServer) error {
+	ctx := s.withRetryBudget(ss.Context())
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+
+	sendError := func(st *rpc.Status, o *typespb.Opaque) error {
+		return ss.Send(&provider.ListContainerStreamResponse{Status: st, Opaque: o})
+	}
+	send := func(info *provider.ResourceInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.redact(ctx, info)
+		return ss.Send(&provider.ListContainerStreamResponse{Status: status.NewOK(ctx), Info: info})
+	}
+
+	listReq := &provider.ListContainerRequest{
+		Opaque:                req.Opaque,
+		Ref:                   req.Ref,
+		ArbitraryMetadataKeys: req.ArbitraryMetadataKeys,
+	}
+
+	p, err := s.getPath(ctx, req.Ref, req.ArbitraryMetadataKeys...)
+	if err != nil {
+		return sendError(getPathErrorStatus(ctx, err), nil)
+	}
+
+	folder, err := s.isSharedFolder(ctx, p)
+	if err != nil {
+		return sendError(splitErrorStatus(ctx, err), nil)
+	}
+	if !folder {
+		res, err := s.listContainerResolvingShares(ctx, listReq)
+		if err != nil {
+			return err
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			return sendError(res.Status, res.Opaque)
+		}
+		for _, info := range res.Infos {
+			if err := send(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c, err := s.find(ctx, req.Ref)
+	if err != nil {
+		return sendError(findErrorStatus(ctx, err), nil)
+	}
+
+	lcr, err := s.listContainerOn(ctx, c, listReq)
+	if err != nil {
+		return sendError(status.NewInternal(ctx, err, "gateway: error listing shared folder"), nil)
+	}
+	if lcr.Status.Code != rpc.Code_CODE_OK {
+		return sendError(lcr.Status, lcr.Opaque)
+	}
+
+	for _, ref := range lcr.Infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := s.resolveMount(ctx, c, p, ref)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			info = s.brokenMount(ctx, p, ref, err)
+		}
+		if info == nil {
+			continue
+		}
+		if err := send(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *svc) listContainer(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+	c, err := s.find(ctx, req.Ref)
+	if err != nil {
+		return &provider.ListContainerResponse{
+			Status: findErrorStatus(ctx, err),
+		}, nil
+	}
+
+	res, err := s.listContainerOn(ctx, c, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error calling ListContainer")
+	}
 
 	return res, nil
 }
 
 func (s *svc) ListContainer(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+	ctx, done := s.observe(ctx, "ListContainer")
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	res, err := s.listContainerResolvingShares(ctx, req)
+	done(res.GetStatus(), err)
+	if err != nil {
+		return nil, err
+	}
+
+	s.redact(ctx, res.Infos...)
+	return res, nil
+}
+
+func (s *svc) listContainerResolvingShares(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
 	p, err := s.getPath(ctx, req.Ref, req.ArbitraryMetadataKeys...)
 	if err != nil {
 		return &provider.ListContainerResponse{
-			Status: status.NewInternal(ctx, err, "gateway: error getting path for ref"),
+			Status: getPathErrorStatus(ctx, err),
 		}, nil
 	}
 
+	if st := canceledStatus(ctx, "gateway: error listing"); st != nil {
+		return &provider.ListContainerResponse{Status: st}, nil
+	}
+
 	if !s.inSharedFolder(ctx, p) {
 		return s.listContainer(ctx, req)
 	}
 
-	if s.isSharedFolder(ctx, p) {
+	folder, name, child, err := s.classifySharePath(ctx, p)
+	if err != nil {
+		return &provider.ListContainerResponse{
+			Status: splitErrorStatus(ctx, err),
+		}, nil
+	}
+
+	if folder {
 		// TODO(labkode): we need to generate a unique etag if any of the underlying share changes.
 		// the response will contain all the share names and we need to convert them to non reference types.
-		lcr, err := s.listContainer(ctx, req)
+		// the client is kept to resolve the references pointing to the same storage.
+		c, err := s.find(ctx, req.Ref)
 		if err != nil {
 			return &provider.ListContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error listing shared folder"),
+				Status: findErrorStatus(ctx, err),
 			}, nil
 		}
 
-		for i, ref := range lcr.Infos {
-
-			info, err := s.checkRef(ctx, ref)
-			if err != nil {
-				return &provider.ListContainerResponse{
-					Status: status.NewInternal(ctx, err, "gateway: error resolving reference:"+info.Path),
-				}, nil
-			}
-
-			base := path.Base(ref.Path)
-			info.Path = path.Join(p, base)
-
-			lcr.Infos[i] = info
+		lcr, err := s.listContainerOn(ctx, c, req)
+		if err != nil {
+			return &provider.ListContainerResponse{
+				Status: status.NewInternal(ctx, err, "gateway: error listing shared folder"),
+			}, nil
+		}
 
+		infos, err := s.resolveMounts(ctx, c, p, lcr.Infos)
+		if err != nil {
+			return &provider.ListContainerResponse{
+				Status: status.NewCancelled(ctx, err, "gateway: error listing shared folder: request canceled"),
+			}, nil
 		}
+		lcr.Infos = infos
 		return lcr, nil
 	}
 
 	log := appctx.GetLogger(ctx)
 
 	// we need to provide the info of the target, not the reference.
-	if s.isShareName(ctx, p) {
+	if name {
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
 				Path: p,
@@ -1112,20 +2133,28 @@ func (s *svc) ListContainer(ctx context.Context, req *provider.ListContainerRequ
 		}
 
 		if res.Status.Code != rpc.Code_CODE_OK {
-			err := status.NewErrorFromCode(res.Status.Code, "gateway")
+			err := shareNameError(p, res.Status.Code)
 			log.Err(err).Msg("gateway: error stating")
+			st, o := shareError(ctx, err, "gateway: error stating share")
 			return &provider.ListContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error stating share"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
 		ri, err := s.checkRef(ctx, res.Info)
 		if err != nil {
+			st, o := shareError(ctx, err, "gateway: error resolving reference:"+p)
 			return &provider.ListContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error resolving reference:"+p),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error listing"); st != nil {
+			return &provider.ListContainerResponse{Status: st}, nil
+		}
+
 		if ri.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
 			err := errtypes.NotSupported("gateway: list container: cannot list non-container type:" + ri.Path)
 			log.Err(err).Msg("gateway: error listing")
@@ -1166,8 +2195,13 @@ func (s *svc) ListContainer(ctx context.Context, req *provider.ListContainerRequ
 
 	}
 
-	if s.isShareChild(ctx, p) {
-		shareName, shareChild := s.splitShare(ctx, p)
+	if child {
+		shareName, shareChild, err := s.splitShare(ctx, p)
+		if err != nil {
+			return &provider.ListContainerResponse{
+				Status: status.NewInvalidArg(ctx, err.Error()),
+			}, nil
+		}
 
 		ref := &provider.Reference{
 			Spec: &provider.Reference_Path{
@@ -1184,20 +2218,28 @@ func (s *svc) ListContainer(ctx context.Context, req *provider.ListContainerRequ
 		}
 
 		if res.Status.Code != rpc.Code_CODE_OK {
-			err := status.NewErrorFromCode(res.Status.Code, "gateway")
+			err := shareNameError(shareName, res.Status.Code)
 			log.Err(err).Msg("gateway: error stating")
+			st, o := shareError(ctx, err, "gateway: error stating share child")
 			return &provider.ListContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error stating share child"),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
 		ri, err := s.checkRef(ctx, res.Info)
 		if err != nil {
+			st, o := shareError(ctx, err, "gateway: error resolving reference:"+p)
 			return &provider.ListContainerResponse{
-				Status: status.NewInternal(ctx, err, "gateway: error resolving reference:"+p),
+				Status: st,
+				Opaque: o,
 			}, nil
 		}
 
+		if st := canceledStatus(ctx, "gateway: error listing"); st != nil {
+			return &provider.ListContainerResponse{Status: st}, nil
+		}
+
 		if ri.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
 			err := errtypes.NotSupported("gateway: list container: cannot list non-container type:" + ri.Path)
 			log.Err(err).Msg("gateway: error listing")
@@ -1236,14 +2278,75 @@ func (s *svc) ListContainer(ctx context.Context, req *provider.ListContainerRequ
 		}
 
 		return newRes, nil
+	}
+
+	return &provider.ListContainerResponse{
+		Status: unknownPathStatus(ctx, "list container", p),
+	}, nil
+}
 
+// mountEntry returns the info of the target of a share mounted in the shared folder p.
+// The path is the one of the mount point and the id of the reference itself is added
+// to the opaque, so clients can address the mount independently of the target.
+func mountEntry(p string, ref, target *provider.ResourceInfo) *provider.ResourceInfo {
+	target.Path = path.Join(p, path.Base(ref.Path))
+
+	if ref.Id == nil {
+		return target
+	}
+
+	mountID, err := json.Marshal(ref.Id)
+	if err != nil {
+		return target
 	}
 
-	panic("gateway: stating an unknown path:" + p)
+	if target.Opaque == nil {
+		target.Opaque = &typespb.Opaque{}
+	}
+	if target.Opaque.Map == nil {
+		target.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+	}
+	target.Opaque.Map["mount_id"] = &typespb.OpaqueEntry{
+		Decoder: "json",
+		Value:   mountID,
+	}
+	return target
+}
+
+// pathLimitError is returned for the paths exceeding the maximum length or number of segments.
+type pathLimitError string
+
+func (e pathLimitError) Error() string {
+	return "gateway: path exceeds the limits: " + string(e)
+}
+
+// getPathErrorStatus returns the status of the responses failing to get the path of a reference.
+func getPathErrorStatus(ctx context.Context, err error) *rpc.Status {
+	if _, ok := errors.Cause(err).(pathLimitError); ok {
+		return status.NewInvalidArg(ctx, err.Error())
+	}
+	return status.NewInternal(ctx, err, "gateway: error getting path for ref")
+}
+
+// checkPathLimits bounds the work done on the paths sent by the clients, which are split,
+// joined and matched against the shared folder all along the resolution of the shares.
+func (s *svc) checkPathLimits(p string) error {
+	if max := s.c.MaxPathLength; max > 0 && len(p) > max {
+		return pathLimitError(fmt.Sprintf("length %d over %d", len(p), max))
+	}
+	if max := s.c.MaxPathSegments; max > 0 {
+		if n := len(strings.FieldsFunc(p, func(r rune) bool { return r == '/' })); n > max {
+			return pathLimitError(fmt.Sprintf("%d segments over %d", n, max))
+		}
+	}
+	return nil
 }
 
 func (s *svc) getPath(ctx context.Context, ref *provider.Reference, keys ...string) (string, error) {
 	if ref.GetPath() != "" {
+		if err := s.checkPathLimits(ref.GetPath()); err != nil {
+			return "", err
+		}
 		return ref.GetPath(), nil
 	}
 
@@ -1260,6 +2363,9 @@ func (s *svc) getPath(ctx context.Context, ref *provider.Reference, keys ...stri
 			return "", err
 		}
 
+		if err := s.checkPathLimits(res.Info.Path); err != nil {
+			return "", err
+		}
 		return res.Info.Path, nil
 	}
 
@@ -1267,65 +2373,112 @@ func (s *svc) getPath(ctx context.Context, ref *provider.Reference, keys ...stri
 }
 
 // /home/MyShares/
-func (s *svc) isSharedFolder(ctx context.Context, p string) bool {
+func (s *svc) isSharedFolder(ctx context.Context, p string) (bool, error) {
 	return s.split(ctx, p, 2)
 }
 
 // /home/MyShares/photos/
-func (s *svc) isShareName(ctx context.Context, p string) bool {
+func (s *svc) isShareName(ctx context.Context, p string) (bool, error) {
 	return s.split(ctx, p, 3)
 }
 
 // /home/MyShares/photos/Ibiza/beach.png
-func (s *svc) isShareChild(ctx context.Context, p string) bool {
+func (s *svc) isShareChild(ctx context.Context, p string) (bool, error) {
 	return s.split(ctx, p, 4)
 }
 
+// classifySharePath reports whether p is the share folder, a share name or a share child,
+// or an error if p is malformed.
+func (s *svc) classifySharePath(ctx context.Context, p string) (folder, name, child bool, err error) {
+	if folder, err = s.isSharedFolder(ctx, p); err != nil {
+		return false, false, false, err
+	}
+	if name, err = s.isShareName(ctx, p); err != nil {
+		return false, false, false, err
+	}
+	if child, err = s.isShareChild(ctx, p); err != nil {
+		return false, false, false, err
+	}
+	return folder, name, child, nil
+}
+
+// splitError is returned when a path does not contain the parts expected
+// for a path inside the share folder.
+type splitError struct {
+	msg   string
+	path  string
+	parts []string
+}
+
+func (e *splitError) Error() string {
+	return fmt.Sprintf("gateway: %s: path:%s parts:%q", e.msg, e.path, e.parts)
+}
+
+// splitErrorStatus returns the status of the responses to requests whose path is malformed.
+func splitErrorStatus(ctx context.Context, err error) *rpc.Status {
+	return status.NewInvalidArg(ctx, err.Error())
+}
+
 // always validate that the path contains the share folder
 // split cannot be called with i<2
-func (s *svc) split(ctx context.Context, p string, i int) bool {
+func (s *svc) split(ctx context.Context, p string, i int) (bool, error) {
 	log := appctx.GetLogger(ctx)
+	parts := s.splitPath(ctx, p)
+
 	if i < 2 {
-		panic("split called with i < 2")
+		return false, &splitError{msg: fmt.Sprintf("split called with i=%d < 2", i), path: p, parts: parts}
 	}
 
-	parts := s.splitPath(ctx, p)
+	// the paths handled by the gateway are absolute and hold no NUL byte, an empty
+	// path is the one of a reference by id, never in the share folder.
+	if p == "" {
+		return false, nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsRune(p, 0) {
+		return false, &splitError{msg: "split: malformed path", path: p, parts: parts}
+	}
 
-	// validate that we have always at least two elements
+	// the home itself and the root are not in the share folder
 	if len(parts) < 2 {
-		panic(fmt.Sprintf("split: len(parts) < 2: path:%s parts:%+v", p, parts))
+		return false, nil
 	}
 
-	// validate the share folder is always the second element, first element is always the hardcoded value of "home"
-	if parts[1] != s.c.ShareFolder {
-		log.Debug().Msgf("gateway: split: parts[1]:%+v != shareFolder:%+v", parts[1], s.c.ShareFolder)
-		return false
+	// validate the share folder is always the second element, the first element is always the home of the user
+	if parts[0] != strings.Trim(s.getHome(ctx), "/") || parts[1] != s.c.ShareFolder {
+		log.Debug().Msgf("gateway: split: parts:%+v not in shareFolder:%+v of the home", parts, s.c.ShareFolder)
+		return false, nil
 	}
 
 	log.Debug().Msgf("gateway: split: path:%+v parts:%+v shareFolder:%+v", p, parts, s.c.ShareFolder)
 
 	if len(parts) == i && parts[i-1] != "" {
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
 
-// path must contain a share path with share children, if not it will panic.
+// path must contain a share path with share children, if not an error is returned.
 // should be called after checking isShareChild == true
-func (s *svc) splitShare(ctx context.Context, p string) (string, string) {
+func (s *svc) splitShare(ctx context.Context, p string) (string, string, error) {
 	parts := s.splitPath(ctx, p)
 	if len(parts) != 4 {
-		panic("gateway: path for splitShare does not contain 4 elements:" + p)
+		return "", "", &splitError{msg: "splitShare: path does not contain 4 elements", path: p, parts: parts}
 	}
 
 	shareName := path.Join("/", parts[0], parts[1], parts[2])
 	shareChild := path.Join("/", parts[3])
-	return shareName, shareChild
+	return shareName, shareChild, nil
 }
 
 func (s *svc) splitPath(ctx context.Context, p string) []string {
-	p = strings.Trim(p, "/")
+	p = strings.Trim(path.Clean("/"+p), "/")
+
+	// the home can span several elements, e.g. /eos/user/e/einstein, and is kept as the first one.
+	home := strings.Trim(s.getHome(ctx), "/")
+	if strings.HasPrefix(p, home+"/") {
+		return append([]string{home}, strings.SplitN(strings.TrimPrefix(p, home+"/"), "/", 3)...)
+	}
 	return strings.SplitN(p, "/", 4) // ["home", "MyShares", "photos", "Ibiza/beach.png"]
 }
 
@@ -1336,15 +2489,13 @@ func (s *svc) getSharedFolder(ctx context.Context) string {
 }
 
 func (s *svc) ListFileVersions(ctx context.Context, req *provider.ListFileVersionsRequest) (*provider.ListFileVersionsResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.ListFileVersionsResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.ListFileVersionsResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
@@ -1357,19 +2508,18 @@ func (s *svc) ListFileVersions(ctx context.Context, req *provider.ListFileVersio
 }
 
 func (s *svc) RestoreFileVersion(ctx context.Context, req *provider.RestoreFileVersionRequest) (*provider.RestoreFileVersionResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.RestoreFileVersionResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.RestoreFileVersionResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.RestoreFileVersion(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling RestoreFileVersion")
 	}
@@ -1377,21 +2527,190 @@ func (s *svc) RestoreFileVersion(ctx context.Context, req *provider.RestoreFileV
 	return res, nil
 }
 
+// ListRecycleStream streams the recycle items of the storage provider responsible for req.Ref,
+// so large trashbins don't need to be held in memory. The stream ends with a status frame
+// without recycle item.
 func (s *svc) ListRecycleStream(req *gateway.ListRecycleStreamRequest, ss gateway.GatewayAPI_ListRecycleStreamServer) error {
-	return errors.New("Unimplemented")
+	ctx := s.withRetryBudget(ss.Context())
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+
+	sendStatus := func(st *rpc.Status, o *typespb.Opaque) error {
+		return ss.Send(&provider.ListRecycleStreamResponse{Status: st, Opaque: o})
+	}
+	send := func(item *provider.RecycleItem) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return ss.Send(&provider.ListRecycleStreamResponse{Status: status.NewOK(ctx), RecycleItem: item})
+	}
+
+	// the items deleted from a share need their paths rewritten, which is done by listShareRecycle.
+	p := req.GetRef().GetPath()
+	var name, child bool
+	if s.inSharedFolder(ctx, p) {
+		var err error
+		if _, name, child, err = s.classifySharePath(ctx, p); err != nil {
+			return sendStatus(splitErrorStatus(ctx, err), nil)
+		}
+	}
+	if name || child {
+		res, err := s.listShareRecycle(ctx, &gateway.ListRecycleRequest{
+			Opaque: req.Opaque,
+			Ref:    req.Ref,
+			FromTs: req.FromTs,
+			ToTs:   req.ToTs,
+		}, p, child)
+		if err != nil {
+			return sendStatus(status.NewInternal(ctx, err, "gateway: error listing recycle"), nil)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			return sendStatus(res.Status, res.Opaque)
+		}
+		for _, item := range res.RecycleItems {
+			if err := send(item); err != nil {
+				return err
+			}
+		}
+		return sendStatus(status.NewOK(ctx), nil)
+	}
+
+	c, err := s.find(ctx, req.GetRef())
+	if err != nil {
+		return sendStatus(findErrorStatus(ctx, err), nil)
+	}
+
+	stream, err := c.ListRecycleStream(ctx, &provider.ListRecycleStreamRequest{
+		Opaque: req.Opaque,
+		FromTs: req.FromTs,
+		ToTs:   req.ToTs,
+	})
+	if err != nil {
+		return sendStatus(status.NewInternal(ctx, err, "gateway: error calling ListRecycleStream"), nil)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return sendStatus(status.NewInternal(ctx, err, "gateway: error receiving recycle items"), nil)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			return sendStatus(res.Status, res.Opaque)
+		}
+		// storage providers may end their own stream with a status frame.
+		if res.RecycleItem == nil {
+			continue
+		}
+		if err := send(res.RecycleItem); err != nil {
+			return err
+		}
+	}
+
+	return sendStatus(status.NewOK(ctx), nil)
 }
 
 // TODO use the ListRecycleRequest.Ref to only list the trish of a specific storage
 func (s *svc) ListRecycle(ctx context.Context, req *gateway.ListRecycleRequest) (*provider.ListRecycleResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+
+	// the items deleted from a share are in the recycle of the storage of the share target.
+	if p := req.GetRef().GetPath(); s.inSharedFolder(ctx, p) {
+		_, name, child, err := s.classifySharePath(ctx, p)
+		if err != nil {
+			return &provider.ListRecycleResponse{
+				Status: splitErrorStatus(ctx, err),
+			}, nil
+		}
+		if name || child {
+			return s.listShareRecycle(ctx, req, p, child)
+		}
+	}
+
 	c, err := s.find(ctx, req.GetRef())
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
+		return &provider.ListRecycleResponse{
+			Status: findErrorStatus(ctx, err),
+		}, nil
+	}
+
+	res, err := c.ListRecycle(ctx, &provider.ListRecycleRequest{
+		Opaque: req.Opaque,
+		FromTs: req.FromTs,
+		ToTs:   req.ToTs,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error calling ListRecycleRequest")
+	}
+
+	return res, nil
+}
+
+// listShareRecycle lists the recycle items of the share target deleted under the share path p,
+// a share name or, when child is set, a share child. The original paths of the items are
+// rewritten to be under the share path, as seen by the user.
+//
+// The CS3 recycle listing has no reference, so the whole recycle bin of the storage of the
+// target is listed with the credentials of the user, trusting the storage to only list the
+// items the user may access, and the items outside the share path are dropped here.
+func (s *svc) listShareRecycle(ctx context.Context, req *gateway.ListRecycleRequest, p string, child bool) (*provider.ListRecycleResponse, error) {
+	log := appctx.GetLogger(ctx)
+
+	shareName, shareChild := p, ""
+	if child {
+		var err error
+		shareName, shareChild, err = s.splitShare(ctx, p)
+		if err != nil {
 			return &provider.ListRecycleResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
+				Status: status.NewInvalidArg(ctx, err.Error()),
 			}, nil
 		}
+	}
+
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: shareName,
+		},
+	}
+
+	statRes, err := s.stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
 		return &provider.ListRecycleResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: status.NewInternal(ctx, err, "gateway: error listing recycle"),
+		}, nil
+	}
+
+	if statRes.Status.Code != rpc.Code_CODE_OK {
+		err := shareNameError(shareName, statRes.Status.Code)
+		log.Err(err).Msg("gateway: error listing recycle")
+		st, o := shareError(ctx, err, "gateway: error listing recycle")
+		return &provider.ListRecycleResponse{
+			Status: st,
+			Opaque: o,
+		}, nil
+	}
+
+	ri, err := s.checkRef(ctx, statRes.Info)
+	if err != nil {
+		log.Err(err).Msg("gateway: error resolving reference")
+		st, o := shareError(ctx, err, "gateway: error listing recycle")
+		return &provider.ListRecycleResponse{
+			Status: st,
+			Opaque: o,
+		}, nil
+	}
+
+	c, err := s.findByPath(ctx, ri.Path)
+	if err != nil {
+		return &provider.ListRecycleResponse{
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
@@ -1404,23 +2723,43 @@ func (s *svc) ListRecycle(ctx context.Context, req *gateway.ListRecycleRequest)
 		return nil, errors.Wrap(err, "gateway: error calling ListRecycleRequest")
 	}
 
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return res, nil
+	}
+
+	res.RecycleItems = shareRecycleItems(res.RecycleItems, path.Join(ri.Path, shareChild), ri.Path, shareName)
 	return res, nil
 }
 
+// shareRecycleItems returns the items originally under prefix, with the target path of the share
+// in their original path replaced by the share name. The paths are cleaned first, so that an item
+// escaping the prefix with dot-dot elements is dropped.
+func shareRecycleItems(items []*provider.RecycleItem, prefix, target, shareName string) []*provider.RecycleItem {
+	filtered := make([]*provider.RecycleItem, 0, len(items))
+	for _, item := range items {
+		p := path.Clean(item.Path)
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		item.Path = path.Join(shareName, strings.TrimPrefix(p, target))
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
 func (s *svc) RestoreRecycleItem(ctx context.Context, req *provider.RestoreRecycleItemRequest) (*provider.RestoreRecycleItemResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.RestoreRecycleItemResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.RestoreRecycleItemResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
 	res, err := c.RestoreRecycleItem(ctx, req)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling RestoreRecycleItem")
 	}
@@ -1429,16 +2768,14 @@ func (s *svc) RestoreRecycleItem(ctx context.Context, req *provider.RestoreRecyc
 }
 
 func (s *svc) PurgeRecycle(ctx context.Context, req *gateway.PurgeRecycleRequest) (*provider.PurgeRecycleResponse, error) {
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
 	// lookup storage by treating the key as a path. It has been prefixed with the storage path in ListRecycle
 	c, err := s.find(ctx, req.Ref)
 	if err != nil {
-		if _, ok := err.(errtypes.IsNotFound); ok {
-			return &provider.PurgeRecycleResponse{
-				Status: status.NewNotFound(ctx, "storage provider not found"),
-			}, nil
-		}
 		return &provider.PurgeRecycleResponse{
-			Status: status.NewInternal(ctx, err, "error finding storage provider"),
+			Status: findErrorStatus(ctx, err),
 		}, nil
 	}
 
@@ -1446,15 +2783,204 @@ func (s *svc) PurgeRecycle(ctx context.Context, req *gateway.PurgeRecycleRequest
 		Opaque: req.GetOpaque(),
 		Ref:    req.GetRef(),
 	})
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling PurgeRecycle")
 	}
 	return res, nil
 }
 
+// GetQuota returns the quota of the user home.
 func (s *svc) GetQuota(ctx context.Context, req *gateway.GetQuotaRequest) (*provider.GetQuotaResponse, error) {
-	res := &provider.GetQuotaResponse{
-		Status: status.NewUnimplemented(ctx, nil, "GetQuota not yet implemented"),
+	ctx = s.withRetryBudget(ctx)
+	ctx = s.withProviderMemo(ctx)
+	ctx = s.withStatMemo(ctx)
+	log := appctx.GetLogger(ctx)
+
+	home := s.getHome(ctx)
+	ref := req.Ref
+	if ref.GetPath() == "" && ref.GetId() == nil {
+		ref = &provider.Reference{
+			Spec: &provider.Reference_Path{
+				Path: home,
+			},
+		}
+	}
+
+	// the quota of a share is the one of the storage of its target.
+	p := ref.GetPath()
+	var name, child bool
+	if s.inSharedFolder(ctx, p) {
+		var err error
+		if _, name, child, err = s.classifySharePath(ctx, p); err != nil {
+			return &provider.GetQuotaResponse{
+				Status: splitErrorStatus(ctx, err),
+			}, nil
+		}
+	}
+	isShare := name || child
+	if isShare {
+		shareName, shareChild := p, ""
+		if child {
+			var err error
+			shareName, shareChild, err = s.splitShare(ctx, p)
+			if err != nil {
+				return &provider.GetQuotaResponse{
+					Status: status.NewInvalidArg(ctx, err.Error()),
+				}, nil
+			}
+		}
+
+		statRes, err := s.stat(ctx, &provider.StatRequest{
+			Ref: &provider.Reference{
+				Spec: &provider.Reference_Path{
+					Path: shareName,
+				},
+			},
+		})
+		if err != nil {
+			return &provider.GetQuotaResponse{
+				Status: status.NewInternal(ctx, err, "gateway: error stating share"),
+			}, nil
+		}
+
+		if statRes.Status.Code != rpc.Code_CODE_OK {
+			err := shareNameError(shareName, statRes.Status.Code)
+			log.Err(err).Msg("gateway: error getting quota")
+			st, o := shareError(ctx, err, "gateway: error getting quota")
+			return &provider.GetQuotaResponse{
+				Status: st,
+				Opaque: o,
+			}, nil
+		}
+
+		ri, err := s.checkRef(ctx, statRes.Info)
+		if err != nil {
+			st, o := shareError(ctx, err, "gateway: error resolving reference:"+shareName)
+			return &provider.GetQuotaResponse{
+				Status: st,
+				Opaque: o,
+			}, nil
+		}
+
+		ref = &provider.Reference{
+			Spec: &provider.Reference_Path{
+				Path: path.Join(ri.Path, shareChild),
+			},
+		}
+	}
+
+	c, err := s.find(ctx, ref)
+	if err != nil {
+		return &provider.GetQuotaResponse{
+			Status: findErrorStatus(ctx, err),
+		}, nil
+	}
+
+	res, err := c.GetQuota(ctx, &provider.GetQuotaRequest{
+		Opaque: withQuotaRef(req.Opaque, ref),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error calling GetQuota")
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK || s.c.IncludeSharesInQuota || isShare {
+		return res, nil
+	}
+
+	// the shared folder only needs to be excluded from the quota of the home,
+	// which the resources given by id are in if their path is.
+	if ref.GetPath() == "" {
+		statRes, err := s.stat(ctx, &provider.StatRequest{Ref: ref})
+		if err != nil {
+			return &provider.GetQuotaResponse{
+				Status: status.NewInternal(ctx, err, "gateway: error stating resource"),
+			}, nil
+		}
+		if statRes.Status.Code != rpc.Code_CODE_OK {
+			return &provider.GetQuotaResponse{
+				Status: statRes.Status,
+			}, nil
+		}
+		p = statRes.Info.Path
+	}
+	if p != home && !strings.HasPrefix(p, home+"/") {
+		return res, nil
+	}
+
+	// the storage of the home is listed directly, the gateway would resolve the references.
+	list := func(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+		c, err := s.find(ctx, req.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return c.ListContainer(ctx, req)
+	}
+	return s.excludeSharedFolder(ctx, res, list)
+}
+
+// withQuotaRef returns a copy of the opaque o with the reference the quota is asked for,
+// as the requests to the storage providers have no reference: the path in the "path"
+// entry or the json encoded resource id in the "id" entry.
+func withQuotaRef(o *typespb.Opaque, ref *provider.Reference) *typespb.Opaque {
+	m := map[string]*typespb.OpaqueEntry{}
+	for k, v := range o.GetMap() {
+		m[k] = v
+	}
+
+	if p := ref.GetPath(); p != "" {
+		m["path"] = &typespb.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte(p),
+		}
+	} else if id, err := json.Marshal(ref.GetId()); err == nil {
+		m["id"] = &typespb.OpaqueEntry{
+			Decoder: "json",
+			Value:   id,
+		}
+	}
+	return &typespb.Opaque{Map: m}
+}
+
+// excludeSharedFolder removes from the used bytes the bytes stored under the shared folder by the
+// storage of the home. Received shares live in the storage of their owners and must not count towards
+// the quota of the user: the storage of the home only holds references to them, whose bytes are not
+// stored there whatever size the storage reports for them, so only the other resources are excluded.
+func (s *svc) excludeSharedFolder(ctx context.Context, res *provider.GetQuotaResponse, list listContainerFunc) (*provider.GetQuotaResponse, error) {
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: s.getSharedFolder(ctx),
+		},
+	}
+	listRes, err := list(ctx, &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		return &provider.GetQuotaResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error listing shared folder"),
+		}, nil
+	}
+
+	switch listRes.Status.Code {
+	case rpc.Code_CODE_OK:
+	case rpc.Code_CODE_NOT_FOUND:
+		// no shares have been mounted yet
+		return res, nil
+	default:
+		err := status.NewErrorFromCode(listRes.Status.Code, "gateway")
+		return &provider.GetQuotaResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error listing shared folder"),
+		}, nil
+	}
+
+	var stored uint64
+	for _, info := range listRes.Infos {
+		if info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+			stored += info.Size
+		}
+	}
+	if stored >= res.UsedBytes {
+		res.UsedBytes = 0
+	} else {
+		res.UsedBytes -= stored
 	}
 	return res, nil
 }
@@ -1477,6 +3003,18 @@ func (s *svc) findByPath(ctx context.Context, path string) (provider.ProviderAPI
 	return s.find(ctx, ref)
 }
 
+// findErrorStatus returns the status of the responses failing to find the storage provider of a reference.
+func findErrorStatus(ctx context.Context, err error) *rpc.Status {
+	switch err.(type) {
+	case errtypes.IsNotFound:
+		return status.NewNotFound(ctx, "storage provider not found")
+	case errtypes.IsUnavailable:
+		return status.NewUnavailable(ctx, err, err.Error())
+	default:
+		return status.NewInternal(ctx, err, "error finding storage provider")
+	}
+}
+
 func (s *svc) find(ctx context.Context, ref *provider.Reference) (provider.ProviderAPIClient, error) {
 	p, err := s.findProvider(ctx, ref)
 	if err != nil {
@@ -1486,7 +3024,7 @@ func (s *svc) find(ctx context.Context, ref *provider.Reference) (provider.Provi
 }
 
 func (s *svc) getStorageProviderClient(ctx context.Context, p *registry.ProviderInfo) (provider.ProviderAPIClient, error) {
-	c, err := pool.GetStorageProviderServiceClient(p.Address)
+	c, err := s.conns.get(p.Address)
 	if err != nil {
 		err = errors.Wrap(err, "gateway: error getting a storage provider client")
 		return nil, err
@@ -1495,34 +3033,73 @@ func (s *svc) getStorageProviderClient(ctx context.Context, p *registry.Provider
 	return c, nil
 }
 
-func (s *svc) findProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
-	c, err := pool.GetStorageRegistryClient(s.c.StorageRegistryEndpoint)
+// selectProvider returns the provider of ref. When the registry returns several replicas,
+// the first one whose circuit is not open is selected.
+func (s *svc) selectProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
+	r, ok := s.storageRegistry.(ReplicatedStorageRegistry)
+	if !ok {
+		return s.storageRegistry.FindProvider(ctx, ref)
+	}
+
+	candidates, err := r.FindProviders(ctx, ref)
 	if err != nil {
-		err = errors.Wrap(err, "gateway: error getting storage registry client")
 		return nil, err
 	}
 
-	res, err := c.GetStorageProvider(ctx, &registry.GetStorageProviderRequest{
-		Ref: ref,
-	})
+	for _, p := range candidates {
+		if !s.breaker.isOpen(p.Address) {
+			return p, nil
+		}
+		appctx.GetLogger(ctx).Debug().Str("address", p.Address).Msg("gateway: skipping unhealthy storage provider")
+	}
 
-	if err != nil {
-		err = errors.Wrap(err, "gateway: error calling GetStorageProvider")
-		return nil, err
+	if len(candidates) == 0 {
+		return nil, errtypes.NotFound("gateway: storage provider not found for reference:" + ref.String())
 	}
+	return nil, errtypes.Unavailable("gateway: all the storage providers are unhealthy for reference:" + ref.String())
+}
 
-	if res.Status.Code != rpc.Code_CODE_OK {
-		if res.Status.Code == rpc.Code_CODE_NOT_FOUND {
-			return nil, errtypes.NotFound("gateway: storage provider not found for reference:" + ref.String())
+// findProvider returns the provider of ref, looking it up in the request memo, then in the
+// provider cache and finally in the storage registry. Lookup errors are never cached, so a
+// storage registered for a newly created resource is found as soon as the registry knows it,
+// and refs without storage id bypass both the memo and the cache. Paths are cached per user,
+// since the registry may route them differently for each user.
+func (s *svc) findProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
+	memo, _ := ctx.Value(providerMemoKey{}).(*providerMemo)
+	key, ok := s.memoKey(ctx, ref)
+	if memo != nil && ok {
+		if p, found := memo.get(key); found {
+			return p, nil
+		}
+	}
+
+	if ok {
+		if v, found := s.providerCache.get(s.cacheKey(ctx, key)); found {
+			// a provider that became unhealthy is looked up again to select one of its replicas.
+			if p := v.(*registry.ProviderInfo); !s.breaker.isOpen(p.Address) {
+				if memo != nil {
+					memo.set(key, p)
+				}
+				return p, nil
+			}
 		}
-		err := status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+
+	p, err := s.selectProvider(ctx, ref)
+	if err != nil {
 		return nil, err
 	}
 
-	if res.Provider == nil {
+	if p == nil {
 		err := errors.New("gateway: provider is nil")
 		return nil, err
 	}
 
-	return res.Provider, nil
+	if ok {
+		if memo != nil {
+			memo.set(key, p)
+		}
+		s.providerCache.set(s.cacheKey(ctx, key), p)
+	}
+	return p, nil
 }
@@ -0,0 +1,2086 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/user"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var parentPathsTests = []struct {
+	name string
+	path string
+	out  []string
+}{
+	{"root", "/", []string{}},
+	{"single level", "/home", []string{"/home"}},
+	{"several levels", "/home/a/b", []string{"/home", "/home/a", "/home/a/b"}},
+	{"trailing slash", "/home/a/", []string{"/home", "/home/a"}},
+	{"relative", "home/a", []string{"/home", "/home/a"}},
+}
+
+func TestParentPaths(t *testing.T) {
+	for _, tt := range parentPathsTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := parentPaths(tt.path)
+			if !reflect.DeepEqual(r, tt.out) {
+				t.Errorf("expected %v, got %v", tt.out, r)
+			}
+		})
+	}
+}
+
+// fakeTree simulates a storage holding the given resources indexed by path.
+type fakeTree struct {
+	resources map[string]provider.ResourceType
+	created   []string
+}
+
+func (f *fakeTree) stat(ctx context.Context, req *provider.StatRequest) (*provider.StatResponse, error) {
+	p := req.Ref.GetPath()
+	t, ok := f.resources[p]
+	if !ok {
+		return &provider.StatResponse{Status: status.NewNotFound(ctx, "not found: "+p)}, nil
+	}
+	return &provider.StatResponse{
+		Status: status.NewOK(ctx),
+		Info:   &provider.ResourceInfo{Path: p, Type: t},
+	}, nil
+}
+
+func (f *fakeTree) createContainer(ctx context.Context, req *provider.CreateContainerRequest) (*provider.CreateContainerResponse, error) {
+	p := req.Ref.GetPath()
+	f.resources[p] = provider.ResourceType_RESOURCE_TYPE_CONTAINER
+	f.created = append(f.created, p)
+	return &provider.CreateContainerResponse{Status: status.NewOK(ctx)}, nil
+}
+
+var mkdirAllTests = []struct {
+	name     string
+	existing map[string]provider.ResourceType
+	path     string
+	code     rpc.Code
+	created  []string
+}{
+	{
+		name:     "nothing exists",
+		existing: map[string]provider.ResourceType{},
+		path:     "/home/a/b",
+		code:     rpc.Code_CODE_OK,
+		created:  []string{"/home", "/home/a", "/home/a/b"},
+	},
+	{
+		name: "partially existing",
+		existing: map[string]provider.ResourceType{
+			"/home":   provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+			"/home/a": provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+		},
+		path:    "/home/a/b/c",
+		code:    rpc.Code_CODE_OK,
+		created: []string{"/home/a/b", "/home/a/b/c"},
+	},
+	{
+		name: "leaf already exists",
+		existing: map[string]provider.ResourceType{
+			"/home":   provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+			"/home/a": provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+		},
+		path:    "/home/a",
+		code:    rpc.Code_CODE_OK,
+		created: nil,
+	},
+	{
+		name: "file in the path",
+		existing: map[string]provider.ResourceType{
+			"/home":   provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+			"/home/a": provider.ResourceType_RESOURCE_TYPE_FILE,
+		},
+		path:    "/home/a/b",
+		code:    rpc.Code_CODE_INVALID_ARGUMENT,
+		created: nil,
+	},
+}
+
+func TestMkdirAll(t *testing.T) {
+	for _, tt := range mkdirAllTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tree := &fakeTree{resources: tt.existing}
+			res, err := mkdirAll(context.Background(), tt.path, tree.stat, tree.createContainer)
+			if err != nil {
+				t.Fatalf("mkdirAll() error = %v", err)
+			}
+			if res.Status.Code != tt.code {
+				t.Errorf("mkdirAll() code = %v, want %v", res.Status.Code, tt.code)
+			}
+			if !reflect.DeepEqual(tree.created, tt.created) {
+				t.Errorf("mkdirAll() created = %v, want %v", tree.created, tt.created)
+			}
+		})
+	}
+}
+
+var shareExpirationTests = []struct {
+	name     string
+	metadata map[string]string
+	out      string
+}{
+	{"expiring share", map[string]string{shareExpirationKey: "1600000000"}, "1600000000"},
+	{"non expiring share", nil, ""},
+	{"empty expiration", map[string]string{shareExpirationKey: ""}, ""},
+	{"invalid expiration", map[string]string{shareExpirationKey: "tomorrow"}, ""},
+}
+
+func TestShareExpiration(t *testing.T) {
+	for _, tt := range shareExpirationTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &provider.ResourceInfo{
+				Type:              provider.ResourceType_RESOURCE_TYPE_REFERENCE,
+				Path:              "/home/MyShares/photos",
+				ArbitraryMetadata: &provider.ArbitraryMetadata{Metadata: tt.metadata},
+			}
+			exp := shareExpiration(context.Background(), ref)
+			if exp != tt.out {
+				t.Errorf("expected %q, got %q", tt.out, exp)
+			}
+
+			o := withShareExpiration(nil, exp)
+			if tt.out == "" {
+				if o != nil {
+					t.Errorf("expected no opaque for non expiring share, got %v", o)
+				}
+				return
+			}
+			if string(o.Map[shareExpirationKey].Value) != tt.out {
+				t.Errorf("expected opaque expiration %q, got %v", tt.out, o)
+			}
+		})
+	}
+}
+
+var splitShareTests = []struct {
+	name      string
+	path      string
+	shareName string
+	child     string
+	err       bool
+}{
+	{"share child", "/home/MyShares/photos/Ibiza/beach.png", "/home/MyShares/photos", "/Ibiza/beach.png", false},
+	{"share name", "/home/MyShares/photos", "", "", true},
+	{"share folder", "/home/MyShares", "", "", true},
+	{"empty", "", "", "", true},
+}
+
+func TestSplitShare(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares"}}
+	for _, tt := range splitShareTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			shareName, child, err := s.splitShare(context.Background(), tt.path)
+			if (err != nil) != tt.err {
+				t.Fatalf("splitShare() error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "path:"+tt.path) {
+					t.Errorf("splitShare() error = %v, expected the path in the diagnostic", err)
+				}
+				return
+			}
+			if shareName != tt.shareName || child != tt.child {
+				t.Errorf("splitShare() = %v %v, want %v %v", shareName, child, tt.shareName, tt.child)
+			}
+		})
+	}
+}
+
+func TestSplitInvalidIndex(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares"}}
+	if _, err := s.split(context.Background(), "/home/MyShares", 1); err == nil {
+		t.Errorf("split() expected error for index < 2")
+	}
+}
+
+func TestSplitPaths(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares"}}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		path    string
+		folder  bool
+		share   bool
+		child   bool
+		wantErr bool
+	}{
+		{"root", "/", false, false, false, false},
+		{"home", "/home", false, false, false, false},
+		{"reference by id", "", false, false, false, false},
+		{"shared folder", "/home/MyShares", true, false, false, false},
+		{"share name", "/home/MyShares/photos", false, true, false, false},
+		{"share child", "/home/MyShares/photos/Ibiza/beach.png", false, false, true, false},
+		{"relative", "home/MyShares/photos", false, false, false, true},
+		{"nul byte", "/home/MyShares/pho\x00tos", false, false, false, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			folder, share, child, err := s.classifySharePath(ctx, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("classifySharePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if folder != tt.folder || share != tt.share || child != tt.child {
+				t.Errorf("classifySharePath() = %v, %v, %v, want %v, %v, %v", folder, share, child, tt.folder, tt.share, tt.child)
+			}
+		})
+	}
+}
+
+func TestMalformedSharePathInvalidArg(t *testing.T) {
+	s, stop := newTestGateway(t, newSharesStorage())
+	defer stop()
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/pho\x00tos"}}
+	res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_INVALID_ARGUMENT {
+		t.Errorf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_INVALID_ARGUMENT)
+	}
+}
+
+// TestSplitMalformedPaths feeds random paths to the split helpers to make
+// sure no panic escapes.
+func TestSplitMalformedPaths(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares"}}
+	ctx := context.Background()
+	tokens := []string{"/", "//", "home", "MyShares", "", ".", "..", "photos", " ", "a/b"}
+	r := rand.New(rand.NewSource(42))
+
+	for n := 0; n < 10000; n++ {
+		var b strings.Builder
+		for j := r.Intn(8); j > 0; j-- {
+			b.WriteString(tokens[r.Intn(len(tokens))])
+		}
+		p := b.String()
+
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("panic for path %q: %v", p, e)
+				}
+			}()
+			for i := 0; i < 6; i++ {
+				_, _ = s.split(ctx, p, i)
+			}
+			_, _, _, _ = s.classifySharePath(ctx, p)
+			_, _, _ = s.splitShare(ctx, p)
+		}()
+	}
+}
+
+func TestExcludeSharedFolder(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares"}}
+	ctx := context.Background()
+
+	var infos []*provider.ResourceInfo
+	list := func(ctx context.Context, req *provider.ListContainerRequest) (*provider.ListContainerResponse, error) {
+		if req.Ref.GetPath() != "/home/MyShares" {
+			t.Fatalf("unexpected listing of %s", req.Ref.GetPath())
+		}
+		return &provider.ListContainerResponse{Status: status.NewOK(ctx), Infos: infos}, nil
+	}
+	// the storage reports the size of the target of the references, stored by the owners
+	share := &provider.ResourceInfo{Path: "/home/MyShares/photos", Type: provider.ResourceType_RESOURCE_TYPE_REFERENCE, Size: 40}
+	file := func(size uint64) *provider.ResourceInfo {
+		return &provider.ResourceInfo{Path: "/home/MyShares/notes.txt", Type: provider.ResourceType_RESOURCE_TYPE_FILE, Size: size}
+	}
+
+	tests := []struct {
+		name  string
+		used  uint64
+		infos []*provider.ResourceInfo
+		out   uint64
+	}{
+		{"no shares", 100, nil, 100},
+		{"received shares", 100, []*provider.ResourceInfo{share}, 100},
+		{"resources stored in the shared folder", 100, []*provider.ResourceInfo{share, file(30)}, 70},
+		{"stored bigger than used", 10, []*provider.ResourceInfo{file(40)}, 0},
+	}
+
+	for _, tt := range tests {
+		infos = tt.infos
+		res := &provider.GetQuotaResponse{Status: status.NewOK(ctx), TotalBytes: 1000, UsedBytes: tt.used}
+		res, err := s.excludeSharedFolder(ctx, res, list)
+		if err != nil {
+			t.Fatalf("%s: excludeSharedFolder() error = %v", tt.name, err)
+		}
+		if res.UsedBytes != tt.out {
+			t.Errorf("%s: used bytes = %d, want %d", tt.name, res.UsedBytes, tt.out)
+		}
+		if res.TotalBytes != 1000 {
+			t.Errorf("%s: total bytes = %d, want 1000", tt.name, res.TotalBytes)
+		}
+	}
+}
+
+func TestWithCacheHints(t *testing.T) {
+	info := &provider.ResourceInfo{
+		Path:  "/home/photos/beach.png",
+		Type:  provider.ResourceType_RESOURCE_TYPE_FILE,
+		Etag:  "\"5f2a1b\"",
+		Mtime: &typespb.Timestamp{Seconds: 1590000000},
+	}
+
+	storageOpaque := &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			"eos": {Decoder: "plain", Value: []byte("x")},
+		},
+	}
+
+	o := withCacheHints(storageOpaque, info)
+	if string(o.Map["etag"].Value) != info.Etag {
+		t.Errorf("expected etag %s, got %s", info.Etag, o.Map["etag"].Value)
+	}
+	if string(o.Map["mtime"].Value) != "1590000000" {
+		t.Errorf("expected mtime 1590000000, got %s", o.Map["mtime"].Value)
+	}
+	if _, ok := o.Map["eos"]; !ok {
+		t.Errorf("expected the storage opaque to be kept, got %v", o)
+	}
+
+	if o := withCacheHints(nil, &provider.ResourceInfo{}); o != nil {
+		t.Errorf("expected no opaque without etag and mtime, got %v", o)
+	}
+}
+
+func TestGetDataGateway(t *testing.T) {
+	s := &svc{
+		c: &config{
+			DataGatewayEndpoint: "https://data.example.org/data",
+			DataGateways: map[string]string{
+				"eu-west": "https://data-eu.example.org/data",
+				"us-east": "https://data-us.example.org/data",
+			},
+		},
+	}
+
+	regionOf := func(region string) *registry.ProviderInfo {
+		return &registry.ProviderInfo{
+			Address: "localhost:17000",
+			Opaque: &typespb.Opaque{
+				Map: map[string]*typespb.OpaqueEntry{
+					"region": {Decoder: "plain", Value: []byte(region)},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		provider *registry.ProviderInfo
+		endpoint string
+	}{
+		{"same region", regionOf("eu-west"), "https://data-eu.example.org/data"},
+		{"other region", regionOf("us-east"), "https://data-us.example.org/data"},
+		{"unknown region", regionOf("ap-south"), "https://data.example.org/data"},
+		{"no region", &registry.ProviderInfo{Address: "localhost:17000"}, "https://data.example.org/data"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := s.getDataGateway(tt.provider)
+			if err != nil {
+				t.Fatalf("getDataGateway() error = %v", err)
+			}
+			if e != tt.endpoint {
+				t.Errorf("expected %s, got %s", tt.endpoint, e)
+			}
+		})
+	}
+}
+
+func TestMountEntry(t *testing.T) {
+	ref := &provider.ResourceInfo{
+		Type:   provider.ResourceType_RESOURCE_TYPE_REFERENCE,
+		Id:     &provider.ResourceId{StorageId: "home", OpaqueId: "mount-1"},
+		Path:   "/home/MyShares/photos",
+		Target: "cs3:eos/target-1",
+	}
+	target := &provider.ResourceInfo{
+		Type: provider.ResourceType_RESOURCE_TYPE_CONTAINER,
+		Id:   &provider.ResourceId{StorageId: "eos", OpaqueId: "target-1"},
+		Path: "/eos/user/p/peter/Holidays/photos",
+	}
+
+	info := mountEntry("/home/MyShares", ref, target)
+	if info.Path != "/home/MyShares/photos" {
+		t.Errorf("expected path /home/MyShares/photos, got %s", info.Path)
+	}
+	if info.Id.OpaqueId != "target-1" {
+		t.Errorf("expected target id target-1, got %v", info.Id)
+	}
+
+	e, ok := info.Opaque.GetMap()["mount_id"]
+	if !ok {
+		t.Fatalf("expected mount id in opaque, got %v", info.Opaque)
+	}
+	mountID := &provider.ResourceId{}
+	if err := json.Unmarshal(e.Value, mountID); err != nil {
+		t.Fatalf("error decoding mount id: %v", err)
+	}
+	if mountID.StorageId != "home" || mountID.OpaqueId != "mount-1" {
+		t.Errorf("expected mount id home/mount-1, got %v", mountID)
+	}
+}
+
+func TestShareNameCollidesWithFolder(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/photos/beach.png", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.add("/users/peter/music", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/music", "/users/peter/music")
+	storage.dataEndpoint = "http://127.0.0.1:19001/data"
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	// the regular folder takes precedence over share resolution
+	for _, p := range []string{"/home/MyShares/photos", "/home/MyShares/photos/beach.png"} {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", p, err)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			t.Fatalf("Stat(%s) code = %v, want %v", p, res.Status.Code, rpc.Code_CODE_OK)
+		}
+		if res.Info.Path != p {
+			t.Errorf("Stat(%s) path = %v", p, res.Info.Path)
+		}
+	}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+	res, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("ListContainer() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("ListContainer() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	got := map[string]string{}
+	for _, info := range res.Infos {
+		got[info.Path] = info.Id.OpaqueId
+	}
+	want := map[string]string{
+		"/home/MyShares/photos": "/home/MyShares/photos",
+		"/home/MyShares/music":  "/users/peter/music",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListContainer() entries = %v, want %v", got, want)
+	}
+
+	// and for all the other operations on the children and the name of the share
+	child := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+	down, err := s.InitiateFileDownload(context.Background(), &provider.InitiateFileDownloadRequest{Ref: child})
+	if err != nil {
+		t.Fatalf("InitiateFileDownload() error = %v", err)
+	}
+	if down.Status.Code != rpc.Code_CODE_OK || down.DownloadEndpoint != storage.dataEndpoint+"/home/MyShares/photos/beach.png" {
+		t.Errorf("InitiateFileDownload() = %v, want the download of the regular file", down)
+	}
+
+	del, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: child})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if del.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Delete() code = %v, want %v", del.Status.Code, rpc.Code_CODE_OK)
+	}
+	if _, ok := storage.lookup(child); ok {
+		t.Errorf("Delete() did not delete the regular file")
+	}
+
+	name := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+	del, err = s.Delete(context.Background(), &provider.DeleteRequest{Ref: name})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if del.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Delete() code = %v, want %v", del.Status.Code, rpc.Code_CODE_OK)
+	}
+	if _, ok := storage.lookup(name); ok {
+		t.Errorf("Delete() did not delete the regular folder")
+	}
+}
+
+func TestStatShareNameNotReference(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/photos/beach.png", provider.ResourceType_RESOURCE_TYPE_FILE)
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.ShareNameCollision = shareNameCollisionError
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+	res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_INTERNAL {
+		t.Errorf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_INTERNAL)
+	}
+
+	child := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+	down, err := s.InitiateFileDownload(context.Background(), &provider.InitiateFileDownloadRequest{Ref: child})
+	if err != nil {
+		t.Fatalf("InitiateFileDownload() error = %v", err)
+	}
+	if down.Status.Code != rpc.Code_CODE_INTERNAL {
+		t.Errorf("InitiateFileDownload() code = %v, want %v", down.Status.Code, rpc.Code_CODE_INTERNAL)
+	}
+
+	del, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: child})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if del.Status.Code != rpc.Code_CODE_INTERNAL {
+		t.Errorf("Delete() code = %v, want %v", del.Status.Code, rpc.Code_CODE_INTERNAL)
+	}
+	if _, ok := storage.lookup(child); !ok {
+		t.Errorf("Delete() deleted the colliding file")
+	}
+}
+
+func TestStatShareName(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+	res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	if res.Info.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER || res.Info.Path != "/home/MyShares/photos" {
+		t.Errorf("Stat() info = %v, want the target mounted at the share name", res.Info)
+	}
+}
+
+func TestStatShareChildResolutionCache(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays/a.jpg", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.add("/users/peter/Holidays/b.jpg", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.resolutionCache = newTTLCache(time.Minute, 10)
+	s.resolutionSem = make(chan struct{}, 1)
+
+	stat := func(p string) {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+		}
+	}
+
+	stat("/home/MyShares/photos/a.jpg")
+	first := storage.count("Stat")
+	stat("/home/MyShares/photos/b.jpg")
+	second := storage.count("Stat") - first
+
+	// only the child itself has to be stated again
+	if second != 1 {
+		t.Errorf("second share child stat hit the storage %d times, want 1 (first: %d)", second, first)
+	}
+}
+
+func TestResolutionCacheCopies(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.resolutionCache = newTTLCache(time.Minute, 10)
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+	var target string
+	for i := 0; i < 3; i++ {
+		res, err := s.statResolution(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("statResolution() error = %v", err)
+		}
+		if i == 0 {
+			target = res.Info.Target
+		}
+		if res.Info.Path != "/home/MyShares/photos" || res.Info.Target != target || res.Info.Opaque != nil {
+			t.Fatalf("statResolution() #%d info = %v, want the unchanged reference", i, res.Info)
+		}
+		if i > 0 && storage.count("Stat") != 1 {
+			t.Errorf("statResolution() #%d stated the storage again, want the cached result", i)
+		}
+
+		// the callers rewrite the results they get
+		res.Info.Path = "/home/MyShares/other"
+		res.Info.Target = "/users/marie/other"
+		res.Info.Opaque = &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{
+			"mount_id": {Decoder: "plain", Value: []byte("other")},
+		}}
+	}
+}
+
+// countingRegistry counts the lookups done in the wrapped storage registry.
+type countingRegistry struct {
+	StorageRegistry
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *countingRegistry) FindProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	return r.StorageRegistry.FindProvider(ctx, ref)
+}
+
+func TestListSharedFolderSameStorage(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	for _, name := range []string{"photos", "music", "docs"} {
+		storage.add("/users/peter/"+name, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		storage.addReference("/home/MyShares/"+name, "/users/peter/"+name)
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	reg := &countingRegistry{StorageRegistry: s.storageRegistry}
+	s.storageRegistry = reg
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+	res, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("ListContainer() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("ListContainer() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	if len(res.Infos) != 3 {
+		t.Fatalf("ListContainer() returned %d entries, want 3", len(res.Infos))
+	}
+
+	// the targets live in the storage of the shared folder, only the listing needs a lookup
+	if reg.calls != 1 {
+		t.Errorf("registry called %d times, want 1", reg.calls)
+	}
+}
+
+func TestListSharedFolderReshares(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	// two hops: einstein <- marie <- peter
+	storage.addReference("/users/marie/MyShares/Holidays", "/users/peter/Holidays")
+	storage.addReference("/home/MyShares/photos", "/users/marie/MyShares/Holidays")
+	// three hops: einstein <- richard <- marie <- peter
+	storage.addReference("/users/richard/MyShares/Holidays", "/users/marie/MyShares/Holidays")
+	storage.addReference("/home/MyShares/pictures", "/users/richard/MyShares/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.MaxReferenceHops = 2
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+	res, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("ListContainer() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("ListContainer() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+
+	// the share over the limit is left out
+	if len(res.Infos) != 1 {
+		t.Fatalf("ListContainer() returned %d entries, want 1", len(res.Infos))
+	}
+	info := res.Infos[0]
+	if info.Type != provider.ResourceType_RESOURCE_TYPE_CONTAINER || info.Id.OpaqueId != "/users/peter/Holidays" {
+		t.Errorf("ListContainer() entry = %v, want the ultimate target", info)
+	}
+	if info.Path != "/home/MyShares/photos" {
+		t.Errorf("ListContainer() path = %v, want /home/MyShares/photos", info.Path)
+	}
+}
+
+func TestReferenceLoop(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	// marie and richard reshare each other's share
+	storage.addReference("/users/marie/MyShares/loop", "/users/richard/MyShares/loop")
+	storage.addReference("/users/richard/MyShares/loop", "/users/marie/MyShares/loop")
+	storage.addReference("/home/MyShares/loop", "/users/marie/MyShares/loop")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	// the loop is detected long before the hop limit
+	s.c.MaxReferenceHops = 1000
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/loop"}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Errorf("Stat() error = %v", err)
+			return
+		}
+		if res.Status.Code == rpc.Code_CODE_OK {
+			t.Errorf("Stat() code = %v, want an error", res.Status.Code)
+		}
+
+		// the loop only hides the share from the listing
+		ref = &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+		lres, err := s.ListContainer(context.Background(), &provider.ListContainerRequest{Ref: ref})
+		if err != nil {
+			t.Errorf("ListContainer() error = %v", err)
+			return
+		}
+		if lres.Status.Code != rpc.Code_CODE_OK || len(lres.Infos) != 1 || lres.Infos[0].Path != "/home/MyShares/photos" {
+			t.Errorf("ListContainer() = %v, want only the photos share", lres)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("resolving a reference loop did not terminate")
+	}
+
+	// the reference, marie's and richard's reshares and marie's again for each request
+	if n := storage.count("Stat"); n > 10 {
+		t.Errorf("resolving the loop took %d stats", n)
+	}
+}
+
+func TestHandleRefLoopError(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.addReference("/a", "/b")
+	storage.addReference("/b", "/a")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.MaxReferenceHops = 1000
+
+	ri, _ := storage.lookup(&provider.Reference{Spec: &provider.Reference_Path{Path: "/a"}})
+	_, err := s.checkRef(context.Background(), ri)
+	if errors.Cause(err) != errReferenceLoop {
+		t.Fatalf("checkRef() error = %v, want %v", err, errReferenceLoop)
+	}
+	if !strings.Contains(err.Error(), "home//a -> home//b -> home//a") {
+		t.Errorf("checkRef() error = %v, expected the chain in the diagnostic", err)
+	}
+}
+
+func TestTransfersWithoutDataGateway(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/file.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/file.txt"}}
+	down, err := s.InitiateFileDownload(context.Background(), &provider.InitiateFileDownloadRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("InitiateFileDownload() error = %v", err)
+	}
+	if down.Status.Code != rpc.Code_CODE_INTERNAL || down.DownloadEndpoint != "" {
+		t.Errorf("InitiateFileDownload() = %v, want an internal error without endpoint", down)
+	}
+
+	up, err := s.InitiateFileUpload(context.Background(), &provider.InitiateFileUploadRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("InitiateFileUpload() error = %v", err)
+	}
+	if up.Status.Code != rpc.Code_CODE_INTERNAL || up.UploadEndpoint != "" {
+		t.Errorf("InitiateFileUpload() = %v, want an internal error without endpoint", up)
+	}
+}
+
+func TestTransferProtocols(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/file.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.protocols = []*transferProtocol{
+		{Protocol: "simple", Endpoint: "http://127.0.0.1:19001/data/simple/file.txt"},
+		{Protocol: "tus", Endpoint: "http://127.0.0.1:19001/data/tus/upload-id"},
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.DataGatewayEndpoint = "https://reva.example.org/datagateway"
+	s.c.TransferSharedSecret = "secret"
+	s.c.TransferExpires = 10
+	s.c.TransferMaxExpires = 10
+
+	// checkProtocols verifies that each protocol is routed to the data gateway with a token
+	// signing the endpoint of the provider.
+	checkProtocols := func(t *testing.T, o *typespb.Opaque) {
+		var protocols []*transferProtocol
+		if err := json.Unmarshal(o.GetMap()[protocolsKey].GetValue(), &protocols); err != nil {
+			t.Fatalf("error decoding protocols: %v", err)
+		}
+		if len(protocols) != len(storage.protocols) {
+			t.Fatalf("got %d protocols, want %d", len(protocols), len(storage.protocols))
+		}
+		for i, p := range protocols {
+			if p.Protocol != storage.protocols[i].Protocol || p.Endpoint != s.c.DataGatewayEndpoint {
+				t.Errorf("protocol %d = %+v, want %s routed to the data gateway", i, p, storage.protocols[i].Protocol)
+			}
+			claims := &transferClaims{}
+			_, err := jwt.ParseWithClaims(p.Token, claims, func(token *jwt.Token) (interface{}, error) {
+				return []byte("secret"), nil
+			})
+			if err != nil {
+				t.Fatalf("error parsing the token of protocol %s: %v", p.Protocol, err)
+			}
+			if claims.Target != storage.protocols[i].Endpoint {
+				t.Errorf("token of protocol %s signs %s, want %s", p.Protocol, claims.Target, storage.protocols[i].Endpoint)
+			}
+		}
+	}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/file.txt"}}
+	down, err := s.InitiateFileDownload(context.Background(), &provider.InitiateFileDownloadRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("InitiateFileDownload() error = %v", err)
+	}
+	if down.Status.Code != rpc.Code_CODE_OK || down.Token == "" {
+		t.Fatalf("InitiateFileDownload() = %v, want a signed download", down)
+	}
+	checkProtocols(t, down.Opaque)
+
+	up, err := s.InitiateFileUpload(context.Background(), &provider.InitiateFileUploadRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("InitiateFileUpload() error = %v", err)
+	}
+	if up.Status.Code != rpc.Code_CODE_OK || up.Token == "" {
+		t.Fatalf("InitiateFileUpload() = %v, want a signed upload", up)
+	}
+	checkProtocols(t, up.Opaque)
+}
+
+func TestShareResolutionErrors(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	// the owner deleted the shared folder
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	tests := []struct {
+		name string
+		path string
+		code rpc.Code
+		err  string
+	}{
+		{"missing mount", "/home/MyShares/music", rpc.Code_CODE_NOT_FOUND, "share_not_mounted"},
+		{"missing mount child", "/home/MyShares/music/song.mp3", rpc.Code_CODE_NOT_FOUND, "share_not_mounted"},
+		{"missing target", "/home/MyShares/photos", rpc.Code_CODE_FAILED_PRECONDITION, "share_target_not_found"},
+		{"missing target child", "/home/MyShares/photos/beach.png", rpc.Code_CODE_FAILED_PRECONDITION, "share_target_not_found"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.path}}
+			res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if res.Status.Code != tt.code {
+				t.Errorf("Stat() code = %v, want %v", res.Status.Code, tt.code)
+			}
+			if e := res.GetOpaque().GetMap()["error"]; e == nil || string(e.Value) != tt.err {
+				t.Errorf("Stat() opaque = %v, want error %s", res.Opaque, tt.err)
+			}
+		})
+	}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+	res, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_FAILED_PRECONDITION {
+		t.Errorf("Delete() code = %v, want %v", res.Status.Code, rpc.Code_CODE_FAILED_PRECONDITION)
+	}
+}
+
+func TestShareResolutionCanceled(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/richard/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/richard/Holidays/beach.png", provider.ResourceType_RESOURCE_TYPE_FILE)
+	// marie reshares richard's folder
+	storage.addReference("/users/marie/MyShares/photos", "/users/richard/Holidays")
+	storage.addReference("/home/MyShares/photos", "/users/marie/MyShares/photos")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) (*rpc.Status, error)
+	}{
+		{"stat", func(ctx context.Context) (*rpc.Status, error) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+			res, err := s.Stat(ctx, &provider.StatRequest{Ref: ref})
+			return res.GetStatus(), err
+		}},
+		{"list container", func(ctx context.Context) (*rpc.Status, error) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+			res, err := s.ListContainer(ctx, &provider.ListContainerRequest{Ref: ref})
+			return res.GetStatus(), err
+		}},
+		{"delete", func(ctx context.Context) (*rpc.Status, error) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+			res, err := s.Delete(ctx, &provider.DeleteRequest{Ref: ref})
+			return res.GetStatus(), err
+		}},
+		{"move", func(ctx context.Context) (*rpc.Status, error) {
+			src := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/beach.png"}}
+			dst := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/sea.png"}}
+			res, err := s.Move(ctx, &provider.MoveRequest{Source: src, Destination: dst})
+			return res.GetStatus(), err
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// the client goes away while the first reference is being followed
+			storage.onStat = func(ref *provider.Reference) {
+				if ref.GetId() != nil {
+					cancel()
+				}
+			}
+			defer func() { storage.onStat = nil }()
+			before := storage.count("Stat")
+
+			st, err := tt.call(ctx)
+			if err != nil {
+				t.Fatalf("%s error = %v", tt.name, err)
+			}
+			if st.GetCode() != rpc.Code_CODE_CANCELLED {
+				t.Errorf("%s code = %v, want %v", tt.name, st.GetCode(), rpc.Code_CODE_CANCELLED)
+			}
+			// the share name and at most the first hop, never richard's folder
+			if n := storage.count("Stat") - before; n > 2 {
+				t.Errorf("%s took %d stats after the request was canceled", tt.name, n)
+			}
+			for _, m := range []string{"ListContainer", "Delete", "Move"} {
+				if n := storage.count(m); n != 0 {
+					t.Errorf("%s forwarded %d %s calls to the storage", tt.name, n, m)
+				}
+			}
+		})
+	}
+}
+
+func TestUntrustedShareTarget(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/Holidays", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/Holidays")
+	// a crafted reference pointing to a storage the share was not created for
+	storage.addReference("/home/MyShares/secrets", "/users/peter/Holidays").Target = "cs3:admin//etc"
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.TrustedReferenceTargets = []string{"home"}
+
+	tests := []struct {
+		path string
+		code rpc.Code
+	}{
+		{"/home/MyShares/photos", rpc.Code_CODE_OK},
+		{"/home/MyShares/secrets", rpc.Code_CODE_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.path}}
+		res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if res.Status.Code != tt.code {
+			t.Errorf("Stat(%s) code = %v, want %v", tt.path, res.Status.Code, tt.code)
+		}
+	}
+}
+
+func TestGetHome(t *testing.T) {
+	withHome := &userpb.User{
+		Id:       &userpb.UserId{OpaqueId: "einstein"},
+		Username: "einstein",
+		Opaque: &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				"home": {Decoder: "plain", Value: []byte("/eos/project/migrated/einstein")},
+			},
+		},
+	}
+	withoutHome := &userpb.User{
+		Id:       &userpb.UserId{OpaqueId: "marie"},
+		Username: "marie",
+	}
+	layout := "/eos/user/{{substr 0 1 .Username}}/{{.Username}}"
+
+	tests := []struct {
+		name string
+		c    *config
+		u    *userpb.User
+		home string
+	}{
+		{"attribute", &config{HomeAttribute: "home", HomeLayout: layout}, withHome, "/eos/project/migrated/einstein"},
+		{"layout", &config{HomeAttribute: "home", HomeLayout: layout}, withoutHome, "/eos/user/m/marie"},
+		{"default", &config{HomeAttribute: "home"}, withoutHome, "/home"},
+		{"legacy default", &config{}, withHome, "/home"},
+		{"username layout", &config{HomeLayout: "/home/{{.Username}}"}, withoutHome, "/home/marie"},
+		{"relative layout", &config{HomeLayout: "users/{{.Id.OpaqueId}}"}, withoutHome, "/users/marie"},
+		{"no user", &config{HomeAttribute: "home", HomeLayout: layout}, nil, "/home"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &svc{c: tt.c}
+			ctx := context.Background()
+			if tt.u != nil {
+				ctx = user.ContextSetUser(ctx, tt.u)
+			}
+			if home := s.getHome(ctx); home != tt.home {
+				t.Errorf("getHome() = %v, want %v", home, tt.home)
+			}
+		})
+	}
+}
+
+func TestSplitShareAttributeHome(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares", HomeAttribute: "home"}}
+	ctx := user.ContextSetUser(context.Background(), &userpb.User{
+		Id:       &userpb.UserId{OpaqueId: "einstein"},
+		Username: "einstein",
+		Opaque: &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				"home": {Decoder: "plain", Value: []byte("/eos/project/migrated/einstein")},
+			},
+		},
+	})
+
+	if ok, err := s.isShareChild(ctx, "/eos/project/migrated/einstein/MyShares/photos/Ibiza/beach.png"); err != nil || !ok {
+		t.Fatalf("isShareChild() = %v, %v, want true", ok, err)
+	}
+	shareName, shareChild, err := s.splitShare(ctx, "/eos/project/migrated/einstein/MyShares/photos/Ibiza/beach.png")
+	if err != nil {
+		t.Fatalf("splitShare() error = %v", err)
+	}
+	if shareName != "/eos/project/migrated/einstein/MyShares/photos" || shareChild != "/Ibiza/beach.png" {
+		t.Errorf("splitShare() = %v, %v", shareName, shareChild)
+	}
+	if ok, err := s.isShareName(ctx, "/eos/project/migrated/einstein/MyShares/photos"); err != nil || !ok {
+		t.Errorf("isShareName() = %v, %v, want true", ok, err)
+	}
+}
+
+func TestSplitShareLayoutHome(t *testing.T) {
+	s := &svc{c: &config{ShareFolder: "MyShares", HomeLayout: "/eos/user/{{substr 0 1 .Username}}/{{.Username}}"}}
+	ctx := user.ContextSetUser(context.Background(), &userpb.User{Id: &userpb.UserId{OpaqueId: "einstein"}, Username: "einstein"})
+
+	if ok, err := s.isShareChild(ctx, "/eos/user/e/einstein/MyShares/photos/Ibiza/beach.png"); err != nil || !ok {
+		t.Fatalf("isShareChild() = %v, %v, want true", ok, err)
+	}
+	shareName, shareChild, err := s.splitShare(ctx, "/eos/user/e/einstein/MyShares/photos/Ibiza/beach.png")
+	if err != nil {
+		t.Fatalf("splitShare() error = %v", err)
+	}
+	if shareName != "/eos/user/e/einstein/MyShares/photos" || shareChild != "/Ibiza/beach.png" {
+		t.Errorf("splitShare() = %v, %v", shareName, shareChild)
+	}
+	if ok, err := s.isShareName(ctx, "/eos/user/e/einstein/MyShares/photos"); err != nil || !ok {
+		t.Errorf("isShareName() = %v, %v, want true", ok, err)
+	}
+}
+
+func TestSharedFolderLayoutHome(t *testing.T) {
+	tests := []struct {
+		name         string
+		layout       string
+		sharedFolder string
+		shareName    string
+		notShared    string
+	}{
+		{"legacy default", "", "/home/MyShares", "/home/MyShares/photos", "/home/photos"},
+		{"username layout", "/home/{{.Username}}", "/home/einstein/MyShares", "/home/einstein/MyShares/photos", "/home/MyShares/photos"},
+		{"nested layout", "/users/{{substr 0 1 .Username}}/{{.Username}}", "/users/e/einstein/MyShares", "/users/e/einstein/MyShares/photos", "/users/e/MyShares"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &svc{c: &config{ShareFolder: "MyShares", HomeLayout: tt.layout}}
+			ctx := user.ContextSetUser(context.Background(), &userpb.User{Id: &userpb.UserId{OpaqueId: "einstein"}, Username: "einstein"})
+
+			if p := s.getSharedFolder(ctx); p != tt.sharedFolder {
+				t.Errorf("getSharedFolder() = %v, want %v", p, tt.sharedFolder)
+			}
+			if ok, err := s.isSharedFolder(ctx, tt.sharedFolder); err != nil || !ok {
+				t.Errorf("isSharedFolder(%s) = %v, %v, want true", tt.sharedFolder, ok, err)
+			}
+			if ok, err := s.isShareName(ctx, tt.shareName); err != nil || !ok {
+				t.Errorf("isShareName(%s) = %v, %v, want true", tt.shareName, ok, err)
+			}
+			if s.inSharedFolder(ctx, tt.notShared) {
+				t.Errorf("inSharedFolder(%s) = true, want false", tt.notShared)
+			}
+		})
+	}
+}
+
+func TestCheckTransferExpires(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       config
+		expires int64
+		wantErr bool
+	}{
+		{"within max", config{TransferExpires: 10, TransferMaxExpires: 60}, 10, false},
+		{"capped", config{TransferExpires: 7200, TransferMaxExpires: 3600}, 3600, false},
+		{"zero", config{TransferExpires: 0, TransferMaxExpires: 3600}, 0, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.checkTransferExpires()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkTransferExpires() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.c.TransferExpires != tt.expires {
+				t.Errorf("expected transfer_expires %d, got %d", tt.expires, tt.c.TransferExpires)
+			}
+		})
+	}
+}
+
+func TestNewNegativeConcurrentResolutions(t *testing.T) {
+	srv, err := New(map[string]interface{}{
+		"max_concurrent_resolutions": -1,
+		"token_managers":             map[string]map[string]interface{}{"jwt": {"secret": "secret"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer srv.Close()
+
+	if n := cap(srv.(*svc).resolutionSem); n != 100 {
+		t.Errorf("New() allows %d concurrent resolutions, want the default 100", n)
+	}
+}
+
+func TestNewTransferClockSkew(t *testing.T) {
+	tests := []struct {
+		name string
+		skew interface{}
+		want int64
+	}{
+		{"unset", nil, 5},
+		{"zero", 0, 5},
+		{"configured", 30, 30},
+		{"disabled", -1, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			conf := map[string]interface{}{
+				"token_managers": map[string]map[string]interface{}{"jwt": {"secret": "secret"}},
+			}
+			if tt.skew != nil {
+				conf["transfer_clock_skew"] = tt.skew
+			}
+			srv, err := New(conf, nil)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer srv.Close()
+
+			if skew := srv.(*svc).c.TransferClockSkew; skew != tt.want {
+				t.Errorf("New() transfer clock skew = %d, want %d", skew, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignNotBefore(t *testing.T) {
+	s := &svc{c: &config{TransferSharedSecret: "secret", TransferExpires: 10, TransferClockSkew: 5}}
+	tkn, err := s.sign(context.Background(), "http://127.0.0.1:19001/data/file", downloadMethods, 0, "", 10)
+	if err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+
+	claims := &transferClaims{}
+	_, err = jwt.ParseWithClaims(tkn, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("secret"), nil
+	})
+	if err != nil {
+		t.Fatalf("ParseWithClaims() error = %v", err)
+	}
+
+	if claims.NotBefore != claims.IssuedAt-5 {
+		t.Errorf("expected nbf %d, got %d", claims.IssuedAt-5, claims.NotBefore)
+	}
+	if claims.ExpiresAt != claims.IssuedAt+10 {
+		t.Errorf("expected exp %d, got %d", claims.IssuedAt+10, claims.ExpiresAt)
+	}
+}
+
+func TestTransferExpires(t *testing.T) {
+	s := &svc{c: &config{TransferSharedSecret: "secret", TransferExpires: 10, TransferMaxExpires: 3600}}
+	ttl := func(v string) *typespb.Opaque {
+		return &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{transferTTLKey: {Decoder: "plain", Value: []byte(v)}}}
+	}
+
+	tests := []struct {
+		name    string
+		opaque  *typespb.Opaque
+		expires int64
+	}{
+		{"default", nil, 10},
+		{"other opaque", &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"Upload-Length": {Decoder: "plain", Value: []byte("42")}}}, 10},
+		{"requested", ttl("600"), 600},
+		{"shorter", ttl("5"), 5},
+		{"clamped", ttl("86400"), 3600},
+		{"invalid", ttl("forever"), 10},
+		{"zero", ttl("0"), 10},
+		{"negative", ttl("-60"), 10},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			expires := s.transferExpires(context.Background(), tt.opaque)
+			if expires != tt.expires {
+				t.Fatalf("transferExpires() = %d, want %d", expires, tt.expires)
+			}
+
+			// the token lives as long as requested
+			tkn, err := s.sign(context.Background(), "http://127.0.0.1:19001/data/file", downloadMethods, 0, "", expires)
+			if err != nil {
+				t.Fatalf("sign() error = %v", err)
+			}
+			claims := &transferClaims{}
+			if _, err := jwt.ParseWithClaims(tkn, claims, func(token *jwt.Token) (interface{}, error) {
+				return []byte("secret"), nil
+			}); err != nil {
+				t.Fatalf("ParseWithClaims() error = %v", err)
+			}
+			if claims.ExpiresAt != claims.IssuedAt+tt.expires {
+				t.Errorf("expected exp %d, got %d", claims.IssuedAt+tt.expires, claims.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestSignTransferClaims(t *testing.T) {
+	s := &svc{c: &config{TransferSharedSecret: "secret", TransferExpires: 10}}
+
+	parse := func(tkn string) *transferClaims {
+		claims := &transferClaims{}
+		_, err := jwt.ParseWithClaims(tkn, claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte("secret"), nil
+		})
+		if err != nil {
+			t.Fatalf("ParseWithClaims() error = %v", err)
+		}
+		return claims
+	}
+
+	target := "http://127.0.0.1:19001/data/file"
+	first, err := s.sign(context.Background(), target, uploadMethods, 42, "", 10)
+	if err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+	second, err := s.sign(context.Background(), target, uploadMethods, 42, "", 10)
+	if err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+
+	claims := parse(first)
+	if claims.V != transferClaimsVersion {
+		t.Errorf("expected version %d, got %d", transferClaimsVersion, claims.V)
+	}
+	if claims.Target != target || claims.Length != 42 || !reflect.DeepEqual(claims.Methods, uploadMethods) {
+		t.Errorf("sign() claims = %+v, want target %s, length 42 and methods %v", claims, target, uploadMethods)
+	}
+	if claims.Nonce == "" || claims.Nonce == parse(second).Nonce {
+		t.Errorf("expected a unique nonce, got %q", claims.Nonce)
+	}
+}
+
+func TestUploadLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		opaque *typespb.Opaque
+		length int64
+	}{
+		{"missing", nil, 0},
+		{"set", &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"Upload-Length": {Decoder: "plain", Value: []byte("42")}}}, 42},
+		{"invalid", &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"Upload-Length": {Decoder: "plain", Value: []byte("big")}}}, 0},
+		{"negative", &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"Upload-Length": {Decoder: "plain", Value: []byte("-1")}}}, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if l := uploadLength(tt.opaque); l != tt.length {
+				t.Errorf("uploadLength() = %d, want %d", l, tt.length)
+			}
+		})
+	}
+}
+
+func TestProviderMemo(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	names := []string{"photos", "music", "docs"}
+	for _, name := range names {
+		storage.add("/users/peter/"+name, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		storage.addReference("/home/MyShares/"+name, "/users/peter/"+name)
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	reg := &countingRegistry{StorageRegistry: s.storageRegistry}
+	s.storageRegistry = reg
+
+	// a batch request touching all the shares of the shared folder
+	batch := func(ctx context.Context) {
+		for _, name := range names {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/" + name}}
+			res, err := s.Stat(ctx, &provider.StatRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+		}
+	}
+
+	// the shared folder is resolved by path and the targets by storage id
+	batch(s.withProviderMemo(context.Background()))
+	if reg.calls != 2 {
+		t.Errorf("registry called %d times in a request, want 2", reg.calls)
+	}
+
+	// every request resolves the providers again
+	batch(s.withProviderMemo(context.Background()))
+	if reg.calls != 4 {
+		t.Errorf("registry called %d times in two requests, want 4", reg.calls)
+	}
+}
+
+func TestStatMemo(t *testing.T) {
+	storage := newSharesStorage()
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	stat := func(ctx context.Context, p string) {
+		t.Helper()
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+		res, err := s.Stat(ctx, &provider.StatRequest{Ref: ref})
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if res.Status.Code != rpc.Code_CODE_OK {
+			t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+		}
+	}
+
+	ctx := s.withStatMemo(context.Background())
+	stat(ctx, "/home/MyShares/photos/Ibiza")
+	stats := storage.count("Stat")
+	stat(ctx, "/home/MyShares/photos/Ibiza")
+	if got := storage.count("Stat"); got != stats {
+		t.Errorf("Stat() called the provider %d times again in the same request, want 0", got-stats)
+	}
+
+	// changes in the storage are seen by the next stats of the request
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/Documents"}}
+	if _, err := s.CreateContainer(ctx, &provider.CreateContainerRequest{Ref: ref}); err != nil {
+		t.Fatalf("CreateContainer() error = %v", err)
+	}
+	stat(ctx, "/home/MyShares/photos/Ibiza")
+	if got := storage.count("Stat"); got != 2*stats {
+		t.Errorf("Stat() called the provider %d times after a change, want %d", got-stats, stats)
+	}
+
+	// other requests do not share the memo
+	stat(context.Background(), "/home/MyShares/photos/Ibiza")
+	if got := storage.count("Stat"); got != 3*stats {
+		t.Errorf("Stat() called the provider %d times in another request, want %d", got-2*stats, stats)
+	}
+
+	s.c.DisableStatMemo = true
+	ctx = s.withStatMemo(context.Background())
+	stat(ctx, "/home/MyShares/photos/Ibiza")
+	stat(ctx, "/home/MyShares/photos/Ibiza")
+	if got := storage.count("Stat"); got != 5*stats {
+		t.Errorf("Stat() called the provider %d times with the memo disabled, want %d", got-3*stats, 2*stats)
+	}
+}
+
+func BenchmarkStatMemo(b *testing.B) {
+	for _, disabled := range []bool{true, false} {
+		name := "memo"
+		if disabled {
+			name = "nomemo"
+		}
+		b.Run(name, func(b *testing.B) {
+			storage := newSharesStorage()
+			s, stop := newTestGateway(b, storage)
+			defer stop()
+			s.c.DisableStatMemo = disabled
+
+			// a webdav propfind stats the nested share and then its parents
+			paths := []string{"/home/MyShares/photos/Ibiza", "/home/MyShares/photos", "/home/MyShares/photos/Ibiza"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ctx := s.withStatMemo(context.Background())
+				for _, p := range paths {
+					ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+					if _, err := s.Stat(ctx, &provider.StatRequest{Ref: ref}); err != nil {
+						b.Fatalf("Stat() error = %v", err)
+					}
+				}
+			}
+			b.ReportMetric(float64(storage.count("Stat"))/float64(b.N), "stats/op")
+		})
+	}
+}
+
+func TestProviderCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		open  bool
+		calls int
+	}{
+		{"cached", time.Minute, false, 2},
+		{"disabled", -1, false, 4},
+		{"unhealthy provider", time.Minute, true, 4},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, stop := newTestGateway(t, newSharesStorage())
+			defer stop()
+			reg := &countingRegistry{StorageRegistry: s.storageRegistry}
+			s.storageRegistry = reg
+			s.providerCache = newTTLCache(tt.ttl, 100)
+			s.breaker = newCircuitBreaker(1, time.Minute)
+
+			for i := 0; i < 2; i++ {
+				ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+				res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+				if err != nil {
+					t.Fatalf("Stat() error = %v", err)
+				}
+				if res.Status.Code != rpc.Code_CODE_OK {
+					t.Fatalf("Stat() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+				}
+				if tt.open {
+					// the cached providers go down after the first stat
+					for _, e := range s.providerCache.entries {
+						s.breaker.record(e.value.(*registry.ProviderInfo).Address, gstatus.Error(codes.Unavailable, "down"))
+					}
+				}
+			}
+
+			if reg.calls != tt.calls {
+				t.Errorf("registry called %d times, want %d", reg.calls, tt.calls)
+			}
+		})
+	}
+}
+
+// userRegistry routes every path to a provider of its own for each user.
+type userRegistry struct {
+	StorageRegistry
+}
+
+func (r *userRegistry) FindProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
+	u, _ := user.ContextGetUser(ctx)
+	return &registry.ProviderInfo{ProviderPath: "/", Address: "storage-" + u.GetId().GetOpaqueId()}, nil
+}
+
+func TestProviderCachePerUser(t *testing.T) {
+	s, stop := newTestGateway(t, newSharesStorage())
+	defer stop()
+	s.storageRegistry = &userRegistry{StorageRegistry: s.storageRegistry}
+	s.providerCache = newTTLCache(time.Minute, 100)
+
+	for _, id := range []string{"einstein", "marie", "einstein"} {
+		ctx := user.ContextSetUser(context.Background(), &userpb.User{Id: &userpb.UserId{Idp: "cernbox", OpaqueId: id}})
+		ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/eos/project/data"}}
+		p, err := s.findProvider(ctx, ref)
+		if err != nil {
+			t.Fatalf("findProvider() error = %v", err)
+		}
+		if want := "storage-" + id; p.Address != want {
+			t.Errorf("findProvider() for %s = %s, want %s", id, p.Address, want)
+		}
+	}
+}
+
+// BenchmarkStatProviderCache stats the same tree repeatedly and reports the
+// registry lookups done per stat.
+func BenchmarkStatProviderCache(b *testing.B) {
+	for _, ttl := range []time.Duration{-1, time.Minute} {
+		name := "uncached"
+		if ttl > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, stop := newTestGateway(b, newSharesStorage())
+			defer stop()
+			reg := &countingRegistry{StorageRegistry: s.storageRegistry}
+			s.storageRegistry = reg
+			s.providerCache = newTTLCache(ttl, 100)
+
+			paths := []string{"/home", "/home/MyShares", "/home/MyShares/photos", "/home/MyShares/photos/Ibiza"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ref := &provider.Reference{Spec: &provider.Reference_Path{Path: paths[i%len(paths)]}}
+				if _, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref}); err != nil {
+					b.Fatalf("Stat() error = %v", err)
+				}
+			}
+			b.ReportMetric(float64(reg.calls)/float64(b.N), "lookups/op")
+		})
+	}
+}
+
+func TestListShareRecycle(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/home/MyShares/photos", "/users/peter/photos")
+	// a folder named as the shared folder outside the home holds no share
+	storage.add("/other/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/other/MyShares/photos", "/users/peter/photos")
+	storage.recycle = []*provider.RecycleItem{
+		{Key: "1", Path: "/users/peter/photos/Ibiza/beach.png"},
+		{Key: "2", Path: "/users/peter/photos/Paris/tower.png"},
+		{Key: "3", Path: "/users/peter/photosbackup/old.png"},
+		{Key: "4", Path: "/home/Documents/reports"},
+		// the bin of the target holds items outside the share, never listed in the share
+		{Key: "5", Path: "/users/peter/photos/../private/diary.txt"},
+		{Key: "6", Path: ""},
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	tests := []struct {
+		name string
+		path string
+		want map[string]string
+	}{
+		{"home", "/home", map[string]string{
+			"1": "/users/peter/photos/Ibiza/beach.png",
+			"2": "/users/peter/photos/Paris/tower.png",
+			"3": "/users/peter/photosbackup/old.png",
+			"4": "/home/Documents/reports",
+			"5": "/users/peter/photos/../private/diary.txt",
+			"6": "",
+		}},
+		{"share name", "/home/MyShares/photos", map[string]string{
+			"1": "/home/MyShares/photos/Ibiza/beach.png",
+			"2": "/home/MyShares/photos/Paris/tower.png",
+		}},
+		{"outside the home", "/other/MyShares/photos", map[string]string{
+			"1": "/users/peter/photos/Ibiza/beach.png",
+			"2": "/users/peter/photos/Paris/tower.png",
+			"3": "/users/peter/photosbackup/old.png",
+			"4": "/home/Documents/reports",
+			"5": "/users/peter/photos/../private/diary.txt",
+			"6": "",
+		}},
+		{"share child", "/home/MyShares/photos/Ibiza", map[string]string{
+			"1": "/home/MyShares/photos/Ibiza/beach.png",
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.path}}
+			res, err := s.ListRecycle(context.Background(), &gateway.ListRecycleRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("ListRecycle() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("ListRecycle() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+
+			got := map[string]string{}
+			for _, item := range res.RecycleItems {
+				got[item.Key] = item.Path
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetQuota(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER).Size = 7
+	storage.add("/users/peter/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER).Size = 4
+	// the storage reports the size of the target of the reference, which it does not store
+	storage.addReference("/home/MyShares/photos", "/users/peter/photos").Size = 4
+	storage.add("/home/MyShares/notes.txt", provider.ResourceType_RESOURCE_TYPE_FILE).Size = 3
+	// a folder named as the shared folder outside the home holds no share
+	storage.add("/other", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/other/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/other/MyShares/photos", "/users/peter/photos")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	tests := []struct {
+		name string
+		ref  *provider.Reference
+		path string
+		used uint64
+	}{
+		{"outside the home", &provider.Reference{Spec: &provider.Reference_Path{Path: "/other/MyShares/photos"}}, "/other/MyShares/photos", 10},
+		{"home by default", nil, "/home", 7},
+		{"home by id", &provider.Reference{Spec: &provider.Reference_Id{Id: &provider.ResourceId{StorageId: "home", OpaqueId: "/home"}}}, "", 7},
+		{"outside the home by id", &provider.Reference{Spec: &provider.Reference_Id{Id: &provider.ResourceId{StorageId: "home", OpaqueId: "/other"}}}, "", 10},
+		{"share name", &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}, "/users/peter/photos", 10},
+		{"share child", &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos/Ibiza"}}, "/users/peter/photos/Ibiza", 10},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.GetQuota(context.Background(), &gateway.GetQuotaRequest{Ref: tt.ref})
+			if err != nil {
+				t.Fatalf("GetQuota() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("GetQuota() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+			if res.TotalBytes != 100 || res.UsedBytes != tt.used {
+				t.Errorf("GetQuota() = %d/%d, want %d/100", res.UsedBytes, res.TotalBytes, tt.used)
+			}
+
+			storage.Lock()
+			forwarded := storage.quotaRequests[len(storage.quotaRequests)-1]
+			storage.Unlock()
+			if p := string(forwarded.GetOpaque().GetMap()["path"].GetValue()); p != tt.path {
+				t.Errorf("GetQuota() forwarded path %s, want %s", p, tt.path)
+			}
+		})
+	}
+}
+
+// TestPathologicalPaths feeds malformed paths to the path routed handlers to
+// make sure they fail with a status instead of a panic.
+func TestPathologicalPaths(t *testing.T) {
+	s, stop := newTestGateway(t, newSharesStorage())
+	defer stop()
+
+	paths := []string{
+		"",
+		"/",
+		"///",
+		"home",
+		"/home/",
+		"/home/MyShares/",
+		"/home/MyShares//",
+		"/home/MySharesX",
+		"/home/MySharesX/photos",
+		"/home/MyShares//photos",
+		"/home/MyShares/photos/",
+		"/home/MyShares/photos//Ibiza/",
+		"/home/MyShares/../MyShares/photos",
+	}
+
+	for _, p := range paths {
+		p := p
+		t.Run(p, func(t *testing.T) {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("panic for path %q: %v", p, e)
+				}
+			}()
+
+			ctx := context.Background()
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: p}}
+			dst := &provider.Reference{Spec: &provider.Reference_Path{Path: path.Join(p, "moved")}}
+
+			if _, err := s.Stat(ctx, &provider.StatRequest{Ref: ref}); err != nil {
+				t.Errorf("Stat() error = %v", err)
+			}
+			if _, err := s.ListContainer(ctx, &provider.ListContainerRequest{Ref: ref}); err != nil {
+				t.Errorf("ListContainer() error = %v", err)
+			}
+			_, _ = s.CreateContainer(ctx, &provider.CreateContainerRequest{Ref: ref})
+			_, _ = s.Delete(ctx, &provider.DeleteRequest{Ref: ref})
+			_, _ = s.Move(ctx, &provider.MoveRequest{Source: ref, Destination: dst})
+			_, _ = s.InitiateFileUpload(ctx, &provider.InitiateFileUploadRequest{Ref: ref})
+			_, _ = s.InitiateFileDownload(ctx, &provider.InitiateFileDownloadRequest{Ref: ref})
+		})
+	}
+}
+
+func TestUnknownPathStatus(t *testing.T) {
+	st := unknownPathStatus(context.Background(), "stat", "/home/MyShares/x")
+	if st.Code != rpc.Code_CODE_INVALID_ARGUMENT {
+		t.Errorf("unknownPathStatus() code = %v, want %v", st.Code, rpc.Code_CODE_INVALID_ARGUMENT)
+	}
+	if !strings.Contains(st.Message, "/home/MyShares/x") {
+		t.Errorf("unknownPathStatus() message = %v, expected the path in the diagnostic", st.Message)
+	}
+}
+
+func TestLockTokenForwarded(t *testing.T) {
+	lock := &typespb.Opaque{
+		Map: map[string]*typespb.OpaqueEntry{
+			lockTokenKey: {Decoder: "plain", Value: []byte("opaquelocktoken:1234")},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		opaque *typespb.Opaque
+		call   func(s *svc, o *typespb.Opaque) (*rpc.Status, error)
+		sent   func(f *fakeStorage) *typespb.Opaque
+	}{
+		{
+			name:   "delete",
+			opaque: lock,
+			call: func(s *svc, o *typespb.Opaque) (*rpc.Status, error) {
+				res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: pathRef("/home/Documents")})
+				return res.GetStatus(), err
+			},
+			sent: func(f *fakeStorage) *typespb.Opaque { return f.deleteRequests[len(f.deleteRequests)-1].Opaque },
+		},
+		{
+			name:   "delete share child",
+			opaque: lock,
+			call: func(s *svc, o *typespb.Opaque) (*rpc.Status, error) {
+				res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: pathRef("/home/MyShares/photos/Ibiza")})
+				return res.GetStatus(), err
+			},
+			sent: func(f *fakeStorage) *typespb.Opaque { return f.deleteRequests[len(f.deleteRequests)-1].Opaque },
+		},
+		{
+			name:   "delete share name",
+			opaque: lock,
+			call: func(s *svc, o *typespb.Opaque) (*rpc.Status, error) {
+				res, err := s.Delete(context.Background(), &provider.DeleteRequest{Opaque: o, Ref: pathRef("/home/MyShares/music")})
+				return res.GetStatus(), err
+			},
+			sent: func(f *fakeStorage) *typespb.Opaque { return f.deleteRequests[len(f.deleteRequests)-1].Opaque },
+		},
+		{
+			name:   "move share child",
+			opaque: lock,
+			call: func(s *svc, o *typespb.Opaque) (*rpc.Status, error) {
+				res, err := s.Move(context.Background(), &provider.MoveRequest{
+					Opaque:      o,
+					Source:      pathRef("/home/MyShares/photos/Ibiza"),
+					Destination: pathRef("/home/MyShares/photos/Mallorca"),
+				})
+				return res.GetStatus(), err
+			},
+			sent: func(f *fakeStorage) *typespb.Opaque { return f.moveRequests[len(f.moveRequests)-1].Opaque },
+		},
+		{
+			name:   "move without lock",
+			opaque: nil,
+			call: func(s *svc, o *typespb.Opaque) (*rpc.Status, error) {
+				res, err := s.Move(context.Background(), &provider.MoveRequest{
+					Opaque:      o,
+					Source:      pathRef("/home/MyShares/photos/Paris"),
+					Destination: pathRef("/home/MyShares/photos/Lyon"),
+				})
+				return res.GetStatus(), err
+			},
+			sent: func(f *fakeStorage) *typespb.Opaque { return f.moveRequests[len(f.moveRequests)-1].Opaque },
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newSharesStorage()
+			storage.add("/home/Documents", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+
+			st, err := tt.call(s, tt.opaque)
+			if err != nil {
+				t.Fatalf("call error = %v", err)
+			}
+			if st.Code != rpc.Code_CODE_OK {
+				t.Fatalf("call code = %v, want %v", st.Code, rpc.Code_CODE_OK)
+			}
+
+			got := string(tt.sent(storage).GetMap()[lockTokenKey].GetValue())
+			want := string(tt.opaque.GetMap()[lockTokenKey].GetValue())
+			if got != want {
+				t.Errorf("forwarded lock token = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCrossStorageMove(t *testing.T) {
+	home := newFakeStorage("home")
+	home.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	home.add("/home/report.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	eos := newFakeStorage("eos")
+	eos.add("/eos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	s, stop := newTestGateway(t, home)
+	defer stop()
+	defer mountFakeStorage(t, s, "/eos", eos)()
+
+	tests := []struct {
+		name       string
+		dst        string
+		code       rpc.Code
+		crossStore bool
+	}{
+		{"same provider", "/home/renamed.txt", rpc.Code_CODE_OK, false},
+		{"different providers", "/eos/report.txt", rpc.Code_CODE_UNIMPLEMENTED, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			src := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/report.txt"}}
+			dst := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.dst}}
+			res, err := s.Move(context.Background(), &provider.MoveRequest{Source: src, Destination: dst})
+			if err != nil {
+				t.Fatalf("Move() error = %v", err)
+			}
+
+			e := res.GetOpaque().GetMap()["error"]
+			marked := e != nil && string(e.Value) == crossStorageMoveError
+			if marked != tt.crossStore {
+				t.Errorf("Move() opaque = %v, cross storage marker = %v, want %v", res.Opaque, marked, tt.crossStore)
+			}
+			if res.Status.Code != tt.code {
+				t.Errorf("Move() code = %v, want %v", res.Status.Code, tt.code)
+			}
+		})
+	}
+
+	// the cross storage move never reaches any storage
+	if n := len(eos.moveRequests); n != 0 {
+		t.Errorf("Move() forwarded %d requests to the destination storage", n)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/file.txt", provider.ResourceType_RESOURCE_TYPE_FILE).Size = 4096
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.DataGatewayEndpoint = "https://reva.example.org/datagateway"
+	s.c.TransferSharedSecret = "secret"
+	s.c.TransferExpires = 10
+	s.c.TransferMaxExpires = 10
+
+	tests := []struct {
+		name  string
+		rng   string
+		code  rpc.Code
+		claim string
+	}{
+		{"full download", "", rpc.Code_CODE_OK, ""},
+		{"range", "bytes=0-1023", rpc.Code_CODE_OK, "bytes=0-1023"},
+		{"open range", "bytes=1024-", rpc.Code_CODE_OK, "bytes=1024-4095"},
+		{"suffix range", "bytes=-96", rpc.Code_CODE_OK, "bytes=4000-4095"},
+		{"end beyond size", "bytes=4000-8191", rpc.Code_CODE_OK, "bytes=4000-4095"},
+		{"start beyond size", "bytes=4096-8191", rpc.Code_CODE_OUT_OF_RANGE, ""},
+		{"reversed range", "bytes=1023-0", rpc.Code_CODE_INVALID_ARGUMENT, ""},
+		{"several ranges", "bytes=0-9,20-29", rpc.Code_CODE_INVALID_ARGUMENT, ""},
+		{"other unit", "items=0-9", rpc.Code_CODE_INVALID_ARGUMENT, ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := &provider.InitiateFileDownloadRequest{
+				Ref: &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/file.txt"}},
+			}
+			if tt.rng != "" {
+				req.Opaque = &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{
+					downloadRangeKey: {Decoder: "plain", Value: []byte(tt.rng)},
+				}}
+			}
+			before := storage.count("InitiateFileDownload")
+
+			res, err := s.InitiateFileDownload(context.Background(), req)
+			if err != nil {
+				t.Fatalf("InitiateFileDownload() error = %v", err)
+			}
+			if res.Status.Code != tt.code {
+				t.Fatalf("InitiateFileDownload() code = %v, want %v", res.Status.Code, tt.code)
+			}
+			if tt.code != rpc.Code_CODE_OK {
+				if n := storage.count("InitiateFileDownload") - before; n != 0 {
+					t.Errorf("invalid range forwarded %d times to the storage", n)
+				}
+				return
+			}
+
+			claims := &transferClaims{}
+			_, err = jwt.ParseWithClaims(res.Token, claims, func(token *jwt.Token) (interface{}, error) {
+				return []byte("secret"), nil
+			})
+			if err != nil {
+				t.Fatalf("ParseWithClaims() error = %v", err)
+			}
+			if claims.Range != tt.claim {
+				t.Errorf("signed range = %q, want %q", claims.Range, tt.claim)
+			}
+			if got := string(res.GetOpaque().GetMap()[downloadRangeKey].GetValue()); got != tt.claim {
+				t.Errorf("returned range = %q, want %q", got, tt.claim)
+			}
+			sent := storage.downloadRequests[len(storage.downloadRequests)-1]
+			if got := string(sent.GetOpaque().GetMap()[downloadRangeKey].GetValue()); got != tt.claim {
+				t.Errorf("forwarded range = %q, want %q", got, tt.claim)
+			}
+		})
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+	s.c.MaxPathLength = 32
+	s.c.MaxPathSegments = 5
+
+	tests := []struct {
+		name    string
+		path    string
+		invalid bool
+	}{
+		{"segments at the limit", "/home/a/b/c/d", false},
+		{"segments at the limit with slashes", "//home/a/b//c/d/", false},
+		{"segments over the limit", "/home/a/b/c/d/e", true},
+		{"length at the limit", "/home/" + strings.Repeat("x", 26), false},
+		{"length over the limit", "/home/" + strings.Repeat("x", 27), true},
+		{"share child over the limit", "/home/MyShares/photos/a/b/c", true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.path}}
+			res, err := s.Stat(context.Background(), &provider.StatRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if invalid := res.Status.Code == rpc.Code_CODE_INVALID_ARGUMENT; invalid != tt.invalid {
+				t.Errorf("Stat(%s) code = %v, want invalid %v", tt.path, res.Status.Code, tt.invalid)
+			}
+
+			before := storage.count("Delete")
+			dres, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if invalid := dres.Status.Code == rpc.Code_CODE_INVALID_ARGUMENT; invalid != tt.invalid {
+				t.Errorf("Delete(%s) code = %v, want invalid %v", tt.path, dres.Status.Code, tt.invalid)
+			}
+			if tt.invalid && storage.count("Delete") != before {
+				t.Errorf("Delete(%s) forwarded a path over the limits", tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
+	regdriver "github.com/cs3org/reva/pkg/storage/registry/registry"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// StorageRegistry finds the storage provider in charge of a reference.
+// By default the gateway asks the storage registry service, but any of the
+// storage registry drivers can be plugged for simple deployments.
+type StorageRegistry interface {
+	FindProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error)
+}
+
+// ReplicatedStorageRegistry is implemented by the storage registries able to return
+// several providers, replicas serving the same storage, for a reference.
+// The gateway picks the first healthy one.
+type ReplicatedStorageRegistry interface {
+	FindProviders(ctx context.Context, ref *provider.Reference) ([]*registry.ProviderInfo, error)
+}
+
+// ListingStorageRegistry is implemented by the storage registries able to list all the
+// providers they know, for the gateway to probe their health.
+type ListingStorageRegistry interface {
+	ListProviders(ctx context.Context) ([]*registry.ProviderInfo, error)
+}
+
+func getStorageRegistry(c *config) (StorageRegistry, error) {
+	if c.StorageRegistryDriver == "" {
+		return newGRPCStorageRegistry(c.StorageRegistryEndpoint), nil
+	}
+
+	if f, ok := regdriver.NewFuncs[c.StorageRegistryDriver]; ok {
+		return f(c.StorageRegistryDrivers[c.StorageRegistryDriver])
+	}
+
+	return nil, fmt.Errorf("driver %s not found for storage registry", c.StorageRegistryDriver)
+}
+
+// grpcStorageRegistry resolves providers using the storage registry service. Every lookup
+// goes through the registry, so the gateway holds a single connection to it, dialed on first
+// use and dialed again as soon as it fails instead of waiting for grpc to reconnect it.
+type grpcStorageRegistry struct {
+	endpoint string
+	// dial connects to the registry, pool.NewConn by default.
+	dial func(endpoint string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client registry.RegistryAPIClient
+}
+
+func newGRPCStorageRegistry(endpoint string) *grpcStorageRegistry {
+	return &grpcStorageRegistry{endpoint: endpoint, dial: pool.NewConn}
+}
+
+// getClient returns the client of the registry, connecting to it when there is no connection
+// yet or the current one failed. The keepalive pings detect a registry gone away between calls.
+func (r *grpcStorageRegistry) getClient() (registry.RegistryAPIClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil {
+		switch r.conn.GetState() {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			_ = r.conn.Close()
+			r.conn, r.client = nil, nil
+		default:
+			return r.client, nil
+		}
+	}
+
+	conn, err := r.dial(r.endpoint, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:    pool.DefaultKeepaliveTime,
+		Timeout: pool.DefaultKeepaliveTimeout,
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error getting storage registry client")
+	}
+	r.conn, r.client = conn, registry.NewRegistryAPIClient(conn)
+	return r.client, nil
+}
+
+// failed drops the connection of the client after a call failed because the registry was
+// unreachable, so the next call reconnects. A client replaced in the meantime is kept.
+func (r *grpcStorageRegistry) failed(c registry.RegistryAPIClient, err error) {
+	if gstatus.Code(errors.Cause(err)) != codes.Unavailable {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil && r.client == c {
+		_ = r.conn.Close()
+		r.conn, r.client = nil, nil
+	}
+}
+
+// Close closes the connection to the registry.
+func (r *grpcStorageRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn, r.client = nil, nil
+	return err
+}
+
+func (r *grpcStorageRegistry) FindProvider(ctx context.Context, ref *provider.Reference) (*registry.ProviderInfo, error) {
+	c, err := r.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.GetStorageProvider(ctx, &registry.GetStorageProviderRequest{
+		Ref: ref,
+	})
+
+	if err != nil {
+		r.failed(c, err)
+		err = errors.Wrap(err, "gateway: error calling GetStorageProvider")
+		return nil, err
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK {
+		if res.Status.Code == rpc.Code_CODE_NOT_FOUND {
+			return nil, errtypes.NotFound("gateway: storage provider not found for reference:" + ref.String())
+		}
+		err := status.NewErrorFromCode(res.Status.Code, "gateway")
+		return nil, err
+	}
+
+	return res.Provider, nil
+}
+
+func (r *grpcStorageRegistry) ListProviders(ctx context.Context) ([]*registry.ProviderInfo, error) {
+	c, err := r.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.ListStorageProviders(ctx, &registry.ListStorageProvidersRequest{})
+	if err != nil {
+		r.failed(c, err)
+		err = errors.Wrap(err, "gateway: error calling ListStorageProviders")
+		return nil, err
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK {
+		err := status.NewErrorFromCode(res.Status.Code, "gateway")
+		return nil, err
+	}
+
+	return res.Providers, nil
+}
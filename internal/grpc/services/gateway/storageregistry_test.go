@@ -0,0 +1,188 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	registry "github.com/cs3org/go-cs3apis/cs3/storage/registry/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
+	_ "github.com/cs3org/reva/pkg/storage/registry/static"
+	"google.golang.org/grpc"
+)
+
+func TestGetStorageRegistryDefault(t *testing.T) {
+	c := &config{StorageRegistryEndpoint: "localhost:19000"}
+	r, err := getStorageRegistry(c)
+	if err != nil {
+		t.Fatalf("getStorageRegistry() error = %v", err)
+	}
+	if _, ok := r.(*grpcStorageRegistry); !ok {
+		t.Errorf("getStorageRegistry() got = %T, want *grpcStorageRegistry", r)
+	}
+}
+
+func TestGetStorageRegistryUnknown(t *testing.T) {
+	c := &config{StorageRegistryDriver: "nope"}
+	if _, err := getStorageRegistry(c); err == nil {
+		t.Errorf("getStorageRegistry() expected error for unknown driver")
+	}
+}
+
+func TestFindProviderStatic(t *testing.T) {
+	c := &config{
+		StorageRegistryDriver: "static",
+		StorageRegistryDrivers: map[string]map[string]interface{}{
+			"static": {
+				"rules": map[string]string{
+					"/home":                                "localhost:17000",
+					"/home/MyShares":                       "localhost:18000",
+					"123e4567-e89b-12d3-a456-426655440000": "localhost:17000",
+				},
+			},
+		},
+	}
+	r, err := getStorageRegistry(c)
+	if err != nil {
+		t.Fatalf("getStorageRegistry() error = %v", err)
+	}
+	s := &svc{c: c, storageRegistry: r}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		ref     *provider.Reference
+		address string
+	}{
+		{
+			"by path",
+			&provider.Reference{Spec: &provider.Reference_Path{Path: "/home/docs"}},
+			"localhost:17000",
+		},
+		{
+			"longest prefix",
+			&provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}},
+			"localhost:18000",
+		},
+		{
+			"by id",
+			&provider.Reference{Spec: &provider.Reference_Id{Id: &provider.ResourceId{StorageId: "123e4567-e89b-12d3-a456-426655440000", OpaqueId: "x"}}},
+			"localhost:17000",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := s.findProvider(ctx, tt.ref)
+			if err != nil {
+				t.Fatalf("findProvider() error = %v", err)
+			}
+			if p.Address != tt.address {
+				t.Errorf("findProvider() address = %v, want %v", p.Address, tt.address)
+			}
+		})
+	}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/eos/user"}}
+	_, err = s.findProvider(ctx, ref)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("findProvider() error = %v, want not found", err)
+	}
+}
+
+// fakeRegistry is a storage registry service serving every reference from a single provider.
+type fakeRegistry struct {
+	registry.UnimplementedRegistryAPIServer
+	address string
+}
+
+func (f *fakeRegistry) GetStorageProvider(ctx context.Context, req *registry.GetStorageProviderRequest) (*registry.GetStorageProviderResponse, error) {
+	return &registry.GetStorageProviderResponse{
+		Status:   status.NewOK(ctx),
+		Provider: &registry.ProviderInfo{Address: f.address},
+	}, nil
+}
+
+// serveRegistry serves the fake registry on lis and returns the function stopping it.
+func serveRegistry(lis net.Listener) func() {
+	srv := grpc.NewServer()
+	registry.RegisterRegistryAPIServer(srv, &fakeRegistry{address: "localhost:17000"})
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	return srv.Stop
+}
+
+func TestGRPCStorageRegistryReconnect(t *testing.T) {
+	lis := listen(t)
+	addr := lis.Addr().String()
+	stop := serveRegistry(lis)
+
+	r := newGRPCStorageRegistry(addr)
+	defer r.Close()
+	var dials int
+	r.dial = func(endpoint string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		dials++
+		return pool.NewConn(endpoint, opts...)
+	}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}}
+	find := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := r.FindProvider(ctx, ref)
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := find(); err != nil {
+			t.Fatalf("FindProvider() error = %v", err)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("dialed the registry %d times, want the connection reused", dials)
+	}
+
+	// the registry goes away
+	stop()
+	if err := find(); err == nil {
+		t.Fatalf("FindProvider() error = nil with the registry down")
+	}
+
+	// and comes back at the same address
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("error listening again on %s: %v", addr, err)
+	}
+	defer serveRegistry(lis)()
+
+	if err := find(); err != nil {
+		t.Fatalf("FindProvider() after the registry came back error = %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("dialed the registry %d times, want a single reconnection", dials)
+	}
+}
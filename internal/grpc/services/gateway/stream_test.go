@@ -0,0 +1,283 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+
+	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"google.golang.org/grpc"
+)
+
+// listContainerStream collects the responses sent on a ListContainerStream.
+type listContainerStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	sent  []*provider.ListContainerStreamResponse
+	onRes func()
+}
+
+func (s *listContainerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *listContainerStream) Send(res *provider.ListContainerStreamResponse) error {
+	s.sent = append(s.sent, res)
+	if s.onRes != nil {
+		s.onRes()
+	}
+	return nil
+}
+
+func newSharesStorage() *fakeStorage {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	for _, name := range []string{"photos", "music", "docs"} {
+		storage.add("/users/peter/"+name, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		storage.addReference("/home/MyShares/"+name, "/users/peter/"+name)
+	}
+	storage.add("/users/peter/photos/Ibiza", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/photos/Paris", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	return storage
+}
+
+func TestListContainerStream(t *testing.T) {
+	s, stop := newTestGateway(t, newSharesStorage())
+	defer stop()
+
+	tests := []struct {
+		name  string
+		path  string
+		paths []string
+	}{
+		{"shared folder", "/home/MyShares", []string{"/home/MyShares/docs", "/home/MyShares/music", "/home/MyShares/photos"}},
+		{"share name", "/home/MyShares/photos", []string{"/home/MyShares/photos/Ibiza", "/home/MyShares/photos/Paris"}},
+		{"home", "/home", []string{"/home/MyShares"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ss := &listContainerStream{ctx: context.Background()}
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: tt.path}}
+			if err := s.ListContainerStream(&provider.ListContainerStreamRequest{Ref: ref}, ss); err != nil {
+				t.Fatalf("ListContainerStream() error = %v", err)
+			}
+
+			paths := []string{}
+			for _, res := range ss.sent {
+				if res.Status.Code != rpc.Code_CODE_OK {
+					t.Fatalf("ListContainerStream() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+				}
+				paths = append(paths, res.Info.Path)
+			}
+			sort.Strings(paths)
+			if len(paths) != len(tt.paths) {
+				t.Fatalf("expected %v, got %v", tt.paths, paths)
+			}
+			for i := range paths {
+				if paths[i] != tt.paths[i] {
+					t.Errorf("expected %v, got %v", tt.paths, paths)
+				}
+			}
+		})
+	}
+}
+
+func TestListContainerStreamErrors(t *testing.T) {
+	s, stop := newTestGateway(t, newSharesStorage())
+	defer stop()
+
+	ss := &listContainerStream{ctx: context.Background()}
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/nope"}}
+	if err := s.ListContainerStream(&provider.ListContainerStreamRequest{Ref: ref}, ss); err != nil {
+		t.Fatalf("ListContainerStream() error = %v", err)
+	}
+	if len(ss.sent) != 1 || ss.sent[0].Status.Code != rpc.Code_CODE_NOT_FOUND {
+		t.Fatalf("ListContainerStream() sent %v, want a not found status", ss.sent)
+	}
+}
+
+func TestListContainerStreamCancel(t *testing.T) {
+	storage := newSharesStorage()
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	// the client goes away after the first share
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss := &listContainerStream{ctx: ctx, onRes: cancel}
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares"}}
+	err := s.ListContainerStream(&provider.ListContainerStreamRequest{Ref: ref}, ss)
+	if err != context.Canceled {
+		t.Fatalf("ListContainerStream() error = %v, want %v", err, context.Canceled)
+	}
+	if len(ss.sent) != 1 {
+		t.Errorf("ListContainerStream() sent %d entries after the cancellation, want 1", len(ss.sent))
+	}
+	// the remaining shares are not resolved
+	if n := storage.count("Stat"); n != 1 {
+		t.Errorf("resolved %d shares, want 1", n)
+	}
+}
+
+// listRecycleStream collects the responses sent on a ListRecycleStream.
+type listRecycleStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	sent  []*provider.ListRecycleStreamResponse
+	onRes func()
+}
+
+func (s *listRecycleStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *listRecycleStream) Send(res *provider.ListRecycleStreamResponse) error {
+	s.sent = append(s.sent, res)
+	if s.onRes != nil {
+		s.onRes()
+	}
+	return nil
+}
+
+func newRecycleStorage(n, batch int) *fakeStorage {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.recycleBatch = batch
+	for i := 0; i < n; i++ {
+		storage.recycle = append(storage.recycle, &provider.RecycleItem{
+			Key:  strconv.Itoa(i),
+			Path: "/home/file" + strconv.Itoa(i),
+		})
+	}
+	return storage
+}
+
+func TestListRecycleStream(t *testing.T) {
+	tests := []struct {
+		name  string
+		items int
+		batch int
+	}{
+		{"empty", 0, 10},
+		{"single batch", 5, 10},
+		{"several batches", 250, 16},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newRecycleStorage(tt.items, tt.batch)
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+
+			req := &gateway.ListRecycleStreamRequest{
+				Ref:    &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}},
+				FromTs: &typespb.Timestamp{Seconds: 10},
+				ToTs:   &typespb.Timestamp{Seconds: 20},
+			}
+			ss := &listRecycleStream{ctx: context.Background()}
+			if err := s.ListRecycleStream(req, ss); err != nil {
+				t.Fatalf("ListRecycleStream() error = %v", err)
+			}
+
+			if len(ss.sent) != tt.items+1 {
+				t.Fatalf("ListRecycleStream() sent %d frames, want %d", len(ss.sent), tt.items+1)
+			}
+			for i, res := range ss.sent[:tt.items] {
+				if res.Status.Code != rpc.Code_CODE_OK {
+					t.Fatalf("ListRecycleStream() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+				}
+				if res.RecycleItem.GetKey() != strconv.Itoa(i) {
+					t.Errorf("expected item %d, got %v", i, res.RecycleItem)
+				}
+			}
+			last := ss.sent[tt.items]
+			if last.Status.Code != rpc.Code_CODE_OK || last.RecycleItem != nil {
+				t.Errorf("ListRecycleStream() terminal frame = %v, want an ok status without item", last)
+			}
+
+			if len(storage.recycleStreamRequests) != 1 {
+				t.Fatalf("expected one ListRecycleStream request, got %d", len(storage.recycleStreamRequests))
+			}
+			fwd := storage.recycleStreamRequests[0]
+			if fwd.FromTs.GetSeconds() != 10 || fwd.ToTs.GetSeconds() != 20 {
+				t.Errorf("forwarded time range = %v-%v, want 10-20", fwd.FromTs, fwd.ToTs)
+			}
+		})
+	}
+}
+
+func TestListRecycleStreamOutsideHome(t *testing.T) {
+	storage := newRecycleStorage(3, 10)
+	// a folder named as the shared folder outside the home holds no share
+	storage.add("/other/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/users/peter/photos", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.addReference("/other/MyShares/photos", "/users/peter/photos")
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	req := &gateway.ListRecycleStreamRequest{
+		Ref: &provider.Reference{Spec: &provider.Reference_Path{Path: "/other/MyShares/photos"}},
+	}
+	ss := &listRecycleStream{ctx: context.Background()}
+	if err := s.ListRecycleStream(req, ss); err != nil {
+		t.Fatalf("ListRecycleStream() error = %v", err)
+	}
+
+	if len(ss.sent) != 4 {
+		t.Fatalf("ListRecycleStream() sent %d frames, want 4", len(ss.sent))
+	}
+	if n := storage.count("ListRecycle"); n != 0 {
+		t.Errorf("ListRecycleStream() listed the recycle %d times as the one of a share, want 0", n)
+	}
+	if len(storage.recycleStreamRequests) != 1 {
+		t.Errorf("expected one ListRecycleStream request, got %d", len(storage.recycleStreamRequests))
+	}
+}
+
+func TestListRecycleStreamCancel(t *testing.T) {
+	s, stop := newTestGateway(t, newRecycleStorage(100, 10))
+	defer stop()
+
+	// the client goes away after the first item
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss := &listRecycleStream{ctx: ctx, onRes: cancel}
+
+	req := &gateway.ListRecycleStreamRequest{
+		Ref: &provider.Reference{Spec: &provider.Reference_Path{Path: "/home"}},
+	}
+	err := s.ListRecycleStream(req, ss)
+	if err != context.Canceled {
+		t.Fatalf("ListRecycleStream() error = %v, want %v", err, context.Canceled)
+	}
+	if len(ss.sent) != 1 {
+		t.Errorf("ListRecycleStream() sent %d frames after the cancellation, want 1", len(ss.sent))
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/rgrpc/todo/pool"
+	tokenpkg "github.com/cs3org/reva/pkg/token"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+// UnmountSummary reports the outcome of unmounting all the shares of a user.
+type UnmountSummary struct {
+	// Unmounted is the number of share references removed from the shared folder.
+	Unmounted int
+	// Failures maps the path of the share references that could not be removed to the reason.
+	Failures map[string]string
+}
+
+// UnmountAllShares removes all the share references mounted in the shared folder of the user,
+// for example when offboarding the user or after removing a federation partner.
+// Only the mount points are removed, the targets of the shares are not touched.
+// The operation is restricted to the members of the admin group.
+func (s *svc) UnmountAllShares(ctx context.Context, userID *userpb.UserId) (*UnmountSummary, error) {
+	log := appctx.GetLogger(ctx)
+
+	admin, ok := user.ContextGetUser(ctx)
+	if !ok || !isAdmin(admin, s.c.AdminGroup) {
+		return nil, errtypes.PermissionDenied("gateway: unmounting all shares requires admin privileges")
+	}
+
+	ctx, err := s.impersonate(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedFolder := s.getSharedFolder(ctx)
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: sharedFolder,
+		},
+	}
+	c, err := s.find(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error finding storage provider of the shared folder")
+	}
+
+	res, err := c.ListContainer(ctx, &provider.ListContainerRequest{Ref: ref})
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error listing shared folder")
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return nil, status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+
+	summary := &UnmountSummary{Failures: map[string]string{}}
+	for _, info := range res.Infos {
+		// only share references are unmounted, regular resources in the shared folder are left alone.
+		if info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+			continue
+		}
+
+		// deleting a share name unmounts the share.
+		dres, err := s.Delete(ctx, &provider.DeleteRequest{
+			Ref: &provider.Reference{
+				Spec: &provider.Reference_Path{
+					Path: info.Path,
+				},
+			},
+		})
+		switch {
+		case err != nil:
+			summary.Failures[info.Path] = err.Error()
+		case dres.Status.Code != rpc.Code_CODE_OK:
+			summary.Failures[info.Path] = fmt.Sprintf("%s: %s", dres.Status.Code, dres.Status.Message)
+		default:
+			summary.Unmounted++
+		}
+	}
+
+	log.Info().Str("user", userID.GetOpaqueId()).Int("unmounted", summary.Unmounted).Int("failures", len(summary.Failures)).Msg("gateway: unmounted all shares")
+	return summary, nil
+}
+
+// unmountShare removes the reference mounting the share at the share name p, leaving the
+// target of the share untouched. When references are committed by the gateway, the received
+// share is also rejected in the share manager, so that the share is not mounted again.
+func (s *svc) unmountShare(ctx context.Context, req *provider.DeleteRequest, p string) (*provider.DeleteResponse, error) {
+	log := appctx.GetLogger(ctx)
+
+	ref := &provider.Reference{
+		Spec: &provider.Reference_Path{
+			Path: p,
+		},
+	}
+
+	statRes, err := s.stat(ctx, &provider.StatRequest{Ref: ref})
+	if err != nil {
+		return &provider.DeleteResponse{
+			Status: status.NewInternal(ctx, err, "gateway: error unmounting share"),
+		}, nil
+	}
+	if statRes.Status.Code != rpc.Code_CODE_OK {
+		err := shareNameError(p, statRes.Status.Code)
+		log.Err(err).Msg("gateway: error unmounting share")
+		st, o := shareError(ctx, err, "gateway: error unmounting share")
+		return &provider.DeleteResponse{
+			Status: st,
+			Opaque: o,
+		}, nil
+	}
+
+	req.Ref = ref
+	res, err := s.delete(ctx, req)
+	if err != nil || res.Status.Code != rpc.Code_CODE_OK {
+		return res, err
+	}
+
+	// a regular resource in the shared folder is not a mount point, it is just deleted,
+	// and a dry run unmounts nothing, so the share is kept.
+	if statRes.Info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE || !s.c.CommitShareToStorageRef || isDryRun(req.Opaque) {
+		return res, nil
+	}
+
+	if err := s.rejectReceivedShare(ctx, statRes.Info.Target); err != nil {
+		log.Warn().Err(err).Str("path", p).Msg("gateway: share unmounted but not rejected in the share manager")
+		if res.Opaque == nil {
+			res.Opaque = &typespb.Opaque{}
+		}
+		if res.Opaque.Map == nil {
+			res.Opaque.Map = map[string]*typespb.OpaqueEntry{}
+		}
+		res.Opaque.Map["warning"] = &typespb.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte("the share was unmounted but could still be mounted again: " + err.Error()),
+		}
+		res.Opaque = relayWarnings(res.Status, res.Opaque)
+	}
+	return res, nil
+}
+
+// rejectReceivedShare rejects the accepted share of the current user whose resource is the
+// target of a share reference, as the reference mounting it was removed.
+func (s *svc) rejectReceivedShare(ctx context.Context, target string) error {
+	id, err := referenceTargetID(target)
+	if err != nil {
+		return err
+	}
+
+	c, err := pool.GetUserShareProviderClient(s.c.UserShareProviderEndpoint)
+	if err != nil {
+		return errors.Wrap(err, "gateway: error getting user share provider client")
+	}
+
+	lres, err := c.ListReceivedShares(ctx, &collaboration.ListReceivedSharesRequest{})
+	if err != nil {
+		return errors.Wrap(err, "gateway: error listing received shares")
+	}
+	if lres.Status.Code != rpc.Code_CODE_OK {
+		return status.NewErrorFromCode(lres.Status.Code, "gateway")
+	}
+
+	for _, rs := range lres.Shares {
+		rid := rs.GetShare().GetResourceId()
+		if rs.State != collaboration.ShareState_SHARE_STATE_ACCEPTED || rid.GetStorageId() != id.StorageId || rid.GetOpaqueId() != id.OpaqueId {
+			continue
+		}
+
+		ures, err := c.UpdateReceivedShare(ctx, &collaboration.UpdateReceivedShareRequest{
+			Ref: &collaboration.ShareReference{
+				Spec: &collaboration.ShareReference_Id{
+					Id: rs.Share.Id,
+				},
+			},
+			Field: &collaboration.UpdateReceivedShareRequest_UpdateField{
+				Field: &collaboration.UpdateReceivedShareRequest_UpdateField_State{
+					State: collaboration.ShareState_SHARE_STATE_REJECTED,
+				},
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "gateway: error rejecting received share")
+		}
+		if ures.Status.Code != rpc.Code_CODE_OK {
+			return status.NewErrorFromCode(ures.Status.Code, "gateway")
+		}
+	}
+	return nil
+}
+
+// referenceTargetID returns the id of the resource a cs3 reference target points to.
+func referenceTargetID(target string) (*provider.ResourceId, error) {
+	uri, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gateway: error parsing target uri:%s", target)
+	}
+	if uri.Scheme != "cs3" {
+		return nil, errors.New("gateway: no reference handler for scheme:" + uri.Scheme)
+	}
+
+	// a cs3 ref has the following layout: <storage_id>/<opaque_id>
+	parts := strings.SplitN(uri.Opaque, "/", 2)
+	if len(parts) < 2 {
+		return nil, errors.New("gateway: cs3 ref does not follow the layout storageid/opaqueid:" + uri.Opaque)
+	}
+	return &provider.ResourceId{StorageId: parts[0], OpaqueId: parts[1]}, nil
+}
+
+// impersonate returns a context to act on behalf of the user with the given id,
+// carrying the user and a token minted for it in place of the ones of the caller.
+func (s *svc) impersonate(ctx context.Context, userID *userpb.UserId) (context.Context, error) {
+	res, err := s.GetUser(ctx, &userpb.GetUserRequest{UserId: userID})
+	if err != nil {
+		return nil, err
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		if res.Status.Code == rpc.Code_CODE_NOT_FOUND {
+			return nil, errtypes.NotFound("gateway: user not found: " + userID.GetOpaqueId())
+		}
+		return nil, status.NewErrorFromCode(res.Status.Code, "gateway")
+	}
+
+	tkn, err := s.tokenmgr.MintToken(ctx, res.User)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway: error minting token")
+	}
+
+	// the token of the caller must be replaced, appending it would keep the one of the caller.
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(tokenpkg.TokenHeader, tkn)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	ctx = tokenpkg.ContextSetToken(ctx, tkn)
+	ctx = user.ContextSetUser(ctx, res.User)
+	return ctx, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/rgrpc/status"
+	"github.com/cs3org/reva/pkg/token/manager/jwt"
+	"github.com/cs3org/reva/pkg/user"
+	"google.golang.org/grpc"
+)
+
+// fakeUsers is an in memory user provider.
+type fakeUsers struct {
+	userpb.UnimplementedUserAPIServer
+	users map[string]*userpb.User
+}
+
+func (f *fakeUsers) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.GetUserResponse, error) {
+	u, ok := f.users[req.UserId.GetOpaqueId()]
+	if !ok {
+		return &userpb.GetUserResponse{Status: status.NewNotFound(ctx, "fake: user not found")}, nil
+	}
+	return &userpb.GetUserResponse{Status: status.NewOK(ctx), User: u}, nil
+}
+
+// fakeShares is an in memory user share provider.
+type fakeShares struct {
+	collaboration.UnimplementedCollaborationAPIServer
+	sync.Mutex
+	received []*collaboration.ReceivedShare
+	// fail makes the updates of the received shares fail.
+	fail bool
+}
+
+func (f *fakeShares) ListReceivedShares(ctx context.Context, req *collaboration.ListReceivedSharesRequest) (*collaboration.ListReceivedSharesResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	return &collaboration.ListReceivedSharesResponse{Status: status.NewOK(ctx), Shares: f.received}, nil
+}
+
+func (f *fakeShares) GetReceivedShare(ctx context.Context, req *collaboration.GetReceivedShareRequest) (*collaboration.GetReceivedShareResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	for _, rs := range f.received {
+		if rs.Share.Id.OpaqueId == req.Ref.GetId().GetOpaqueId() {
+			return &collaboration.GetReceivedShareResponse{Status: status.NewOK(ctx), Share: rs}, nil
+		}
+	}
+	return &collaboration.GetReceivedShareResponse{Status: status.NewNotFound(ctx, "fake: share not found")}, nil
+}
+
+func (f *fakeShares) UpdateReceivedShare(ctx context.Context, req *collaboration.UpdateReceivedShareRequest) (*collaboration.UpdateReceivedShareResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.fail {
+		return &collaboration.UpdateReceivedShareResponse{Status: status.NewInternal(ctx, errtypes.InternalError("fake"), "fake: error updating share")}, nil
+	}
+	for _, rs := range f.received {
+		if rs.Share.Id.OpaqueId == req.Ref.GetId().GetOpaqueId() {
+			rs.State = req.Field.GetState()
+			return &collaboration.UpdateReceivedShareResponse{Status: status.NewOK(ctx)}, nil
+		}
+	}
+	return &collaboration.UpdateReceivedShareResponse{Status: status.NewNotFound(ctx, "fake: share not found")}, nil
+}
+
+func (f *fakeShares) state(id string) collaboration.ShareState {
+	f.Lock()
+	defer f.Unlock()
+	for _, rs := range f.received {
+		if rs.Share.Id.OpaqueId == id {
+			return rs.State
+		}
+	}
+	return collaboration.ShareState_SHARE_STATE_INVALID
+}
+
+func TestDeleteShareNameUnmounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		commitRef bool
+		fail      bool
+		state     collaboration.ShareState
+		warning   bool
+	}{
+		{"references not committed", false, false, collaboration.ShareState_SHARE_STATE_ACCEPTED, false},
+		{"share rejected", true, false, collaboration.ShareState_SHARE_STATE_REJECTED, false},
+		{"share manager failure", true, true, collaboration.ShareState_SHARE_STATE_ACCEPTED, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newSharesStorage()
+			s, stop := newTestGateway(t, storage)
+			defer stop()
+
+			shares := &fakeShares{fail: tt.fail}
+			for _, name := range []string{"photos", "music"} {
+				shares.received = append(shares.received, &collaboration.ReceivedShare{
+					Share: &collaboration.Share{
+						Id:         &collaboration.ShareId{OpaqueId: name},
+						ResourceId: &provider.ResourceId{StorageId: "home", OpaqueId: "/users/peter/" + name},
+					},
+					State: collaboration.ShareState_SHARE_STATE_ACCEPTED,
+				})
+			}
+			lis := listen(t)
+			srv := grpc.NewServer()
+			collaboration.RegisterCollaborationAPIServer(srv, shares)
+			go func() {
+				_ = srv.Serve(lis)
+			}()
+			defer srv.Stop()
+
+			s.c.CommitShareToStorageRef = tt.commitRef
+			s.c.UserShareProviderEndpoint = lis.Addr().String()
+
+			ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/photos"}}
+			res, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: ref})
+			if err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if res.Status.Code != rpc.Code_CODE_OK {
+				t.Fatalf("Delete() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+			}
+			if _, ok := res.Opaque.GetMap()[warningsKey]; ok != tt.warning {
+				t.Errorf("Delete() opaque = %v, want warning %v", res.Opaque, tt.warning)
+			}
+
+			if _, ok := storage.lookup(ref); ok {
+				t.Errorf("share is still mounted")
+			}
+			if _, ok := storage.lookup(&provider.Reference{Spec: &provider.Reference_Path{Path: "/users/peter/photos/Ibiza"}}); !ok {
+				t.Errorf("target of the share was removed")
+			}
+			if state := shares.state("photos"); state != tt.state {
+				t.Errorf("share state = %v, want %v", state, tt.state)
+			}
+			if state := shares.state("music"); state != collaboration.ShareState_SHARE_STATE_ACCEPTED {
+				t.Errorf("other share state = %v, want it accepted", state)
+			}
+		})
+	}
+}
+
+func TestUnmountAllShares(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/MyShares/notes", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	names := []string{"photos", "music", "docs"}
+	for _, name := range names {
+		storage.add("/users/peter/"+name, provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+		storage.addReference("/home/MyShares/"+name, "/users/peter/"+name)
+	}
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	lis := listen(t)
+	srv := grpc.NewServer()
+	marie := &userpb.User{Id: &userpb.UserId{OpaqueId: "marie"}, Username: "marie"}
+	userpb.RegisterUserAPIServer(srv, &fakeUsers{users: map[string]*userpb.User{"marie": marie}})
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+
+	s.c.AdminGroup = "admins"
+	s.c.UserProviderEndpoint = lis.Addr().String()
+	tokenmgr, err := jwt.New(map[string]interface{}{"secret": "secret"})
+	if err != nil {
+		t.Fatalf("jwt.New() error = %v", err)
+	}
+	s.tokenmgr = tokenmgr
+
+	admin := &userpb.User{Id: &userpb.UserId{OpaqueId: "admin"}, Groups: []string{"admins"}}
+	ctx := user.ContextSetUser(context.Background(), admin)
+
+	// not an admin
+	_, err = s.UnmountAllShares(user.ContextSetUser(context.Background(), marie), marie.Id)
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Fatalf("UnmountAllShares() error = %v, want permission denied", err)
+	}
+
+	// unknown user
+	_, err = s.UnmountAllShares(ctx, &userpb.UserId{OpaqueId: "nobody"})
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Fatalf("UnmountAllShares() error = %v, want not found", err)
+	}
+
+	summary, err := s.UnmountAllShares(ctx, marie.Id)
+	if err != nil {
+		t.Fatalf("UnmountAllShares() error = %v", err)
+	}
+	if summary.Unmounted != len(names) {
+		t.Errorf("unmounted %d shares, want %d", summary.Unmounted, len(names))
+	}
+	if len(summary.Failures) != 0 {
+		t.Errorf("unexpected failures: %v", summary.Failures)
+	}
+
+	for _, name := range names {
+		if _, ok := storage.lookup(&provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/" + name}}); ok {
+			t.Errorf("share %s is still mounted", name)
+		}
+		if _, ok := storage.lookup(&provider.Reference{Spec: &provider.Reference_Path{Path: "/users/peter/" + name}}); !ok {
+			t.Errorf("target of share %s was removed", name)
+		}
+	}
+	if _, ok := storage.lookup(&provider.Reference{Spec: &provider.Reference_Path{Path: "/home/MyShares/notes"}}); !ok {
+		t.Errorf("regular folder in the shared folder was removed")
+	}
+}
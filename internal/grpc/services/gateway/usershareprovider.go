@@ -419,6 +419,7 @@ func (s *svc) createReference(ctx context.Context, resourceID *provider.Resource
 	}
 
 	createRefRes, err := c.CreateReference(ctx, createRefReq)
+	s.forgetStats(ctx)
 	if err != nil {
 		log.Err(err).Msg("gateway: error calling GetHome")
 		return &rpc.Status{
@@ -457,6 +458,7 @@ func (s *svc) addGrant(ctx context.Context, id *provider.ResourceId, g *provider
 	}
 
 	grantRes, err := c.AddGrant(ctx, grantReq)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling AddGrant")
 	}
@@ -491,6 +493,7 @@ func (s *svc) removeGrant(ctx context.Context, id *provider.ResourceId, g *provi
 	}
 
 	grantRes, err := c.RemoveGrant(ctx, grantReq)
+	s.forgetStats(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "gateway: error calling RemoveGrant")
 	}
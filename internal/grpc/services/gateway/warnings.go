@@ -0,0 +1,61 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"encoding/json"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+)
+
+// warningsKey is the key of the opaque of the gateway responses holding the non-fatal
+// warnings reported by the providers along with a successful status, as a json list
+// of messages. Providers report them either in the same way or as a single plain
+// message under the "warning" key.
+const warningsKey = "warnings"
+
+// relayWarnings returns the opaque of a provider response with its warnings, if any,
+// relayed under the warnings key so clients do not need to know about the providers.
+func relayWarnings(st *rpc.Status, o *typespb.Opaque) *typespb.Opaque {
+	if st.GetCode() != rpc.Code_CODE_OK || o == nil {
+		return o
+	}
+
+	var warnings []string
+	if e, ok := o.Map[warningsKey]; ok {
+		if e.Decoder != "json" || json.Unmarshal(e.Value, &warnings) != nil {
+			warnings = []string{string(e.Value)}
+		}
+	}
+	if e, ok := o.Map["warning"]; ok && len(e.Value) > 0 {
+		warnings = append(warnings, string(e.Value))
+		delete(o.Map, "warning")
+	}
+	if len(warnings) == 0 {
+		return o
+	}
+
+	value, err := json.Marshal(warnings)
+	if err != nil {
+		return o
+	}
+	o.Map[warningsKey] = &typespb.OpaqueEntry{Decoder: "json", Value: value}
+	return o
+}
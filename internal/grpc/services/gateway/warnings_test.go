@@ -0,0 +1,86 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+)
+
+func TestRelayWarnings(t *testing.T) {
+	ok := &rpc.Status{Code: rpc.Code_CODE_OK}
+	plain := func(v string) *typespb.OpaqueEntry { return &typespb.OpaqueEntry{Decoder: "plain", Value: []byte(v)} }
+
+	tests := []struct {
+		name     string
+		st       *rpc.Status
+		o        *typespb.Opaque
+		warnings []string
+	}{
+		{"single warning", ok, &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"warning": plain("antivirus scan pending")}}, []string{"antivirus scan pending"}},
+		{"json warnings", ok, &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"warnings": {Decoder: "json", Value: []byte(`["a","b"]`)}}}, []string{"a", "b"}},
+		{"plain warnings", ok, &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"warnings": plain("a")}}, []string{"a"}},
+		{"no warnings", ok, &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"etag": plain("1")}}, nil},
+		{"failed", &rpc.Status{Code: rpc.Code_CODE_INTERNAL}, &typespb.Opaque{Map: map[string]*typespb.OpaqueEntry{"warning": plain("a")}}, nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			o := relayWarnings(tt.st, tt.o)
+			var warnings []string
+			if e, ok := o.GetMap()[warningsKey]; ok {
+				if err := json.Unmarshal(e.Value, &warnings); err != nil {
+					t.Fatalf("error decoding warnings: %v", err)
+				}
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("relayWarnings() warnings = %v, want %v", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestDeleteRelaysWarnings(t *testing.T) {
+	storage := newFakeStorage("home")
+	storage.add("/home", provider.ResourceType_RESOURCE_TYPE_CONTAINER)
+	storage.add("/home/file.txt", provider.ResourceType_RESOURCE_TYPE_FILE)
+	storage.warning = "moved to the recycle bin of the project"
+	s, stop := newTestGateway(t, storage)
+	defer stop()
+
+	ref := &provider.Reference{Spec: &provider.Reference_Path{Path: "/home/file.txt"}}
+	res, err := s.Delete(context.Background(), &provider.DeleteRequest{Ref: ref})
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if res.Status.Code != rpc.Code_CODE_OK {
+		t.Fatalf("Delete() code = %v, want %v", res.Status.Code, rpc.Code_CODE_OK)
+	}
+	e, ok := res.GetOpaque().GetMap()[warningsKey]
+	if !ok || e.Decoder != "json" || string(e.Value) != `["moved to the recycle bin of the project"]` {
+		t.Errorf("Delete() opaque = %v, want the warning relayed", res.Opaque)
+	}
+}
@@ -20,9 +20,13 @@ package ocminvitemanager
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 
 	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
 	"github.com/cs3org/reva/pkg/ocm/invite"
 	"github.com/cs3org/reva/pkg/ocm/invite/manager/registry"
 	"github.com/cs3org/reva/pkg/rgrpc"
@@ -94,6 +98,9 @@ func New(m map[string]interface{}, ss *grpc.Server) (rgrpc.Service, error) {
 }
 
 func (s *service) Close() error {
+	if c, ok := s.im.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
@@ -102,8 +109,16 @@ func (s *service) UnprotectedEndpoints() []string {
 }
 
 func (s *service) GenerateInviteToken(ctx context.Context, req *invitepb.GenerateInviteTokenRequest) (*invitepb.GenerateInviteTokenResponse, error) {
+	if description, ok := req.GetOpaque().GetMap()[invite.DescriptionOpaqueKey]; ok {
+		ctx = invite.ContextSetDescription(ctx, string(description.Value))
+	}
 	token, err := s.im.GenerateToken(ctx)
 	if err != nil {
+		if _, ok := err.(errtypes.IsPermissionDenied); ok {
+			return &invitepb.GenerateInviteTokenResponse{
+				Status: status.NewPermissionDenied(ctx, err, "error generating invite token"),
+			}, nil
+		}
 		return &invitepb.GenerateInviteTokenResponse{
 			Status: status.NewInternal(ctx, err, "error generating invite token"),
 		}, nil
@@ -118,6 +133,16 @@ func (s *service) GenerateInviteToken(ctx context.Context, req *invitepb.Generat
 func (s *service) ForwardInvite(ctx context.Context, req *invitepb.ForwardInviteRequest) (*invitepb.ForwardInviteResponse, error) {
 	err := s.im.ForwardInvite(ctx, req.InviteToken, req.OriginSystemProvider)
 	if err != nil {
+		switch err.(type) {
+		case errtypes.IsPermissionDenied:
+			return &invitepb.ForwardInviteResponse{
+				Status: status.NewPermissionDenied(ctx, err, "error forwarding invite"),
+			}, nil
+		case errtypes.IsBadRequest:
+			return &invitepb.ForwardInviteResponse{
+				Status: status.NewInvalid(ctx, err.Error()),
+			}, nil
+		}
 		return &invitepb.ForwardInviteResponse{
 			Status: status.NewInternal(ctx, err, "error forwarding invite"),
 		}, nil
@@ -129,21 +154,51 @@ func (s *service) ForwardInvite(ctx context.Context, req *invitepb.ForwardInvite
 }
 
 func (s *service) AcceptInvite(ctx context.Context, req *invitepb.AcceptInviteRequest) (*invitepb.AcceptInviteResponse, error) {
-	err := s.im.AcceptInvite(ctx, req.InviteToken, req.RemoteUser)
+	inviter, err := s.im.AcceptInvite(ctx, req.InviteToken, req.RemoteUser)
 	if err != nil {
+		switch err.(type) {
+		case errtypes.IsNotFound:
+			return &invitepb.AcceptInviteResponse{
+				Status: status.NewNotFound(ctx, "invite token not found"),
+			}, nil
+		case errtypes.IsBadRequest:
+			return &invitepb.AcceptInviteResponse{
+				Status: status.NewInvalid(ctx, err.Error()),
+			}, nil
+		}
 		return &invitepb.AcceptInviteResponse{
 			Status: status.NewInternal(ctx, err, "error accepting invite"),
 		}, nil
 	}
 
+	inviterID, err := json.Marshal(inviter.GetId())
+	if err != nil {
+		return &invitepb.AcceptInviteResponse{
+			Status: status.NewInternal(ctx, err, "error encoding inviter"),
+		}, nil
+	}
+
 	return &invitepb.AcceptInviteResponse{
 		Status: status.NewOK(ctx),
+		Opaque: &types.Opaque{
+			Map: map[string]*types.OpaqueEntry{
+				invite.InviterOpaqueKey: {
+					Decoder: "json",
+					Value:   inviterID,
+				},
+			},
+		},
 	}, nil
 }
 
 func (s *service) GetRemoteUser(ctx context.Context, req *invitepb.GetRemoteUserRequest) (*invitepb.GetRemoteUserResponse, error) {
 	remoteUser, err := s.im.GetRemoteUser(ctx, req.RemoteUserId)
 	if err != nil {
+		if _, ok := err.(errtypes.IsBadRequest); ok {
+			return &invitepb.GetRemoteUserResponse{
+				Status: status.NewInvalid(ctx, err.Error()),
+			}, nil
+		}
 		return &invitepb.GetRemoteUserResponse{
 			Status: status.NewInternal(ctx, err, "error fetching remote user details"),
 		}, nil
@@ -0,0 +1,90 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package ocminvitemanager
+
+import (
+	"context"
+	"testing"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	_ "github.com/cs3org/reva/pkg/ocm/invite/manager/memory"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+func newTestContext(opaqueID string) context.Context {
+	u := &userpb.User{
+		Id: &userpb.UserId{
+			Idp:      "http://localhost:20080",
+			OpaqueId: opaqueID,
+		},
+		Username:    opaqueID,
+		Mail:        opaqueID + "@example.org",
+		DisplayName: opaqueID,
+	}
+	return user.ContextSetUser(context.Background(), u)
+}
+
+func TestForwardInviteOfAnotherUser(t *testing.T) {
+	svc, err := New(map[string]interface{}{"driver": "memory"}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	s := svc.(*service)
+	defer s.Close()
+
+	einstein := newTestContext("einstein")
+	res, err := s.GenerateInviteToken(einstein, &invitepb.GenerateInviteTokenRequest{})
+	if err != nil || res.GetStatus().GetCode() != rpc.Code_CODE_OK {
+		t.Fatalf("GenerateInviteToken() = %v, %v", res.GetStatus(), err)
+	}
+	token := res.GetInviteToken().GetToken()
+	marie := &userpb.UserId{Idp: "http://localhost:20080", OpaqueId: "marie"}
+
+	tests := []struct {
+		name        string
+		inviteToken *invitepb.InviteToken
+		wantDenied  bool
+	}{
+		// ocmd only forwards the token given in the form
+		{"token only", &invitepb.InviteToken{Token: token}, true},
+		{"owner claimed by the client", &invitepb.InviteToken{Token: token, UserId: marie}, true},
+		// the owner of the tokens of other providers is not known
+		{"token of another provider", &invitepb.InviteToken{Token: "foreign", UserId: user.ContextMustGetUser(einstein).GetId()}, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// the provider info is not needed as the request must be rejected before being sent
+			res, err := s.ForwardInvite(newTestContext("marie"), &invitepb.ForwardInviteRequest{
+				InviteToken:          tt.inviteToken,
+				OriginSystemProvider: &ocmprovider.ProviderInfo{},
+			})
+			if err != nil {
+				t.Fatalf("ForwardInvite() error = %v", err)
+			}
+			if denied := res.GetStatus().GetCode() == rpc.Code_CODE_PERMISSION_DENIED; denied != tt.wantDenied {
+				t.Errorf("ForwardInvite() status = %v, want permission denied %v", res.GetStatus(), tt.wantDenied)
+			}
+		})
+	}
+}
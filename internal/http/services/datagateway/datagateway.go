@@ -20,10 +20,14 @@ package datagateway
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cs3org/reva/pkg/appctx"
@@ -47,15 +51,36 @@ func init() {
 }
 
 // transferClaims are custom claims for a JWT token to be used between the metadata and data gateways.
+// Tokens without version only carry the target, they are deprecated.
 type transferClaims struct {
 	jwt.StandardClaims
 	Target string `json:"target"`
+	// V is the version of the claims.
+	V int `json:"v,omitempty"`
+	// Methods are the HTTP methods the token can be used with.
+	Methods []string `json:"methods,omitempty"`
+	// Length is the expected length of the upload, 0 if unknown.
+	Length int64 `json:"length,omitempty"`
+	// Range is the only byte range the download can be done for, the whole file if empty.
+	Range string `json:"range,omitempty"`
+	// Nonce makes every token unique.
+	Nonce string `json:"nonce,omitempty"`
 }
+
+// transferClaimsVersion is the latest version of the transfer claims.
+const transferClaimsVersion = 2
+
 type config struct {
 	Prefix               string `mapstructure:"prefix"`
 	TransferSharedSecret string `mapstructure:"transfer_shared_secret"`
 	Timeout              int64  `mapstructure:"timeout"`
 	Insecure             bool   `mapstructure:"insecure"`
+	// RejectUnversionedTokens rejects the deprecated tokens only signing the target.
+	RejectUnversionedTokens bool `mapstructure:"reject_unversioned_tokens"`
+	// TransferSigningAlg is the algorithm the transfer tokens are signed with.
+	TransferSigningAlg string `mapstructure:"transfer_signing_alg"`
+	// TransferPublicKey is the path of the PEM encoded public key verifying RSA and ECDSA signed tokens.
+	TransferPublicKey string `mapstructure:"transfer_public_key"`
 }
 
 func (c *config) init() {
@@ -64,11 +89,18 @@ func (c *config) init() {
 	}
 
 	c.TransferSharedSecret = sharedconf.GetJWTSecret(c.TransferSharedSecret)
+
+	if c.TransferSigningAlg == "" {
+		c.TransferSigningAlg = "HS256"
+	}
 }
 
 type svc struct {
 	conf    *config
 	handler http.Handler
+	nonces  *nonceCache
+	// verifyKey verifies the transfer tokens, the shared secret if nil.
+	verifyKey interface{}
 }
 
 // New returns a new datagateway
@@ -80,7 +112,12 @@ func New(m map[string]interface{}, log *zerolog.Logger) (global.Service, error)
 
 	conf.init()
 
-	s := &svc{conf: conf}
+	key, err := getVerifyKey(conf.TransferSigningAlg, conf.TransferSharedSecret, conf.TransferPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &svc{conf: conf, nonces: newNonceCache(), verifyKey: key}
 	s.setHandler()
 	return s, nil
 }
@@ -140,20 +177,170 @@ func (s *svc) verify(ctx context.Context, r *http.Request) (*transferClaims, err
 		r.Header.Set(TokenTransportHeader, token)
 	}
 
-	j, err := jwt.ParseWithClaims(token, &transferClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.conf.TransferSharedSecret), nil
-	})
+	j, err := jwt.ParseWithClaims(token, &transferClaims{}, s.keyFunc)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "error parsing token")
 	}
 
-	if claims, ok := j.Claims.(*transferClaims); ok && j.Valid {
-		return claims, nil
+	claims, ok := j.Claims.(*transferClaims)
+	if !ok || !j.Valid {
+		return nil, errtypes.InvalidCredentials("token invalid")
+	}
+
+	if err := s.verifyRequest(ctx, r, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keyFunc returns the key verifying the token, refusing tokens not signed with the configured algorithm.
+func (s *svc) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := s.conf.TransferSigningAlg
+	if alg == "" {
+		alg = "HS256"
+	}
+	if token.Method.Alg() != alg {
+		return nil, errtypes.InvalidCredentials("unexpected signing algorithm " + token.Method.Alg())
+	}
+	if s.verifyKey == nil {
+		return []byte(s.conf.TransferSharedSecret), nil
+	}
+	return s.verifyKey, nil
+}
+
+// getVerifyKey returns the key verifying the transfer tokens signed with alg: the shared secret
+// for HMAC algorithms, the PEM encoded public key stored at keyPath for RSA and ECDSA ones.
+func getVerifyKey(alg, secret, keyPath string) (interface{}, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, errors.New("datagateway: unknown transfer signing algorithm " + alg)
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return []byte(secret), nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+	default:
+		return nil, errors.New("datagateway: unsupported transfer signing algorithm " + alg)
+	}
+
+	if keyPath == "" {
+		return nil, errors.New("datagateway: transfer_public_key is required for " + alg)
+	}
+	pem, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "datagateway: error reading transfer public key")
 	}
 
-	err = errtypes.InvalidCredentials("token invalid")
-	return nil, err
+	var key interface{}
+	if _, ok := method.(*jwt.SigningMethodRSA); ok {
+		key, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+	} else {
+		key, err = jwt.ParseECPublicKeyFromPEM(pem)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "datagateway: error parsing transfer public key")
+	}
+	return key, nil
+}
+
+// verifyRequest checks that the request is the one the token was signed for.
+func (s *svc) verifyRequest(ctx context.Context, r *http.Request, claims *transferClaims) error {
+	switch claims.V {
+	case 0:
+		if s.conf.RejectUnversionedTokens {
+			return errtypes.InvalidCredentials("token without version")
+		}
+		appctx.GetLogger(ctx).Warn().Str("target", claims.Target).Msg("datagateway: accepting deprecated token without version")
+		return nil
+	case transferClaimsVersion:
+	default:
+		return errtypes.InvalidCredentials(fmt.Sprintf("unknown token version %d", claims.V))
+	}
+
+	if claims.Nonce == "" {
+		return errtypes.InvalidCredentials("token without nonce")
+	}
+
+	allowed := false
+	for _, m := range claims.Methods {
+		if m == r.Method {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return errtypes.InvalidCredentials("token not valid for method " + r.Method)
+	}
+
+	if claims.Length > 0 && r.ContentLength >= 0 {
+		switch r.Method {
+		case "PUT":
+			if r.ContentLength != claims.Length {
+				return errtypes.InvalidCredentials(fmt.Sprintf("content length %d does not match the signed length %d", r.ContentLength, claims.Length))
+			}
+		case "PATCH":
+			offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil {
+				offset = 0
+			}
+			if offset+r.ContentLength > claims.Length {
+				return errtypes.InvalidCredentials(fmt.Sprintf("upload exceeds the signed length %d", claims.Length))
+			}
+		}
+	}
+
+	if claims.Range != "" && r.Method == "GET" {
+		if rng := r.Header.Get("Range"); rng != "" && rng != claims.Range {
+			return errtypes.InvalidCredentials(fmt.Sprintf("range %s does not match the signed range %s", rng, claims.Range))
+		}
+	}
+
+	// a PUT uploads the whole file in one request, so its token cannot be used twice.
+	// The nonce is reserved for the upload, doPut releases it if the upload fails.
+	if r.Method == "PUT" && !s.nonces.reserve(claims.Nonce, time.Unix(claims.ExpiresAt, 0)) {
+		return errtypes.InvalidCredentials("token already used")
+	}
+	return nil
+}
+
+// nonceCache remembers the nonces of the tokens already used until the tokens expire.
+// The cache is local to the instance: behind a load balancer, a token can be used
+// once against every datagateway.
+type nonceCache struct {
+	sync.Mutex
+	used map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{used: map[string]time.Time{}}
+}
+
+// release forgets the nonce, so that the token can be used again.
+func (c *nonceCache) release(nonce string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.used, nonce)
+}
+
+// reserve records the nonce and reports whether it was not used before.
+func (c *nonceCache) reserve(nonce string, expires time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for n, exp := range c.used {
+		if now.After(exp) {
+			delete(c.used, n)
+		}
+	}
+
+	if _, ok := c.used[nonce]; ok {
+		return false
+	}
+	c.used[nonce] = expires
+	return true
 }
 
 func (s *svc) doHead(w http.ResponseWriter, r *http.Request) {
@@ -227,6 +414,10 @@ func (s *svc) doGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	httpReq.Header = r.Header
+	if claims.Range != "" {
+		// the token only allows to download the signed range, even if the client did not ask for it.
+		httpReq.Header.Set("Range", claims.Range)
+	}
 
 	httpRes, err := httpClient.Do(httpReq)
 	if err != nil {
@@ -237,12 +428,12 @@ func (s *svc) doGet(w http.ResponseWriter, r *http.Request) {
 	defer httpRes.Body.Close()
 
 	copyHeader(w.Header(), httpRes.Header)
-	if httpRes.StatusCode != http.StatusOK {
+	if httpRes.StatusCode != http.StatusOK && httpRes.StatusCode != http.StatusPartialContent {
 		w.WriteHeader(httpRes.StatusCode)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(httpRes.StatusCode)
 	_, err = io.Copy(w, httpRes.Body)
 	if err != nil {
 		log.Err(err).Msg("error writing body after headers were sent")
@@ -261,6 +452,14 @@ func (s *svc) doPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the token is only used once the upload succeeded, a failed one can be retried
+	uploaded := false
+	defer func() {
+		if !uploaded {
+			s.nonces.release(claims.Nonce)
+		}
+	}()
+
 	target := claims.Target
 	// add query params to target, clients can send checksums and other information.
 	targetURL, err := url.Parse(target)
@@ -301,6 +500,7 @@ func (s *svc) doPut(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(httpRes.StatusCode)
 		return
 	}
+	uploaded = true
 
 	w.WriteHeader(http.StatusOK)
 	_, err = io.Copy(w, httpRes.Body)
@@ -0,0 +1,267 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package datagateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func signTestToken(t *testing.T, claims transferClaims) string {
+	claims.StandardClaims = jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Audience:  "reva",
+	}
+	tkn, err := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+	return tkn
+}
+
+func TestVerify(t *testing.T) {
+	v2 := transferClaims{
+		Target:  "http://127.0.0.1:19001/data/file",
+		V:       transferClaimsVersion,
+		Methods: []string{"PUT", "PATCH", "HEAD"},
+		Length:  5,
+		Nonce:   "abc",
+	}
+
+	ranged := transferClaims{
+		Target:  v2.Target,
+		V:       transferClaimsVersion,
+		Methods: []string{"GET", "HEAD"},
+		Range:   "bytes=0-1023",
+		Nonce:   "abc",
+	}
+
+	tests := []struct {
+		name   string
+		claims transferClaims
+		method string
+		body   string
+		offset string
+		rng    string
+		reject bool
+		err    bool
+	}{
+		{"upload", v2, "PUT", "hello", "", "", false, false},
+		{"wrong method", v2, "GET", "", "", "", false, true},
+		{"wrong length", v2, "PUT", "hello world", "", "", false, true},
+		{"chunk", v2, "PATCH", "lo", "3", "", false, false},
+		{"chunk beyond length", v2, "PATCH", "lo", "4", "", false, true},
+		{"no nonce", transferClaims{Target: v2.Target, V: transferClaimsVersion, Methods: []string{"GET"}}, "GET", "", "", "", false, true},
+		{"unknown version", transferClaims{Target: v2.Target, V: 3, Methods: []string{"GET"}, Nonce: "abc"}, "GET", "", "", "", false, true},
+		{"unversioned", transferClaims{Target: v2.Target}, "PUT", "hello world", "", "", false, false},
+		{"unversioned rejected", transferClaims{Target: v2.Target}, "GET", "", "", "", true, true},
+		{"range", ranged, "GET", "", "", "bytes=0-1023", false, false},
+		{"range not asked", ranged, "GET", "", "", "", false, false},
+		{"other range", ranged, "GET", "", "", "bytes=1024-2047", false, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &svc{conf: &config{TransferSharedSecret: "secret", RejectUnversionedTokens: tt.reject}, nonces: newNonceCache()}
+			r := httptest.NewRequest(tt.method, "/datagateway", strings.NewReader(tt.body))
+			r.Header.Set(TokenTransportHeader, signTestToken(t, tt.claims))
+			if tt.offset != "" {
+				r.Header.Set("Upload-Offset", tt.offset)
+			}
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+
+			_, err := s.verify(context.Background(), r)
+			if (err != nil) != tt.err {
+				t.Errorf("verify() error = %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	s := &svc{conf: &config{TransferSharedSecret: "secret"}, nonces: newNonceCache()}
+	tkn := signTestToken(t, transferClaims{
+		Target:  "http://127.0.0.1:19001/data/file",
+		V:       transferClaimsVersion,
+		Methods: []string{"GET", "PUT"},
+		Nonce:   "abc",
+	})
+
+	do := func(method string) error {
+		r := httptest.NewRequest(method, "/datagateway", strings.NewReader("hello"))
+		r.Header.Set(TokenTransportHeader, tkn)
+		_, err := s.verify(context.Background(), r)
+		return err
+	}
+
+	// downloads can be resumed with the same token
+	for i := 0; i < 2; i++ {
+		if err := do(http.MethodGet); err != nil {
+			t.Fatalf("verify() error = %v", err)
+		}
+	}
+
+	if err := do(http.MethodPut); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+	if err := do(http.MethodPut); err == nil {
+		t.Errorf("verify() expected an error replaying an upload")
+	}
+}
+
+func TestPutRetryAfterFailure(t *testing.T) {
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	s := &svc{conf: &config{TransferSharedSecret: "secret", Timeout: 10}, nonces: newNonceCache()}
+	tkn := signTestToken(t, transferClaims{
+		Target:  srv.URL + "/data/file",
+		V:       transferClaimsVersion,
+		Methods: []string{"PUT"},
+		Nonce:   "abc",
+	})
+
+	put := func() int {
+		r := httptest.NewRequest(http.MethodPut, "/datagateway", strings.NewReader("hello"))
+		r.Header.Set(TokenTransportHeader, tkn)
+		w := httptest.NewRecorder()
+		s.doPut(w, r)
+		return w.Code
+	}
+
+	// a failed upload does not use the token
+	if code := put(); code != http.StatusInternalServerError {
+		t.Fatalf("doPut() status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	status = http.StatusOK
+	if code := put(); code != http.StatusOK {
+		t.Fatalf("doPut() status = %d, want %d", code, http.StatusOK)
+	}
+	if code := put(); code != http.StatusForbidden {
+		t.Errorf("doPut() status = %d replaying an upload, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestVerifySigningAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reva-datagateway")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("error marshaling public key: %v", err)
+	}
+	publicPath := path.Join(dir, "public.pem")
+	if err := ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing public key: %v", err)
+	}
+
+	claims := transferClaims{
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		Target:         "http://127.0.0.1:19001/data/file",
+		V:              transferClaimsVersion,
+		Methods:        []string{"GET"},
+		Nonce:          "abc",
+	}
+	rsaToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(private)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		alg   string
+		key   string
+		token string
+		err   bool
+	}{
+		{"hmac", "HS256", "", hmacToken, false},
+		{"rsa", "RS256", publicPath, rsaToken, false},
+		{"hmac token with rsa configured", "RS256", publicPath, hmacToken, true},
+		{"rsa token with hmac configured", "HS256", "", rsaToken, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := getVerifyKey(tt.alg, "secret", tt.key)
+			if err != nil {
+				t.Fatalf("getVerifyKey() error = %v", err)
+			}
+			s := &svc{conf: &config{TransferSharedSecret: "secret", TransferSigningAlg: tt.alg}, nonces: newNonceCache(), verifyKey: key}
+
+			r := httptest.NewRequest(http.MethodGet, "/datagateway", nil)
+			r.Header.Set(TokenTransportHeader, tt.token)
+			_, err = s.verify(context.Background(), r)
+			if (err != nil) != tt.err {
+				t.Errorf("verify() error = %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGetVerifyKeyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		alg     string
+		keyPath string
+	}{
+		{"unknown algorithm", "XS256", ""},
+		{"missing key", "RS256", ""},
+		{"unreadable key", "ES256", "/nonexistent/key.pem"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := getVerifyKey(tt.alg, "secret", tt.keyPath); err == nil {
+				t.Errorf("getVerifyKey() expected an error")
+			}
+		})
+	}
+}
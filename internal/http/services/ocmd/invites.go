@@ -230,7 +230,14 @@ func (h *invitesHandler) acceptInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if acceptInviteResponse.Status.Code != rpc.Code_CODE_OK {
-		WriteError(w, r, APIErrorServerError, "grpc accept invite request failed", errors.New(acceptInviteResponse.Status.Message))
+		switch acceptInviteResponse.Status.Code {
+		case rpc.Code_CODE_NOT_FOUND:
+			WriteError(w, r, APIErrorNotFound, "invite token not found", errors.New(acceptInviteResponse.Status.Message))
+		case rpc.Code_CODE_INVALID_ARGUMENT:
+			WriteError(w, r, APIErrorInvalidParameter, "invite token expired or already used", errors.New(acceptInviteResponse.Status.Message))
+		default:
+			WriteError(w, r, APIErrorServerError, "grpc accept invite request failed", errors.New(acceptInviteResponse.Status.Message))
+		}
 		return
 	}
 
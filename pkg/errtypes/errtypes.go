@@ -75,6 +75,22 @@ func (e NotSupported) Error() string { return "error: not supported: " + string(
 // IsNotSupported implements the IsNotSupported interface.
 func (e NotSupported) IsNotSupported() {}
 
+// BadRequest is the error to use when the request contains invalid arguments.
+type BadRequest string
+
+func (e BadRequest) Error() string { return "error: bad request: " + string(e) }
+
+// IsBadRequest implements the IsBadRequest interface.
+func (e BadRequest) IsBadRequest() {}
+
+// Unavailable is the error to use when a service is temporarily unavailable.
+type Unavailable string
+
+func (e Unavailable) Error() string { return "error: unavailable: " + string(e) }
+
+// IsUnavailable implements the IsUnavailable interface.
+func (e Unavailable) IsUnavailable() {}
+
 // IsNotFound is the interface to implement
 // to specify that an a resource is not found.
 type IsNotFound interface {
@@ -116,3 +132,15 @@ type IsNotSupported interface {
 type IsPermissionDenied interface {
 	IsPermissionDenied()
 }
+
+// IsBadRequest is the interface to implement
+// to specify that the request contains invalid arguments.
+type IsBadRequest interface {
+	IsBadRequest()
+}
+
+// IsUnavailable is the interface to implement
+// to specify that a service is temporarily unavailable.
+type IsUnavailable interface {
+	IsUnavailable()
+}
@@ -0,0 +1,74 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package invite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+)
+
+// The events logged for the audit of the invite acceptances, in the event field.
+// The names of the events and of their fields are stable, to be parsed downstream.
+const (
+	AuditInviteAccepted = "ocm_invite_accepted"
+	AuditInviteRejected = "ocm_invite_rejected"
+)
+
+// AuditAcceptInvite logs the outcome of the acceptance of the invite token by the remote user:
+// which remote user accepted whose invite from which provider, or why the acceptance was
+// rejected. The local user is the inviter, unknown when a token that does not exist is rejected.
+// The token itself is not logged, as it would let anyone reading the logs accept it, only its id.
+func AuditAcceptInvite(ctx context.Context, token *invitepb.InviteToken, remoteUser, inviter *userpb.User, err error) {
+	local := inviter.GetId()
+	if local == nil {
+		local = token.GetUserId()
+	}
+
+	log := appctx.GetLogger(ctx)
+	event := log.Info().Str("event", AuditInviteAccepted)
+	msg := "ocm: invite accepted"
+	if err != nil {
+		event = log.Info().Str("event", AuditInviteRejected).Str("reason", err.Error())
+		msg = "ocm: invite rejected"
+	}
+
+	event.
+		Str("local_user_id", local.GetOpaqueId()).
+		Str("local_user_idp", local.GetIdp()).
+		Str("remote_user_id", remoteUser.GetId().GetOpaqueId()).
+		Str("remote_idp", remoteUser.GetId().GetIdp()).
+		Str("token_id", TokenID(token)).
+		Str("timestamp", time.Now().UTC().Format(time.RFC3339)).
+		Msg(msg)
+}
+
+// TokenID returns the id of an invite token, identifying the token in the logs without revealing it.
+func TokenID(token *invitepb.InviteToken) string {
+	if token.GetToken() == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token.GetToken()))
+	return hex.EncodeToString(sum[:8])
+}
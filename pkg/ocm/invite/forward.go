@@ -0,0 +1,302 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package invite
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/provider"
+	"github.com/pkg/errors"
+)
+
+const acceptInviteEndpoint = "invites/accept"
+
+// DefaultForwardAttempts is the number of times an invite is forwarded to a partner provider
+// failing with a transient error when unspecified in the config.
+const DefaultForwardAttempts = 3
+
+// DefaultForwardRetryDelay is the delay in milliseconds before forwarding an invite again
+// when unspecified in the config.
+const DefaultForwardRetryDelay = 500
+
+// DefaultForwardTimeout is the time in seconds to wait for the partner providers to
+// answer a forwarded invite when unspecified in the config.
+const DefaultForwardTimeout = 10
+
+// profileFields maps the opaque keys of a user to the optional form fields sent when forwarding invites.
+var profileFields = map[string]string{
+	"avatar_url":  "avatarURL",
+	"profile_url": "profileURL",
+}
+
+// ForwardConfig is the configuration of the forwarding of the invites to the partner providers,
+// embedded in the configurations of the managers.
+type ForwardConfig struct {
+	// MaxResponseSize is the maximum number of bytes read from the responses of the partner providers.
+	MaxResponseSize int64 `mapstructure:"max_response_size"`
+	// ForwardTimeout is the time in seconds to wait for the partner providers to accept a forwarded invite.
+	ForwardTimeout int `mapstructure:"forward_timeout"`
+	// ForwardAttempts is the number of times an invite is forwarded to a partner provider
+	// that cannot be reached or fails with a server error.
+	ForwardAttempts int `mapstructure:"forward_attempts"`
+	// ForwardRetryDelay is the delay in milliseconds before forwarding an invite again, doubled every attempt.
+	ForwardRetryDelay int `mapstructure:"forward_retry_delay"`
+	// CACert is the file of the PEM encoded certificates of the authorities trusted to verify
+	// the partner providers, e.g. for private meshes. Empty means using the system pool.
+	CACert string `mapstructure:"ca_cert"`
+	// Insecure allows to forward invites to partner providers over plain http and without
+	// verifying their certificates.
+	Insecure bool `mapstructure:"insecure"`
+	// AllowIncompleteProfile allows to forward invites of users without display name or
+	// valid email, for the meshes accepting them.
+	AllowIncompleteProfile bool `mapstructure:"allow_incomplete_profile"`
+
+	client *http.Client
+}
+
+// Init sets the defaults of the unspecified options and creates the client forwarding the invites.
+func (c *ForwardConfig) Init() error {
+	if c.MaxResponseSize == 0 {
+		c.MaxResponseSize = DefaultMaxResponseSize
+	}
+
+	if c.ForwardTimeout == 0 {
+		c.ForwardTimeout = DefaultForwardTimeout
+	}
+
+	if c.ForwardAttempts == 0 {
+		c.ForwardAttempts = DefaultForwardAttempts
+	}
+
+	if c.ForwardRetryDelay == 0 {
+		c.ForwardRetryDelay = DefaultForwardRetryDelay
+	}
+
+	client, err := NewForwardClient(c.ForwardTimeout, c.CACert, c.Insecure)
+	if err != nil {
+		return err
+	}
+	c.client = client
+	return nil
+}
+
+// Forward sends the invite token of the user to the OCM endpoints of the origin provider,
+// the endpoints after the first one being failovers tried in order until one accepts it.
+// The owner of the token is checked by the managers beforehand.
+func (c *ForwardConfig) Forward(ctx context.Context, token *invitepb.InviteToken, u *userpb.User, originProvider *ocmprovider.ProviderInfo) error {
+	if !c.AllowIncompleteProfile {
+		if err := CheckProfile(u); err != nil {
+			return err
+		}
+	}
+
+	requestBody := url.Values{
+		"token":             {token.GetToken()},
+		"userID":            {u.GetId().GetOpaqueId()},
+		"recipientProvider": {u.GetId().GetIdp()},
+		"email":             {u.GetMail()},
+		"name":              {u.GetDisplayName()},
+	}
+	addProfileFields(requestBody, u)
+	ocmEndpoints, err := OCMEndpoints(originProvider)
+	if err != nil {
+		return err
+	}
+
+	for _, ocmEndpoint := range ocmEndpoints {
+		if err = c.forwardTo(ctx, ocmEndpoint, requestBody); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// forwardTo sends the form accepting an invite to the OCM endpoint of a partner provider.
+func (c *ForwardConfig) forwardTo(ctx context.Context, ocmEndpoint string, requestBody url.Values) error {
+	if err := CheckEndpoint(ocmEndpoint, c.Insecure); err != nil {
+		return err
+	}
+
+	resp, err := PostFormWithRetries(ctx, c.client, fmt.Sprintf("%s%s", ocmEndpoint, acceptInviteEndpoint), requestBody,
+		c.ForwardAttempts, time.Duration(c.ForwardRetryDelay)*time.Millisecond)
+	if err != nil {
+		return errors.Wrap(err, "invite: error sending post request")
+	}
+
+	defer resp.Body.Close()
+	respBody, truncated, err := ReadResponse(resp.Body, c.MaxResponseSize)
+	if err != nil {
+		return errors.Wrap(err, "invite: error reading response body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrap(errors.New(ResponseError(resp.Status, respBody, truncated)), "invite: error sending accept post request")
+	}
+	return nil
+}
+
+// addProfileFields adds the optional profile fields of the user, if set in its opaque, to the form.
+func addProfileFields(form url.Values, u *userpb.User) {
+	for key, field := range profileFields {
+		if e, ok := u.GetOpaque().GetMap()[key]; ok && len(e.Value) > 0 {
+			form.Set(field, string(e.Value))
+		}
+	}
+}
+
+// OCMEndpoints returns the endpoints of all the OCM services of the provider, in their order.
+func OCMEndpoints(originProvider *ocmprovider.ProviderInfo) ([]string, error) {
+	var endpoints []string
+	for _, s := range provider.ServicesByType(originProvider, provider.ServiceTypeOCM) {
+		endpoints = append(endpoints, s.Endpoint.Path)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("invite: ocm endpoint not specified for mesh provider")
+	}
+	return endpoints, nil
+}
+
+// CheckTokenOwner verifies that the user forwarding an invite is the owner the token has been
+// generated for. The owner must be taken from the stored tokens, the one carried by the request
+// is supplied by the client. A nil owner, for the tokens generated by other providers which are
+// not stored, cannot be checked.
+func CheckTokenOwner(owner, userID *userpb.UserId) error {
+	if owner == nil {
+		return nil
+	}
+	if owner.GetOpaqueId() != userID.GetOpaqueId() || owner.GetIdp() != userID.GetIdp() {
+		return errtypes.PermissionDenied("invite: invite token does not belong to user " + userID.GetOpaqueId())
+	}
+	return nil
+}
+
+// IsAdmin returns whether the user is a member of the admin group.
+func IsAdmin(u *userpb.User, group string) bool {
+	if group == "" {
+		return false
+	}
+	for _, g := range u.GetGroups() {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// NewForwardClient returns the client forwarding invites to the partner providers,
+// giving up after timeout seconds so that a hanging partner does not block the caller.
+// The certificates of the partners are verified against the system pool or, when set,
+// the PEM encoded certificates in the caCert file, unless insecure.
+func NewForwardClient(timeout int, caCert string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "invite: error reading ca certificates")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("invite: no certificate found in " + caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// the defaults are kept, e.g. the proxy from the environment and the dial timeouts
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// CheckEndpoint verifies that the invites are forwarded over TLS to the endpoint,
+// unless insecure.
+func CheckEndpoint(endpoint string, insecure bool) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrap(err, "invite: error parsing endpoint "+endpoint)
+	}
+	if u.Scheme != "https" && !insecure {
+		return errors.New("invite: refusing to forward invite to non https endpoint " + endpoint)
+	}
+	return nil
+}
+
+// CheckProfile verifies that the user forwarding an invite has a display name and a valid
+// email, as sent to the partner provider, which would otherwise reject the invite.
+func CheckProfile(u *userpb.User) error {
+	if u.GetDisplayName() == "" {
+		return errtypes.BadRequest("invite: the display name of user " + u.GetId().GetOpaqueId() + " is missing")
+	}
+	if u.GetMail() == "" {
+		return errtypes.BadRequest("invite: the email of user " + u.GetId().GetOpaqueId() + " is missing")
+	}
+	// only bare addresses are accepted, not the forms with a display name
+	if addr, err := mail.ParseAddress(u.GetMail()); err != nil || addr.Address != u.GetMail() {
+		return errtypes.BadRequest("invite: the email of user " + u.GetId().GetOpaqueId() + " is invalid: " + u.GetMail())
+	}
+	return nil
+}
+
+// PostForm posts the form to the url of a partner provider with the client,
+// aborting when the context is canceled.
+func PostForm(ctx context.Context, client *http.Client, u string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
+
+// PostFormWithRetries posts the form like PostForm, trying up to attempts times while the
+// partner provider cannot be reached or answers with a server error, as happens during its
+// deployments. The delay between the attempts starts at delay and doubles every attempt.
+// Client errors are not retried, they mean that the invite is refused.
+func PostFormWithRetries(ctx context.Context, client *http.Client, u string, form url.Values, attempts int, delay time.Duration) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := PostForm(ctx, client, u, form)
+		transient := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if !transient || attempt >= attempts || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay << uint(attempt-1)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package invite
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+)
+
+func TestNewForwardClient(t *testing.T) {
+	c, err := NewForwardClient(DefaultForwardTimeout, "", true)
+	if err != nil {
+		t.Fatalf("NewForwardClient() error = %v", err)
+	}
+
+	transport := c.Transport.(*http.Transport)
+	if transport == http.DefaultTransport {
+		t.Fatalf("NewForwardClient() shares the default transport")
+	}
+	if transport.Proxy == nil {
+		t.Errorf("NewForwardClient() transport ignores the proxy from the environment")
+	}
+	if transport.TLSHandshakeTimeout != http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout {
+		t.Errorf("NewForwardClient() TLSHandshakeTimeout = %v, want the default", transport.TLSHandshakeTimeout)
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("NewForwardClient() transport verifies the certificates of insecure partners")
+	}
+}
+
+func TestAddProfileFields(t *testing.T) {
+	u := &userpb.User{
+		Id: &userpb.UserId{OpaqueId: "einstein"},
+		Opaque: &typespb.Opaque{
+			Map: map[string]*typespb.OpaqueEntry{
+				"avatar_url": {Decoder: "plain", Value: []byte("https://cernbox.cern.ch/avatars/einstein.png")},
+			},
+		},
+	}
+
+	form := url.Values{}
+	addProfileFields(form, u)
+	if form.Get("avatarURL") != "https://cernbox.cern.ch/avatars/einstein.png" {
+		t.Errorf("expected avatar url in form, got %v", form)
+	}
+	if _, ok := form["profileURL"]; ok {
+		t.Errorf("expected no profile url in form, got %v", form)
+	}
+}
@@ -20,23 +20,109 @@ package invite
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
 	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
 )
 
+// DefaultMaxActiveTokensPerUser is the number of unexpired tokens a user can hold
+// when unspecified in the config.
+const DefaultMaxActiveTokensPerUser = 100
+
+// ExpiredTokenRetention is the time the expired tokens are remembered after their expiration,
+// once removed, for the accepts of the invites to still fail as expired rather than unknown.
+const ExpiredTokenRetention = 30 * 24 * time.Hour
+
 // Manager is the interface that is used to perform operations to invites.
 type Manager interface {
 	// GenerateToken creates a new token for the user with a specified validity.
+	// The description set in the context with ContextSetDescription is stored with the token.
 	GenerateToken(ctx context.Context) (*invitepb.InviteToken, error)
 
 	// ForwardInvite forwards a received invite to the sync'n'share system provider.
 	ForwardInvite(ctx context.Context, invite *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error
 
-	// AcceptInvite completes an invitation acceptance.
-	AcceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) error
+	// AcceptInvite completes an invitation acceptance and returns the user who generated the token,
+	// of whom only the id is known, for the caller to trust the inviter in return.
+	AcceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error)
 
 	// GetRemoteUser retrieves details about a remote user who has accepted an invite to share.
 	GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId) (*userpb.User, error)
+
+	// ListInvites returns the unexpired tokens generated by the user in the context.
+	ListInvites(ctx context.Context) ([]*Invite, error)
+
+	// RevokeToken invalidates a token generated by the user in the context before it expires.
+	RevokeToken(ctx context.Context, token *invitepb.InviteToken) error
+
+	// PurgeUser removes the tokens generated by a local user and the users who accepted them.
+	// It can only be called by admins.
+	PurgeUser(ctx context.Context, userID *userpb.UserId) error
+}
+
+// Invite is an invite token with the description given by the user who generated it,
+// for the user to tell the tokens apart.
+type Invite struct {
+	Token       *invitepb.InviteToken
+	Description string
+}
+
+// InviterOpaqueKey is the key of the opaque of the responses to accept invites holding
+// the JSON encoded id of the user who generated the token.
+const InviterOpaqueKey = "inviter"
+
+// DescriptionOpaqueKey is the key of the opaque of the requests to generate tokens holding their description.
+const DescriptionOpaqueKey = "description"
+
+type descriptionKey struct{}
+
+// ContextSetDescription stores the description of the token to generate in the context.
+func ContextSetDescription(ctx context.Context, description string) context.Context {
+	return context.WithValue(ctx, descriptionKey{}, description)
+}
+
+// ContextGetDescription returns the description of the token to generate, if any.
+func ContextGetDescription(ctx context.Context) string {
+	d, _ := ctx.Value(descriptionKey{}).(string)
+	return d
+}
+
+// TooManyTokensError returns the error of a user holding already max unexpired tokens.
+func TooManyTokensError(max int) error {
+	return errtypes.PermissionDenied(fmt.Sprintf("reached the maximum of %d active invite tokens", max))
+}
+
+// FindRemoteUser returns the accepted user with the id. The idp of the id can be left empty
+// when a single accepted user has its opaque id, otherwise the match would be arbitrary
+// and a bad request error is returned.
+func FindRemoteUser(acceptedUsers []*userpb.User, remoteUserID *userpb.UserId) (*userpb.User, error) {
+	var match *userpb.User
+	for _, acceptedUser := range acceptedUsers {
+		if acceptedUser.GetId().GetOpaqueId() != remoteUserID.GetOpaqueId() {
+			continue
+		}
+		if acceptedUser.GetId().GetIdp() == remoteUserID.GetIdp() {
+			return acceptedUser, nil
+		}
+		if remoteUserID.GetIdp() == "" {
+			if match != nil {
+				return nil, AmbiguousRemoteUserError(remoteUserID)
+			}
+			match = acceptedUser
+		}
+	}
+	if match == nil {
+		return nil, errtypes.NotFound(remoteUserID.GetOpaqueId())
+	}
+	return match, nil
+}
+
+// AmbiguousRemoteUserError returns the error of a remote user id without idp matching
+// several accepted users.
+func AmbiguousRemoteUserError(remoteUserID *userpb.UserId) error {
+	return errtypes.BadRequest("remote user " + remoteUserID.GetOpaqueId() + " is ambiguous, its idp is required")
 }
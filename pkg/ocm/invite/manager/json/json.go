@@ -21,11 +21,10 @@ package json
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -39,25 +38,51 @@ import (
 	"github.com/cs3org/reva/pkg/user"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
-const acceptInviteEndpoint = "invites/accept"
-
 type inviteModel struct {
 	File          string
 	Invites       map[string]*invitepb.InviteToken `json:"invites"`
 	AcceptedUsers map[string][]*userpb.User        `json:"accepted_users"`
+	// UsedTokens maps the single use tokens already accepted to their expiration, in seconds since epoch.
+	UsedTokens map[string]uint64 `json:"used_tokens"`
+	// ExpiredTokens maps the expired tokens removed from the invites to their expiration, in seconds
+	// since epoch. They are remembered for invite.ExpiredTokenRetention.
+	ExpiredTokens map[string]uint64 `json:"expired_tokens"`
+	// Descriptions maps the tokens to the descriptions given by their owners.
+	Descriptions map[string]string `json:"descriptions"`
 }
 
 type manager struct {
-	config     *config
-	sync.Mutex // concurrent access to the file
-	model      *inviteModel
+	config       *config
+	sync.RWMutex // concurrent access to the file
+	model        *inviteModel
+
+	done      chan struct{} // closed to stop the sweeper
+	closeOnce sync.Once
 }
 
 type config struct {
 	File       string `mapstructure:"file"`
 	Expiration string `mapstructure:"expiration"`
+	AdminGroup string `mapstructure:"admin_group"`
+	// TokenGenerator is the name of the strategy generating the invite tokens.
+	TokenGenerator string `mapstructure:"token_generator"`
+	// TokenLength is the number of random bytes of the tokens, for the base58 and random generators.
+	TokenLength int `mapstructure:"token_length"`
+	// SweepInterval is the time in seconds between the removals of the expired tokens from the file.
+	// A negative value disables the periodic removal, the expired tokens are still removed on every save.
+	SweepInterval int `mapstructure:"sweep_interval"`
+	// SingleUse makes the tokens acceptable only once.
+	SingleUse bool `mapstructure:"single_use"`
+	// MaxActiveTokensPerUser is the number of unexpired tokens a user can hold.
+	// A negative value disables the limit.
+	MaxActiveTokensPerUser int `mapstructure:"max_active_tokens_per_user"`
+
+	invite.ForwardConfig `mapstructure:",squash"`
+
+	expiration time.Duration
 }
 
 func init() {
@@ -72,6 +97,38 @@ func (c *config) init() error {
 	if c.Expiration == "" {
 		c.Expiration = token.DefaultExpirationTime
 	}
+	expiration, err := token.ParseExpiration(c.Expiration)
+	if err != nil {
+		return err
+	}
+	c.expiration = expiration
+
+	if c.TokenGenerator == "" {
+		c.TokenGenerator = token.DefaultGenerator
+	}
+
+	if c.TokenLength == 0 {
+		c.TokenLength = token.DefaultLength
+	}
+
+	if c.SweepInterval == 0 {
+		c.SweepInterval = 3600
+	}
+
+	if c.MaxActiveTokensPerUser == 0 {
+		c.MaxActiveTokensPerUser = invite.DefaultMaxActiveTokensPerUser
+	}
+
+	if err := c.ForwardConfig.Init(); err != nil {
+		return err
+	}
+
+	if _, err := token.GetGenerator(c.TokenGenerator); err != nil {
+		return err
+	}
+	if err := token.CheckLength(c.TokenLength); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -99,6 +156,11 @@ func New(m map[string]interface{}) (invite.Manager, error) {
 	manager := &manager{
 		config: config,
 		model:  model,
+		done:   make(chan struct{}),
+	}
+
+	if config.SweepInterval > 0 {
+		go manager.sweepEvery(time.Duration(config.SweepInterval) * time.Second)
 	}
 
 	return manager, nil
@@ -136,6 +198,10 @@ func loadOrCreate(file string) (*inviteModel, error) {
 	}
 
 	model := &inviteModel{}
+	// an empty file, e.g. left by a crash of a previous version while writing, holds no invites.
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
 	if err := json.Unmarshal(data, model); err != nil {
 		err = errors.Wrap(err, "error decoding invite data to json")
 		return nil, err
@@ -147,19 +213,31 @@ func loadOrCreate(file string) (*inviteModel, error) {
 	if model.AcceptedUsers == nil {
 		model.AcceptedUsers = make(map[string][]*userpb.User)
 	}
+	if model.UsedTokens == nil {
+		model.UsedTokens = make(map[string]uint64)
+	}
+	if model.ExpiredTokens == nil {
+		model.ExpiredTokens = make(map[string]uint64)
+	}
+	if model.Descriptions == nil {
+		model.Descriptions = make(map[string]string)
+	}
 
 	model.File = file
 	return model, nil
 }
 
+// Save writes the model to its file, removing the expired tokens first.
 func (model *inviteModel) Save() error {
+	model.prune(time.Now())
+
 	data, err := json.Marshal(model)
 	if err != nil {
 		err = errors.Wrap(err, "error encoding invite data to json")
 		return err
 	}
 
-	if err := ioutil.WriteFile(model.File, data, 0644); err != nil {
+	if err := writeFileAtomic(model.File, data); err != nil {
 		err = errors.Wrap(err, "error writing invite data to file: "+model.File)
 		return err
 	}
@@ -167,10 +245,120 @@ func (model *inviteModel) Save() error {
 	return nil
 }
 
+// writeFileAtomic replaces the content of file with data, writing it to a temporary
+// file synced to disk before renaming it over file, so that a crash while writing
+// leaves either the old or the new content but never a truncated file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	// the temporary file is left only when failing before the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// prune removes the tokens expired at now and returns how many were removed. The removed tokens
+// are remembered as expired, until the end of their retention.
+func (model *inviteModel) prune(now time.Time) int {
+	removed := 0
+	for k, t := range model.Invites {
+		if t.GetExpiration() != nil && uint64(now.Unix()) > t.Expiration.Seconds {
+			model.removeToken(k)
+			model.ExpiredTokens[k] = t.Expiration.Seconds
+			removed++
+		}
+	}
+	for k, expiration := range model.UsedTokens {
+		if uint64(now.Unix()) > expiration {
+			delete(model.UsedTokens, k)
+			model.ExpiredTokens[k] = expiration
+			removed++
+		}
+	}
+	retention := uint64(invite.ExpiredTokenRetention.Seconds())
+	for k, expiration := range model.ExpiredTokens {
+		if uint64(now.Unix()) > expiration+retention {
+			delete(model.ExpiredTokens, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// countTokens returns the number of tokens generated by the user.
+func (model *inviteModel) countTokens(userID *userpb.UserId) int {
+	n := 0
+	for _, t := range model.Invites {
+		if t.GetUserId().GetOpaqueId() == userID.GetOpaqueId() {
+			n++
+		}
+	}
+	return n
+}
+
+// removeToken removes the token and its description.
+func (model *inviteModel) removeToken(token string) {
+	delete(model.Invites, token)
+	delete(model.Descriptions, token)
+}
+
+// sweep removes the expired tokens and persists the model if any was removed.
+func (m *manager) sweep() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.model.prune(time.Now()) == 0 {
+		return nil
+	}
+	if err := m.model.Save(); err != nil {
+		return errors.Wrap(err, "json: error saving model")
+	}
+	return nil
+}
+
+// sweepEvery sweeps the expired tokens at every interval until the manager is closed.
+func (m *manager) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if err := m.sweep(); err != nil {
+				log.Error().Err(err).Msg("json: error sweeping expired invite tokens")
+			}
+		}
+	}
+}
+
+// Close stops the removal of the expired tokens.
+func (m *manager) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
 func (m *manager) GenerateToken(ctx context.Context) (*invitepb.InviteToken, error) {
 
 	contexUser := user.ContextMustGetUser(ctx)
-	inviteToken, err := token.CreateToken(m.config.Expiration, contexUser.GetId())
+	inviteToken, err := token.CreateTokenFor(m.config.expiration, m.config.TokenGenerator, m.config.TokenLength, contexUser.GetId())
 	if err != nil {
 		return nil, err
 	}
@@ -179,104 +367,183 @@ func (m *manager) GenerateToken(ctx context.Context) (*invitepb.InviteToken, err
 	m.Lock()
 	defer m.Unlock()
 
+	if max := m.config.MaxActiveTokensPerUser; max > 0 {
+		// the expired tokens do not count against the limit
+		m.model.prune(time.Now())
+		if m.model.countTokens(contexUser.GetId()) >= max {
+			return nil, invite.TooManyTokensError(max)
+		}
+	}
+
 	m.model.Invites[inviteToken.GetToken()] = inviteToken
+	if description := invite.ContextGetDescription(ctx); description != "" {
+		m.model.Descriptions[inviteToken.GetToken()] = description
+	}
 	if err := m.model.Save(); err != nil {
 		err = errors.Wrap(err, "error saving model")
 		return nil, err
 	}
 
+	m.recordAcceptedUsers(ctx, contexUser.GetId())
 	return inviteToken, nil
 }
 
-func (m *manager) ForwardInvite(ctx context.Context, invite *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
+func (m *manager) ForwardInvite(ctx context.Context, inviteToken *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
 
 	contextUser := user.ContextMustGetUser(ctx)
-	requestBody := url.Values{
-		"token":             {invite.GetToken()},
-		"userID":            {contextUser.GetId().GetOpaqueId()},
-		"recipientProvider": {contextUser.GetId().GetIdp()},
-		"email":             {contextUser.GetMail()},
-		"name":              {contextUser.GetDisplayName()},
-	}
-	ocmEndpoint, err := getOCMEndpoint(originProvider)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.PostForm(fmt.Sprintf("%s%s", ocmEndpoint, acceptInviteEndpoint), requestBody)
-	if err != nil {
-		err = errors.Wrap(err, "json: error sending post request")
-		return err
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		respBody, e := ioutil.ReadAll(resp.Body)
-		if e != nil {
-			e = errors.Wrap(e, "json: error reading request body")
-			return e
-		}
-		err = errors.Wrap(errors.New(fmt.Sprintf("%s: %s", resp.Status, string(respBody))), "json: error sending accept post request")
+	if err := m.checkTokenOwner(inviteToken, contextUser.GetId()); err != nil {
 		return err
 	}
+	return m.config.Forward(ctx, inviteToken, contextUser, originProvider)
+}
 
-	return nil
+func (m *manager) AcceptInvite(ctx context.Context, inviteToken *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+	inviter, err := m.acceptInvite(ctx, inviteToken, remoteUser)
+	invite.AuditAcceptInvite(ctx, inviteToken, remoteUser, inviter, err)
+	return inviter, err
 }
 
-func (m *manager) AcceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) error {
+func (m *manager) acceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
 
 	m.Lock()
 	defer m.Unlock()
 
 	inviteToken, err := m.getTokenIfValid(invite)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Add to the list of accepted users
 	userKey := inviteToken.GetUserId().GetOpaqueId()
 	for _, acceptedUser := range m.model.AcceptedUsers[userKey] {
 		if acceptedUser.Id.GetOpaqueId() == remoteUser.Id.OpaqueId && acceptedUser.Id.GetIdp() == remoteUser.Id.Idp {
-			return errors.New("json: user already added to accepted users")
+			return nil, errors.New("json: user already added to accepted users")
 		}
 
 	}
 	m.model.AcceptedUsers[userKey] = append(m.model.AcceptedUsers[userKey], remoteUser)
+	if m.config.SingleUse {
+		m.model.removeToken(inviteToken.GetToken())
+		m.model.UsedTokens[inviteToken.GetToken()] = inviteToken.GetExpiration().GetSeconds()
+	}
 	if err := m.model.Save(); err != nil {
 		err = errors.Wrap(err, "json: error saving model")
-		return err
+		return nil, err
 	}
-	return nil
+
+	m.recordAcceptedUsers(ctx, inviteToken.GetUserId())
+	return &userpb.User{Id: inviteToken.GetUserId()}, nil
 }
 
 func (m *manager) GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId) (*userpb.User, error) {
 
 	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
-	for _, acceptedUser := range m.model.AcceptedUsers[userKey] {
-		if (acceptedUser.Id.GetOpaqueId() == remoteUserID.OpaqueId) && (remoteUserID.Idp == "" || acceptedUser.Id.GetIdp() == remoteUserID.Idp) {
-			return acceptedUser, nil
+
+	m.RLock()
+	defer m.RUnlock()
+	return invite.FindRemoteUser(m.model.AcceptedUsers[userKey], remoteUserID)
+}
+
+func (m *manager) ListInvites(ctx context.Context) ([]*invite.Invite, error) {
+	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
+	now := uint64(time.Now().Unix())
+
+	m.RLock()
+	defer m.RUnlock()
+
+	invites := []*invite.Invite{}
+	for k, t := range m.model.Invites {
+		if t.GetUserId().GetOpaqueId() == userKey && now <= t.GetExpiration().GetSeconds() {
+			invites = append(invites, &invite.Invite{Token: t, Description: m.model.Descriptions[k]})
 		}
 	}
-	return nil, errtypes.NotFound(remoteUserID.OpaqueId)
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Token.Token < invites[j].Token.Token })
+	return invites, nil
+}
+
+func (m *manager) RevokeToken(ctx context.Context, token *invitepb.InviteToken) error {
+	userID := user.ContextMustGetUser(ctx).GetId()
+
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.model.Invites[token.GetToken()]
+	if !ok {
+		return errtypes.NotFound(token.GetToken())
+	}
+	owner := t.GetUserId()
+	if owner.GetOpaqueId() != userID.GetOpaqueId() || owner.GetIdp() != userID.GetIdp() {
+		return errtypes.PermissionDenied("json: invite token does not belong to user " + userID.GetOpaqueId())
+	}
+
+	m.model.removeToken(token.GetToken())
+	if err := m.model.Save(); err != nil {
+		return errors.Wrap(err, "json: error saving model")
+	}
+	return nil
+}
+
+func (m *manager) PurgeUser(ctx context.Context, userID *userpb.UserId) error {
+	ctxUser := user.ContextMustGetUser(ctx)
+	if !invite.IsAdmin(ctxUser, m.config.AdminGroup) {
+		return errtypes.PermissionDenied("json: user " + ctxUser.GetId().GetOpaqueId() + " is not allowed to purge users")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for k, t := range m.model.Invites {
+		owner := t.GetUserId()
+		if owner.GetOpaqueId() == userID.GetOpaqueId() && owner.GetIdp() == userID.GetIdp() {
+			m.model.removeToken(k)
+		}
+	}
+	delete(m.model.AcceptedUsers, userID.GetOpaqueId())
+
+	if err := m.model.Save(); err != nil {
+		return errors.Wrap(err, "json: error saving model")
+	}
+	return nil
+}
+
+// recordAcceptedUsers emits the number of remote users who accepted the invites of the user.
+// The lock must be held.
+func (m *manager) recordAcceptedUsers(ctx context.Context, userID *userpb.UserId) {
+	invite.RecordAcceptedUsers(ctx, userID, m.acceptedUsersCount(userID))
+}
+
+// acceptedUsersCount returns the number of remote users who accepted the invites of the user.
+// The lock must be held.
+func (m *manager) acceptedUsersCount(userID *userpb.UserId) int {
+	return len(m.model.AcceptedUsers[userID.GetOpaqueId()])
 }
 
 func (m *manager) getTokenIfValid(token *invitepb.InviteToken) (*invitepb.InviteToken, error) {
 	inviteToken, ok := m.model.Invites[token.GetToken()]
 	if !ok {
-		return nil, errors.New("json: invalid token")
+		if _, used := m.model.UsedTokens[token.GetToken()]; used {
+			return nil, errtypes.BadRequest("json: token already used")
+		}
+		if _, expired := m.model.ExpiredTokens[token.GetToken()]; expired {
+			return nil, errtypes.BadRequest("json: token expired")
+		}
+		return nil, errtypes.NotFound("json: invalid token")
 	}
 
 	if uint64(time.Now().Unix()) > inviteToken.Expiration.Seconds {
-		return nil, errors.New("json: token expired")
+		return nil, errtypes.BadRequest("json: token expired")
 	}
 	return inviteToken, nil
 }
 
-func getOCMEndpoint(originProvider *ocmprovider.ProviderInfo) (string, error) {
-	for _, s := range originProvider.Services {
-		if s.Endpoint.Type.Name == "OCM" {
-			return s.Endpoint.Path, nil
-		}
+// checkTokenOwner verifies that the user forwarding an invite is the owner of the stored token.
+// Tokens generated by other providers are not stored and cannot be checked.
+func (m *manager) checkTokenOwner(token *invitepb.InviteToken, userID *userpb.UserId) error {
+	m.RLock()
+	t, ok := m.model.Invites[token.GetToken()]
+	m.RUnlock()
+	if !ok {
+		return nil
 	}
-	return "", errors.New("json: ocm endpoint not specified for mesh provider")
+	return invite.CheckTokenOwner(t.GetUserId(), userID)
 }
@@ -0,0 +1,849 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package json
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/invite"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+func newTestContext(opaqueID string, groups ...string) context.Context {
+	u := &userpb.User{
+		Id: &userpb.UserId{
+			Idp:      "http://localhost:20080",
+			OpaqueId: opaqueID,
+		},
+		Username:    opaqueID,
+		Mail:        opaqueID + "@example.org",
+		DisplayName: opaqueID,
+		Groups:      groups,
+	}
+	return user.ContextSetUser(context.Background(), u)
+}
+
+func newTestManager(t *testing.T) (*manager, func()) {
+	dir, err := ioutil.TempDir("", "reva-json-invites-")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	m, err := New(map[string]interface{}{
+		"file":        path.Join(dir, "ocm-invites.json"),
+		"admin_group": "admins",
+		"insecure":    true,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("New() error = %v", err)
+	}
+	return m.(*manager), func() {
+		m.(*manager).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForwardInviteOfAnotherUser(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the provider info is not needed as the request must be rejected before being sent
+	forwarded := &invitepb.InviteToken{Token: inviteToken.GetToken()}
+	err = m.ForwardInvite(newTestContext("marie"), forwarded, &ocmprovider.ProviderInfo{})
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("ForwardInvite() error = %v, want permission denied", err)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+
+	err = m.PurgeUser(newTestContext("richard"), inviteToken.GetUserId())
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("PurgeUser() error = %v, want permission denied", err)
+	}
+
+	if err := m.PurgeUser(newTestContext("richard", "admins"), inviteToken.GetUserId()); err != nil {
+		t.Fatalf("PurgeUser() error = %v", err)
+	}
+
+	if _, err := m.GetRemoteUser(einstein, remote.GetId()); err == nil {
+		t.Errorf("GetRemoteUser() error = nil, want not found")
+	}
+
+	model, err := loadOrCreate(m.config.File)
+	if err != nil {
+		t.Fatalf("loadOrCreate() error = %v", err)
+	}
+	if len(model.Invites) != 0 || len(model.AcceptedUsers) != 0 {
+		t.Errorf("purged user still stored: invites = %v, accepted users = %v", model.Invites, model.AcceptedUsers)
+	}
+}
+
+// endlessBody is an infinite response body.
+type endlessBody struct{}
+
+func (endlessBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestForwardInviteOversizedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.Copy(w, endlessBody{})
+	}))
+	defer srv.Close()
+
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+	m.config.MaxResponseSize = 1024
+	m.config.ForwardAttempts = 1
+
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	// reading the whole body would never end
+	err = m.ForwardInvite(ctx, inviteToken, originProvider)
+	if err == nil {
+		t.Fatalf("ForwardInvite() expected error")
+	}
+	if !strings.Contains(err.Error(), "truncated at 1024 bytes") {
+		t.Errorf("ForwardInvite() error = %v, want truncated body", err)
+	}
+	if len(err.Error()) > 2048 {
+		t.Errorf("ForwardInvite() error of %d bytes, want bounded by the limit", len(err.Error()))
+	}
+}
+
+func TestSweepExpiredTokens(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	valid, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	m.Lock()
+	m.model.Invites["expired"] = &invitepb.InviteToken{
+		Token:      "expired",
+		UserId:     valid.GetUserId(),
+		Expiration: &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())},
+	}
+	m.Unlock()
+
+	if err := m.sweep(); err != nil {
+		t.Fatalf("sweep() error = %v", err)
+	}
+
+	model, err := loadOrCreate(m.config.File)
+	if err != nil {
+		t.Fatalf("loadOrCreate() error = %v", err)
+	}
+	if _, ok := model.Invites["expired"]; ok {
+		t.Errorf("expired token still stored after a sweep")
+	}
+	if _, ok := model.Invites[valid.GetToken()]; !ok {
+		t.Errorf("valid token removed by a sweep")
+	}
+}
+
+func TestAcceptSweptExpiredToken(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	expired, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	m.Lock()
+	m.model.Invites[expired.GetToken()].Expiration = &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())}
+	m.Unlock()
+	if err := m.sweep(); err != nil {
+		t.Fatalf("sweep() error = %v", err)
+	}
+
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	_, err = m.AcceptInvite(einstein, expired, marie)
+	if _, ok := err.(errtypes.IsBadRequest); !ok {
+		t.Errorf("AcceptInvite() of a swept expired token error = %v, want bad request", err)
+	}
+
+	// the expired tokens are forgotten after their retention
+	m.Lock()
+	m.model.prune(time.Now().Add(invite.ExpiredTokenRetention + time.Minute))
+	m.Unlock()
+	_, err = m.AcceptInvite(einstein, expired, marie)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("AcceptInvite() of a forgotten expired token error = %v, want not found", err)
+	}
+}
+
+func TestCloseStopsSweeper(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.sweepEvery(10 * time.Millisecond)
+		close(stopped)
+	}()
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("sweeper still running %v after Close()", time.Second)
+	}
+
+	// closing again is a no-op
+	if err := m.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestListInvites(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	generated := map[string][]string{}
+	for _, u := range []string{"einstein", "marie", "einstein"} {
+		inviteToken, err := m.GenerateToken(newTestContext(u))
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		generated[u] = append(generated[u], inviteToken.GetToken())
+	}
+	m.Lock()
+	m.model.Invites["expired"] = &invitepb.InviteToken{
+		Token:      "expired",
+		UserId:     &userpb.UserId{Idp: "http://localhost:20080", OpaqueId: "einstein"},
+		Expiration: &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())},
+	}
+	m.Unlock()
+
+	for _, u := range []string{"einstein", "marie", "richard"} {
+		invites, err := m.ListInvites(newTestContext(u))
+		if err != nil {
+			t.Fatalf("ListInvites() error = %v", err)
+		}
+		if len(invites) != len(generated[u]) {
+			t.Errorf("ListInvites() of %s returned %d tokens, want %d", u, len(invites), len(generated[u]))
+		}
+		for _, i := range invites {
+			if i.Token.GetUserId().GetOpaqueId() != u {
+				t.Errorf("ListInvites() of %s returned the token of %s", u, i.Token.GetUserId().GetOpaqueId())
+			}
+		}
+	}
+}
+
+func TestInviteDescriptions(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	descriptions := map[string]string{
+		"einstein": "for the physics department",
+		"marie":    "for the chemistry department",
+	}
+	tokens := map[string]string{}
+	for u, d := range descriptions {
+		inviteToken, err := m.GenerateToken(invite.ContextSetDescription(newTestContext(u), d))
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		tokens[u] = inviteToken.GetToken()
+	}
+
+	// the descriptions must survive a restart
+	reloaded, err := New(map[string]interface{}{
+		"file":     m.config.File,
+		"insecure": true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for u, d := range descriptions {
+		invites, err := reloaded.ListInvites(newTestContext(u))
+		if err != nil {
+			t.Fatalf("ListInvites() error = %v", err)
+		}
+		if len(invites) != 1 {
+			t.Fatalf("ListInvites() of %s returned %d tokens, want 1", u, len(invites))
+		}
+		if invites[0].Token.GetToken() != tokens[u] || invites[0].Description != d {
+			t.Errorf("ListInvites() of %s = %s %q, want %s %q", u, invites[0].Token.GetToken(), invites[0].Description, tokens[u], d)
+		}
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	err = m.RevokeToken(newTestContext("marie"), inviteToken)
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("RevokeToken() of another user error = %v, want permission denied", err)
+	}
+
+	if err := m.RevokeToken(einstein, inviteToken); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil {
+		t.Errorf("AcceptInvite() of a revoked token error = nil, want an error")
+	}
+
+	err = m.RevokeToken(einstein, inviteToken)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("RevokeToken() of an unknown token error = %v, want not found", err)
+	}
+}
+
+func TestForwardInviteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+	m.config.ForwardTimeout = 1
+	m.config.ForwardAttempts = 1
+	if err := m.config.ForwardConfig.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	start := time.Now()
+	if err := m.ForwardInvite(ctx, inviteToken, originProvider); err == nil {
+		t.Fatalf("ForwardInvite() to a hanging provider error = nil, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ForwardInvite() returned after %s, want after the 1s timeout", elapsed)
+	}
+
+	// a canceled request does not wait for the timeout
+	m.config.ForwardTimeout = 60
+	if err := m.config.ForwardConfig.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	canceled, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := m.ForwardInvite(canceled, inviteToken, originProvider); err == nil {
+		t.Fatalf("ForwardInvite() of a canceled request error = nil, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ForwardInvite() returned after %s, want after the cancellation", elapsed)
+	}
+}
+
+func TestSingleUseTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		singleUse bool
+		wantErr   string
+	}{
+		{"reusable", false, ""},
+		{"single use", true, "token already used"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, cleanup := newTestManager(t)
+			defer cleanup()
+			m.config.SingleUse = tt.singleUse
+
+			einstein := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(einstein)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+
+			marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+			if _, err := m.AcceptInvite(einstein, inviteToken, marie); err != nil {
+				t.Fatalf("AcceptInvite() error = %v", err)
+			}
+
+			model, err := loadOrCreate(m.config.File)
+			if err != nil {
+				t.Fatalf("loadOrCreate() error = %v", err)
+			}
+			if _, stored := model.Invites[inviteToken.GetToken()]; stored == tt.singleUse {
+				t.Errorf("accepted token stored = %v, want %v", stored, !tt.singleUse)
+			}
+
+			richard := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+			_, err = m.AcceptInvite(einstein, inviteToken, richard)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("AcceptInvite() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("AcceptInvite() error = %v, want %q", err, tt.wantErr)
+			}
+
+			unknown := &invitepb.InviteToken{Token: "unknown"}
+			if _, err := m.AcceptInvite(einstein, unknown, richard); err == nil || !strings.Contains(err.Error(), "invalid token") {
+				t.Errorf("AcceptInvite() of an unknown token error = %v, want invalid token", err)
+			}
+		})
+	}
+}
+
+func TestInvalidExpiration(t *testing.T) {
+	_, err := New(map[string]interface{}{"file": "/nonexistent/ocm-invites.json", "expiration": "7 days"})
+	if err == nil || !strings.Contains(err.Error(), "expiration") {
+		t.Errorf("New() error = %v, want an error about the expiration", err)
+	}
+}
+
+func TestSaveRecovery(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// a crash in the middle of a save leaves a partial temporary file next to the intact file
+	dir := path.Dir(m.config.File)
+	partial := path.Join(dir, ".ocm-invites.json.tmp1234")
+	if err := ioutil.WriteFile(partial, []byte(`{"invites":{"abc`), 0644); err != nil {
+		t.Fatalf("error writing partial file: %v", err)
+	}
+
+	model, err := loadOrCreate(m.config.File)
+	if err != nil {
+		t.Fatalf("loadOrCreate() after a partial write error = %v", err)
+	}
+	if _, ok := model.Invites[inviteToken.GetToken()]; !ok {
+		t.Errorf("token lost after a partial write")
+	}
+
+	// saving does not leave temporary files behind
+	if _, err := m.GenerateToken(newTestContext("einstein")); err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("error reading dir: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("found %d files after saving, want the invites and the partial file", len(files))
+	}
+
+	// a file truncated by a previous version is considered empty
+	if err := ioutil.WriteFile(m.config.File, nil, 0644); err != nil {
+		t.Fatalf("error truncating file: %v", err)
+	}
+	model, err = loadOrCreate(m.config.File)
+	if err != nil {
+		t.Fatalf("loadOrCreate() of an empty file error = %v", err)
+	}
+	if len(model.Invites) != 0 {
+		t.Errorf("loadOrCreate() of an empty file returned %d invites, want 0", len(model.Invites))
+	}
+}
+
+func TestMaxActiveTokensPerUser(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+	m.config.MaxActiveTokensPerUser = 2
+
+	einstein := newTestContext("einstein")
+	var first *invitepb.InviteToken
+	for i := 0; i < 2; i++ {
+		inviteToken, err := m.GenerateToken(einstein)
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		if first == nil {
+			first = inviteToken
+		}
+	}
+
+	if _, err := m.GenerateToken(einstein); err == nil {
+		t.Fatalf("GenerateToken() over the limit error = nil, want an error")
+	}
+	if _, err := m.GenerateToken(newTestContext("marie")); err != nil {
+		t.Errorf("GenerateToken() of another user error = %v", err)
+	}
+
+	// an expired token frees a slot
+	m.Lock()
+	m.model.Invites[first.GetToken()].Expiration = &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())}
+	m.Unlock()
+	if _, err := m.GenerateToken(einstein); err != nil {
+		t.Errorf("GenerateToken() after a token expired error = %v", err)
+	}
+}
+
+func TestAcceptInviteErrors(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+	m.config.SingleUse = true
+
+	einstein := newTestContext("einstein")
+	valid, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	expired, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	used, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, used, marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	// expired after accepting, as saving removes the expired tokens
+	m.Lock()
+	m.model.Invites[expired.GetToken()].Expiration = &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())}
+	m.Unlock()
+
+	tests := []struct {
+		name           string
+		token          *invitepb.InviteToken
+		wantNotFound   bool
+		wantBadRequest bool
+	}{
+		{"unknown", &invitepb.InviteToken{Token: "unknown"}, true, false},
+		{"expired", expired, false, true},
+		{"used", used, false, true},
+		// last, accepting saves the tokens and removes the expired ones
+		{"valid", valid, false, false},
+	}
+
+	richard := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.AcceptInvite(einstein, tt.token, richard)
+			if _, ok := err.(errtypes.IsNotFound); ok != tt.wantNotFound {
+				t.Errorf("AcceptInvite() error = %v, want not found %v", err, tt.wantNotFound)
+			}
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Errorf("AcceptInvite() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+		})
+	}
+}
+
+func TestForwardInviteFailover(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	newServer := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			w.WriteHeader(status)
+		}))
+	}
+	primary := newServer("primary", http.StatusServiceUnavailable)
+	defer primary.Close()
+	failover := newServer("failover", http.StatusOK)
+	defer failover.Close()
+
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+	m.config.ForwardAttempts = 1
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	ocmService := func(srv *httptest.Server) *ocmprovider.Service {
+		return &ocmprovider.Service{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}
+	}
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{ocmService(primary), ocmService(failover)},
+	}
+
+	if err := m.ForwardInvite(ctx, inviteToken, originProvider); err != nil {
+		t.Errorf("ForwardInvite() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["primary"] != 1 || calls["failover"] != 1 {
+		t.Errorf("ForwardInvite() sent %v requests, want one to each endpoint", calls)
+	}
+}
+
+func TestAcceptInviteInviter(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the accepting provider only knows the token itself
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	inviter, err := m.AcceptInvite(einstein, &invitepb.InviteToken{Token: inviteToken.GetToken()}, remote)
+	if err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	owner := user.ContextMustGetUser(einstein).GetId()
+	if inviter.GetId().GetOpaqueId() != owner.GetOpaqueId() || inviter.GetId().GetIdp() != owner.GetIdp() {
+		t.Errorf("AcceptInvite() inviter = %v, want %v", inviter, owner)
+	}
+
+	// accepting again is refused and returns no inviter
+	if inviter, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil || inviter != nil {
+		t.Errorf("AcceptInvite() of an already accepted user = %v, %v, want an error", inviter, err)
+	}
+}
+
+func TestGetRemoteUserCollidingOpaqueIDs(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	// two providers issued the opaque id marie
+	for _, remote := range []*userpb.User{
+		{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, Mail: "marie@cesnet.cz"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, Mail: "marie@cern.ch"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "richard"}, Mail: "richard@cern.ch"},
+	} {
+		if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+			t.Fatalf("AcceptInvite() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		remoteUserID   *userpb.UserId
+		wantMail       string
+		wantBadRequest bool
+	}{
+		{"first idp", &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, "marie@cesnet.cz", false},
+		{"second idp", &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, "marie@cern.ch", false},
+		{"ambiguous", &userpb.UserId{OpaqueId: "marie"}, "", true},
+		{"single candidate", &userpb.UserId{OpaqueId: "richard"}, "richard@cern.ch", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			remoteUser, err := m.GetRemoteUser(einstein, tt.remoteUserID)
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Fatalf("GetRemoteUser() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+			if remoteUser.GetMail() != tt.wantMail {
+				t.Errorf("GetRemoteUser() = %v, want %s", remoteUser, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestConcurrentGetRemoteUser(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the readers run along the acceptances, the race detector reports unguarded accesses
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: fmt.Sprintf("user%d", i)}}
+		go func() {
+			defer wg.Done()
+			if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+				t.Errorf("AcceptInvite() error = %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = m.GetRemoteUser(einstein, remote.GetId())
+			_, _ = m.ListInvites(einstein)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		remoteUserID := &userpb.UserId{Idp: "cesnet.cz", OpaqueId: fmt.Sprintf("user%d", i)}
+		if _, err := m.GetRemoteUser(einstein, remoteUserID); err != nil {
+			t.Errorf("GetRemoteUser() error = %v", err)
+		}
+	}
+}
+
+func TestForwardInviteProfile(t *testing.T) {
+	var mu sync.Mutex
+	var forwarded int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded++
+	}))
+	defer srv.Close()
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	tests := []struct {
+		name            string
+		mail            string
+		displayName     string
+		allowIncomplete bool
+		wantBadRequest  bool
+	}{
+		{"valid", "einstein@example.org", "Albert Einstein", false, false},
+		{"empty email", "", "Albert Einstein", false, true},
+		{"malformed email", "einstein.example.org", "Albert Einstein", false, true},
+		{"email with display name", "Albert <einstein@example.org>", "Albert Einstein", false, true},
+		{"empty display name", "einstein@example.org", "", false, true},
+		{"incomplete allowed", "", "", true, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, cleanup := newTestManager(t)
+			defer cleanup()
+			m.config.AllowIncompleteProfile = tt.allowIncomplete
+			ctx := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(ctx)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			u := user.ContextMustGetUser(ctx)
+			u.Mail, u.DisplayName = tt.mail, tt.displayName
+
+			mu.Lock()
+			before := forwarded
+			mu.Unlock()
+			err = m.ForwardInvite(ctx, inviteToken, originProvider)
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Fatalf("ForwardInvite() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+			if !tt.wantBadRequest && err != nil {
+				t.Fatalf("ForwardInvite() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if sent := forwarded > before; sent == tt.wantBadRequest {
+				t.Errorf("ForwardInvite() sent the invite %v, want %v", sent, !tt.wantBadRequest)
+			}
+		})
+	}
+}
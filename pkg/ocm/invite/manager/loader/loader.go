@@ -22,5 +22,7 @@ import (
 	// Load core share manager drivers.
 	_ "github.com/cs3org/reva/pkg/ocm/invite/manager/json"
 	_ "github.com/cs3org/reva/pkg/ocm/invite/manager/memory"
+	_ "github.com/cs3org/reva/pkg/ocm/invite/manager/redis"
+	_ "github.com/cs3org/reva/pkg/ocm/invite/manager/sql"
 	// Add your own here
 )
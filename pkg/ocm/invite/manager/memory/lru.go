@@ -0,0 +1,71 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package memory
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru tracks the order in which keys are used, to evict the least recently used ones.
+type lru struct {
+	sync.Mutex
+	order *list.List // of keys, the most recently used first
+	elems map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+// touch marks the key as the most recently used and returns the least recently
+// used keys exceeding max, which are not tracked anymore. A non-positive max evicts nothing.
+func (l *lru) touch(key string, max int) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+	} else {
+		l.elems[key] = l.order.PushFront(key)
+	}
+
+	var evicted []string
+	for max > 0 && l.order.Len() > max {
+		e := l.order.Back()
+		k := l.order.Remove(e).(string)
+		delete(l.elems, k)
+		evicted = append(evicted, k)
+	}
+	return evicted
+}
+
+// remove stops tracking the key.
+func (l *lru) remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
+}
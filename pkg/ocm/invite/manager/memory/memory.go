@@ -20,9 +20,7 @@ package memory
 
 import (
 	"context"
-	"fmt"
-	"net/http"
-	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -39,90 +37,270 @@ import (
 	"github.com/pkg/errors"
 )
 
-const acceptInviteEndpoint = "invites/accept"
+// defaultMaxEntries is the number of tokens and of users with accepted invites
+// tracked when unspecified in the config.
+const defaultMaxEntries = 100000
 
 func init() {
 	registry.Register("memory", New)
 }
 
-func (c *config) init() {
+func (c *config) init() error {
 	if c.Expiration == "" {
 		c.Expiration = token.DefaultExpirationTime
 	}
+	expiration, err := token.ParseExpiration(c.Expiration)
+	if err != nil {
+		return err
+	}
+	c.expiration = expiration
+
+	if c.TokenGenerator == "" {
+		c.TokenGenerator = token.DefaultGenerator
+	}
+
+	if c.TokenLength == 0 {
+		c.TokenLength = token.DefaultLength
+	}
+
+	if c.MaxActiveTokensPerUser == 0 {
+		c.MaxActiveTokensPerUser = invite.DefaultMaxActiveTokensPerUser
+	}
+
+	if c.SweepInterval == 0 {
+		c.SweepInterval = 3600
+	}
+
+	if c.MaxTokens == 0 {
+		c.MaxTokens = defaultMaxEntries
+	}
+
+	if c.MaxAcceptedUsers == 0 {
+		c.MaxAcceptedUsers = defaultMaxEntries
+	}
+
+	if err := c.ForwardConfig.Init(); err != nil {
+		return err
+	}
+	return nil
 }
 
-// New returns a new invite manager.
-func New(m map[string]interface{}) (invite.Manager, error) {
+func parseConfig(m map[string]interface{}) (*config, error) {
 	c := &config{}
 	if err := mapstructure.Decode(m, c); err != nil {
+		return nil, err
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	if _, err := token.GetGenerator(c.TokenGenerator); err != nil {
+		return nil, err
+	}
+	if err := token.CheckLength(c.TokenLength); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// New returns a new invite manager.
+func New(m map[string]interface{}) (invite.Manager, error) {
+	c, err := parseConfig(m)
+	if err != nil {
 		err = errors.Wrap(err, "error creating a new manager")
 		return nil, err
 	}
-	c.init()
 
-	return &manager{
+	mgr := &manager{
 		Invites:       sync.Map{},
 		AcceptedUsers: sync.Map{},
-		Config:        c,
-	}, nil
+		config:        c,
+		tokensLRU:     newLRU(),
+		acceptedLRU:   newLRU(),
+		done:          make(chan struct{}),
+	}
+
+	if c.SweepInterval > 0 {
+		go mgr.sweepEvery(time.Duration(c.SweepInterval) * time.Second)
+	}
+
+	return mgr, nil
 }
 
 type manager struct {
 	Invites       sync.Map
 	AcceptedUsers sync.Map
-	Config        *config
+	// UsedTokens holds the single use tokens already accepted.
+	UsedTokens sync.Map
+	// ExpiredTokens maps the expired tokens removed by the sweeps to their expiration, in seconds
+	// since epoch. They are remembered for invite.ExpiredTokenRetention.
+	ExpiredTokens sync.Map
+	// Descriptions maps the tokens to the descriptions given by their owners.
+	Descriptions sync.Map
+
+	generateLock sync.Mutex   // serializes the generation of tokens against the limit per user
+	acceptLock   sync.Mutex   // serializes the acceptances, consuming the single use tokens once
+	configLock   sync.RWMutex // guards config against reloads
+	config       *config
+
+	// tokensLRU and acceptedLRU track the use of the keys of Invites and
+	// AcceptedUsers to evict the least recently used ones above the limits.
+	tokensLRU   *lru
+	acceptedLRU *lru
+
+	done      chan struct{} // closed to stop the sweeper
+	closeOnce sync.Once
 }
 
 type config struct {
 	Expiration string `mapstructure:"expiration"`
+	AdminGroup string `mapstructure:"admin_group"`
+	// TokenGenerator is the name of the strategy generating the invite tokens.
+	TokenGenerator string `mapstructure:"token_generator"`
+	// TokenLength is the number of random bytes of the tokens, for the base58 and random generators.
+	TokenLength int `mapstructure:"token_length"`
+	// SingleUse makes the tokens acceptable only once.
+	SingleUse bool `mapstructure:"single_use"`
+	// MaxActiveTokensPerUser is the number of unexpired tokens a user can hold.
+	// A negative value disables the limit.
+	MaxActiveTokensPerUser int `mapstructure:"max_active_tokens_per_user"`
+	// SweepInterval is the time in seconds between the removals of the expired tokens.
+	// A negative value disables the removal. It is only read when creating the manager.
+	SweepInterval int `mapstructure:"sweep_interval"`
+	// MaxTokens is the number of tokens kept, the least recently used are removed above it.
+	// A negative value disables the limit.
+	MaxTokens int `mapstructure:"max_tokens"`
+	// MaxAcceptedUsers is the number of users whose accepted invites are kept,
+	// the least recently used are removed above it. A negative value disables the limit.
+	MaxAcceptedUsers int `mapstructure:"max_accepted_users"`
+
+	invite.ForwardConfig `mapstructure:",squash"`
+
+	expiration time.Duration
+}
+
+// Reload replaces the configuration of the manager.
+// It is safe to call while other requests are being served.
+func (m *manager) Reload(c map[string]interface{}) error {
+	conf, err := parseConfig(c)
+	if err != nil {
+		return errors.Wrap(err, "memory: error reloading config")
+	}
+
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	m.config = conf
+	return nil
+}
+
+func (m *manager) getConfig() *config {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	return m.config
+}
+
+// Close stops the removal of the expired tokens.
+func (m *manager) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
+// sweep removes the tokens expired at now and returns how many were removed. The removed tokens
+// are remembered as expired until the end of their retention, for AcceptInvite to keep rejecting
+// them as expired rather than unknown.
+func (m *manager) sweep(now time.Time) int {
+	removed := 0
+	m.Invites.Range(func(key, value interface{}) bool {
+		if t := value.(*invitepb.InviteToken); isExpired(t, now) {
+			m.removeToken(key.(string))
+			m.ExpiredTokens.Store(key, t.Expiration.Seconds)
+			removed++
+		}
+		return true
+	})
+	m.UsedTokens.Range(func(key, value interface{}) bool {
+		if t := value.(*invitepb.InviteToken); isExpired(t, now) {
+			m.UsedTokens.Delete(key)
+			m.ExpiredTokens.Store(key, t.Expiration.Seconds)
+			removed++
+		}
+		return true
+	})
+	retention := uint64(invite.ExpiredTokenRetention.Seconds())
+	m.ExpiredTokens.Range(func(key, value interface{}) bool {
+		if uint64(now.Unix()) > value.(uint64)+retention {
+			m.ExpiredTokens.Delete(key)
+			removed++
+		}
+		return true
+	})
+	return removed
+}
+
+// sweepEvery sweeps the expired tokens at every interval until the manager is closed.
+func (m *manager) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.sweep(now)
+		}
+	}
+}
+
+func isExpired(t *invitepb.InviteToken, now time.Time) bool {
+	return t.GetExpiration() != nil && uint64(now.Unix()) > t.Expiration.Seconds
 }
 
 func (m *manager) GenerateToken(ctx context.Context) (*invitepb.InviteToken, error) {
 
 	ctxUser := user.ContextMustGetUser(ctx)
-	inviteToken, err := token.CreateToken(m.Config.Expiration, ctxUser.GetId())
+	c := m.getConfig()
+	inviteToken, err := token.CreateTokenFor(c.expiration, c.TokenGenerator, c.TokenLength, ctxUser.GetId())
 	if err != nil {
 		return nil, errors.Wrap(err, "memory: error creating token")
 	}
 
+	m.generateLock.Lock()
+	defer m.generateLock.Unlock()
+	if c.MaxActiveTokensPerUser > 0 && m.countActiveTokens(ctxUser.GetId()) >= c.MaxActiveTokensPerUser {
+		return nil, invite.TooManyTokensError(c.MaxActiveTokensPerUser)
+	}
+
 	m.Invites.Store(inviteToken.GetToken(), inviteToken)
+	if description := invite.ContextGetDescription(ctx); description != "" {
+		m.Descriptions.Store(inviteToken.GetToken(), description)
+	}
+	m.touchToken(inviteToken.GetToken(), c.MaxTokens)
+	m.recordAcceptedUsers(ctx, ctxUser.GetId())
 	return inviteToken, nil
 }
 
-func (m *manager) ForwardInvite(ctx context.Context, invite *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
+func (m *manager) ForwardInvite(ctx context.Context, inviteToken *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
 
 	contextUser := user.ContextMustGetUser(ctx)
-	requestBody := url.Values{
-		"token":             {invite.GetToken()},
-		"userID":            {contextUser.GetId().GetOpaqueId()},
-		"recipientProvider": {contextUser.GetId().GetIdp()},
-		"email":             {contextUser.GetMail()},
-		"name":              {contextUser.GetDisplayName()},
-	}
-	ocmEndpoint, err := getOCMEndpoint(originProvider)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.PostForm(fmt.Sprintf("%s%s", ocmEndpoint, acceptInviteEndpoint), requestBody)
-	if err != nil {
-		err = errors.Wrap(err, "memory: error sending post request")
-		return err
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		err = errors.Wrap(errors.New(resp.Status), "memory: error sending accept post request")
+	if err := m.checkTokenOwner(inviteToken, contextUser.GetId()); err != nil {
 		return err
 	}
+	return m.getConfig().Forward(ctx, inviteToken, contextUser, originProvider)
+}
 
-	return nil
+func (m *manager) AcceptInvite(ctx context.Context, inviteToken *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+	inviter, err := m.acceptInvite(ctx, inviteToken, remoteUser)
+	invite.AuditAcceptInvite(ctx, inviteToken, remoteUser, inviter, err)
+	return inviter, err
 }
 
-func (m *manager) AcceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) error {
+func (m *manager) acceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+	// the token is validated and consumed, and the accepted users updated, as a whole.
+	m.acceptLock.Lock()
+	defer m.acceptLock.Unlock()
+
 	inviteToken, err := m.getTokenIfValid(invite)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	currUser := inviteToken.GetUserId().GetOpaqueId()
@@ -131,17 +309,27 @@ func (m *manager) AcceptInvite(ctx context.Context, invite *invitepb.InviteToken
 		acceptedUsers := usersList.([]*userpb.User)
 		for _, acceptedUser := range acceptedUsers {
 			if acceptedUser.Id.GetOpaqueId() == remoteUser.Id.OpaqueId && acceptedUser.Id.GetIdp() == remoteUser.Id.Idp {
-				return errors.New("memory: user already added to accepted users")
+				return nil, errors.New("memory: user already added to accepted users")
 			}
 		}
 
-		acceptedUsers = append(acceptedUsers, remoteUser)
-		m.AcceptedUsers.Store(currUser, acceptedUsers)
+		// the list is copied, GetRemoteUser reads the stored one without lock.
+		updated := make([]*userpb.User, len(acceptedUsers), len(acceptedUsers)+1)
+		copy(updated, acceptedUsers)
+		m.AcceptedUsers.Store(currUser, append(updated, remoteUser))
 	} else {
 		acceptedUsers := []*userpb.User{remoteUser}
 		m.AcceptedUsers.Store(currUser, acceptedUsers)
 	}
-	return nil
+	m.touchAcceptedUsers(currUser)
+
+	if m.getConfig().SingleUse {
+		m.removeToken(inviteToken.GetToken())
+		m.UsedTokens.Store(inviteToken.GetToken(), inviteToken)
+	}
+
+	m.recordAcceptedUsers(ctx, inviteToken.GetUserId())
+	return &userpb.User{Id: inviteToken.GetUserId()}, nil
 }
 
 func (m *manager) GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId) (*userpb.User, error) {
@@ -152,34 +340,152 @@ func (m *manager) GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId
 		return nil, errtypes.NotFound(remoteUserID.OpaqueId)
 	}
 
-	acceptedUsers := usersList.([]*userpb.User)
-	for _, acceptedUser := range acceptedUsers {
-		if (acceptedUser.Id.GetOpaqueId() == remoteUserID.OpaqueId) && (remoteUserID.Idp == "" || acceptedUser.Id.GetIdp() == remoteUserID.Idp) {
-			return acceptedUser, nil
+	remoteUser, err := invite.FindRemoteUser(usersList.([]*userpb.User), remoteUserID)
+	if err != nil {
+		return nil, err
+	}
+	m.touchAcceptedUsers(currUser)
+	return remoteUser, nil
+}
+
+func (m *manager) ListInvites(ctx context.Context) ([]*invite.Invite, error) {
+	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
+	now := uint64(time.Now().Unix())
+
+	invites := []*invite.Invite{}
+	m.Invites.Range(func(key, value interface{}) bool {
+		t := value.(*invitepb.InviteToken)
+		if t.GetUserId().GetOpaqueId() == userKey && now <= t.GetExpiration().GetSeconds() {
+			description, _ := m.Descriptions.Load(key)
+			d, _ := description.(string)
+			invites = append(invites, &invite.Invite{Token: t, Description: d})
 		}
+		return true
+	})
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Token.Token < invites[j].Token.Token })
+	return invites, nil
+}
+
+// countActiveTokens returns the number of unexpired tokens generated by the user.
+func (m *manager) countActiveTokens(userID *userpb.UserId) int {
+	now := uint64(time.Now().Unix())
+	n := 0
+	m.Invites.Range(func(key, value interface{}) bool {
+		t := value.(*invitepb.InviteToken)
+		if t.GetUserId().GetOpaqueId() == userID.GetOpaqueId() && now <= t.GetExpiration().GetSeconds() {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// removeToken removes the token and its description.
+func (m *manager) removeToken(token string) {
+	m.Invites.Delete(token)
+	m.Descriptions.Delete(token)
+	m.tokensLRU.remove(token)
+}
+
+// touchToken marks the token as used, removing the least recently used tokens above max.
+func (m *manager) touchToken(token string, max int) {
+	for _, evicted := range m.tokensLRU.touch(token, max) {
+		m.removeToken(evicted)
+	}
+}
+
+// touchAcceptedUsers marks the users who accepted the invites of the user as used,
+// removing the least recently used ones above the limit.
+func (m *manager) touchAcceptedUsers(userKey string) {
+	for _, evicted := range m.acceptedLRU.touch(userKey, m.getConfig().MaxAcceptedUsers) {
+		m.AcceptedUsers.Delete(evicted)
+	}
+}
+
+func (m *manager) RevokeToken(ctx context.Context, token *invitepb.InviteToken) error {
+	userID := user.ContextMustGetUser(ctx).GetId()
+
+	t, ok := m.Invites.Load(token.GetToken())
+	if !ok {
+		return errtypes.NotFound(token.GetToken())
+	}
+	owner := t.(*invitepb.InviteToken).GetUserId()
+	if owner.GetOpaqueId() != userID.GetOpaqueId() || owner.GetIdp() != userID.GetIdp() {
+		return errtypes.PermissionDenied("memory: invite token does not belong to user " + userID.GetOpaqueId())
 	}
-	return nil, errtypes.NotFound(remoteUserID.OpaqueId)
 
+	m.removeToken(token.GetToken())
+	return nil
+}
+
+func (m *manager) PurgeUser(ctx context.Context, userID *userpb.UserId) error {
+	ctxUser := user.ContextMustGetUser(ctx)
+	if !invite.IsAdmin(ctxUser, m.getConfig().AdminGroup) {
+		return errtypes.PermissionDenied("memory: user " + ctxUser.GetId().GetOpaqueId() + " is not allowed to purge users")
+	}
+
+	m.Invites.Range(func(key, value interface{}) bool {
+		owner := value.(*invitepb.InviteToken).GetUserId()
+		if owner.GetOpaqueId() == userID.GetOpaqueId() && owner.GetIdp() == userID.GetIdp() {
+			m.removeToken(key.(string))
+		}
+		return true
+	})
+	// the used tokens are stored whole, with the id of their owner
+	m.UsedTokens.Range(func(key, value interface{}) bool {
+		owner := value.(*invitepb.InviteToken).GetUserId()
+		if owner.GetOpaqueId() == userID.GetOpaqueId() && owner.GetIdp() == userID.GetIdp() {
+			m.UsedTokens.Delete(key)
+		}
+		return true
+	})
+	m.acceptLock.Lock()
+	defer m.acceptLock.Unlock()
+	m.AcceptedUsers.Delete(userID.GetOpaqueId())
+	m.acceptedLRU.remove(userID.GetOpaqueId())
+	return nil
+}
+
+// recordAcceptedUsers emits the number of remote users who accepted the invites of the user.
+func (m *manager) recordAcceptedUsers(ctx context.Context, userID *userpb.UserId) {
+	invite.RecordAcceptedUsers(ctx, userID, m.acceptedUsersCount(userID))
+}
+
+// acceptedUsersCount returns the number of remote users who accepted the invites of the user.
+func (m *manager) acceptedUsersCount(userID *userpb.UserId) int {
+	usersList, ok := m.AcceptedUsers.Load(userID.GetOpaqueId())
+	if !ok {
+		return 0
+	}
+	return len(usersList.([]*userpb.User))
 }
 
 func (m *manager) getTokenIfValid(token *invitepb.InviteToken) (*invitepb.InviteToken, error) {
 	tokenInterface, ok := m.Invites.Load(token.GetToken())
 	if !ok {
-		return nil, errors.New("memory: invalid token")
+		if _, used := m.UsedTokens.Load(token.GetToken()); used {
+			return nil, errtypes.BadRequest("memory: token already used")
+		}
+		if _, expired := m.ExpiredTokens.Load(token.GetToken()); expired {
+			return nil, errtypes.BadRequest("memory: token expired")
+		}
+		return nil, errtypes.NotFound("memory: invalid token")
 	}
 
 	inviteToken := tokenInterface.(*invitepb.InviteToken)
 	if uint64(time.Now().Unix()) > inviteToken.Expiration.Seconds {
-		return nil, errors.New("memory: token expired")
+		return nil, errtypes.BadRequest("memory: token expired")
 	}
+	m.touchToken(inviteToken.GetToken(), m.getConfig().MaxTokens)
 	return inviteToken, nil
 }
 
-func getOCMEndpoint(originProvider *ocmprovider.ProviderInfo) (string, error) {
-	for _, s := range originProvider.Services {
-		if s.Endpoint.Type.Name == "OCM" {
-			return s.Endpoint.Path, nil
-		}
+// checkTokenOwner verifies that the user forwarding an invite is the owner of the stored token.
+// Tokens generated by other providers are not stored and cannot be checked.
+func (m *manager) checkTokenOwner(token *invitepb.InviteToken, userID *userpb.UserId) error {
+	t, ok := m.Invites.Load(token.GetToken())
+	if !ok {
+		return nil
 	}
-	return "", errors.New("json: ocm endpoint not specified for mesh provider")
+	return invite.CheckTokenOwner(t.(*invitepb.InviteToken).GetUserId(), userID)
 }
@@ -0,0 +1,1248 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/invite"
+	"github.com/cs3org/reva/pkg/ocm/invite/token"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/rs/zerolog"
+	"go.opencensus.io/stats/view"
+)
+
+func newTestContext(opaqueID string, groups ...string) context.Context {
+	u := &userpb.User{
+		Id: &userpb.UserId{
+			Idp:      "http://localhost:20080",
+			OpaqueId: opaqueID,
+		},
+		Username:    opaqueID,
+		Mail:        opaqueID + "@example.org",
+		DisplayName: opaqueID,
+		Groups:      groups,
+	}
+	return user.ContextSetUser(context.Background(), u)
+}
+
+func TestReloadWhileGeneratingTokens(t *testing.T) {
+	m, err := New(map[string]interface{}{"expiration": "1h", "max_active_tokens_per_user": -1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+	ctx := newTestContext("4c510ada-c86b-4815-8820-42cdf82c3d51")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := mgr.GenerateToken(ctx); err != nil {
+					t.Errorf("GenerateToken() error = %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := mgr.Reload(map[string]interface{}{"expiration": "2h", "max_active_tokens_per_user": -1}); err != nil {
+					t.Errorf("Reload() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if mgr.getConfig().Expiration != "2h" {
+		t.Errorf("expected expiration 2h after reload, got %s", mgr.getConfig().Expiration)
+	}
+}
+
+func TestReloadDefaults(t *testing.T) {
+	m, err := New(map[string]interface{}{"expiration": "1h"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+	if err := mgr.Reload(map[string]interface{}{}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if mgr.getConfig().Expiration != token.DefaultExpirationTime {
+		t.Errorf("expected default expiration after reload, got %s", mgr.getConfig().Expiration)
+	}
+}
+
+func TestForwardInviteOfAnotherUser(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the provider info is not needed as the request must be rejected before being sent
+	forwarded := &invitepb.InviteToken{Token: inviteToken.GetToken()}
+	err = m.ForwardInvite(newTestContext("marie"), forwarded, &ocmprovider.ProviderInfo{})
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("ForwardInvite() error = %v, want permission denied", err)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	m, err := New(map[string]interface{}{"admin_group": "admins", "single_use": true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	if _, err := m.GenerateToken(invite.ContextSetDescription(einstein, "for marie")); err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	err = m.PurgeUser(newTestContext("richard"), inviteToken.GetUserId())
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("PurgeUser() error = %v, want permission denied", err)
+	}
+
+	if err := m.PurgeUser(newTestContext("richard", "admins"), inviteToken.GetUserId()); err != nil {
+		t.Fatalf("PurgeUser() error = %v", err)
+	}
+
+	_, err = m.GetRemoteUser(einstein, remote.GetId())
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("GetRemoteUser() error = %v, want not found", err)
+	}
+
+	// nothing keyed to the purged user remains
+	for name, stored := range map[string]*sync.Map{
+		"invites":        &mgr.Invites,
+		"used tokens":    &mgr.UsedTokens,
+		"accepted users": &mgr.AcceptedUsers,
+		"descriptions":   &mgr.Descriptions,
+	} {
+		stored.Range(func(key, value interface{}) bool {
+			t.Errorf("%s of purged user still stored: %v", name, key)
+			return true
+		})
+	}
+}
+
+func TestRecordAcceptedUsers(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+	einstein := newTestContext("einstein")
+
+	recorded := func() int64 {
+		rows, err := view.RetrieveData(invite.AcceptedUsersMeasure.Name())
+		if err != nil {
+			t.Fatalf("RetrieveData() error = %v", err)
+		}
+		if len(rows) == 0 {
+			return 0
+		}
+		return rows[0].Data.(*view.DistributionData).Count
+	}
+	before := recorded()
+
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	for _, id := range []string{"marie", "richard"} {
+		remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: id}}
+		if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+			t.Fatalf("AcceptInvite() error = %v", err)
+		}
+	}
+
+	if n := mgr.acceptedUsersCount(inviteToken.GetUserId()); n != 2 {
+		t.Errorf("acceptedUsersCount() = %d, want 2", n)
+	}
+	if n := recorded() - before; n != 3 {
+		t.Errorf("recorded %d accepted users counts, want 3", n)
+	}
+}
+
+func TestTokenGenerator(t *testing.T) {
+	if _, err := New(map[string]interface{}{"token_generator": "unknown"}); err == nil {
+		t.Fatalf("New() expected error for an unknown token generator")
+	}
+
+	m, err := New(map[string]interface{}{"token_generator": "words"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if len(strings.Split(inviteToken.GetToken(), "-")) != 8 {
+		t.Errorf("expected a token of 8 words, got %s", inviteToken.GetToken())
+	}
+}
+
+func TestTokenLength(t *testing.T) {
+	if _, err := New(map[string]interface{}{"token_generator": "random", "token_length": 8}); err == nil {
+		t.Fatalf("New() expected error for a token length below the minimum")
+	}
+
+	m, err := New(map[string]interface{}{"token_generator": "random", "token_length": 48})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	// 48 bytes are encoded in 64 base64 characters
+	if len(inviteToken.GetToken()) != 64 {
+		t.Errorf("expected a token of 64 characters, got %s", inviteToken.GetToken())
+	}
+}
+
+// endlessBody is an infinite response body.
+type endlessBody struct{}
+
+func (endlessBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestForwardInviteOversizedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.Copy(w, endlessBody{})
+	}))
+	defer srv.Close()
+
+	mgr, err := New(map[string]interface{}{"max_response_size": 1024, "insecure": true, "forward_attempts": 1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	m := mgr.(*manager)
+
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	// reading the whole body would never end
+	err = m.ForwardInvite(ctx, inviteToken, originProvider)
+	if err == nil {
+		t.Fatalf("ForwardInvite() expected error")
+	}
+	if !strings.Contains(err.Error(), "truncated at 1024 bytes") {
+		t.Errorf("ForwardInvite() error = %v, want truncated body", err)
+	}
+	if len(err.Error()) > 2048 {
+		t.Errorf("ForwardInvite() error of %d bytes, want bounded by the limit", len(err.Error()))
+	}
+}
+
+func TestListInvites(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	generated := map[string][]string{}
+	for _, u := range []string{"einstein", "marie", "einstein"} {
+		inviteToken, err := m.GenerateToken(newTestContext(u))
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		generated[u] = append(generated[u], inviteToken.GetToken())
+	}
+	m.(*manager).Invites.Store("expired", &invitepb.InviteToken{
+		Token:      "expired",
+		UserId:     &userpb.UserId{Idp: "http://localhost:20080", OpaqueId: "einstein"},
+		Expiration: &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())},
+	})
+
+	for _, u := range []string{"einstein", "marie", "richard"} {
+		invites, err := m.ListInvites(newTestContext(u))
+		if err != nil {
+			t.Fatalf("ListInvites() error = %v", err)
+		}
+		if len(invites) != len(generated[u]) {
+			t.Errorf("ListInvites() of %s returned %d tokens, want %d", u, len(invites), len(generated[u]))
+		}
+		for _, i := range invites {
+			if i.Token.GetUserId().GetOpaqueId() != u {
+				t.Errorf("ListInvites() of %s returned the token of %s", u, i.Token.GetUserId().GetOpaqueId())
+			}
+		}
+	}
+}
+
+func TestInviteDescriptions(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	descriptions := map[string]string{
+		"einstein": "for the physics department",
+		"marie":    "for the chemistry department",
+	}
+	for u, d := range descriptions {
+		if _, err := m.GenerateToken(invite.ContextSetDescription(newTestContext(u), d)); err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+	}
+	if _, err := m.GenerateToken(newTestContext("einstein")); err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	for u, d := range descriptions {
+		invites, err := m.ListInvites(newTestContext(u))
+		if err != nil {
+			t.Fatalf("ListInvites() error = %v", err)
+		}
+		found := 0
+		for _, i := range invites {
+			if i.Description == "" {
+				continue
+			}
+			found++
+			if i.Description != d {
+				t.Errorf("ListInvites() of %s returned description %q, want %q", u, i.Description, d)
+			}
+		}
+		if found != 1 {
+			t.Errorf("ListInvites() of %s returned %d descriptions, want 1", u, found)
+		}
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	err = m.RevokeToken(newTestContext("marie"), inviteToken)
+	if _, ok := err.(errtypes.IsPermissionDenied); !ok {
+		t.Errorf("RevokeToken() of another user error = %v, want permission denied", err)
+	}
+
+	if err := m.RevokeToken(einstein, inviteToken); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil {
+		t.Errorf("AcceptInvite() of a revoked token error = nil, want an error")
+	}
+
+	err = m.RevokeToken(einstein, inviteToken)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("RevokeToken() of an unknown token error = %v, want not found", err)
+	}
+}
+
+func TestForwardInviteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	m, err := New(map[string]interface{}{"forward_timeout": 1, "insecure": true, "forward_attempts": 1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	start := time.Now()
+	if err := m.ForwardInvite(ctx, inviteToken, originProvider); err == nil {
+		t.Fatalf("ForwardInvite() to a hanging provider error = nil, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ForwardInvite() returned after %s, want after the 1s timeout", elapsed)
+	}
+}
+
+func TestForwardInviteTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	dir, err := ioutil.TempDir("", "reva-invite-tls-")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert := path.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, certPEM, 0644); err != nil {
+		t.Fatalf("error writing ca certificate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+		config   map[string]interface{}
+		wantErr  bool
+	}{
+		{"custom ca", srv.URL, map[string]interface{}{"ca_cert": caCert}, false},
+		{"unknown authority", srv.URL, map[string]interface{}{"forward_attempts": 1}, true},
+		{"insecure tls", srv.URL, map[string]interface{}{"insecure": true}, false},
+		{"plain http", plain.URL, map[string]interface{}{"ca_cert": caCert}, true},
+		{"insecure plain http", plain.URL, map[string]interface{}{"insecure": true}, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			ctx := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(ctx)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			originProvider := &ocmprovider.ProviderInfo{
+				Services: []*ocmprovider.Service{{
+					Endpoint: &ocmprovider.ServiceEndpoint{
+						Type: &ocmprovider.ServiceType{Name: "OCM"},
+						Path: tt.endpoint + "/",
+					},
+				}},
+			}
+
+			err = m.ForwardInvite(ctx, inviteToken, originProvider)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ForwardInvite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInvalidCACert(t *testing.T) {
+	if _, err := New(map[string]interface{}{"ca_cert": "/nonexistent/ca.pem"}); err == nil {
+		t.Errorf("New() with a missing ca certificate error = nil, want an error")
+	}
+}
+
+func TestSingleUseTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		singleUse bool
+		wantErr   string
+	}{
+		{"reusable", false, ""},
+		{"single use", true, "token already used"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(map[string]interface{}{"single_use": tt.singleUse})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			einstein := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(einstein)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+
+			marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+			if _, err := m.AcceptInvite(einstein, inviteToken, marie); err != nil {
+				t.Fatalf("AcceptInvite() error = %v", err)
+			}
+
+			richard := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+			_, err = m.AcceptInvite(einstein, inviteToken, richard)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("AcceptInvite() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("AcceptInvite() error = %v, want %q", err, tt.wantErr)
+			}
+
+			unknown := &invitepb.InviteToken{Token: "unknown"}
+			if _, err := m.AcceptInvite(einstein, unknown, richard); err == nil || !strings.Contains(err.Error(), "invalid token") {
+				t.Errorf("AcceptInvite() of an unknown token error = %v, want invalid token", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentAcceptInvite(t *testing.T) {
+	tests := []struct {
+		name      string
+		singleUse bool
+		accepted  int
+	}{
+		{"reusable", false, 100},
+		{"single use", true, 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(map[string]interface{}{"single_use": tt.singleUse})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			mgr := m.(*manager)
+			defer mgr.Close()
+
+			einstein := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(einstein)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			accepted := 0
+			start := make(chan struct{})
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: fmt.Sprintf("user%d", i)}}
+					if _, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil {
+						mu.Lock()
+						accepted++
+						mu.Unlock()
+					}
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			if accepted != tt.accepted {
+				t.Errorf("%d concurrent acceptances succeeded, want %d", accepted, tt.accepted)
+			}
+			if n := mgr.acceptedUsersCount(inviteToken.GetUserId()); n != tt.accepted {
+				t.Errorf("acceptedUsersCount() = %d, want %d", n, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestExpirationConfig(t *testing.T) {
+	tests := []struct {
+		expiration string
+		want       time.Duration
+		wantErr    bool
+	}{
+		{"72h", 72 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"a week", 0, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.expiration, func(t *testing.T) {
+			m, err := New(map[string]interface{}{"expiration": tt.expiration})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("New() error = nil, want an error for expiration %q", tt.expiration)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			before := time.Now()
+			inviteToken, err := m.GenerateToken(newTestContext("einstein"))
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			expires := time.Unix(int64(inviteToken.GetExpiration().GetSeconds()), 0)
+			if d := expires.Sub(before); d < tt.want-time.Second || d > tt.want+time.Second {
+				t.Errorf("GenerateToken() expires in %v, want %v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardInviteRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		calls    int
+	}{
+		{"transient failures", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}, false, 3},
+		{"too many failures", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}, true, 3},
+		{"refused", []int{http.StatusBadRequest, http.StatusOK}, true, 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer srv.Close()
+
+			m, err := New(map[string]interface{}{"insecure": true, "forward_attempts": 3, "forward_retry_delay": 10})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			ctx := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(ctx)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			originProvider := &ocmprovider.ProviderInfo{
+				Services: []*ocmprovider.Service{{
+					Endpoint: &ocmprovider.ServiceEndpoint{
+						Type: &ocmprovider.ServiceType{Name: "OCM"},
+						Path: srv.URL + "/",
+					},
+				}},
+			}
+
+			err = m.ForwardInvite(ctx, inviteToken, originProvider)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ForwardInvite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if calls != tt.calls {
+				t.Errorf("ForwardInvite() sent %d requests, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestForwardInviteRetriesCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	m, err := New(map[string]interface{}{"insecure": true, "forward_attempts": 3, "forward_retry_delay": 60000})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := m.ForwardInvite(ctx, inviteToken, originProvider); err == nil {
+		t.Fatalf("ForwardInvite() error = nil, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ForwardInvite() returned after %s, want when canceled while waiting to retry", elapsed)
+	}
+}
+
+func TestMaxActiveTokensPerUser(t *testing.T) {
+	m, err := New(map[string]interface{}{"max_active_tokens_per_user": 2})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+
+	einstein := newTestContext("einstein")
+	var first *invitepb.InviteToken
+	for i := 0; i < 2; i++ {
+		inviteToken, err := m.GenerateToken(einstein)
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		if first == nil {
+			first = inviteToken
+		}
+	}
+
+	if _, err := m.GenerateToken(einstein); err == nil {
+		t.Fatalf("GenerateToken() over the limit error = nil, want an error")
+	}
+	if _, err := m.GenerateToken(newTestContext("marie")); err != nil {
+		t.Errorf("GenerateToken() of another user error = %v", err)
+	}
+
+	// an expired token frees a slot
+	expired := *first
+	expired.Expiration = &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())}
+	mgr.Invites.Store(first.GetToken(), &expired)
+	if _, err := m.GenerateToken(einstein); err != nil {
+		t.Errorf("GenerateToken() after a token expired error = %v", err)
+	}
+}
+
+func TestAcceptInviteErrors(t *testing.T) {
+	m, err := New(map[string]interface{}{"single_use": true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	einstein := newTestContext("einstein")
+	valid, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	expired, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	used, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, used, marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	expiredCopy := *expired
+	expiredCopy.Expiration = &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())}
+	m.(*manager).Invites.Store(expired.GetToken(), &expiredCopy)
+
+	tests := []struct {
+		name           string
+		token          *invitepb.InviteToken
+		wantNotFound   bool
+		wantBadRequest bool
+	}{
+		{"unknown", &invitepb.InviteToken{Token: "unknown"}, true, false},
+		{"expired", expired, false, true},
+		{"used", used, false, true},
+		{"valid", valid, false, false},
+	}
+
+	richard := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.AcceptInvite(einstein, tt.token, richard)
+			if _, ok := err.(errtypes.IsNotFound); ok != tt.wantNotFound {
+				t.Errorf("AcceptInvite() error = %v, want not found %v", err, tt.wantNotFound)
+			}
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Errorf("AcceptInvite() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+		})
+	}
+}
+
+func TestSweepExpiredTokens(t *testing.T) {
+	m, err := New(map[string]interface{}{"sweep_interval": -1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+	defer mgr.Close()
+
+	valid, err := m.GenerateToken(newTestContext("einstein"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	mgr.Invites.Store("expired", &invitepb.InviteToken{
+		Token:      "expired",
+		UserId:     &userpb.UserId{Idp: "http://localhost:20080", OpaqueId: "einstein"},
+		Expiration: &typespb.Timestamp{Seconds: uint64(time.Now().Add(-time.Minute).Unix())},
+	})
+	mgr.Descriptions.Store("expired", "for the physics department")
+
+	go mgr.sweepEvery(10 * time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := mgr.Invites.Load("expired"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired token not removed after %v", time.Second)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := mgr.Descriptions.Load("expired"); ok {
+		t.Errorf("description of the expired token not removed")
+	}
+	if _, ok := mgr.Invites.Load(valid.GetToken()); !ok {
+		t.Errorf("valid token removed")
+	}
+
+	if err := mgr.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestAcceptSweptExpiredToken(t *testing.T) {
+	m, err := New(map[string]interface{}{"sweep_interval": -1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+
+	einstein := newTestContext("einstein")
+	expired, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	mgr.sweep(time.Now().Add(time.Until(time.Unix(int64(expired.GetExpiration().GetSeconds()), 0)) + time.Minute))
+
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	_, err = m.AcceptInvite(einstein, expired, marie)
+	if _, ok := err.(errtypes.IsBadRequest); !ok {
+		t.Errorf("AcceptInvite() of a swept expired token error = %v, want bad request", err)
+	}
+
+	// the expired tokens are forgotten after their retention
+	mgr.sweep(time.Now().Add(time.Until(time.Unix(int64(expired.GetExpiration().GetSeconds()), 0)) + invite.ExpiredTokenRetention + time.Minute))
+	_, err = m.AcceptInvite(einstein, expired, marie)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("AcceptInvite() of a forgotten expired token error = %v, want not found", err)
+	}
+}
+
+func TestMaxTokens(t *testing.T) {
+	m, err := New(map[string]interface{}{"max_tokens": 2})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mgr := m.(*manager)
+
+	einstein := newTestContext("einstein")
+	var tokens []*invitepb.InviteToken
+	for i := 0; i < 2; i++ {
+		inviteToken, err := m.GenerateToken(einstein)
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		tokens = append(tokens, inviteToken)
+	}
+
+	// using the oldest token makes the second one the least recently used
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, tokens[0], marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	recent, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		token *invitepb.InviteToken
+		kept  bool
+	}{
+		{tokens[0], true},
+		{tokens[1], false},
+		{recent, true},
+	} {
+		if _, ok := mgr.Invites.Load(tt.token.GetToken()); ok != tt.kept {
+			t.Errorf("token %s kept = %v, want %v", tt.token.GetToken(), ok, tt.kept)
+		}
+	}
+}
+
+func TestMaxAcceptedUsers(t *testing.T) {
+	m, err := New(map[string]interface{}{"max_accepted_users": 2})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+	accept := func(u string) {
+		ctx := newTestContext(u)
+		inviteToken, err := m.GenerateToken(ctx)
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		if _, err := m.AcceptInvite(ctx, inviteToken, remote); err != nil {
+			t.Fatalf("AcceptInvite() error = %v", err)
+		}
+	}
+
+	accept("einstein")
+	accept("marie")
+	// reading the users of einstein makes marie the least recently used
+	if _, err := m.GetRemoteUser(newTestContext("einstein"), remote.GetId()); err != nil {
+		t.Fatalf("GetRemoteUser() error = %v", err)
+	}
+	accept("feynman")
+
+	for u, kept := range map[string]bool{"einstein": true, "marie": false, "feynman": true} {
+		_, err := m.GetRemoteUser(newTestContext(u), remote.GetId())
+		if (err == nil) != kept {
+			t.Errorf("GetRemoteUser() of %s error = %v, want kept %v", u, err, kept)
+		}
+	}
+}
+
+func TestForwardInviteFailover(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	newServer := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			w.WriteHeader(status)
+		}))
+	}
+	primary := newServer("primary", http.StatusServiceUnavailable)
+	defer primary.Close()
+	failover := newServer("failover", http.StatusOK)
+	defer failover.Close()
+
+	m, err := New(map[string]interface{}{"insecure": true, "forward_attempts": 1})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ctx := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(ctx)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	ocmService := func(srv *httptest.Server) *ocmprovider.Service {
+		return &ocmprovider.Service{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}
+	}
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{ocmService(primary), ocmService(failover)},
+	}
+
+	if err := m.ForwardInvite(ctx, inviteToken, originProvider); err != nil {
+		t.Errorf("ForwardInvite() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["primary"] != 1 || calls["failover"] != 1 {
+		t.Errorf("ForwardInvite() sent %v requests, want one to each endpoint", calls)
+	}
+}
+
+func TestAcceptInviteInviter(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the accepting provider only knows the token itself
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	inviter, err := m.AcceptInvite(einstein, &invitepb.InviteToken{Token: inviteToken.GetToken()}, remote)
+	if err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	owner := user.ContextMustGetUser(einstein).GetId()
+	if inviter.GetId().GetOpaqueId() != owner.GetOpaqueId() || inviter.GetId().GetIdp() != owner.GetIdp() {
+		t.Errorf("AcceptInvite() inviter = %v, want %v", inviter, owner)
+	}
+
+	// accepting again is refused and returns no inviter
+	if inviter, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil || inviter != nil {
+		t.Errorf("AcceptInvite() of an already accepted user = %v, %v, want an error", inviter, err)
+	}
+}
+
+func TestGetRemoteUserCollidingOpaqueIDs(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	// two providers issued the opaque id marie
+	for _, remote := range []*userpb.User{
+		{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, Mail: "marie@cesnet.cz"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, Mail: "marie@cern.ch"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "richard"}, Mail: "richard@cern.ch"},
+	} {
+		if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+			t.Fatalf("AcceptInvite() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		remoteUserID   *userpb.UserId
+		wantMail       string
+		wantBadRequest bool
+	}{
+		{"first idp", &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, "marie@cesnet.cz", false},
+		{"second idp", &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, "marie@cern.ch", false},
+		{"ambiguous", &userpb.UserId{OpaqueId: "marie"}, "", true},
+		{"single candidate", &userpb.UserId{OpaqueId: "richard"}, "richard@cern.ch", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			remoteUser, err := m.GetRemoteUser(einstein, tt.remoteUserID)
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Fatalf("GetRemoteUser() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+			if remoteUser.GetMail() != tt.wantMail {
+				t.Errorf("GetRemoteUser() = %v, want %s", remoteUser, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestForwardInviteProfile(t *testing.T) {
+	var mu sync.Mutex
+	var forwarded int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded++
+	}))
+	defer srv.Close()
+	originProvider := &ocmprovider.ProviderInfo{
+		Services: []*ocmprovider.Service{{
+			Endpoint: &ocmprovider.ServiceEndpoint{
+				Type: &ocmprovider.ServiceType{Name: "OCM"},
+				Path: srv.URL + "/",
+			},
+		}},
+	}
+
+	tests := []struct {
+		name            string
+		mail            string
+		displayName     string
+		allowIncomplete bool
+		wantBadRequest  bool
+	}{
+		{"valid", "einstein@example.org", "Albert Einstein", false, false},
+		{"empty email", "", "Albert Einstein", false, true},
+		{"malformed email", "einstein.example.org", "Albert Einstein", false, true},
+		{"email with display name", "Albert <einstein@example.org>", "Albert Einstein", false, true},
+		{"empty display name", "einstein@example.org", "", false, true},
+		{"incomplete allowed", "", "", true, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(map[string]interface{}{"insecure": true, "allow_incomplete_profile": tt.allowIncomplete})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			ctx := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(ctx)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			u := user.ContextMustGetUser(ctx)
+			u.Mail, u.DisplayName = tt.mail, tt.displayName
+
+			mu.Lock()
+			before := forwarded
+			mu.Unlock()
+			err = m.ForwardInvite(ctx, inviteToken, originProvider)
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Fatalf("ForwardInvite() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+			if !tt.wantBadRequest && err != nil {
+				t.Fatalf("ForwardInvite() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if sent := forwarded > before; sent == tt.wantBadRequest {
+				t.Errorf("ForwardInvite() sent the invite %v, want %v", sent, !tt.wantBadRequest)
+			}
+		})
+	}
+}
+
+func TestAuditAcceptInvite(t *testing.T) {
+	m, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	einstein := appctx.WithLogger(newTestContext("einstein"), &logger)
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	if err := m.RevokeToken(einstein, inviteToken); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	if _, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil {
+		t.Fatalf("AcceptInvite() of a revoked token error = nil, want an error")
+	}
+
+	logged := buf.String()
+	var events []map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(logged))
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if e["event"] == invite.AuditInviteAccepted || e["event"] == invite.AuditInviteRejected {
+			events = append(events, e)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("logged %d audit events, want 2: %v", len(events), events)
+	}
+
+	for i, event := range []string{invite.AuditInviteAccepted, invite.AuditInviteRejected} {
+		e := events[i]
+		want := map[string]interface{}{
+			"event":          event,
+			"level":          "info",
+			"local_user_id":  "einstein",
+			"local_user_idp": "http://localhost:20080",
+			"remote_user_id": "marie",
+			"remote_idp":     "cesnet.cz",
+			"token_id":       invite.TokenID(inviteToken),
+		}
+		for k, v := range want {
+			if e[k] != v {
+				t.Errorf("%s event %s = %v, want %v", event, k, e[k], v)
+			}
+		}
+		if ts, _ := e["timestamp"].(string); ts == "" {
+			t.Errorf("%s event has no timestamp", event)
+		} else if _, err := time.Parse(time.RFC3339, ts); err != nil {
+			t.Errorf("%s event timestamp = %q: %v", event, ts, err)
+		}
+	}
+
+	if strings.Contains(logged, inviteToken.GetToken()) {
+		t.Errorf("the audit events contain the token %q", inviteToken.GetToken())
+	}
+	if _, ok := events[0]["reason"]; ok {
+		t.Errorf("accepted event has a reason %v", events[0]["reason"])
+	}
+	if r, _ := events[1]["reason"].(string); r == "" {
+		t.Errorf("rejected event has no reason")
+	}
+}
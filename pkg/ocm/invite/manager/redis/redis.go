@@ -0,0 +1,514 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/invite"
+	"github.com/cs3org/reva/pkg/ocm/invite/manager/registry"
+	"github.com/cs3org/reva/pkg/ocm/invite/token"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// The tokens are stored under tokenPrefix with a TTL ending at their expiration, so that
+// redis removes them once expired. The tokens of a user are indexed under userTokensPrefix
+// and the users who accepted the invites of a user under acceptedUsersPrefix.
+const (
+	tokenPrefix         = "ocm-invite:"
+	usedTokenPrefix     = "ocm-invite-used:"
+	userTokensPrefix    = "ocm-invites:"
+	acceptedUsersPrefix = "ocm-accepted-users:"
+)
+
+type manager struct {
+	config *config
+	pool   *redis.Pool
+}
+
+type config struct {
+	// Redis is the address of the redis server.
+	Redis      string `mapstructure:"redis"`
+	Expiration string `mapstructure:"expiration"`
+	AdminGroup string `mapstructure:"admin_group"`
+	// TokenGenerator is the name of the strategy generating the invite tokens.
+	TokenGenerator string `mapstructure:"token_generator"`
+	// TokenLength is the number of random bytes of the tokens, for the base58 and random generators.
+	TokenLength int `mapstructure:"token_length"`
+	// SingleUse makes the tokens acceptable only once.
+	SingleUse bool `mapstructure:"single_use"`
+	// MaxActiveTokensPerUser is the number of unexpired tokens a user can hold.
+	// A negative value disables the limit.
+	MaxActiveTokensPerUser int `mapstructure:"max_active_tokens_per_user"`
+
+	invite.ForwardConfig `mapstructure:",squash"`
+
+	expiration time.Duration
+}
+
+// storedToken is the value stored for a token.
+type storedToken struct {
+	Token       *invitepb.InviteToken `json:"token"`
+	Description string                `json:"description,omitempty"`
+}
+
+func init() {
+	registry.Register("redis", New)
+}
+
+func (c *config) init() error {
+	if c.Redis == "" {
+		c.Redis = ":6379"
+	}
+
+	if c.Expiration == "" {
+		c.Expiration = token.DefaultExpirationTime
+	}
+	expiration, err := token.ParseExpiration(c.Expiration)
+	if err != nil {
+		return err
+	}
+	c.expiration = expiration
+
+	if c.TokenGenerator == "" {
+		c.TokenGenerator = token.DefaultGenerator
+	}
+
+	if c.TokenLength == 0 {
+		c.TokenLength = token.DefaultLength
+	}
+
+	if err := c.ForwardConfig.Init(); err != nil {
+		return err
+	}
+
+	if c.MaxActiveTokensPerUser == 0 {
+		c.MaxActiveTokensPerUser = invite.DefaultMaxActiveTokensPerUser
+	}
+
+	if _, err := token.GetGenerator(c.TokenGenerator); err != nil {
+		return err
+	}
+	if err := token.CheckLength(c.TokenLength); err != nil {
+		return err
+	}
+	return nil
+}
+
+// New returns a new invite manager storing the invites in redis.
+func New(m map[string]interface{}) (invite.Manager, error) {
+	c := &config{}
+	if err := mapstructure.Decode(m, c); err != nil {
+		err = errors.Wrap(err, "error parsing config for redis invite manager")
+		return nil, err
+	}
+	if err := c.init(); err != nil {
+		err = errors.Wrap(err, "error setting config defaults for redis invite manager")
+		return nil, err
+	}
+
+	return &manager{
+		config: c,
+		pool:   initRedisPool(c.Redis),
+	}, nil
+}
+
+func initRedisPool(address string) *redis.Pool {
+	return &redis.Pool{
+
+		MaxIdle:     50,
+		MaxActive:   1000,
+		IdleTimeout: 240 * time.Second,
+
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address)
+		},
+
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// Close closes the connections to redis.
+func (m *manager) Close() error {
+	return m.pool.Close()
+}
+
+func (m *manager) GenerateToken(ctx context.Context) (*invitepb.InviteToken, error) {
+
+	contextUser := user.ContextMustGetUser(ctx)
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	if max := m.config.MaxActiveTokensPerUser; max > 0 {
+		tokens, err := getUserTokens(conn, contextUser.GetId().GetOpaqueId())
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) >= max {
+			return nil, invite.TooManyTokensError(max)
+		}
+	}
+
+	inviteToken, err := token.CreateTokenFor(m.config.expiration, m.config.TokenGenerator, m.config.TokenLength, contextUser.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&storedToken{Token: inviteToken, Description: invite.ContextGetDescription(ctx)})
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error encoding token")
+	}
+
+	ttl := int64(m.config.expiration / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	if _, err := conn.Do("SET", tokenPrefix+inviteToken.GetToken(), data, "EX", ttl); err != nil {
+		return nil, errors.Wrap(err, "redis: error storing token")
+	}
+	if _, err := conn.Do("SADD", userTokensPrefix+contextUser.GetId().GetOpaqueId(), inviteToken.GetToken()); err != nil {
+		return nil, errors.Wrap(err, "redis: error indexing token")
+	}
+
+	m.recordAcceptedUsers(ctx, conn, contextUser.GetId())
+	return inviteToken, nil
+}
+
+func (m *manager) ForwardInvite(ctx context.Context, inviteToken *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
+
+	contextUser := user.ContextMustGetUser(ctx)
+	if err := m.checkTokenOwner(inviteToken, contextUser.GetId()); err != nil {
+		return err
+	}
+	return m.config.Forward(ctx, inviteToken, contextUser, originProvider)
+}
+
+func (m *manager) AcceptInvite(ctx context.Context, inviteToken *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+	inviter, err := m.acceptInvite(ctx, inviteToken, remoteUser)
+	invite.AuditAcceptInvite(ctx, inviteToken, remoteUser, inviter, err)
+	return inviter, err
+}
+
+// acceptInvite records the remote user as accepted by the owner of the token. The token and the
+// accepted users are watched while they are checked, a concurrent accept changing them aborts the
+// transaction recording the user, which is then tried again against the new state. A single use
+// token or a remote user is thus only accepted once.
+func (m *manager) acceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "redis: error accepting invite")
+		}
+
+		inviteToken, err := m.tryAcceptInvite(conn, invite, remoteUser)
+		if err != nil {
+			return nil, err
+		}
+		if inviteToken != nil {
+			m.recordAcceptedUsers(ctx, conn, inviteToken.GetUserId())
+			return &userpb.User{Id: inviteToken.GetUserId()}, nil
+		}
+	}
+}
+
+// tryAcceptInvite accepts the invite in a transaction, returning a nil token when the transaction
+// has been aborted by a concurrent change of the watched keys.
+func (m *manager) tryAcceptInvite(conn redis.Conn, invite *invitepb.InviteToken, remoteUser *userpb.User) (*invitepb.InviteToken, error) {
+	// the keys stay watched on errors, before the connection goes back to the pool
+	defer conn.Do("UNWATCH")
+
+	if _, err := conn.Do("WATCH", tokenPrefix+invite.GetToken(), usedTokenPrefix+invite.GetToken()); err != nil {
+		return nil, errors.Wrap(err, "redis: error watching token")
+	}
+	inviteToken, err := getTokenIfValid(conn, invite)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add to the list of accepted users
+	userKey := inviteToken.GetUserId().GetOpaqueId()
+	if _, err := conn.Do("WATCH", acceptedUsersPrefix+userKey); err != nil {
+		return nil, errors.Wrap(err, "redis: error watching accepted users")
+	}
+	acceptedUsers, err := getAcceptedUsers(conn, userKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, acceptedUser := range acceptedUsers {
+		if acceptedUser.Id.GetOpaqueId() == remoteUser.Id.OpaqueId && acceptedUser.Id.GetIdp() == remoteUser.Id.Idp {
+			return nil, errors.New("redis: user already added to accepted users")
+		}
+	}
+
+	data, err := json.Marshal(remoteUser)
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error encoding remote user")
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, errors.Wrap(err, "redis: error starting transaction")
+	}
+	if err := conn.Send("SADD", acceptedUsersPrefix+userKey, data); err != nil {
+		return nil, errors.Wrap(err, "redis: error storing accepted user")
+	}
+	if m.config.SingleUse {
+		// the used token is remembered as long as it would have been valid
+		ttl := int64(inviteToken.GetExpiration().GetSeconds()) - time.Now().Unix()
+		if ttl < 1 {
+			ttl = 1
+		}
+		if err := conn.Send("SET", usedTokenPrefix+inviteToken.GetToken(), 1, "EX", ttl); err != nil {
+			return nil, errors.Wrap(err, "redis: error marking token as used")
+		}
+		if err := conn.Send("DEL", tokenPrefix+inviteToken.GetToken()); err != nil {
+			return nil, errors.Wrap(err, "redis: error removing token")
+		}
+		if err := conn.Send("SREM", userTokensPrefix+userKey, inviteToken.GetToken()); err != nil {
+			return nil, errors.Wrap(err, "redis: error removing token")
+		}
+	}
+	// an aborted transaction replies nil, or no replies for some servers
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil || (err == nil && len(replies) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error storing accepted user")
+	}
+	return inviteToken, nil
+}
+
+func (m *manager) GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId) (*userpb.User, error) {
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
+	acceptedUsers, err := getAcceptedUsers(conn, userKey)
+	if err != nil {
+		return nil, err
+	}
+	return invite.FindRemoteUser(acceptedUsers, remoteUserID)
+}
+
+func (m *manager) ListInvites(ctx context.Context) ([]*invite.Invite, error) {
+	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	tokens, err := getUserTokens(conn, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	invites := make([]*invite.Invite, 0, len(tokens))
+	for _, stored := range tokens {
+		invites = append(invites, &invite.Invite{Token: stored.Token, Description: stored.Description})
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Token.Token < invites[j].Token.Token })
+	return invites, nil
+}
+
+func (m *manager) RevokeToken(ctx context.Context, token *invitepb.InviteToken) error {
+	userID := user.ContextMustGetUser(ctx).GetId()
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	stored, err := getToken(conn, token.GetToken())
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return errtypes.NotFound(token.GetToken())
+	}
+	owner := stored.Token.GetUserId()
+	if owner.GetOpaqueId() != userID.GetOpaqueId() || owner.GetIdp() != userID.GetIdp() {
+		return errtypes.PermissionDenied("redis: invite token does not belong to user " + userID.GetOpaqueId())
+	}
+
+	return removeToken(conn, stored.Token)
+}
+
+func (m *manager) PurgeUser(ctx context.Context, userID *userpb.UserId) error {
+	ctxUser := user.ContextMustGetUser(ctx)
+	if !invite.IsAdmin(ctxUser, m.config.AdminGroup) {
+		return errtypes.PermissionDenied("redis: user " + ctxUser.GetId().GetOpaqueId() + " is not allowed to purge users")
+	}
+
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	tokens, err := redis.Strings(conn.Do("SMEMBERS", userTokensPrefix+userID.GetOpaqueId()))
+	if err != nil {
+		return errors.Wrap(err, "redis: error listing tokens")
+	}
+	for _, t := range tokens {
+		stored, err := getToken(conn, t)
+		if err != nil {
+			return err
+		}
+		if stored != nil && stored.Token.GetUserId().GetIdp() != userID.GetIdp() {
+			continue
+		}
+		if _, err := conn.Do("DEL", tokenPrefix+t); err != nil {
+			return errors.Wrap(err, "redis: error removing token")
+		}
+		if _, err := conn.Do("SREM", userTokensPrefix+userID.GetOpaqueId(), t); err != nil {
+			return errors.Wrap(err, "redis: error removing token")
+		}
+	}
+	if _, err := conn.Do("DEL", acceptedUsersPrefix+userID.GetOpaqueId()); err != nil {
+		return errors.Wrap(err, "redis: error removing accepted users")
+	}
+	return nil
+}
+
+// recordAcceptedUsers emits the number of remote users who accepted the invites of the user.
+func (m *manager) recordAcceptedUsers(ctx context.Context, conn redis.Conn, userID *userpb.UserId) {
+	count, err := redis.Int(conn.Do("SCARD", acceptedUsersPrefix+userID.GetOpaqueId()))
+	if err != nil {
+		return
+	}
+	invite.RecordAcceptedUsers(ctx, userID, count)
+}
+
+// getToken returns the stored token, or nil if there is none or it expired.
+func getToken(conn redis.Conn, t string) (*storedToken, error) {
+	data, err := redis.Bytes(conn.Do("GET", tokenPrefix+t))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error reading token")
+	}
+
+	stored := &storedToken{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, errors.Wrap(err, "redis: error decoding token")
+	}
+	return stored, nil
+}
+
+// getUserTokens returns the unexpired tokens of the user. The tokens expired since they were
+// indexed are removed from the index.
+func getUserTokens(conn redis.Conn, userKey string) ([]*storedToken, error) {
+	members, err := redis.Strings(conn.Do("SMEMBERS", userTokensPrefix+userKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error listing tokens")
+	}
+
+	tokens := make([]*storedToken, 0, len(members))
+	for _, t := range members {
+		stored, err := getToken(conn, t)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			if _, err := conn.Do("SREM", userTokensPrefix+userKey, t); err != nil {
+				return nil, errors.Wrap(err, "redis: error removing expired token")
+			}
+			continue
+		}
+		tokens = append(tokens, stored)
+	}
+	return tokens, nil
+}
+
+// removeToken removes the token and its index entry.
+func removeToken(conn redis.Conn, t *invitepb.InviteToken) error {
+	if _, err := conn.Do("DEL", tokenPrefix+t.GetToken()); err != nil {
+		return errors.Wrap(err, "redis: error removing token")
+	}
+	if _, err := conn.Do("SREM", userTokensPrefix+t.GetUserId().GetOpaqueId(), t.GetToken()); err != nil {
+		return errors.Wrap(err, "redis: error removing token")
+	}
+	return nil
+}
+
+// getAcceptedUsers returns the remote users who accepted the invites of the user.
+func getAcceptedUsers(conn redis.Conn, userKey string) ([]*userpb.User, error) {
+	members, err := redis.ByteSlices(conn.Do("SMEMBERS", acceptedUsersPrefix+userKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "redis: error reading accepted users")
+	}
+	users := make([]*userpb.User, 0, len(members))
+	for _, data := range members {
+		u := &userpb.User{}
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, errors.Wrap(err, "redis: error decoding accepted user")
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// getTokenIfValid returns the stored token. Redis removes the tokens once expired,
+// so expired tokens cannot be told apart from unknown ones.
+func getTokenIfValid(conn redis.Conn, token *invitepb.InviteToken) (*invitepb.InviteToken, error) {
+	stored, err := getToken(conn, token.GetToken())
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		used, err := redis.Bool(conn.Do("EXISTS", usedTokenPrefix+token.GetToken()))
+		if err != nil {
+			return nil, errors.Wrap(err, "redis: error reading token")
+		}
+		if used {
+			return nil, errtypes.BadRequest("redis: token already used")
+		}
+		return nil, errtypes.NotFound("redis: invalid token")
+	}
+	return stored.Token, nil
+}
+
+// checkTokenOwner verifies that the user forwarding an invite is the owner of the stored token.
+// Tokens generated by other providers are not stored and cannot be checked.
+func (m *manager) checkTokenOwner(token *invitepb.InviteToken, userID *userpb.UserId) error {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	stored, err := getToken(conn, token.GetToken())
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return nil
+	}
+	return invite.CheckTokenOwner(stored.Token.GetUserId(), userID)
+}
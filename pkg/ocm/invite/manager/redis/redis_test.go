@@ -0,0 +1,383 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/invite"
+	"github.com/cs3org/reva/pkg/user"
+)
+
+func newTestContext(opaqueID string, groups ...string) context.Context {
+	u := &userpb.User{
+		Id: &userpb.UserId{
+			Idp:      "http://localhost:20080",
+			OpaqueId: opaqueID,
+		},
+		Username:    opaqueID,
+		Mail:        opaqueID + "@example.org",
+		DisplayName: opaqueID,
+		Groups:      groups,
+	}
+	return user.ContextSetUser(context.Background(), u)
+}
+
+// newTestManager returns a manager backed by an in-memory redis server private to the test.
+func newTestManager(t *testing.T, conf map[string]interface{}) (*manager, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("error starting redis: %v", err)
+	}
+	if conf == nil {
+		conf = map[string]interface{}{}
+	}
+	conf["redis"] = s.Addr()
+	conf["admin_group"] = "admins"
+	m, err := New(conf)
+	if err != nil {
+		s.Close()
+		t.Fatalf("New() error = %v", err)
+	}
+	return m.(*manager), s
+}
+
+func TestAcceptInvite(t *testing.T) {
+	m, s := newTestManager(t, nil)
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, Mail: "marie@cesnet.cz"}
+	if _, err := m.AcceptInvite(einstein, inviteToken, marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	if _, err := m.AcceptInvite(einstein, inviteToken, marie); err == nil {
+		t.Errorf("AcceptInvite() of an already accepted user error = nil, want an error")
+	}
+
+	for _, id := range []*userpb.UserId{marie.GetId(), {OpaqueId: "marie"}} {
+		remoteUser, err := m.GetRemoteUser(einstein, id)
+		if err != nil {
+			t.Fatalf("GetRemoteUser() error = %v", err)
+		}
+		if remoteUser.GetMail() != marie.GetMail() {
+			t.Errorf("GetRemoteUser() = %v, want %v", remoteUser, marie)
+		}
+	}
+	if _, err := m.GetRemoteUser(newTestContext("richard"), marie.GetId()); err == nil {
+		t.Errorf("GetRemoteUser() of another user error = nil, want not found")
+	}
+}
+
+func TestTokenExpiration(t *testing.T) {
+	m, s := newTestManager(t, map[string]interface{}{"expiration": "1h"})
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if ttl := s.TTL(tokenPrefix + inviteToken.GetToken()); ttl != time.Hour {
+		t.Errorf("token TTL = %v, want %v", ttl, time.Hour)
+	}
+
+	s.FastForward(time.Hour)
+
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	_, err = m.AcceptInvite(einstein, inviteToken, marie)
+	if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("AcceptInvite() of an expired token error = %v, want not found", err)
+	}
+	if invites, err := m.ListInvites(einstein); err != nil || len(invites) != 0 {
+		t.Errorf("ListInvites() after expiration = %v, %v, want no invites", invites, err)
+	}
+	if s.Exists(userTokensPrefix + "einstein") {
+		t.Errorf("index of the expired token not removed")
+	}
+}
+
+func TestAcceptInviteErrors(t *testing.T) {
+	m, s := newTestManager(t, map[string]interface{}{"single_use": true})
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	used, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, used, marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		token          *invitepb.InviteToken
+		wantNotFound   bool
+		wantBadRequest bool
+	}{
+		{"unknown", &invitepb.InviteToken{Token: "unknown"}, true, false},
+		{"used", used, false, true},
+	}
+
+	richard := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "richard"}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.AcceptInvite(einstein, tt.token, richard)
+			if _, ok := err.(errtypes.IsNotFound); ok != tt.wantNotFound {
+				t.Errorf("AcceptInvite() error = %v, want not found %v", err, tt.wantNotFound)
+			}
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Errorf("AcceptInvite() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+		})
+	}
+}
+
+func TestConcurrentAcceptInvite(t *testing.T) {
+	tests := []struct {
+		name       string
+		singleUse  bool
+		remoteUser func(i int) *userpb.User
+	}{
+		{"single use token", true, func(i int) *userpb.User {
+			return &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: fmt.Sprintf("user-%d", i)}}
+		}},
+		{"same remote user", false, func(i int) *userpb.User {
+			return &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, Mail: fmt.Sprintf("marie-%d@cesnet.cz", i)}
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m, s := newTestManager(t, map[string]interface{}{"single_use": tt.singleUse})
+			defer s.Close()
+			defer m.Close()
+
+			einstein := newTestContext("einstein")
+			inviteToken, err := m.GenerateToken(einstein)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+
+			var wg sync.WaitGroup
+			var accepted int32
+			start := make(chan struct{})
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					if _, err := m.AcceptInvite(einstein, inviteToken, tt.remoteUser(i)); err == nil {
+						atomic.AddInt32(&accepted, 1)
+					}
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			if accepted != 1 {
+				t.Errorf("%d concurrent accepts succeeded, want 1", accepted)
+			}
+			if members, _ := s.Members(acceptedUsersPrefix + "einstein"); len(members) != 1 {
+				t.Errorf("%d accepted users, want 1", len(members))
+			}
+		})
+	}
+}
+
+func TestListInvites(t *testing.T) {
+	m, s := newTestManager(t, nil)
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	described, err := m.GenerateToken(invite.ContextSetDescription(einstein, "for the physics department"))
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	revoked, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, err := m.GenerateToken(newTestContext("marie")); err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	if err := m.RevokeToken(newTestContext("marie"), revoked); err == nil {
+		t.Errorf("RevokeToken() of another user error = nil, want permission denied")
+	}
+	if err := m.RevokeToken(einstein, revoked); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+
+	invites, err := m.ListInvites(einstein)
+	if err != nil {
+		t.Fatalf("ListInvites() error = %v", err)
+	}
+	if len(invites) != 1 || invites[0].Token.GetToken() != described.GetToken() || invites[0].Description != "for the physics department" {
+		t.Errorf("ListInvites() = %v, want only the described token", invites)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	m, s := newTestManager(t, nil)
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	marie := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	if _, err := m.AcceptInvite(einstein, inviteToken, marie); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+
+	userID := &userpb.UserId{Idp: "http://localhost:20080", OpaqueId: "einstein"}
+	if err := m.PurgeUser(newTestContext("richard"), userID); err == nil {
+		t.Errorf("PurgeUser() by a non admin error = nil, want permission denied")
+	}
+	if err := m.PurgeUser(newTestContext("richard", "admins"), userID); err != nil {
+		t.Fatalf("PurgeUser() error = %v", err)
+	}
+
+	if _, err := m.GetRemoteUser(einstein, marie.GetId()); err == nil {
+		t.Errorf("GetRemoteUser() after purge error = nil, want not found")
+	}
+	if invites, err := m.ListInvites(einstein); err != nil || len(invites) != 0 {
+		t.Errorf("ListInvites() after purge = %v, %v, want no invites", invites, err)
+	}
+}
+
+func TestMaxActiveTokensPerUser(t *testing.T) {
+	m, s := newTestManager(t, map[string]interface{}{"max_active_tokens_per_user": 1, "expiration": "1h"})
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	if _, err := m.GenerateToken(einstein); err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, err := m.GenerateToken(einstein); err == nil {
+		t.Fatalf("GenerateToken() over the limit error = nil, want an error")
+	}
+
+	// an expired token frees a slot
+	s.FastForward(time.Hour)
+	if _, err := m.GenerateToken(einstein); err != nil {
+		t.Errorf("GenerateToken() after a token expired error = %v", err)
+	}
+}
+
+func TestAcceptInviteInviter(t *testing.T) {
+	m, s := newTestManager(t, nil)
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// the accepting provider only knows the token itself
+	remote := &userpb.User{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}}
+	inviter, err := m.AcceptInvite(einstein, &invitepb.InviteToken{Token: inviteToken.GetToken()}, remote)
+	if err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	owner := user.ContextMustGetUser(einstein).GetId()
+	if inviter.GetId().GetOpaqueId() != owner.GetOpaqueId() || inviter.GetId().GetIdp() != owner.GetIdp() {
+		t.Errorf("AcceptInvite() inviter = %v, want %v", inviter, owner)
+	}
+
+	// accepting again is refused and returns no inviter
+	if inviter, err := m.AcceptInvite(einstein, inviteToken, remote); err == nil || inviter != nil {
+		t.Errorf("AcceptInvite() of an already accepted user = %v, %v, want an error", inviter, err)
+	}
+}
+
+func TestGetRemoteUserCollidingOpaqueIDs(t *testing.T) {
+	m, s := newTestManager(t, nil)
+	defer s.Close()
+	defer m.Close()
+
+	einstein := newTestContext("einstein")
+	inviteToken, err := m.GenerateToken(einstein)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	// two providers issued the opaque id marie
+	for _, remote := range []*userpb.User{
+		{Id: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, Mail: "marie@cesnet.cz"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, Mail: "marie@cern.ch"},
+		{Id: &userpb.UserId{Idp: "cern.ch", OpaqueId: "richard"}, Mail: "richard@cern.ch"},
+	} {
+		if _, err := m.AcceptInvite(einstein, inviteToken, remote); err != nil {
+			t.Fatalf("AcceptInvite() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		remoteUserID   *userpb.UserId
+		wantMail       string
+		wantBadRequest bool
+	}{
+		{"first idp", &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "marie"}, "marie@cesnet.cz", false},
+		{"second idp", &userpb.UserId{Idp: "cern.ch", OpaqueId: "marie"}, "marie@cern.ch", false},
+		{"ambiguous", &userpb.UserId{OpaqueId: "marie"}, "", true},
+		{"single candidate", &userpb.UserId{OpaqueId: "richard"}, "richard@cern.ch", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			remoteUser, err := m.GetRemoteUser(einstein, tt.remoteUserID)
+			if _, ok := err.(errtypes.IsBadRequest); ok != tt.wantBadRequest {
+				t.Fatalf("GetRemoteUser() error = %v, want bad request %v", err, tt.wantBadRequest)
+			}
+			if remoteUser.GetMail() != tt.wantMail {
+				t.Errorf("GetRemoteUser() = %v, want %s", remoteUser, tt.wantMail)
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	typespb "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/invite"
+	"github.com/cs3org/reva/pkg/ocm/invite/manager/registry"
+	"github.com/cs3org/reva/pkg/ocm/invite/token"
+	"github.com/cs3org/reva/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+
+	// Provides sqlite drivers
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations are the statements creating the schema, in order. The ones already applied
+// to a database are tracked in its invite_schema table, new ones must be appended.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS invites (
+		token TEXT PRIMARY KEY,
+		owner_idp TEXT NOT NULL,
+		owner_opaque_id TEXT NOT NULL,
+		expiration INTEGER NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		used INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS invites_owner ON invites (owner_opaque_id)`,
+	`CREATE TABLE IF NOT EXISTS accepted_users (
+		owner_opaque_id TEXT NOT NULL,
+		idp TEXT NOT NULL,
+		opaque_id TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (owner_opaque_id, idp, opaque_id)
+	)`,
+}
+
+type manager struct {
+	config *config
+	db     *sql.DB
+}
+
+type config struct {
+	// Driver is the name of the database/sql driver, which must be compiled in. The queries use ?
+	// as placeholder, so databases whose drivers only support other ones, e.g. $1 for Postgres,
+	// cannot be used.
+	Driver string `mapstructure:"driver"`
+	// DSN is the data source name of the database, in the format of the driver.
+	DSN        string `mapstructure:"dsn"`
+	Expiration string `mapstructure:"expiration"`
+	AdminGroup string `mapstructure:"admin_group"`
+	// TokenGenerator is the name of the strategy generating the invite tokens.
+	TokenGenerator string `mapstructure:"token_generator"`
+	// TokenLength is the number of random bytes of the tokens, for the base58 and random generators.
+	TokenLength int `mapstructure:"token_length"`
+	// SingleUse makes the tokens acceptable only once.
+	SingleUse bool `mapstructure:"single_use"`
+	// MaxActiveTokensPerUser is the number of unexpired tokens a user can hold.
+	// A negative value disables the limit.
+	MaxActiveTokensPerUser int `mapstructure:"max_active_tokens_per_user"`
+
+	invite.ForwardConfig `mapstructure:",squash"`
+
+	expiration time.Duration
+}
+
+func init() {
+	registry.Register("sql", New)
+}
+
+func (c *config) init() error {
+	if c.Driver == "" {
+		c.Driver = "sqlite3"
+	}
+
+	if c.DSN == "" {
+		c.DSN = "/var/tmp/reva/ocm-invites.db"
+	}
+
+	if c.Expiration == "" {
+		c.Expiration = token.DefaultExpirationTime
+	}
+	expiration, err := token.ParseExpiration(c.Expiration)
+	if err != nil {
+		return err
+	}
+	c.expiration = expiration
+
+	if c.TokenGenerator == "" {
+		c.TokenGenerator = token.DefaultGenerator
+	}
+
+	if c.TokenLength == 0 {
+		c.TokenLength = token.DefaultLength
+	}
+
+	if c.MaxActiveTokensPerUser == 0 {
+		c.MaxActiveTokensPerUser = invite.DefaultMaxActiveTokensPerUser
+	}
+
+	if err := c.ForwardConfig.Init(); err != nil {
+		return err
+	}
+
+	if _, err := token.GetGenerator(c.TokenGenerator); err != nil {
+		return err
+	}
+	if err := token.CheckLength(c.TokenLength); err != nil {
+		return err
+	}
+	return nil
+}
+
+// New returns a new invite manager storing the invites in a SQL database.
+// The queries use ? as placeholder, as supported e.g. by SQLite and MySQL but not by Postgres.
+func New(m map[string]interface{}) (invite.Manager, error) {
+	c := &config{}
+	if err := mapstructure.Decode(m, c); err != nil {
+		err = errors.Wrap(err, "error parsing config for sql invite manager")
+		return nil, err
+	}
+	if err := c.init(); err != nil {
+		err = errors.Wrap(err, "error setting config defaults for sql invite manager")
+		return nil, err
+	}
+
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error opening DB connection")
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &manager{
+		config: c,
+		db:     db,
+	}, nil
+}
+
+// migrate applies the migrations not applied yet to the database.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS invite_schema (version INTEGER NOT NULL)"); err != nil {
+		return errors.Wrap(err, "sql: error creating schema version table")
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM invite_schema").Scan(&version); err != nil {
+		return errors.Wrap(err, "sql: error reading schema version")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "sql: error starting migration")
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "sql: error applying migration %d", i+1)
+		}
+		if _, err := tx.Exec("INSERT INTO invite_schema (version) VALUES (?)", i+1); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "sql: error recording migration %d", i+1)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "sql: error committing migration %d", i+1)
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to the database.
+func (m *manager) Close() error {
+	return m.db.Close()
+}
+
+func (m *manager) GenerateToken(ctx context.Context) (*invitepb.InviteToken, error) {
+
+	contextUser := user.ContextMustGetUser(ctx)
+	inviteToken, err := token.CreateTokenFor(m.config.expiration, m.config.TokenGenerator, m.config.TokenLength, contextUser.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error starting transaction")
+	}
+	defer tx.Rollback()
+
+	// the expired tokens are removed as the json manager does when saving
+	if _, err := tx.ExecContext(ctx, "DELETE FROM invites WHERE expiration < ?", time.Now().Unix()); err != nil {
+		return nil, errors.Wrap(err, "sql: error removing expired tokens")
+	}
+
+	if max := m.config.MaxActiveTokensPerUser; max > 0 {
+		var count int
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM invites WHERE owner_opaque_id=? AND used=0", contextUser.GetId().GetOpaqueId()).Scan(&count)
+		if err != nil {
+			return nil, errors.Wrap(err, "sql: error counting tokens")
+		}
+		if count >= max {
+			return nil, invite.TooManyTokensError(max)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO invites (token, owner_idp, owner_opaque_id, expiration, description) VALUES (?, ?, ?, ?, ?)",
+		inviteToken.GetToken(), contextUser.GetId().GetIdp(), contextUser.GetId().GetOpaqueId(),
+		inviteToken.GetExpiration().GetSeconds(), invite.ContextGetDescription(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error executing insert statement")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "sql: error committing transaction")
+	}
+
+	m.recordAcceptedUsers(ctx, contextUser.GetId())
+	return inviteToken, nil
+}
+
+func (m *manager) ForwardInvite(ctx context.Context, inviteToken *invitepb.InviteToken, originProvider *ocmprovider.ProviderInfo) error {
+
+	contextUser := user.ContextMustGetUser(ctx)
+	if err := m.checkTokenOwner(ctx, inviteToken, contextUser.GetId()); err != nil {
+		return err
+	}
+	return m.config.Forward(ctx, inviteToken, contextUser, originProvider)
+}
+
+func (m *manager) AcceptInvite(ctx context.Context, inviteToken *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+	inviter, err := m.acceptInvite(ctx, inviteToken, remoteUser)
+	invite.AuditAcceptInvite(ctx, inviteToken, remoteUser, inviter, err)
+	return inviter, err
+}
+
+func (m *manager) acceptInvite(ctx context.Context, invite *invitepb.InviteToken, remoteUser *userpb.User) (*userpb.User, error) {
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error starting transaction")
+	}
+	defer tx.Rollback()
+
+	inviteToken, err := getTokenIfValid(ctx, tx, invite)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add to the list of accepted users
+	userKey := inviteToken.GetUserId().GetOpaqueId()
+	var accepted int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM accepted_users WHERE owner_opaque_id=? AND idp=? AND opaque_id=?",
+		userKey, remoteUser.GetId().GetIdp(), remoteUser.GetId().GetOpaqueId()).Scan(&accepted)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error querying accepted users")
+	}
+	if accepted > 0 {
+		return nil, errors.New("sql: user already added to accepted users")
+	}
+
+	data, err := json.Marshal(remoteUser)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error encoding remote user")
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO accepted_users (owner_opaque_id, idp, opaque_id, data) VALUES (?, ?, ?, ?)",
+		userKey, remoteUser.GetId().GetIdp(), remoteUser.GetId().GetOpaqueId(), string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error executing insert statement")
+	}
+
+	if m.config.SingleUse {
+		if err := useToken(ctx, tx, inviteToken.GetToken()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "sql: error committing transaction")
+	}
+
+	m.recordAcceptedUsers(ctx, inviteToken.GetUserId())
+	return &userpb.User{Id: inviteToken.GetUserId()}, nil
+}
+
+func (m *manager) GetRemoteUser(ctx context.Context, remoteUserID *userpb.UserId) (*userpb.User, error) {
+
+	userKey := user.ContextMustGetUser(ctx).GetId().GetOpaqueId()
+	rows, err := m.db.QueryContext(ctx, "SELECT data FROM accepted_users WHERE owner_opaque_id=? AND opaque_id=?",
+		userKey, remoteUserID.GetOpaqueId())
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error querying accepted users")
+	}
+	defer rows.Close()
+
+	var candidates []*userpb.User
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, errors.Wrap(err, "sql: error querying accepted users")
+		}
+		remoteUser := &userpb.User{}
+		if err := json.Unmarshal([]byte(data), remoteUser); err != nil {
+			return nil, errors.Wrap(err, "sql: error decoding remote user")
+		}
+		candidates = append(candidates, remoteUser)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sql: error querying accepted users")
+	}
+	return invite.FindRemoteUser(candidates, remoteUserID)
+}
+
+func (m *manager) ListInvites(ctx context.Context) ([]*invite.Invite, error) {
+	userID := user.ContextMustGetUser(ctx).GetId()
+
+	rows, err := m.db.QueryContext(ctx, "SELECT token, owner_idp, expiration, description FROM invites WHERE owner_opaque_id=? AND expiration >= ? AND used=0 ORDER BY token",
+		userID.GetOpaqueId(), time.Now().Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error querying invites")
+	}
+	defer rows.Close()
+
+	invites := []*invite.Invite{}
+	for rows.Next() {
+		var tkn, idp, description string
+		var expiration uint64
+		if err := rows.Scan(&tkn, &idp, &expiration, &description); err != nil {
+			return nil, errors.Wrap(err, "sql: error scanning invite")
+		}
+		invites = append(invites, &invite.Invite{
+			Token: &invitepb.InviteToken{
+				Token:      tkn,
+				UserId:     &userpb.UserId{Idp: idp, OpaqueId: userID.GetOpaqueId()},
+				Expiration: &typespb.Timestamp{Seconds: expiration},
+			},
+			Description: description,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sql: error listing invites")
+	}
+	return invites, nil
+}
+
+func (m *manager) RevokeToken(ctx context.Context, token *invitepb.InviteToken) error {
+	userID := user.ContextMustGetUser(ctx).GetId()
+
+	owner, err := getToken(ctx, m.db, token.GetToken())
+	if err != nil {
+		return err
+	}
+	if owner == nil || owner.used {
+		return errtypes.NotFound(token.GetToken())
+	}
+	if owner.GetUserId().GetOpaqueId() != userID.GetOpaqueId() || owner.GetUserId().GetIdp() != userID.GetIdp() {
+		return errtypes.PermissionDenied("sql: invite token does not belong to user " + userID.GetOpaqueId())
+	}
+
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM invites WHERE token=?", token.GetToken()); err != nil {
+		return errors.Wrap(err, "sql: error executing delete statement")
+	}
+	return nil
+}
+
+func (m *manager) PurgeUser(ctx context.Context, userID *userpb.UserId) error {
+	ctxUser := user.ContextMustGetUser(ctx)
+	if !invite.IsAdmin(ctxUser, m.config.AdminGroup) {
+		return errtypes.PermissionDenied("sql: user " + ctxUser.GetId().GetOpaqueId() + " is not allowed to purge users")
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "sql: error starting transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM invites WHERE owner_opaque_id=? AND owner_idp=?", userID.GetOpaqueId(), userID.GetIdp()); err != nil {
+		return errors.Wrap(err, "sql: error executing delete statement")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM accepted_users WHERE owner_opaque_id=?", userID.GetOpaqueId()); err != nil {
+		return errors.Wrap(err, "sql: error executing delete statement")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "sql: error committing transaction")
+	}
+	return nil
+}
+
+// recordAcceptedUsers emits the number of remote users who accepted the invites of the user.
+func (m *manager) recordAcceptedUsers(ctx context.Context, userID *userpb.UserId) {
+	var count int
+	if err := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM accepted_users WHERE owner_opaque_id=?", userID.GetOpaqueId()).Scan(&count); err != nil {
+		return
+	}
+	invite.RecordAcceptedUsers(ctx, userID, count)
+}
+
+// storedToken is an invite token read from the database.
+type storedToken struct {
+	*invitepb.InviteToken
+	used bool
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// getToken returns the stored token, or nil if there is none.
+func getToken(ctx context.Context, q querier, tkn string) (*storedToken, error) {
+	var idp, opaqueID string
+	var expiration uint64
+	var used bool
+	err := q.QueryRowContext(ctx, "SELECT owner_idp, owner_opaque_id, expiration, used FROM invites WHERE token=?", tkn).Scan(&idp, &opaqueID, &expiration, &used)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error querying invites")
+	}
+	return &storedToken{
+		InviteToken: &invitepb.InviteToken{
+			Token:      tkn,
+			UserId:     &userpb.UserId{Idp: idp, OpaqueId: opaqueID},
+			Expiration: &typespb.Timestamp{Seconds: expiration},
+		},
+		used: used,
+	}, nil
+}
+
+func getTokenIfValid(ctx context.Context, q querier, token *invitepb.InviteToken) (*invitepb.InviteToken, error) {
+	inviteToken, err := getToken(ctx, q, token.GetToken())
+	if err != nil {
+		return nil, err
+	}
+	if inviteToken == nil {
+		return nil, errtypes.NotFound("sql: invalid token")
+	}
+	if inviteToken.used {
+		return nil, errtypes.BadRequest("sql: token already used")
+	}
+
+	if uint64(time.Now().Unix()) > inviteToken.Expiration.Seconds {
+		return nil, errtypes.BadRequest("sql: token expired")
+	}
+	return inviteToken.InviteToken, nil
+}
+
+// useToken marks a single use token as used. The validity check reads the token before, in the same
+// transaction, but two concurrent accepts can both pass it under the READ COMMITTED isolation of e.g.
+// MySQL: only the update of an unused token consumes it, the other accept failing.
+func useToken(ctx context.Context, tx *sql.Tx, tkn string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE invites SET used=1 WHERE token=? AND used=0", tkn)
+	if err != nil {
+		return errors.Wrap(err, "sql: error executing update statement")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "sql: error executing update statement")
+	}
+	if n == 0 {
+		return errtypes.BadRequest("sql: token already used")
+	}
+	return nil
+}
+
+// checkTokenOwner verifies that the user forwarding an invite is the owner of the stored token.
+// Tokens generated by other providers are not stored and cannot be checked.
+func (m *manager) checkTokenOwner(ctx context.Context, token *invitepb.InviteToken, userID *userpb.UserId) error {
+	t, err := getToken(ctx, m.db, token.GetToken())
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	return invite.CheckTokenOwner(t.GetUserId(), userID)
+}
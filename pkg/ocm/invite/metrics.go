@@ -0,0 +1,53 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package invite
+
+import (
+	"context"
+
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	"github.com/cs3org/reva/pkg/appctx"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+// AcceptedUsersMeasure records the number of remote users who accepted the invites of a user
+// each time the user generates a token or one of the invites is accepted.
+var AcceptedUsersMeasure = stats.Int64("cs3_org_sciencemesh_ocm_accepted_users", "The number of remote users who accepted the invites of a user", stats.UnitDimensionless)
+
+// AcceptedUsersView returns the distribution of the number of accepted users per user.
+func AcceptedUsersView() *view.View {
+	return &view.View{
+		Name:        AcceptedUsersMeasure.Name(),
+		Description: AcceptedUsersMeasure.Description(),
+		Measure:     AcceptedUsersMeasure,
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500),
+	}
+}
+
+func init() {
+	_ = view.Register(AcceptedUsersView())
+}
+
+// RecordAcceptedUsers emits the number of remote users who accepted the invites of the user.
+// The count is not part of the token and is only used for telemetry.
+func RecordAcceptedUsers(ctx context.Context, userID *userpb.UserId, count int) {
+	appctx.GetLogger(ctx).Info().Str("idp", userID.GetIdp()).Str("userid", userID.GetOpaqueId()).Int("accepted_users", count).Msg("ocm invites")
+	stats.Record(ctx, AcceptedUsersMeasure.M(int64(count)))
+}
@@ -0,0 +1,52 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package invite
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// DefaultMaxResponseSize is the maximum number of bytes read from the responses of the
+// partner providers when unspecified in the config.
+const DefaultMaxResponseSize = 64 * 1024
+
+// ReadResponse reads at most max bytes of the body of a response of a partner provider,
+// so that a malicious partner cannot exhaust the memory with a huge body.
+// It reports whether the body was truncated.
+func ReadResponse(body io.Reader, max int64) ([]byte, bool, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(b)) > max {
+		return b[:max], true, nil
+	}
+	return b, false, nil
+}
+
+// ResponseError returns the message describing a failed response of a partner provider
+// with the given status and body, noting whether the body was truncated.
+func ResponseError(status string, body []byte, truncated bool) string {
+	if truncated {
+		return fmt.Sprintf("%s: %s... (response truncated at %d bytes)", status, body, len(body))
+	}
+	return fmt.Sprintf("%s: %s", status, body)
+}
@@ -0,0 +1,168 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package token
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// DefaultGenerator is the generator to be used when unspecified in the config.
+const DefaultGenerator = "uuid"
+
+// DefaultLength is the number of random bytes of the tokens when unspecified in the config.
+const DefaultLength = 16
+
+// MinLength is the smallest number of random bytes of the tokens allowed in the config.
+const MinLength = 16
+
+// Generator generates the random string identifying an invite token. The length is the number
+// of random bytes of the token, honored by the generators whose entropy is configurable.
+type Generator func(length int) (string, error)
+
+var generators = map[string]Generator{
+	"uuid":   uuidGenerator,
+	"base58": base58Generator,
+	"random": randomGenerator,
+	"words":  wordsGenerator,
+}
+
+// Register registers a new token generator under name.
+func Register(name string, g Generator) {
+	generators[name] = g
+}
+
+// GetGenerator returns the generator registered under name.
+func GetGenerator(name string) (Generator, error) {
+	g, ok := generators[name]
+	if !ok {
+		return nil, errors.New("token: unknown token generator: " + name)
+	}
+	return g, nil
+}
+
+// CheckLength verifies that the tokens are long enough to not be guessed.
+func CheckLength(length int) error {
+	if length < MinLength {
+		return fmt.Errorf("token: length of %d bytes is below the minimum of %d", length, MinLength)
+	}
+	return nil
+}
+
+// uuidGenerator returns random UUIDs, whose length is fixed.
+func uuidGenerator(length int) (string, error) {
+	return uuid.New().String(), nil
+}
+
+// randomGenerator encodes random bytes with the URL safe base64 alphabet.
+func randomGenerator(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "token: error reading random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Generator encodes random bytes with the bitcoin alphabet, which leaves out
+// the characters that look alike, 0OIl, for tokens to be copied by hand.
+func base58Generator(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "token: error reading random bytes")
+	}
+
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(int64(len(base58Alphabet)))
+	mod := new(big.Int)
+	var sb strings.Builder
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		sb.WriteByte(base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are encoded with the first character of the alphabet
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		sb.WriteByte(base58Alphabet[0])
+	}
+	return sb.String(), nil
+}
+
+// tokenWords is the number of words of the tokens created by wordsGenerator.
+const tokenWords = 8
+
+// wordsGenerator joins words picked at random from a list of short and distinct words,
+// for tokens to be dictated on the phone, e.g. "river-candle-orbit-...".
+// The 8 words of a token, picked among 256, amount to 64 random bits whatever the length.
+func wordsGenerator(length int) (string, error) {
+	words := make([]string, tokenWords)
+	max := big.NewInt(int64(len(wordList)))
+	for i := range words {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "token: error reading random number")
+		}
+		words[i] = wordList[n.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+var wordList = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "arrow", "atlas",
+	"attic", "audio", "award", "bacon", "badge", "bagel", "baker", "banjo",
+	"barn", "basil", "beach", "beard", "bench", "berry", "bison", "blade",
+	"blank", "blaze", "bloom", "board", "bonus", "boot", "brain", "brass",
+	"bread", "brick", "bride", "brook", "brush", "bunny", "cabin", "cable",
+	"cactus", "camel", "candle", "canoe", "cargo", "carpet", "castle", "cedar",
+	"chalk", "cheese", "cherry", "chess", "chief", "cider", "cigar", "cliff",
+	"clock", "cloud", "clover", "coast", "cobra", "cocoa", "comet", "coral",
+	"cotton", "cougar", "crane", "crater", "crown", "cube", "curve", "daisy",
+	"dance", "delta", "denim", "desk", "diary", "dingo", "disco", "dolphin",
+	"donkey", "dragon", "drum", "eagle", "earth", "easel", "echo", "elbow",
+	"elder", "ember", "engine", "envoy", "falcon", "fern", "ferry", "fiber",
+	"field", "flame", "flute", "focus", "forest", "fossil", "fox", "frost",
+	"fudge", "galaxy", "garden", "garlic", "gecko", "ginger", "glacier", "globe",
+	"goat", "grape", "gravel", "guitar", "hammer", "harbor", "hazel", "hedge",
+	"helmet", "heron", "honey", "horizon", "hotel", "husky", "igloo", "index",
+	"island", "ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle", "kayak",
+	"kettle", "kiwi", "koala", "ladder", "lagoon", "lemon", "lentil", "lilac",
+	"linen", "lizard", "llama", "lobster", "locket", "lotus", "lumber", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "metal", "meteor", "mint",
+	"mirror", "monkey", "mosaic", "motor", "mountain", "muffin", "nectar", "needle",
+	"nickel", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit",
+	"orchid", "otter", "oyster", "paddle", "panda", "paper", "parrot", "peach",
+	"pebble", "pepper", "piano", "pillow", "pirate", "planet", "plum", "pocket",
+	"polar", "pony", "poppy", "puzzle", "quartz", "quilt", "rabbit", "radar",
+	"radio", "raven", "recipe", "ribbon", "river", "robin", "rocket", "saddle",
+	"salmon", "sandal", "satin", "scarf", "shadow", "shell", "silver", "sketch",
+	"sloth", "socket", "spice", "spider", "spoon", "squid", "stable", "statue",
+	"sugar", "summit", "sunset", "switch", "tablet", "tango", "temple", "thunder",
+	"tiger", "timber", "tomato", "topaz", "tractor", "trumpet", "tulip", "tunnel",
+	"turtle", "umbrella", "unicorn", "valley", "velvet", "violin", "volcano", "wagon",
+}
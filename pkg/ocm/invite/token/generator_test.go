@@ -0,0 +1,135 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package token
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGenerators(t *testing.T) {
+	tests := []struct {
+		name   string
+		format *regexp.Regexp
+	}{
+		{"uuid", regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)},
+		{"base58", regexp.MustCompile(`^[1-9A-HJ-NP-Za-km-z]{16,22}$`)},
+		{"random", regexp.MustCompile(`^[A-Za-z0-9_-]{22}$`)},
+		{"words", regexp.MustCompile(`^[a-z]+(-[a-z]+){7}$`)},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			generate, err := GetGenerator(tt.name)
+			if err != nil {
+				t.Fatalf("GetGenerator() error = %v", err)
+			}
+
+			tokens := map[string]bool{}
+			for i := 0; i < 100000; i++ {
+				tkn, err := generate(DefaultLength)
+				if err != nil {
+					t.Fatalf("generate() error = %v", err)
+				}
+				if !tt.format.MatchString(tkn) {
+					t.Fatalf("token %q does not match %s", tkn, tt.format)
+				}
+				if tokens[tkn] {
+					t.Fatalf("token %q generated twice", tkn)
+				}
+				tokens[tkn] = true
+			}
+		})
+	}
+}
+
+func TestTokenLength(t *testing.T) {
+	tests := []struct {
+		length  int
+		wantErr bool
+	}{
+		{8, true},
+		{15, true},
+		{16, false},
+		{32, false},
+		{64, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(strconv.Itoa(tt.length), func(t *testing.T) {
+			token, err := CreateTokenFor(time.Hour, "random", tt.length, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateTokenFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if url.QueryEscape(token.GetToken()) != token.GetToken() {
+				t.Errorf("CreateTokenFor() token %q is not URL safe", token.GetToken())
+			}
+			b, err := base64.RawURLEncoding.DecodeString(token.GetToken())
+			if err != nil {
+				t.Fatalf("error decoding token %q: %v", token.GetToken(), err)
+			}
+			if len(b) != tt.length {
+				t.Errorf("CreateTokenFor() token of %d bytes, want %d", len(b), tt.length)
+			}
+
+			// base58 packs about 5.86 bits per character
+			base58, err := CreateTokenFor(time.Hour, "base58", tt.length, nil)
+			if err != nil {
+				t.Fatalf("CreateTokenFor() error = %v", err)
+			}
+			if min := tt.length * 8 / 6; len(base58.GetToken()) < min {
+				t.Errorf("CreateTokenFor() base58 token %q shorter than %d characters", base58.GetToken(), min)
+			}
+		})
+	}
+}
+
+func TestCreateTokenWith(t *testing.T) {
+	token, err := CreateTokenWith("24h", "words", nil)
+	if err != nil {
+		t.Fatalf("CreateTokenWith() error = %v", err)
+	}
+	if !regexp.MustCompile(`^[a-z]+(-[a-z]+){7}$`).MatchString(token.GetToken()) {
+		t.Errorf("CreateTokenWith() token = %v", token.GetToken())
+	}
+
+	if _, err := CreateTokenWith("24h", "unknown", nil); err == nil {
+		t.Errorf("CreateTokenWith() expected error for an unknown generator")
+	}
+}
+
+func TestWordList(t *testing.T) {
+	seen := map[string]bool{}
+	for _, w := range wordList {
+		if w == "" || seen[w] {
+			t.Errorf("word %q is empty or repeated", w)
+		}
+		seen[w] = true
+	}
+}
@@ -19,28 +19,51 @@
 package token
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 	invitepb "github.com/cs3org/go-cs3apis/cs3/ocm/invite/v1beta1"
 	typesv1beta1 "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
 
 // DefaultExpirationTime is the expiration time to be used when unspecified in the config.
 const DefaultExpirationTime = "24h"
 
-// CreateToken creates a InviteToken object for the userID indicated by userID.
+// CreateToken creates a InviteToken object for the userID indicated by userID,
+// using the default generator.
 func CreateToken(expiration string, userID *userpb.UserId) (*invitepb.InviteToken, error) {
+	return CreateTokenWith(expiration, DefaultGenerator, userID)
+}
 
-	// Parse time of expiration
-	duration, err := time.ParseDuration(expiration)
+// CreateTokenWith creates a InviteToken object for the userID indicated by userID,
+// using the token generator registered under the name generator.
+func CreateTokenWith(expiration, generator string, userID *userpb.UserId) (*invitepb.InviteToken, error) {
+	duration, err := ParseExpiration(expiration)
 	if err != nil {
-		return nil, errors.Wrap(err, "error parsing time of expiration")
+		return nil, err
 	}
+	return CreateTokenFor(duration, generator, DefaultLength, userID)
+}
 
-	tokenID := uuid.New().String()
+// CreateTokenFor creates a InviteToken object valid for the given duration for the userID
+// indicated by userID, using the token generator registered under the name generator to
+// generate a token of length random bytes.
+func CreateTokenFor(duration time.Duration, generator string, length int, userID *userpb.UserId) (*invitepb.InviteToken, error) {
+	generate, err := GetGenerator(generator)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckLength(length); err != nil {
+		return nil, err
+	}
+
+	tokenID, err := generate(length)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating token")
+	}
 	now := time.Now()
 	expirationTime := now.Add(duration)
 
@@ -55,3 +78,27 @@ func CreateToken(expiration string, userID *userpb.UserId) (*invitepb.InviteToke
 
 	return &token, nil
 }
+
+// ParseExpiration parses the validity of the tokens, a Go duration like 72h or
+// a number of days like 7d. The validity must be positive.
+func ParseExpiration(expiration string) (time.Duration, error) {
+	var duration time.Duration
+	if days := strings.TrimSuffix(expiration, "d"); days != expiration {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.Wrap(err, "error parsing time of expiration")
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(expiration)
+		if err != nil {
+			return 0, errors.Wrap(err, "error parsing time of expiration")
+		}
+		duration = d
+	}
+
+	if duration <= 0 {
+		return 0, errors.New("time of expiration must be positive: " + expiration)
+	}
+	return duration, nil
+}
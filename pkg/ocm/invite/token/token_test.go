@@ -21,6 +21,7 @@ package token
 import (
 	"sync"
 	"testing"
+	"time"
 
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 )
@@ -89,3 +90,35 @@ func TestCreateTokenCollision(t *testing.T) {
 		tokens.Store(token.GetToken(), token)
 	}
 }
+
+func TestParseExpiration(t *testing.T) {
+	tests := []struct {
+		expiration string
+		want       time.Duration
+		wantErr    bool
+	}{
+		{"72h", 72 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1d", 24 * time.Hour, false},
+		{"one week", 0, true},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"0h", 0, true},
+		{"-1d", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.expiration, func(t *testing.T) {
+			got, err := ParseExpiration(tt.expiration)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpiration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseExpiration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,16 +22,19 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
-	"net"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
 	"github.com/cs3org/reva/pkg/errtypes"
 	"github.com/cs3org/reva/pkg/ocm/provider"
 	"github.com/cs3org/reva/pkg/ocm/provider/authorizer/registry"
+	"github.com/fsnotify/fsnotify"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 func init() {
@@ -47,7 +50,29 @@ func New(m map[string]interface{}) (provider.Authorizer, error) {
 	}
 	c.init()
 
-	f, err := ioutil.ReadFile(c.Providers)
+	providers, err := loadProviders(c.Providers, c.StrictDomains)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &authorizer{
+		providers: providers,
+		hosts:     provider.NewHostResolver(time.Duration(c.DNSCacheTTL)*time.Second, time.Duration(c.DNSNegativeCacheTTL)*time.Second),
+		conf:      c,
+		done:      make(chan struct{}),
+	}
+
+	if !c.DisableWatch {
+		if err := a.startWatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func loadProviders(file string, strictDomains bool) ([]*ocmprovider.ProviderInfo, error) {
+	f, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
@@ -57,103 +82,177 @@ func New(m map[string]interface{}) (provider.Authorizer, error) {
 		return nil, err
 	}
 
-	return &authorizer{
-		providers: providers,
-		conf:      c,
-	}, nil
+	providers, err = provider.MergeDuplicates(providers, strictDomains)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading providers")
+	}
+	return providers, nil
 }
 
 type config struct {
 	Providers             string `mapstructure:"providers"`
 	VerifyRequestHostname bool   `mapstructure:"verify_request_hostname"`
+	// StrictDomains makes loading fail when a domain is listed more than once.
+	// Otherwise the services of the duplicated entries are merged.
+	StrictDomains bool `mapstructure:"strict_domains"`
+	// DisableWatch disables reloading the providers when their file changes.
+	DisableWatch bool `mapstructure:"disable_watch"`
+	// ReloadDelay is the time in milliseconds waited after a change of the providers file
+	// before reloading it, coalescing the changes of a file written in several steps.
+	ReloadDelay int `mapstructure:"reload_delay"`
+	// DNSCacheTTL is the time in seconds the addresses of the OCM hosts are cached
+	// when verifying the request hostnames.
+	DNSCacheTTL int `mapstructure:"dns_cache_ttl"`
+	// DNSNegativeCacheTTL is the time in seconds the failures to resolve the OCM hosts are cached.
+	DNSNegativeCacheTTL int `mapstructure:"dns_negative_cache_ttl"`
 }
 
 func (c *config) init() {
 	if c.Providers == "" {
 		c.Providers = "/etc/revad/ocm-providers.json"
 	}
+	if c.ReloadDelay == 0 {
+		c.ReloadDelay = 500
+	}
+	if c.DNSCacheTTL == 0 {
+		c.DNSCacheTTL = 300
+	}
+	if c.DNSNegativeCacheTTL == 0 {
+		c.DNSNegativeCacheTTL = 30
+	}
 }
 
 type authorizer struct {
-	providers   []*ocmprovider.ProviderInfo
-	providerIPs *sync.Map
-	conf        *config
+	mu        sync.RWMutex // guards providers against reloads
+	providers []*ocmprovider.ProviderInfo
+	hosts     *provider.HostResolver
+	conf      *config
+
+	done      chan struct{} // closed to stop watching the providers file
+	closeOnce sync.Once
+	reloaded  func(err error) // called after every reload of the providers file, if set
 }
 
-func (a *authorizer) GetInfoByDomain(ctx context.Context, domain string) (*ocmprovider.ProviderInfo, error) {
-	for _, p := range a.providers {
-		if strings.Contains(p.Domain, domain) {
-			return p, nil
-		}
+// Close stops watching the providers file.
+func (a *authorizer) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
+
+// startWatch starts reloading the providers when their file changes.
+func (a *authorizer) startWatch() error {
+	// the directory is watched as editors and deployment tools often replace the file
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "error creating the watcher of the providers file")
 	}
-	return nil, errtypes.NotFound(domain)
+	if err := watcher.Add(filepath.Dir(a.conf.Providers)); err != nil {
+		watcher.Close()
+		return errors.Wrap(err, "error watching the providers file")
+	}
+	go a.watch(watcher)
+	return nil
 }
 
-func (a *authorizer) IsProviderAllowed(ctx context.Context, provider *ocmprovider.ProviderInfo) error {
+// watch reloads the providers when their file changes, until the authorizer is closed.
+func (a *authorizer) watch(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
 
-	var providerAuthorized bool
-	if provider.Domain != "" {
-		for _, p := range a.providers {
-			if p.Domain == provider.Domain {
-				providerAuthorized = true
+	file := filepath.Clean(a.conf.Providers)
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-a.done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				reload = time.After(time.Duration(a.conf.ReloadDelay) * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("json: error watching the ocm providers file")
+		case <-reload:
+			reload = nil
+			err := a.reload()
+			if err != nil {
+				log.Error().Err(err).Msg("json: error reloading the ocm providers, keeping the previous ones")
+			}
+			if a.reloaded != nil {
+				a.reloaded(err)
 			}
 		}
-	} else {
-		providerAuthorized = true
-	}
-
-	switch {
-	case !providerAuthorized:
-		return errtypes.NotFound(provider.GetDomain())
-	case !a.conf.VerifyRequestHostname:
-		return nil
-	case len(provider.Services) == 0:
-		return errtypes.NotSupported("No IP provided")
 	}
+}
 
-	ocmHost, err := getOCMHost(provider)
+// reload replaces the providers with the content of their file, unless it is invalid.
+func (a *authorizer) reload() error {
+	providers, err := loadProviders(a.conf.Providers, a.conf.StrictDomains)
 	if err != nil {
-		return errors.Wrap(err, "json: ocm host not specified for mesh provider")
+		return err
 	}
 
-	providerAuthorized = false
-	var ipList []string
-	if hostIPs, ok := a.providerIPs.Load(ocmHost); ok {
-		ipList = hostIPs.([]string)
-	} else {
-		addr, err := net.LookupIP(ocmHost)
-		if err != nil {
-			return errors.Wrap(err, "json: error looking up client IP")
-		}
-		for _, a := range addr {
-			ipList = append(ipList, a.String())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.providers = providers
+	return nil
+}
+
+func (a *authorizer) getProviders() []*ocmprovider.ProviderInfo {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.providers
+}
+
+func (a *authorizer) GetInfoByDomain(ctx context.Context, domain string) (*ocmprovider.ProviderInfo, error) {
+	providers := a.getProviders()
+	if p := provider.FindProvider(providers, domain); p != nil {
+		return p, nil
+	}
+	for _, p := range providers {
+		if !strings.HasPrefix(p.Domain, provider.WildcardPrefix) && strings.Contains(p.Domain, domain) {
+			return p, nil
 		}
-		a.providerIPs.Store(ocmHost, ipList)
 	}
+	return nil, errtypes.NotFound(domain)
+}
 
-	for _, ip := range ipList {
-		if ip == provider.Services[0].Host {
-			providerAuthorized = true
-		}
+func (a *authorizer) GetInfoByIP(ctx context.Context, ip string) (*ocmprovider.ProviderInfo, error) {
+	// the hosts of the services are resolved through the dns cache
+	return a.hosts.FindByIP(a.getProviders(), ip)
+}
+
+func (a *authorizer) IsProviderAllowed(ctx context.Context, p *ocmprovider.ProviderInfo) error {
+
+	providers := a.getProviders()
+	if p.Domain != "" && provider.FindProvider(providers, p.Domain) == nil {
+		return errtypes.NotFound(p.GetDomain())
 	}
-	if !providerAuthorized {
-		return errtypes.NotFound("OCM Host")
+	if !a.conf.VerifyRequestHostname {
+		return nil
 	}
 
-	return nil
+	// the request is authorized if it comes from any of the OCM hosts of the configured
+	// provider, e.g. from its failover, whatever the hosts the request lists
+	configured, err := a.hosts.FindConfigured(providers, p)
+	if err != nil {
+		return err
+	}
+	return a.hosts.VerifyHostname(configured, p)
 }
 
 func (a *authorizer) ListAllProviders(ctx context.Context) ([]*ocmprovider.ProviderInfo, error) {
-	return a.providers, nil
+	return a.getProviders(), nil
 }
 
-func getOCMHost(originProvider *ocmprovider.ProviderInfo) (string, error) {
-	for _, s := range originProvider.Services {
-		if s.Endpoint.Type.Name == "OCM" {
-			ocmHost := strings.TrimPrefix(s.Host, "https://")
-			ocmHost = strings.TrimPrefix(ocmHost, "http://")
-			return ocmHost, nil
-		}
-	}
-	return "", errtypes.NotFound("OCM Host")
+func (a *authorizer) ListProvidersByService(ctx context.Context, typeName string) ([]*ocmprovider.ProviderInfo, error) {
+	return provider.FilterByService(a.getProviders(), typeName), nil
+}
+
+func (a *authorizer) ListProvidersPaged(ctx context.Context, pageSize int, pageToken string) ([]*ocmprovider.ProviderInfo, string, error) {
+	return provider.Paginate(a.getProviders(), pageSize, pageToken)
 }
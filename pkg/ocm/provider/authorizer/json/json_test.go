@@ -0,0 +1,547 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package json
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+)
+
+const duplicatedDomainProviders = `[
+	{
+		"name": "cernbox",
+		"domain": "cernbox.cern.ch",
+		"services": [
+			{
+				"endpoint": {"type": {"name": "OCM"}, "path": "https://cernbox.cern.ch/ocm/"},
+				"host": "cernbox.cern.ch"
+			}
+		]
+	},
+	{
+		"name": "cernbox-webdav",
+		"domain": "cernbox.cern.ch",
+		"services": [
+			{
+				"endpoint": {"type": {"name": "Webdav"}, "path": "https://cernbox.cern.ch/remote.php/webdav/"},
+				"host": "cernbox.cern.ch"
+			}
+		]
+	},
+	{
+		"name": "oc-cesnet",
+		"domain": "cesnet.cz",
+		"services": []
+	}
+]`
+
+// writeProviders writes the providers to a temporary file and returns its path.
+func writeProviders(t *testing.T, providers string) string {
+	f, err := ioutil.TempFile("", "ocm-providers-*.json")
+	if err != nil {
+		t.Fatalf("error creating providers file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(providers); err != nil {
+		t.Fatalf("error writing providers file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestDuplicatedDomainStrict(t *testing.T) {
+	file := writeProviders(t, duplicatedDomainProviders)
+	defer os.Remove(file)
+
+	_, err := New(map[string]interface{}{
+		"providers":      file,
+		"strict_domains": true,
+	})
+	if err == nil {
+		t.Errorf("expected error loading duplicated domains in strict mode")
+	}
+}
+
+func TestDuplicatedDomainMerge(t *testing.T) {
+	file := writeProviders(t, duplicatedDomainProviders)
+	defer os.Remove(file)
+
+	a, err := New(map[string]interface{}{
+		"providers": file,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	providers, err := a.ListAllProviders(context.Background())
+	if err != nil {
+		t.Fatalf("ListAllProviders() error = %v", err)
+	}
+	if len(providers) != 2 {
+		t.Fatalf("expected 2 providers, got %d", len(providers))
+	}
+
+	p, err := a.GetInfoByDomain(context.Background(), "cernbox.cern.ch")
+	if err != nil {
+		t.Fatalf("GetInfoByDomain() error = %v", err)
+	}
+	if len(p.Services) != 2 {
+		t.Errorf("expected the services of both entries to be merged, got %v", p.Services)
+	}
+}
+
+func TestIsProviderAllowedVerifyHostname(t *testing.T) {
+	file := writeProviders(t, `[
+		{
+			"name": "local",
+			"domain": "localhost",
+			"services": [{"endpoint": {"type": {"name": "OCM"}}, "host": "localhost"}]
+		},
+		{
+			"name": "institution",
+			"domain": "*.institution.edu",
+			"services": [{"endpoint": {"type": {"name": "OCM"}}, "host": "127.0.0.1"}]
+		}
+	]`)
+	defer os.Remove(file)
+
+	a, err := New(map[string]interface{}{
+		"providers":               file,
+		"verify_request_hostname": true,
+		"disable_watch":           true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// the services are those of the request, the first one holding the address of the client
+	client := func(clientIP string) []*ocmprovider.Service {
+		return []*ocmprovider.Service{{Host: clientIP}}
+	}
+	// claimed lists the client as an OCM host of its own, which must not be trusted
+	claimed := func(clientIP string) []*ocmprovider.Service {
+		return []*ocmprovider.Service{
+			{Host: clientIP},
+			{
+				Endpoint: &ocmprovider.ServiceEndpoint{Type: &ocmprovider.ServiceType{Name: "OCM"}},
+				Host:     clientIP,
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		provider    *ocmprovider.ProviderInfo
+		wantAllowed bool
+	}{
+		{"allowed", &ocmprovider.ProviderInfo{Domain: "localhost", Services: client("127.0.0.1")}, true},
+		// the addresses of the host are cached by the first request
+		{"allowed again", &ocmprovider.ProviderInfo{Domain: "localhost", Services: client("127.0.0.1")}, true},
+		{"other address", &ocmprovider.ProviderInfo{Domain: "localhost", Services: client("192.0.2.1")}, false},
+		{"claimed ocm host", &ocmprovider.ProviderInfo{Domain: "localhost", Services: claimed("192.0.2.1")}, false},
+		{"claimed ocm host of a wildcard", &ocmprovider.ProviderInfo{Domain: "lab.institution.edu", Services: claimed("192.0.2.1")}, false},
+		{"unknown domain", &ocmprovider.ProviderInfo{Domain: "cesnet.cz", Services: client("127.0.0.1")}, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.IsProviderAllowed(context.Background(), tt.provider)
+			if tt.wantAllowed && err != nil {
+				t.Errorf("IsProviderAllowed() error = %v", err)
+			}
+			if _, ok := err.(errtypes.IsNotFound); !tt.wantAllowed && !ok {
+				t.Errorf("IsProviderAllowed() error = %v, want not found", err)
+			}
+		})
+	}
+}
+
+func TestReloadProviders(t *testing.T) {
+	file := writeProviders(t, `[{"name": "cernbox", "domain": "cernbox.cern.ch"}]`)
+	defer os.Remove(file)
+
+	p, err := New(map[string]interface{}{
+		"providers":     file,
+		"reload_delay":  10,
+		"disable_watch": true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+	reloads := make(chan error, 100)
+	a.reloaded = func(err error) { reloads <- err }
+	if err := a.startWatch(); err != nil {
+		t.Fatalf("startWatch() error = %v", err)
+	}
+	defer a.Close()
+
+	// waitReload waits for a reload of the providers file failing or not
+	waitReload := func(failed bool) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case err := <-reloads:
+				if (err != nil) == failed {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("providers file not reloaded after 5s")
+			}
+		}
+	}
+
+	if _, err := a.GetInfoByDomain(context.Background(), "cesnet.cz"); err == nil {
+		t.Fatalf("GetInfoByDomain() of a provider not listed yet error = nil")
+	}
+
+	providers := `[{"name": "cernbox", "domain": "cernbox.cern.ch"}, {"name": "oc-cesnet", "domain": "cesnet.cz"}]`
+	if err := ioutil.WriteFile(file, []byte(providers), 0644); err != nil {
+		t.Fatalf("error writing providers file: %v", err)
+	}
+	waitReload(false)
+	if _, err := a.GetInfoByDomain(context.Background(), "cesnet.cz"); err != nil {
+		t.Fatalf("GetInfoByDomain() of a provider added to the file error = %v", err)
+	}
+
+	// a malformed file keeps the previous providers
+	if err := ioutil.WriteFile(file, []byte(`[{"name": "cernbox"`), 0644); err != nil {
+		t.Fatalf("error writing providers file: %v", err)
+	}
+	waitReload(true)
+	all, err := a.ListAllProviders(context.Background())
+	if err != nil {
+		t.Fatalf("ListAllProviders() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("ListAllProviders() after writing a malformed file returned %d providers, want 2", len(all))
+	}
+}
+
+func TestIsProviderAllowedDNSCache(t *testing.T) {
+	file := writeProviders(t, `[{"name": "local", "domain": "localhost"}]`)
+	defer os.Remove(file)
+
+	p, err := New(map[string]interface{}{
+		"providers":               file,
+		"verify_request_hostname": true,
+		"disable_watch":           true,
+		"dns_cache_ttl":           60,
+		"dns_negative_cache_ttl":  10,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+
+	now := time.Now()
+	a.hosts.Now = func() time.Time { return now }
+	resolved := map[string][]net.IP{"ocm.localhost": {net.ParseIP("10.0.0.1")}}
+	lookups := 0
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		if ips, ok := resolved[host]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	// configure makes host the OCM host of the provider
+	configure := func(host string) {
+		a.providers = []*ocmprovider.ProviderInfo{{
+			Domain: "localhost",
+			Services: []*ocmprovider.Service{{
+				Endpoint: &ocmprovider.ServiceEndpoint{Type: &ocmprovider.ServiceType{Name: "OCM"}},
+				Host:     host,
+			}},
+		}}
+	}
+	request := &ocmprovider.ProviderInfo{
+		Domain:   "localhost",
+		Services: []*ocmprovider.Service{{Host: "10.0.0.1"}},
+	}
+
+	tests := []struct {
+		name        string
+		advance     time.Duration
+		moveTo      string
+		host        string
+		wantAllowed bool
+		wantLookups int
+	}{
+		{"resolved", 0, "", "ocm.localhost", true, 1},
+		// the host moves to another address, which is seen once the cache expires
+		{"cached", 59 * time.Second, "10.0.0.2", "ocm.localhost", true, 1},
+		{"expired", 2 * time.Second, "", "ocm.localhost", false, 2},
+		{"unresolvable", 0, "", "unknown.localhost", false, 3},
+		{"unresolvable cached", 9 * time.Second, "", "unknown.localhost", false, 3},
+		{"unresolvable expired", 2 * time.Second, "", "unknown.localhost", false, 4},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		if tt.moveTo != "" {
+			resolved[tt.host] = []net.IP{net.ParseIP(tt.moveTo)}
+		}
+
+		configure(tt.host)
+		err := a.IsProviderAllowed(context.Background(), request)
+		if (err == nil) != tt.wantAllowed {
+			t.Errorf("%s: IsProviderAllowed() error = %v, want allowed %v", tt.name, err, tt.wantAllowed)
+		}
+		if lookups != tt.wantLookups {
+			t.Errorf("%s: %d lookups, want %d", tt.name, lookups, tt.wantLookups)
+		}
+	}
+}
+
+func TestGetInfoByIP(t *testing.T) {
+	file := writeProviders(t, duplicatedDomainProviders)
+	defer os.Remove(file)
+
+	p, err := New(map[string]interface{}{
+		"providers":     file,
+		"disable_watch": true,
+		"dns_cache_ttl": 60,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+
+	lookups := 0
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		if host == "cernbox.cern.ch" {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name       string
+		ip         string
+		wantDomain string
+		wantErr    error
+	}{
+		{"ipv4", "10.0.0.1", "cernbox.cern.ch", nil},
+		{"ipv4 with port", "10.0.0.1:443", "cernbox.cern.ch", nil},
+		{"ipv6", "[fd00::1]:443", "cernbox.cern.ch", nil},
+		{"unknown address", "10.0.0.2", "", errtypes.NotFound("")},
+		{"invalid address", "cernbox.cern.ch", "", errtypes.BadRequest("")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := a.GetInfoByIP(context.Background(), tt.ip)
+			switch tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("GetInfoByIP() error = %v", err)
+				}
+				if info.Domain != tt.wantDomain {
+					t.Errorf("GetInfoByIP() domain = %s, want %s", info.Domain, tt.wantDomain)
+				}
+			case errtypes.NotFound:
+				if _, ok := err.(errtypes.IsNotFound); !ok {
+					t.Errorf("GetInfoByIP() error = %v, want not found", err)
+				}
+			case errtypes.BadRequest:
+				if _, ok := err.(errtypes.IsBadRequest); !ok {
+					t.Errorf("GetInfoByIP() error = %v, want bad request", err)
+				}
+			}
+		})
+	}
+
+	// both providers share the same host, which is resolved once and then served from the cache
+	if lookups != 1 {
+		t.Errorf("GetInfoByIP() did %d lookups, want 1", lookups)
+	}
+}
+
+func TestWildcardDomains(t *testing.T) {
+	file := writeProviders(t, `[
+		{"name": "institution", "domain": "*.institution.edu"},
+		{"name": "physics", "domain": "*.physics.institution.edu"},
+		{"name": "cern", "domain": "cern.institution.edu"}
+	]`)
+	defer os.Remove(file)
+
+	a, err := New(map[string]interface{}{
+		"providers":     file,
+		"disable_watch": true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		domain   string
+		wantName string
+	}{
+		{"cern.institution.edu", "cern"},
+		{"lab.institution.edu", "institution"},
+		{"a.b.institution.edu", "institution"},
+		{"lab.physics.institution.edu", "physics"},
+		{"institution.edu.example.org", ""},
+		{"example.org", ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.domain, func(t *testing.T) {
+			p, err := a.GetInfoByDomain(context.Background(), tt.domain)
+			switch {
+			case tt.wantName == "" && err == nil:
+				t.Errorf("GetInfoByDomain() = %s, want not found", p.GetName())
+			case tt.wantName != "" && err != nil:
+				t.Errorf("GetInfoByDomain() error = %v", err)
+			case tt.wantName != "" && p.GetName() != tt.wantName:
+				t.Errorf("GetInfoByDomain() = %s, want %s", p.GetName(), tt.wantName)
+			}
+
+			err = a.IsProviderAllowed(context.Background(), &ocmprovider.ProviderInfo{Domain: tt.domain})
+			if (err == nil) != (tt.wantName != "") {
+				t.Errorf("IsProviderAllowed() error = %v, want allowed %v", err, tt.wantName != "")
+			}
+		})
+	}
+}
+
+func TestIsProviderAllowedMultipleOCMServices(t *testing.T) {
+	file := writeProviders(t, `[{
+		"name": "local",
+		"domain": "localhost",
+		"services": [
+			{"endpoint": {"type": {"name": "OCM"}}, "host": "https://primary.localhost"},
+			{"endpoint": {"type": {"name": "OCM"}}, "host": "https://failover.localhost"}
+		]
+	}]`)
+	defer os.Remove(file)
+
+	p, err := New(map[string]interface{}{
+		"providers":               file,
+		"verify_request_hostname": true,
+		"disable_watch":           true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "primary.localhost":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "failover.localhost":
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		clientIP    string
+		wantAllowed bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.3", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.clientIP, func(t *testing.T) {
+			// the service holds the address of the client, as sent by the ocmd handlers
+			provider := &ocmprovider.ProviderInfo{
+				Domain:   "localhost",
+				Services: []*ocmprovider.Service{{Host: tt.clientIP}},
+			}
+			err := a.IsProviderAllowed(context.Background(), provider)
+			if (err == nil) != tt.wantAllowed {
+				t.Errorf("IsProviderAllowed() error = %v, want allowed %v", err, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestIsProviderAllowedAddressNotations(t *testing.T) {
+	file := writeProviders(t, `[{"name": "local", "domain": "localhost"}]`)
+	defer os.Remove(file)
+
+	p, err := New(map[string]interface{}{
+		"providers":               file,
+		"verify_request_hostname": true,
+		"disable_watch":           true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		if host == "ocm.localhost" {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name        string
+		clientHost  string
+		ocmHost     string
+		wantAllowed bool
+	}{
+		{"ipv4", "10.0.0.1", "https://10.0.0.1:8443", true},
+		{"ipv6 with port", "[::1]:443", "https://[0:0:0:0:0:0:0:1]:443/ocm", true},
+		{"ipv6 without port", "[::1]", "0:0:0:0:0:0:0:1", true},
+		{"hostname service", "10.0.0.1", "https://ocm.localhost:443", true},
+		{"hostname client", "ocm.localhost", "10.0.0.1", true},
+		{"other ipv6", "::2", "[::1]", false},
+		{"other ipv4", "10.0.0.2", "https://ocm.localhost", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a.providers = []*ocmprovider.ProviderInfo{{
+				Domain: "localhost",
+				Services: []*ocmprovider.Service{{
+					Endpoint: &ocmprovider.ServiceEndpoint{Type: &ocmprovider.ServiceType{Name: "OCM"}},
+					Host:     tt.ocmHost,
+				}},
+			}}
+			provider := &ocmprovider.ProviderInfo{
+				Domain:   "localhost",
+				Services: []*ocmprovider.Service{{Host: tt.clientHost}},
+			}
+			err := a.IsProviderAllowed(context.Background(), provider)
+			if (err == nil) != tt.wantAllowed {
+				t.Errorf("IsProviderAllowed() error = %v, want allowed %v", err, tt.wantAllowed)
+			}
+		})
+	}
+}
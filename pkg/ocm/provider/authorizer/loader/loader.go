@@ -22,5 +22,6 @@ import (
 	// Load core share manager drivers.
 	_ "github.com/cs3org/reva/pkg/ocm/provider/authorizer/json"
 	_ "github.com/cs3org/reva/pkg/ocm/provider/authorizer/open"
+	_ "github.com/cs3org/reva/pkg/ocm/provider/authorizer/sql"
 	// Add your own here
 )
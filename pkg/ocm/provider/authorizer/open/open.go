@@ -22,6 +22,7 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"strings"
 
 	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
@@ -55,6 +56,11 @@ func New(m map[string]interface{}) (provider.Authorizer, error) {
 		return nil, err
 	}
 
+	providers, err = provider.MergeDuplicates(providers, c.StrictDomains)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading providers")
+	}
+
 	return &authorizer{
 		providers: providers,
 	}, nil
@@ -63,6 +69,9 @@ func New(m map[string]interface{}) (provider.Authorizer, error) {
 type config struct {
 	// Users holds a path to a file containing json conforming the Users struct
 	Providers string `mapstructure:"providers"`
+	// StrictDomains makes loading fail when a domain is listed more than once.
+	// Otherwise the services of the duplicated entries are merged.
+	StrictDomains bool `mapstructure:"strict_domains"`
 }
 
 func (c *config) init() {
@@ -84,6 +93,32 @@ func (a *authorizer) GetInfoByDomain(ctx context.Context, domain string) (*ocmpr
 	return nil, errtypes.NotFound(domain)
 }
 
+// GetInfoByIP returns the provider with a service served from the ip address. The open
+// authorizer keeps no cache, the hosts of the services are resolved on every call.
+func (a *authorizer) GetInfoByIP(ctx context.Context, ip string) (*ocmprovider.ProviderInfo, error) {
+	addr := net.ParseIP(provider.SplitHost(ip))
+	if addr == nil {
+		return nil, errtypes.BadRequest("invalid ip address: " + ip)
+	}
+
+	for _, p := range a.providers {
+		for _, s := range p.Services {
+			host := provider.SplitHost(s.Host)
+			ips := []net.IP{net.ParseIP(host)}
+			if ips[0] == nil {
+				var err error
+				if ips, err = net.LookupIP(host); err != nil {
+					continue
+				}
+			}
+			if provider.ContainsAny(ips, []net.IP{addr}) {
+				return p, nil
+			}
+		}
+	}
+	return nil, errtypes.NotFound(ip)
+}
+
 func (a *authorizer) IsProviderAllowed(ctx context.Context, provider *ocmprovider.ProviderInfo) error {
 	return nil
 }
@@ -91,3 +126,11 @@ func (a *authorizer) IsProviderAllowed(ctx context.Context, provider *ocmprovide
 func (a *authorizer) ListAllProviders(ctx context.Context) ([]*ocmprovider.ProviderInfo, error) {
 	return a.providers, nil
 }
+
+func (a *authorizer) ListProvidersByService(ctx context.Context, typeName string) ([]*ocmprovider.ProviderInfo, error) {
+	return provider.FilterByService(a.providers, typeName), nil
+}
+
+func (a *authorizer) ListProvidersPaged(ctx context.Context, pageSize int, pageToken string) ([]*ocmprovider.ProviderInfo, string, error) {
+	return provider.Paginate(a.providers, pageSize, pageToken)
+}
@@ -0,0 +1,341 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/ocm/provider"
+	"github.com/cs3org/reva/pkg/ocm/provider/authorizer/registry"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+
+	// Provides sqlite drivers
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	registry.Register("sql", New)
+}
+
+// migrations are the statements creating the schema, in order. The ones already applied
+// to a database are tracked in its ocm_provider_schema table, new ones must be appended.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS ocm_providers (
+		domain TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		full_name TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		organization TEXT NOT NULL DEFAULT '',
+		homepage TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS ocm_provider_services (
+		domain TEXT NOT NULL REFERENCES ocm_providers (domain) ON DELETE CASCADE,
+		position INTEGER NOT NULL DEFAULT 0,
+		host TEXT NOT NULL DEFAULT '',
+		api_version TEXT NOT NULL DEFAULT '',
+		endpoint_type TEXT NOT NULL,
+		endpoint_name TEXT NOT NULL DEFAULT '',
+		endpoint_path TEXT NOT NULL DEFAULT '',
+		is_monitored INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS ocm_provider_services_domain ON ocm_provider_services (domain)`,
+}
+
+// New returns a new authorizer reading the providers from a SQL database.
+// The queries use ? as placeholder, as supported e.g. by SQLite and MySQL.
+func New(m map[string]interface{}) (provider.Authorizer, error) {
+	c := &config{}
+	if err := mapstructure.Decode(m, c); err != nil {
+		err = errors.Wrap(err, "error decoding conf")
+		return nil, err
+	}
+	c.init()
+
+	dsn := c.DSN
+	if c.Driver == "sqlite3" {
+		dsn = withForeignKeys(dsn)
+	}
+	db, err := sql.Open(c.Driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error opening DB connection")
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &authorizer{
+		db:    db,
+		hosts: provider.NewHostResolver(time.Duration(c.DNSCacheTTL)*time.Second, time.Duration(c.DNSNegativeCacheTTL)*time.Second),
+		conf:  c,
+	}, nil
+}
+
+// withForeignKeys enables the foreign keys, disabled by default by SQLite, on every
+// connection to the database, so that deleting a provider deletes its services.
+func withForeignKeys(dsn string) string {
+	if strings.Contains(dsn, "_foreign_keys=") || strings.Contains(dsn, "_fk=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=1"
+	}
+	return dsn + "?_foreign_keys=1"
+}
+
+type config struct {
+	Driver                string `mapstructure:"driver"`
+	DSN                   string `mapstructure:"dsn"`
+	VerifyRequestHostname bool   `mapstructure:"verify_request_hostname"`
+	// DNSCacheTTL is the time in seconds the addresses of the OCM hosts are cached
+	// when verifying the request hostnames.
+	DNSCacheTTL int `mapstructure:"dns_cache_ttl"`
+	// DNSNegativeCacheTTL is the time in seconds the failures to resolve the OCM hosts are cached.
+	DNSNegativeCacheTTL int `mapstructure:"dns_negative_cache_ttl"`
+}
+
+func (c *config) init() {
+	if c.Driver == "" {
+		c.Driver = "sqlite3"
+	}
+	if c.DSN == "" {
+		c.DSN = "/var/tmp/reva/ocm-providers.db"
+	}
+	if c.DNSCacheTTL == 0 {
+		c.DNSCacheTTL = 300
+	}
+	if c.DNSNegativeCacheTTL == 0 {
+		c.DNSNegativeCacheTTL = 30
+	}
+}
+
+type authorizer struct {
+	db    *sql.DB
+	hosts *provider.HostResolver
+	conf  *config
+}
+
+// migrate applies the migrations not applied yet to the database.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS ocm_provider_schema (version INTEGER NOT NULL)"); err != nil {
+		return errors.Wrap(err, "sql: error creating schema version table")
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM ocm_provider_schema").Scan(&version); err != nil {
+		return errors.Wrap(err, "sql: error reading schema version")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "sql: error starting migration")
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "sql: error applying migration %d", i+1)
+		}
+		if _, err := tx.Exec("INSERT INTO ocm_provider_schema (version) VALUES (?)", i+1); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "sql: error recording migration %d", i+1)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "sql: error committing migration %d", i+1)
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to the database.
+func (a *authorizer) Close() error {
+	return a.db.Close()
+}
+
+const providerColumns = "domain, name, full_name, description, organization, homepage, email"
+
+// queryProviders returns the providers selected by the condition, with their services.
+func (a *authorizer) queryProviders(ctx context.Context, where string, args ...interface{}) ([]*ocmprovider.ProviderInfo, error) {
+	rows, err := a.db.QueryContext(ctx, "SELECT "+providerColumns+" FROM ocm_providers "+where+" ORDER BY domain", args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error reading providers")
+	}
+	defer rows.Close()
+
+	providers := []*ocmprovider.ProviderInfo{}
+	for rows.Next() {
+		p := &ocmprovider.ProviderInfo{}
+		if err := rows.Scan(&p.Domain, &p.Name, &p.FullName, &p.Description, &p.Organization, &p.Homepage, &p.Email); err != nil {
+			return nil, errors.Wrap(err, "sql: error reading providers")
+		}
+		providers = append(providers, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sql: error reading providers")
+	}
+
+	services, err := a.queryServices(ctx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range providers {
+		p.Services = services[p.Domain]
+	}
+	return providers, nil
+}
+
+// queryServices returns the services, in their order, of the providers selected by the condition, by domain.
+func (a *authorizer) queryServices(ctx context.Context, where string, args ...interface{}) (map[string][]*ocmprovider.Service, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT domain, host, api_version, endpoint_type, endpoint_name, endpoint_path, is_monitored
+		FROM ocm_provider_services WHERE domain IN (SELECT domain FROM ocm_providers `+where+`) ORDER BY domain, position`, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql: error reading provider services")
+	}
+	defer rows.Close()
+
+	services := map[string][]*ocmprovider.Service{}
+	for rows.Next() {
+		var domain string
+		s := &ocmprovider.Service{Endpoint: &ocmprovider.ServiceEndpoint{Type: &ocmprovider.ServiceType{}}}
+		if err := rows.Scan(&domain, &s.Host, &s.ApiVersion, &s.Endpoint.Type.Name, &s.Endpoint.Name, &s.Endpoint.Path, &s.Endpoint.IsMonitored); err != nil {
+			return nil, errors.Wrap(err, "sql: error reading provider services")
+		}
+		services[domain] = append(services[domain], s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sql: error reading provider services")
+	}
+	return services, nil
+}
+
+// wildcardCondition selects the providers of the domain, listing it or matching it with a wildcard.
+const wildcardCondition = "WHERE domain=? OR domain LIKE ?"
+
+// hasProvider tells whether the domain is registered, or matches a wildcard entry.
+func (a *authorizer) hasProvider(ctx context.Context, domain string) (bool, error) {
+	rows, err := a.db.QueryContext(ctx, "SELECT domain FROM ocm_providers "+wildcardCondition, domain, provider.WildcardPrefix+"%")
+	if err != nil {
+		return false, errors.Wrap(err, "sql: error reading providers")
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return false, errors.Wrap(err, "sql: error reading providers")
+		}
+		found = found || d == domain || provider.MatchesWildcard(d, domain)
+	}
+	if err := rows.Err(); err != nil {
+		return false, errors.Wrap(err, "sql: error reading providers")
+	}
+	return found, nil
+}
+
+func (a *authorizer) GetInfoByDomain(ctx context.Context, domain string) (*ocmprovider.ProviderInfo, error) {
+	providers, err := a.queryProviders(ctx, wildcardCondition, domain, provider.WildcardPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	if p := provider.FindProvider(providers, domain); p != nil {
+		return p, nil
+	}
+
+	// the domains containing the requested one match too, as with the json authorizer
+	providers, err = a.queryProviders(ctx, "WHERE instr(domain, ?) > 0 AND domain NOT LIKE ?", domain, provider.WildcardPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		return nil, errtypes.NotFound(domain)
+	}
+	return providers[0], nil
+}
+
+func (a *authorizer) GetInfoByIP(ctx context.Context, ip string) (*ocmprovider.ProviderInfo, error) {
+	providers, err := a.queryProviders(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	// the hosts of the services are resolved through the dns cache
+	return a.hosts.FindByIP(providers, ip)
+}
+
+func (a *authorizer) IsProviderAllowed(ctx context.Context, p *ocmprovider.ProviderInfo) error {
+
+	providerAuthorized := true
+	if p.Domain != "" {
+		var err error
+		if providerAuthorized, err = a.hasProvider(ctx, p.Domain); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !providerAuthorized:
+		return errtypes.NotFound(p.GetDomain())
+	case !a.conf.VerifyRequestHostname:
+		return nil
+	}
+
+	// the request is authorized if it comes from any of the OCM hosts of the configured
+	// provider, e.g. from its failover, whatever the hosts the request lists
+	var providers []*ocmprovider.ProviderInfo
+	var err error
+	if p.Domain != "" {
+		providers, err = a.queryProviders(ctx, wildcardCondition, p.Domain, provider.WildcardPrefix+"%")
+	} else {
+		providers, err = a.queryProviders(ctx, "")
+	}
+	if err != nil {
+		return err
+	}
+	configured, err := a.hosts.FindConfigured(providers, p)
+	if err != nil {
+		return err
+	}
+	return a.hosts.VerifyHostname(configured, p)
+}
+
+func (a *authorizer) ListAllProviders(ctx context.Context) ([]*ocmprovider.ProviderInfo, error) {
+	return a.queryProviders(ctx, "")
+}
+
+func (a *authorizer) ListProvidersByService(ctx context.Context, typeName string) ([]*ocmprovider.ProviderInfo, error) {
+	providers, err := a.ListAllProviders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provider.FilterByService(providers, typeName), nil
+}
+
+func (a *authorizer) ListProvidersPaged(ctx context.Context, pageSize int, pageToken string) ([]*ocmprovider.ProviderInfo, string, error) {
+	providers, err := a.ListAllProviders(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return provider.Paginate(providers, pageSize, pageToken)
+}
@@ -0,0 +1,337 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package sql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+)
+
+// newTestAuthorizer returns an authorizer backed by an in-memory SQLite database private to the test,
+// holding the cernbox provider with a primary and a failover OCM service.
+func newTestAuthorizer(t *testing.T, conf map[string]interface{}) *authorizer {
+	if conf == nil {
+		conf = map[string]interface{}{}
+	}
+	conf["dsn"] = "file:" + strings.Replace(t.Name(), "/", "_", -1) + "?mode=memory&cache=shared"
+	p, err := New(conf)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	a := p.(*authorizer)
+
+	statements := []string{
+		`INSERT INTO ocm_providers (domain, name, full_name) VALUES ('cernbox.cern.ch', 'cernbox', 'CERNBox')`,
+		`INSERT INTO ocm_providers (domain, name) VALUES ('cesnet.cz', 'oc-cesnet')`,
+		`INSERT INTO ocm_provider_services (domain, position, host, endpoint_type, endpoint_path)
+			VALUES ('cernbox.cern.ch', 1, 'failover.cern.ch', 'OCM', 'https://failover.cern.ch/ocm/')`,
+		`INSERT INTO ocm_provider_services (domain, position, host, endpoint_type, endpoint_path)
+			VALUES ('cernbox.cern.ch', 0, 'cernbox.cern.ch', 'OCM', 'https://cernbox.cern.ch/ocm/')`,
+		`INSERT INTO ocm_provider_services (domain, position, host, endpoint_type, endpoint_path)
+			VALUES ('cernbox.cern.ch', 2, 'cernbox.cern.ch', 'Webdav', 'https://cernbox.cern.ch/remote.php/webdav/')`,
+	}
+	for _, s := range statements {
+		if _, err := a.db.Exec(s); err != nil {
+			a.Close()
+			t.Fatalf("error inserting providers: %v", err)
+		}
+	}
+	return a
+}
+
+func TestMigrate(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	// migrating again applies nothing
+	if err := migrate(a.db); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+	var applied int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM ocm_provider_schema").Scan(&applied); err != nil {
+		t.Fatalf("error reading schema version: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("%d migrations applied, want %d", applied, len(migrations))
+	}
+}
+
+func TestGetInfoByDomain(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	tests := []struct {
+		name       string
+		domain     string
+		wantDomain string
+	}{
+		{"exact", "cernbox.cern.ch", "cernbox.cern.ch"},
+		{"contained", "cesnet", "cesnet.cz"},
+		{"unknown", "example.org", ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.GetInfoByDomain(context.Background(), tt.domain)
+			if tt.wantDomain == "" {
+				if _, ok := err.(errtypes.IsNotFound); !ok {
+					t.Errorf("GetInfoByDomain() error = %v, want not found", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetInfoByDomain() error = %v", err)
+			}
+			if p.Domain != tt.wantDomain {
+				t.Errorf("GetInfoByDomain() = %v, want domain %s", p, tt.wantDomain)
+			}
+		})
+	}
+
+	p, err := a.GetInfoByDomain(context.Background(), "cernbox.cern.ch")
+	if err != nil {
+		t.Fatalf("GetInfoByDomain() error = %v", err)
+	}
+	if p.FullName != "CERNBox" || len(p.Services) != 3 || p.Services[0].Host != "cernbox.cern.ch" ||
+		p.Services[2].Endpoint.Type.Name != "Webdav" {
+		t.Errorf("GetInfoByDomain() = %v, want the provider with its services in order", p)
+	}
+}
+
+func TestListAllProviders(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	providers, err := a.ListAllProviders(context.Background())
+	if err != nil {
+		t.Fatalf("ListAllProviders() error = %v", err)
+	}
+	if len(providers) != 2 || providers[0].Domain != "cernbox.cern.ch" || providers[1].Domain != "cesnet.cz" {
+		t.Errorf("ListAllProviders() = %v, want the 2 providers", providers)
+	}
+
+	page, next, err := a.ListProvidersPaged(context.Background(), 1, "")
+	if err != nil {
+		t.Fatalf("ListProvidersPaged() error = %v", err)
+	}
+	if len(page) != 1 || next == "" {
+		t.Errorf("ListProvidersPaged() = %v, %q, want 1 provider and a next page", page, next)
+	}
+}
+
+func TestListProvidersByService(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	// cesnet.cz advertises no service
+	providers, err := a.ListProvidersByService(context.Background(), "OCM")
+	if err != nil {
+		t.Fatalf("ListProvidersByService() error = %v", err)
+	}
+	if len(providers) != 1 || providers[0].Domain != "cernbox.cern.ch" {
+		t.Errorf("ListProvidersByService() = %v, want the cernbox provider", providers)
+	}
+
+	providers, err = a.ListProvidersByService(context.Background(), "PublicLink")
+	if err != nil {
+		t.Fatalf("ListProvidersByService() error = %v", err)
+	}
+	if len(providers) != 0 {
+		t.Errorf("ListProvidersByService() = %v, want no provider", providers)
+	}
+}
+
+func TestIsProviderAllowed(t *testing.T) {
+	a := newTestAuthorizer(t, map[string]interface{}{"verify_request_hostname": true})
+	defer a.Close()
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "cernbox.cern.ch":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "failover.cern.ch":
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	for _, s := range []string{
+		`INSERT INTO ocm_providers (domain, name) VALUES ('*.institution.edu', 'institution')`,
+		`INSERT INTO ocm_provider_services (domain, position, host, endpoint_type, endpoint_path)
+			VALUES ('*.institution.edu', 0, 'cernbox.cern.ch', 'OCM', 'https://cernbox.cern.ch/ocm/')`,
+	} {
+		if _, err := a.db.Exec(s); err != nil {
+			t.Fatalf("error inserting providers: %v", err)
+		}
+	}
+
+	// the services are those of the request, the first one holding the address of the client
+	client := func(clientIP string) []*ocmprovider.Service {
+		return []*ocmprovider.Service{{Host: clientIP}}
+	}
+	// claimed lists the client as an OCM host of its own, which must not be trusted
+	claimed := func(clientIP string) []*ocmprovider.Service {
+		return []*ocmprovider.Service{
+			{Host: clientIP},
+			{
+				Endpoint: &ocmprovider.ServiceEndpoint{Type: &ocmprovider.ServiceType{Name: "OCM"}},
+				Host:     clientIP,
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		provider    *ocmprovider.ProviderInfo
+		wantAllowed bool
+	}{
+		{"primary", &ocmprovider.ProviderInfo{Domain: "cernbox.cern.ch", Services: client("10.0.0.1")}, true},
+		{"failover", &ocmprovider.ProviderInfo{Domain: "cernbox.cern.ch", Services: client("10.0.0.2")}, true},
+		{"other address", &ocmprovider.ProviderInfo{Domain: "cernbox.cern.ch", Services: client("10.0.0.3")}, false},
+		{"claimed ocm host", &ocmprovider.ProviderInfo{Domain: "cernbox.cern.ch", Services: claimed("10.0.0.3")}, false},
+		{"claimed ocm host of a wildcard", &ocmprovider.ProviderInfo{Domain: "lab.institution.edu", Services: claimed("10.0.0.3")}, false},
+		{"no domain", &ocmprovider.ProviderInfo{Services: client("10.0.0.2")}, true},
+		{"no domain other address", &ocmprovider.ProviderInfo{Services: claimed("10.0.0.3")}, false},
+		{"unknown domain", &ocmprovider.ProviderInfo{Domain: "example.org", Services: client("10.0.0.1")}, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.IsProviderAllowed(context.Background(), tt.provider)
+			if tt.wantAllowed && err != nil {
+				t.Errorf("IsProviderAllowed() error = %v", err)
+			}
+			if _, ok := err.(errtypes.IsNotFound); !tt.wantAllowed && !ok {
+				t.Errorf("IsProviderAllowed() error = %v, want not found", err)
+			}
+		})
+	}
+}
+
+func TestGetInfoByIP(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+	a.hosts.LookupIP = func(host string) ([]net.IP, error) {
+		if host == "failover.cern.ch" {
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	info, err := a.GetInfoByIP(context.Background(), "10.0.0.2")
+	if err != nil {
+		t.Fatalf("GetInfoByIP() error = %v", err)
+	}
+	if info.Domain != "cernbox.cern.ch" {
+		t.Errorf("GetInfoByIP() domain = %s, want cernbox.cern.ch", info.Domain)
+	}
+
+	if _, err := a.GetInfoByIP(context.Background(), "10.0.0.3"); err == nil {
+		t.Errorf("GetInfoByIP() of an unknown address returned no error")
+	} else if _, ok := err.(errtypes.IsNotFound); !ok {
+		t.Errorf("GetInfoByIP() error = %v, want not found", err)
+	}
+}
+
+func TestWildcardDomains(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	for _, s := range []string{
+		`INSERT INTO ocm_providers (domain, name) VALUES ('*.institution.edu', 'institution')`,
+		`INSERT INTO ocm_providers (domain, name) VALUES ('*.physics.institution.edu', 'physics')`,
+		`INSERT INTO ocm_providers (domain, name) VALUES ('cern.institution.edu', 'cern')`,
+	} {
+		if _, err := a.db.Exec(s); err != nil {
+			t.Fatalf("error inserting providers: %v", err)
+		}
+	}
+
+	tests := []struct {
+		domain   string
+		wantName string
+	}{
+		{"cern.institution.edu", "cern"},
+		{"lab.institution.edu", "institution"},
+		{"a.b.institution.edu", "institution"},
+		{"lab.physics.institution.edu", "physics"},
+		{"institution.edu.example.org", ""},
+		{"example.org", ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.domain, func(t *testing.T) {
+			p, err := a.GetInfoByDomain(context.Background(), tt.domain)
+			switch {
+			case tt.wantName == "" && err == nil:
+				t.Errorf("GetInfoByDomain() = %s, want not found", p.GetName())
+			case tt.wantName != "" && err != nil:
+				t.Errorf("GetInfoByDomain() error = %v", err)
+			case tt.wantName != "" && p.GetName() != tt.wantName:
+				t.Errorf("GetInfoByDomain() = %s, want %s", p.GetName(), tt.wantName)
+			}
+
+			err = a.IsProviderAllowed(context.Background(), &ocmprovider.ProviderInfo{Domain: tt.domain})
+			if (err == nil) != (tt.wantName != "") {
+				t.Errorf("IsProviderAllowed() error = %v, want allowed %v", err, tt.wantName != "")
+			}
+		})
+	}
+}
+
+func TestDeleteProviderServices(t *testing.T) {
+	a := newTestAuthorizer(t, nil)
+	defer a.Close()
+
+	if _, err := a.db.Exec("DELETE FROM ocm_providers WHERE domain='cernbox.cern.ch'"); err != nil {
+		t.Fatalf("error deleting provider: %v", err)
+	}
+	var count int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM ocm_provider_services WHERE domain='cernbox.cern.ch'").Scan(&count); err != nil {
+		t.Fatalf("error reading provider services: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d services left after deleting their provider, want 0", count)
+	}
+}
+
+func TestWithForeignKeys(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"/var/tmp/reva/ocm-providers.db", "/var/tmp/reva/ocm-providers.db?_foreign_keys=1"},
+		{"file:test?mode=memory", "file:test?mode=memory&_foreign_keys=1"},
+		{"file:test?_fk=0", "file:test?_fk=0"},
+	}
+
+	for _, tt := range tests {
+		if got := withForeignKeys(tt.dsn); got != tt.want {
+			t.Errorf("withForeignKeys(%s) = %s, want %s", tt.dsn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package provider
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// WildcardPrefix starts the domains of the entries matching all the subdomains of a domain.
+const WildcardPrefix = "*."
+
+// FindProvider returns the provider of the domain, preferring the entry listing the domain
+// to the most specific wildcard entry matching it, or nil if no entry matches it.
+func FindProvider(providers []*ocmprovider.ProviderInfo, domain string) *ocmprovider.ProviderInfo {
+	var match *ocmprovider.ProviderInfo
+	for _, p := range providers {
+		switch {
+		case p.Domain == domain:
+			return p
+		case MatchesWildcard(p.Domain, domain) && (match == nil || len(p.Domain) > len(match.Domain)):
+			match = p
+		}
+	}
+	return match
+}
+
+// MatchesWildcard tells whether the domain is a subdomain, at any depth, of the wildcard pattern.
+func MatchesWildcard(pattern, domain string) bool {
+	if !strings.HasPrefix(pattern, WildcardPrefix) {
+		return false
+	}
+	return strings.HasSuffix(domain, pattern[1:]) && len(domain) > len(pattern)-1
+}
+
+// HostResolver resolves the hosts of the services of the providers, caching their addresses.
+type HostResolver struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	cache       sync.Map // of *hostIPs by host
+
+	// LookupIP and Now default to net.LookupIP and time.Now.
+	LookupIP func(host string) ([]net.IP, error)
+	Now      func() time.Time
+}
+
+// NewHostResolver returns a resolver caching the addresses of the hosts for ttl,
+// and the failures to resolve them for negativeTTL.
+func NewHostResolver(ttl, negativeTTL time.Duration) *HostResolver {
+	return &HostResolver{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		LookupIP:    net.LookupIP,
+		Now:         time.Now,
+	}
+}
+
+// hostIPs are the addresses a host resolved to, or the error resolving it, until they expire.
+type hostIPs struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// lookupHost returns the addresses of the host, resolving it again once the cached ones expired.
+// Failed resolutions are cached for a shorter time.
+func (r *HostResolver) lookupHost(host string) ([]net.IP, error) {
+	now := r.Now()
+	if cached, ok := r.cache.Load(host); ok {
+		if h := cached.(*hostIPs); now.Before(h.expires) {
+			return h.ips, h.err
+		}
+	}
+
+	h := &hostIPs{expires: now.Add(r.ttl)}
+	h.ips, h.err = r.LookupIP(host)
+	if h.err != nil {
+		h.expires = now.Add(r.negativeTTL)
+	}
+	r.cache.Store(host, h)
+	return h.ips, h.err
+}
+
+// Resolve returns the addresses of the host, which is either a hostname or an IP address.
+func (r *HostResolver) Resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return r.lookupHost(host)
+}
+
+// FindByIP returns the provider one of whose services is served from the ip address.
+func (r *HostResolver) FindByIP(providers []*ocmprovider.ProviderInfo, ip string) (*ocmprovider.ProviderInfo, error) {
+	addr := net.ParseIP(SplitHost(ip))
+	if addr == nil {
+		return nil, errtypes.BadRequest("invalid ip address: " + ip)
+	}
+
+	for _, p := range providers {
+		for _, s := range p.Services {
+			ips, err := r.Resolve(SplitHost(s.Host))
+			if err != nil {
+				log.Debug().Err(err).Str("host", s.Host).Msg("ocm: error resolving service host")
+				continue
+			}
+			if ContainsAny(ips, []net.IP{addr}) {
+				return p, nil
+			}
+		}
+	}
+	return nil, errtypes.NotFound(ip)
+}
+
+// VerifyHostname checks that the request of the provider p, whose first service is the
+// host the request comes from, comes from any of the OCM hosts of the configured provider,
+// e.g. from its failover. The other services of p are supplied by the caller and ignored.
+func (r *HostResolver) VerifyHostname(configured, p *ocmprovider.ProviderInfo) error {
+	if len(p.Services) == 0 {
+		return errtypes.NotSupported("No IP provided")
+	}
+
+	ocmHosts, err := OCMHosts(configured)
+	if err != nil {
+		return errors.Wrap(err, "ocm: ocm host not specified for mesh provider")
+	}
+
+	clientIPs, err := r.Resolve(SplitHost(p.Services[0].Host))
+	if err != nil {
+		return errors.Wrap(err, "ocm: error looking up client IP")
+	}
+
+	var lookupErr error
+	for _, ocmHost := range ocmHosts {
+		ipList, err := r.Resolve(ocmHost)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		if ContainsAny(ipList, clientIPs) {
+			return nil
+		}
+	}
+	if lookupErr != nil {
+		return errors.Wrap(lookupErr, "ocm: error looking up client IP")
+	}
+	return errtypes.NotFound("OCM Host")
+}
+
+// FindConfigured returns the provider among the configured ones the request of the provider p
+// is verified against: the one of its domain, or the one it comes from when it has no domain.
+func (r *HostResolver) FindConfigured(providers []*ocmprovider.ProviderInfo, p *ocmprovider.ProviderInfo) (*ocmprovider.ProviderInfo, error) {
+	if p.Domain == "" {
+		if len(p.Services) == 0 {
+			return nil, errtypes.NotSupported("No IP provided")
+		}
+		return r.FindByIP(providers, p.Services[0].Host)
+	}
+	if configured := FindProvider(providers, p.Domain); configured != nil {
+		return configured, nil
+	}
+	return nil, errtypes.NotFound(p.Domain)
+}
+
+// OCMHosts returns the hosts of all the OCM services of the provider.
+func OCMHosts(p *ocmprovider.ProviderInfo) ([]string, error) {
+	var hosts []string
+	for _, s := range ServicesByType(p, ServiceTypeOCM) {
+		hosts = append(hosts, SplitHost(s.Host))
+	}
+	if len(hosts) == 0 {
+		return nil, errtypes.NotFound("OCM Host")
+	}
+	return hosts, nil
+}
+
+// ContainsAny tells whether any of the addresses is in the list, comparing them
+// independently of their notation, e.g. "::1" and "0:0:0:0:0:0:0:1".
+func ContainsAny(list, addresses []net.IP) bool {
+	for _, ip := range list {
+		for _, addr := range addresses {
+			if ip.Equal(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SplitHost returns the bare hostname or IP address of a service host,
+// which can be a URL, carry a port or be a bracketed IPv6 address.
+func SplitHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package provider
+
+import "testing"
+
+func TestSplitHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"cernbox.cern.ch", "cernbox.cern.ch"},
+		{"cernbox.cern.ch:443", "cernbox.cern.ch"},
+		{"https://cernbox.cern.ch/ocm/", "cernbox.cern.ch"},
+		{"http://10.0.0.1:8080", "10.0.0.1"},
+		{"[::1]:443", "::1"},
+		{"[::1]", "::1"},
+	}
+
+	for _, tt := range tests {
+		if got := SplitHost(tt.host); got != tt.want {
+			t.Errorf("SplitHost(%s) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		domain  string
+		want    bool
+	}{
+		{"*.institution.edu", "lab.institution.edu", true},
+		{"*.institution.edu", "a.b.institution.edu", true},
+		{"*.institution.edu", "institution.edu", false},
+		{"*.institution.edu", "labinstitution.edu", false},
+		{"institution.edu", "lab.institution.edu", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchesWildcard(tt.pattern, tt.domain); got != tt.want {
+			t.Errorf("MatchesWildcard(%s, %s) = %v, want %v", tt.pattern, tt.domain, got, tt.want)
+		}
+	}
+}
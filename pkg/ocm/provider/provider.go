@@ -20,8 +20,19 @@ package provider
 
 import (
 	"context"
+	"encoding/base64"
+	"sort"
 
 	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the types of the services advertised by the providers.
+const (
+	ServiceTypeOCM        = "OCM"
+	ServiceTypeWebDAV     = "Webdav"
+	ServiceTypePublicLink = "PublicLink"
 )
 
 // Authorizer provides provisions to verify and add sync'n'share system providers.
@@ -29,9 +40,161 @@ type Authorizer interface {
 	// GetInfoByDomain returns the information of the provider identified by a specific domain.
 	GetInfoByDomain(ctx context.Context, domain string) (*ocmprovider.ProviderInfo, error)
 
+	// GetInfoByIP returns the information of the provider one of whose services is served
+	// from the given IP address, e.g. the remote address of an incoming request.
+	GetInfoByIP(ctx context.Context, ip string) (*ocmprovider.ProviderInfo, error)
+
 	// IsProviderAllowed checks if a given system provider is integrated into the OCM or not.
 	IsProviderAllowed(ctx context.Context, provider *ocmprovider.ProviderInfo) error
 
 	// ListAllProviders returns the information of all the providers registered in the mesh.
 	ListAllProviders(ctx context.Context) ([]*ocmprovider.ProviderInfo, error)
+
+	// ListProvidersByService returns the information of the providers registered in the mesh
+	// advertising a service of the given type, e.g. the ones supporting webdav transfers.
+	ListProvidersByService(ctx context.Context, typeName string) ([]*ocmprovider.ProviderInfo, error)
+
+	// ListProvidersPaged returns at most pageSize providers, ordered by domain, starting after the
+	// page token. The returned token is used to retrieve the next page and is empty for the last one.
+	ListProvidersPaged(ctx context.Context, pageSize int, pageToken string) ([]*ocmprovider.ProviderInfo, string, error)
+}
+
+// Paginate returns the page of providers starting after pageToken. Providers are sorted by
+// domain so pages stay consistent when the list of providers is reloaded.
+func Paginate(providers []*ocmprovider.ProviderInfo, pageSize int, pageToken string) ([]*ocmprovider.ProviderInfo, string, error) {
+	if pageSize <= 0 {
+		return nil, "", errtypes.BadRequest("page size must be positive")
+	}
+
+	var after string
+	if pageToken != "" {
+		d, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, "", errtypes.BadRequest("invalid page token")
+		}
+		after = string(d)
+	}
+
+	sorted := make([]*ocmprovider.ProviderInfo, len(providers))
+	copy(sorted, providers)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Domain < sorted[j].Domain
+	})
+
+	start := 0
+	if pageToken != "" {
+		start = sort.Search(len(sorted), func(i int) bool {
+			return sorted[i].Domain > after
+		})
+	}
+
+	end := start + pageSize
+	if end >= len(sorted) {
+		return sorted[start:], "", nil
+	}
+
+	next := base64.RawURLEncoding.EncodeToString([]byte(sorted[end-1].Domain))
+	return sorted[start:end], next, nil
+}
+
+// MergeDuplicates detects providers listed more than once with the same domain.
+// In strict mode an error is returned, otherwise the services of the duplicates are
+// merged into the first entry for the domain and a warning is logged.
+func MergeDuplicates(providers []*ocmprovider.ProviderInfo, strict bool) ([]*ocmprovider.ProviderInfo, error) {
+	byDomain := make(map[string]*ocmprovider.ProviderInfo, len(providers))
+	merged := make([]*ocmprovider.ProviderInfo, 0, len(providers))
+
+	for _, p := range providers {
+		first, ok := byDomain[p.Domain]
+		if !ok {
+			byDomain[p.Domain] = p
+			merged = append(merged, p)
+			continue
+		}
+
+		if strict {
+			return nil, errtypes.AlreadyExists("duplicate provider domain: " + p.Domain)
+		}
+
+		log.Warn().Msgf("ocm: provider domain %s is listed more than once, merging its services", p.Domain)
+		for _, svc := range p.Services {
+			if !hasService(first, svc) {
+				first.Services = append(first.Services, svc)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+func hasService(p *ocmprovider.ProviderInfo, svc *ocmprovider.Service) bool {
+	for _, s := range p.Services {
+		if s.GetHost() == svc.GetHost() && s.GetEndpoint().GetType().GetName() == svc.GetEndpoint().GetType().GetName() {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceByType returns the first service of the given type advertised by the provider.
+func ServiceByType(p *ocmprovider.ProviderInfo, typeName string) (*ocmprovider.Service, error) {
+	for _, s := range p.GetServices() {
+		if s.GetEndpoint().GetType().GetName() == typeName {
+			return s, nil
+		}
+	}
+	return nil, errtypes.NotFound(typeName + " service of provider " + p.GetDomain())
+}
+
+// ServicesByType returns all the services of the provider of the given type, in their order.
+func ServicesByType(p *ocmprovider.ProviderInfo, typeName string) []*ocmprovider.Service {
+	var services []*ocmprovider.Service
+	for _, s := range p.GetServices() {
+		if s.GetEndpoint().GetType().GetName() == typeName {
+			services = append(services, s)
+		}
+	}
+	return services
+}
+
+// FilterByService returns, in their order, the providers advertising a service of the given type.
+// Services without an endpoint are not reachable, so they are not taken into account.
+func FilterByService(providers []*ocmprovider.ProviderInfo, typeName string) []*ocmprovider.ProviderInfo {
+	filtered := make([]*ocmprovider.ProviderInfo, 0, len(providers))
+	for _, p := range providers {
+		for _, s := range ServicesByType(p, typeName) {
+			if s.GetEndpoint().GetPath() != "" {
+				filtered = append(filtered, p)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// WebDAVEndpoint returns the webdav endpoint of the provider.
+func WebDAVEndpoint(p *ocmprovider.ProviderInfo) (string, error) {
+	return endpointByType(p, ServiceTypeWebDAV)
+}
+
+// PublicLinkEndpoint returns the endpoint serving the public links of the provider.
+func PublicLinkEndpoint(p *ocmprovider.ProviderInfo) (string, error) {
+	return endpointByType(p, ServiceTypePublicLink)
+}
+
+// GetServiceEndpoint returns the endpoint of the service of the given type of a trusted provider.
+func GetServiceEndpoint(ctx context.Context, a Authorizer, domain, typeName string) (string, error) {
+	p, err := a.GetInfoByDomain(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	return endpointByType(p, typeName)
+}
+
+func endpointByType(p *ocmprovider.ProviderInfo, typeName string) (string, error) {
+	s, err := ServiceByType(p, typeName)
+	if err != nil {
+		return "", err
+	}
+	return s.Endpoint.Path, nil
 }
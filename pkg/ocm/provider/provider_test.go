@@ -0,0 +1,222 @@
+// Copyright 2018-2020 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ocmprovider "github.com/cs3org/go-cs3apis/cs3/ocm/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+)
+
+func TestPaginate(t *testing.T) {
+	providers := []*ocmprovider.ProviderInfo{}
+	// add them unsorted to check pages are ordered by domain
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		providers = append(providers, &ocmprovider.ProviderInfo{Domain: fmt.Sprintf("cern%d.ch", i)})
+	}
+
+	var domains []string
+	var token string
+	pages := 0
+	for {
+		page, next, err := Paginate(providers, 2, token)
+		if err != nil {
+			t.Fatalf("Paginate() error = %v", err)
+		}
+		pages++
+		for _, p := range page {
+			domains = append(domains, p.Domain)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	expected := []string{"cern0.ch", "cern1.ch", "cern2.ch", "cern3.ch", "cern4.ch"}
+	if fmt.Sprint(domains) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, domains)
+	}
+}
+
+func TestPaginateAfterReload(t *testing.T) {
+	providers := []*ocmprovider.ProviderInfo{
+		{Domain: "a.org"}, {Domain: "b.org"}, {Domain: "d.org"},
+	}
+	_, token, err := Paginate(providers, 2, "")
+	if err != nil {
+		t.Fatalf("Paginate() error = %v", err)
+	}
+
+	// a provider is added before the token on reload, the next page must not repeat entries
+	providers = append(providers, &ocmprovider.ProviderInfo{Domain: "aa.org"})
+	page, next, err := Paginate(providers, 2, token)
+	if err != nil {
+		t.Fatalf("Paginate() error = %v", err)
+	}
+	if len(page) != 1 || page[0].Domain != "d.org" || next != "" {
+		t.Errorf("expected last page with d.org, got %v %q", page, next)
+	}
+}
+
+func TestPaginateInvalid(t *testing.T) {
+	if _, _, err := Paginate(nil, 0, ""); err == nil {
+		t.Errorf("expected error for invalid page size")
+	}
+	if _, _, err := Paginate(nil, 10, "%%%"); err == nil {
+		t.Errorf("expected error for invalid page token")
+	}
+}
+
+// staticAuthorizer trusts a fixed list of providers.
+type staticAuthorizer struct {
+	Authorizer
+	providers []*ocmprovider.ProviderInfo
+}
+
+func (a *staticAuthorizer) GetInfoByDomain(ctx context.Context, domain string) (*ocmprovider.ProviderInfo, error) {
+	for _, p := range a.providers {
+		if p.Domain == domain {
+			return p, nil
+		}
+	}
+	return nil, errtypes.NotFound(domain)
+}
+
+func newService(typeName, path string) *ocmprovider.Service {
+	return &ocmprovider.Service{
+		Host: "https://sciencemesh.cesnet.cz",
+		Endpoint: &ocmprovider.ServiceEndpoint{
+			Type: &ocmprovider.ServiceType{Name: typeName},
+			Path: path,
+		},
+	}
+}
+
+func TestServiceByType(t *testing.T) {
+	p := &ocmprovider.ProviderInfo{
+		Domain: "cesnet.cz",
+		Services: []*ocmprovider.Service{
+			newService(ServiceTypeOCM, "https://sciencemesh.cesnet.cz/ocm/"),
+			newService(ServiceTypeWebDAV, "https://sciencemesh.cesnet.cz/remote.php/webdav/"),
+			newService(ServiceTypePublicLink, "https://sciencemesh.cesnet.cz/s/"),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		get      func(*ocmprovider.ProviderInfo) (string, error)
+		endpoint string
+	}{
+		{"ocm", func(p *ocmprovider.ProviderInfo) (string, error) { return endpointByType(p, ServiceTypeOCM) }, "https://sciencemesh.cesnet.cz/ocm/"},
+		{"webdav", WebDAVEndpoint, "https://sciencemesh.cesnet.cz/remote.php/webdav/"},
+		{"public link", PublicLinkEndpoint, "https://sciencemesh.cesnet.cz/s/"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := tt.get(p)
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if endpoint != tt.endpoint {
+				t.Errorf("endpoint = %v, want %v", endpoint, tt.endpoint)
+			}
+		})
+	}
+
+	ocmOnly := &ocmprovider.ProviderInfo{Services: []*ocmprovider.Service{newService(ServiceTypeOCM, "/ocm/")}}
+	if _, err := WebDAVEndpoint(ocmOnly); err == nil {
+		t.Errorf("WebDAVEndpoint() error = nil, want not found")
+	}
+}
+
+func TestGetServiceEndpoint(t *testing.T) {
+	a := &staticAuthorizer{providers: []*ocmprovider.ProviderInfo{
+		{
+			Domain: "cesnet.cz",
+			Services: []*ocmprovider.Service{
+				newService(ServiceTypeOCM, "https://sciencemesh.cesnet.cz/ocm/"),
+				newService(ServiceTypeWebDAV, "https://sciencemesh.cesnet.cz/remote.php/webdav/"),
+			},
+		},
+	}}
+
+	endpoint, err := GetServiceEndpoint(context.Background(), a, "cesnet.cz", ServiceTypeWebDAV)
+	if err != nil {
+		t.Fatalf("GetServiceEndpoint() error = %v", err)
+	}
+	if endpoint != "https://sciencemesh.cesnet.cz/remote.php/webdav/" {
+		t.Errorf("GetServiceEndpoint() = %v", endpoint)
+	}
+
+	if _, err := GetServiceEndpoint(context.Background(), a, "cern.ch", ServiceTypeWebDAV); err == nil {
+		t.Errorf("GetServiceEndpoint() error = nil for an untrusted provider")
+	}
+}
+
+func TestFilterByService(t *testing.T) {
+	providers := []*ocmprovider.ProviderInfo{
+		{Domain: "cernbox.cern.ch", Services: []*ocmprovider.Service{
+			newService(ServiceTypeOCM, "https://cernbox.cern.ch/ocm/"),
+			newService(ServiceTypeWebDAV, "https://cernbox.cern.ch/remote.php/webdav/"),
+		}},
+		{Domain: "cesnet.cz", Services: []*ocmprovider.Service{
+			newService(ServiceTypePublicLink, "https://sciencemesh.cesnet.cz/s/"),
+			newService(ServiceTypeOCM, "https://sciencemesh.cesnet.cz/ocm/"),
+		}},
+		{Domain: "surfdrive.nl"},
+		// an OCM service without an endpoint is not reachable
+		{Domain: "example.org", Services: []*ocmprovider.Service{
+			newService(ServiceTypeOCM, ""),
+			newService(ServiceTypeWebDAV, "https://example.org/webdav/"),
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		typeName string
+		domains  []string
+	}{
+		{"ocm", ServiceTypeOCM, []string{"cernbox.cern.ch", "cesnet.cz"}},
+		{"webdav", ServiceTypeWebDAV, []string{"cernbox.cern.ch", "example.org"}},
+		{"public link", ServiceTypePublicLink, []string{"cesnet.cz"}},
+		{"unknown", "Unknown", []string{}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			domains := []string{}
+			for _, p := range FilterByService(providers, tt.typeName) {
+				domains = append(domains, p.Domain)
+			}
+			if fmt.Sprint(domains) != fmt.Sprint(tt.domains) {
+				t.Errorf("FilterByService() = %v, want %v", domains, tt.domains)
+			}
+		})
+	}
+}
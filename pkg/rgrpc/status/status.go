@@ -99,6 +99,50 @@ func NewUnimplemented(ctx context.Context, err error, msg string) *rpc.Status {
 	}
 }
 
+// NewPermissionDenied returns a Status with CODE_PERMISSION_DENIED and logs the msg.
+func NewPermissionDenied(ctx context.Context, err error, msg string) *rpc.Status {
+	log := appctx.GetLogger(ctx).With().CallerWithSkipFrameCount(3).Logger()
+	log.Warn().Err(err).Msg(msg)
+	return &rpc.Status{
+		Code:    rpc.Code_CODE_PERMISSION_DENIED,
+		Message: msg,
+		Trace:   getTrace(ctx),
+	}
+}
+
+// NewFailedPrecondition returns a Status with CODE_FAILED_PRECONDITION and logs the msg.
+func NewFailedPrecondition(ctx context.Context, err error, msg string) *rpc.Status {
+	log := appctx.GetLogger(ctx).With().CallerWithSkipFrameCount(3).Logger()
+	log.Warn().Err(err).Msg(msg)
+	return &rpc.Status{
+		Code:    rpc.Code_CODE_FAILED_PRECONDITION,
+		Message: msg,
+		Trace:   getTrace(ctx),
+	}
+}
+
+// NewUnavailable returns a Status with CODE_UNAVAILABLE and logs the msg.
+func NewUnavailable(ctx context.Context, err error, msg string) *rpc.Status {
+	log := appctx.GetLogger(ctx).With().CallerWithSkipFrameCount(3).Logger()
+	log.Warn().Err(err).Msg(msg)
+	return &rpc.Status{
+		Code:    rpc.Code_CODE_UNAVAILABLE,
+		Message: msg,
+		Trace:   getTrace(ctx),
+	}
+}
+
+// NewCancelled returns a Status with CODE_CANCELLED and logs the msg.
+func NewCancelled(ctx context.Context, err error, msg string) *rpc.Status {
+	log := appctx.GetLogger(ctx).With().CallerWithSkipFrameCount(3).Logger()
+	log.Warn().Err(err).Msg(msg)
+	return &rpc.Status{
+		Code:    rpc.Code_CODE_CANCELLED,
+		Message: msg,
+		Trace:   getTrace(ctx),
+	}
+}
+
 // NewInvalidArg returns a Status with CODE_INVALID_ARGUMENT.
 func NewInvalidArg(ctx context.Context, msg string) *rpc.Status {
 	return &rpc.Status{Code: rpc.Code_CODE_INVALID_ARGUMENT,
@@ -107,6 +151,15 @@ func NewInvalidArg(ctx context.Context, msg string) *rpc.Status {
 	}
 }
 
+// NewOutOfRange returns a Status with CODE_OUT_OF_RANGE.
+func NewOutOfRange(ctx context.Context, msg string) *rpc.Status {
+	return &rpc.Status{
+		Code:    rpc.Code_CODE_OUT_OF_RANGE,
+		Message: msg,
+		Trace:   getTrace(ctx),
+	}
+}
+
 // NewErrorFromCode returns a standardized Error for a given RPC code.
 func NewErrorFromCode(code rpc.Code, pkgname string) error {
 	return errors.New(pkgname + ": grpc failed with code " + code.String())